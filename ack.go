@@ -0,0 +1,69 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import "sync"
+
+// _AckTable holds the acknowledgments of the entries put with PutEntryWithAck keyed by the entry
+// seq until the time block of the entry is synced and released from the WAL.
+type _AckTable struct {
+	mu   sync.Mutex
+	acks map[uint64]chan error
+}
+
+func newAckTable() *_AckTable {
+	return &_AckTable{acks: make(map[uint64]chan error)}
+}
+
+// add adds the acknowledgment for the seq, the ack channel must be buffered.
+func (t *_AckTable) add(seq uint64, ack chan error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.acks[seq] = ack
+}
+
+// remove removes the acknowledgment for the seq without firing it.
+func (t *_AckTable) remove(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.acks, seq)
+}
+
+// done fires the acknowledgments of the seqs, seqs without an acknowledgment are skipped.
+func (t *_AckTable) done(seqs []uint64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.acks) == 0 {
+		return
+	}
+	for _, seq := range seqs {
+		if ack, ok := t.acks[seq]; ok {
+			ack <- err
+			delete(t.acks, seq)
+		}
+	}
+}
+
+// doneAll fires all the pending acknowledgments.
+func (t *_AckTable) doneAll(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for seq, ack := range t.acks {
+		ack <- err
+		delete(t.acks, seq)
+	}
+}
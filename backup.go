@@ -0,0 +1,200 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+var (
+	backupSignature = [7]byte{'u', 'n', 'i', 't', 'b', 'k', '\x0e'}
+	backupVersion   = uint16(1)
+
+	errBackupCorrupted = errors.New("backup is corrupted")
+	errBackupPath      = errors.New("backup path exists")
+)
+
+// backup writes archive of the DB files and the write ahead logs not yet applied.
+// The archive is a header followed by records of file name, size and content.
+func (db *DB) backup(w io.Writer) error {
+	// The write ahead log of a shared memdb holds the entries of other DBs, so it is not archived and
+	// the entries of the DB are synced to the files instead. The current time block is sealed first.
+	shared := db.internal.mem.shared && !db.opts.flags.readOnly
+	if shared {
+		if err := db.internal.mem.Seal(); err != nil {
+			return err
+		}
+	}
+	// Sync does not run during backup so the files and logs are consistent.
+	select {
+	case db.internal.syncLockC <- struct{}{}:
+	case <-db.internal.closeC:
+		return errClosed
+	}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	if shared {
+		if err := db.syncEntries(); err != nil {
+			return err
+		}
+	}
+
+	if err := db.writeInfo(); err != nil {
+		return err
+	}
+	if err := db.internal.freeList.write(); err != nil {
+		return err
+	}
+
+	header := make([]byte, 9)
+	copy(header[:7], backupSignature[:])
+	binary.LittleEndian.PutUint16(header[7:9], backupVersion)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	db.fs.mu.RLock()
+	for _, files := range db.fs.list {
+		for _, f := range files.fileMap {
+			if err := db.backupFile(w, f.File); err != nil {
+				db.fs.mu.RUnlock()
+				return err
+			}
+		}
+	}
+	db.fs.mu.RUnlock()
+
+	var logs []string
+	if !db.internal.mem.shared {
+		logs = db.internal.mem.LogFiles()
+	}
+	for _, name := range logs {
+		f, err := db.internal.fsys.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// log is released.
+				continue
+			}
+			return err
+		}
+		err = db.backupFile(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// end of archive.
+	_, err := w.Write([]byte{0, 0})
+	return err
+}
+
+func (db *DB) backupFile(w io.Writer, f fs.File) error {
+	name, err := filepath.Rel(db.internal.path, f.Name())
+	if err != nil {
+		return err
+	}
+	name = filepath.ToSlash(name)
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2+len(name)+8)
+	binary.LittleEndian.PutUint16(buf[:2], uint16(len(name)))
+	copy(buf[2:], name)
+	binary.LittleEndian.PutUint64(buf[2+len(name):], uint64(stat.Size()))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, stat.Size()))
+	return err
+}
+
+// RestoreBackup restores the DB from an archive written by Backup into a new path.
+// Entries from the write ahead logs are recovered when the DB is opened.
+func RestoreBackup(r io.Reader, path string) error {
+	return RestoreBackupWithFS(r, path, fs.OS)
+}
+
+// RestoreBackupWithFS restores the DB from an archive written by Backup into a new path
+// on the file system, the restored DB is opened by OpenWithFS on the same file system.
+func RestoreBackupWithFS(r io.Reader, path string, fsys fs.FileSystem) error {
+	if _, err := fsys.Stat(path); err == nil {
+		return errBackupPath
+	}
+
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:7], backupSignature[:]) {
+		return errBackupCorrupted
+	}
+	if binary.LittleEndian.Uint16(header[7:9]) != backupVersion {
+		return errBackupCorrupted
+	}
+
+	buf := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return err
+		}
+		nameLen := binary.LittleEndian.Uint16(buf[:2])
+		if nameLen == 0 {
+			return nil
+		}
+		rawName := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, rawName); err != nil {
+			return err
+		}
+		name := filepath.FromSlash(string(rawName))
+		if filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return errBackupCorrupted
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint64(buf))
+
+		fileName := filepath.Join(path, name)
+		if err := fsys.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+			return err
+		}
+		f, err := fsys.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(f, r, size)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -51,6 +51,8 @@ type (
 		index  []_BatchIndex
 		buffer *bpool.Buffer
 		size   int64
+		// pending is map of topichash to count of entries of the batch marked as being written.
+		pending map[uint64]int
 
 		// commitComplete is used to signal if batch commit is complete and batch is fully written to DB.
 		commitComplete chan struct{}
@@ -72,17 +74,18 @@ func (b *Batch) PutEntry(e *Entry) error {
 	switch {
 	case len(e.Topic) == 0:
 		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
-		return errTopicTooLarge
+	case len(e.Topic) > b.db.opts.maxTopicLength:
+		return ErrEntryTooLarge
 	case len(e.Payload) == 0:
 		return errValueEmpty
-	case len(e.Payload) > maxValueLength:
-		return errValueTooLarge
+	case len(e.Payload) > b.db.opts.maxPayloadSize:
+		return ErrEntryTooLarge
 	}
 	e.Encryption = e.Encryption || b.opts.batchOptions.encryption
 	if err := b.db.setEntry(e); err != nil {
 		return err
 	}
+	b.pending[e.entry.topicHash]++
 
 	var scratch [4]byte
 	binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(e.entry.cache)+4))
@@ -99,7 +102,7 @@ func (b *Batch) PutEntry(e *Entry) error {
 	// reset message entry
 	e.reset()
 
-	return nil
+	return b.autoWrite()
 }
 
 // Delete appends delete entry to batch for given key.
@@ -127,6 +130,7 @@ func (b *Batch) DeleteEntry(e *Entry) error {
 	if err := b.db.setEntry(e); err != nil {
 		return err
 	}
+	b.pending[e.entry.topicHash]++
 
 	var scratch [4]byte
 	binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(e.entry.cache)+4))
@@ -143,7 +147,15 @@ func (b *Batch) DeleteEntry(e *Entry) error {
 	// reset message entry
 	e.reset()
 
-	return nil
+	return b.autoWrite()
+}
+
+// autoWrite writes the entries to the DB once their size reaches the batch write size.
+func (b *Batch) autoWrite() error {
+	if b.opts.batchOptions.writeSize == 0 || b.size < b.opts.batchOptions.writeSize {
+		return nil
+	}
+	return b.Write()
 }
 
 func (b *Batch) writeInternal(fn func(i int, e _Entry, data []byte) error) error {
@@ -170,9 +182,11 @@ func (b *Batch) writeInternal(fn func(i int, e _Entry, data []byte) error) error
 		if index.delFlag && e.seq != 0 {
 			/// Test filter block for presence.
 			if !b.db.internal.filter.Test(e.seq) {
-				return nil
+				continue
+			}
+			if _, err := b.db.delete(e.topicHash, e.seq); err != nil {
+				return err
 			}
-			b.db.delete(e.topicHash, e.seq)
 			continue
 		}
 
@@ -191,7 +205,10 @@ func (b *Batch) writeInternal(fn func(i int, e _Entry, data []byte) error) error
 	return nil
 }
 
-// Write starts writing entries into DB. It returns an error if batch write fails.
+// Write starts writing entries into DB. It returns an error if batch write fails, the
+// entries not written are dropped from the batch. It returns ErrMemdbFull if the memdb
+// is full under the MemdbFullReject or the MemdbFullShrink policy, the memdb is shrunk
+// for the batch as for a put under the MemdbFullShrink policy.
 func (b *Batch) Write() error {
 	// write happens synchronously
 	b.writeLockC <- struct{}{}
@@ -204,7 +221,7 @@ func (b *Batch) Write() error {
 	topics := make(map[uint64]*message.Topic)
 	timeID := b.mem.TimeID()
 	var seqs []uint64
-	b.writeInternal(func(i int, e _Entry, data []byte) error {
+	err := b.writeInternal(func(i int, e _Entry, data []byte) error {
 		if e.topicSize != 0 {
 			t, ok := topics[e.topicHash]
 			if !ok {
@@ -215,20 +232,44 @@ func (b *Batch) Write() error {
 			}
 			b.db.internal.trie.add(newTopic(e.topicHash, 0), t.Parts, t.Depth)
 		}
-		if err := b.mem.Put(e.seq, data); err != nil {
+		if err := b.put(e.seq, data); err != nil {
 			return err
 		}
 		if ok := b.db.internal.timeWindow.add(timeID, e.topicHash, newWinEntry(e.seq, e.expiresAt)); !ok {
 			return errForbidden
 		}
+		b.db.internal.topics.mark(e.topicHash, 1)
+		b.release(e.topicHash, 1, true)
 		seqs = append(seqs, e.seq)
 		return nil
 	})
 
 	b.mem.Write()
+	for _, seq := range seqs {
+		b.db.setVisible(seq)
+	}
 	b.reset()
 
-	return nil
+	return err
+}
+
+// put puts the packed entry into the memdb batch under the memdb full policy of the DB.
+func (b *Batch) put(seq uint64, data []byte) error {
+	key := b.db.internal.mem.key(seq)
+	err := b.mem.Put(key, data)
+	if err == memdb.ErrMemFull && b.db.opts.memdbFullPolicy == MemdbFullShrink {
+		if err := b.db.Flush(); err != nil {
+			return err
+		}
+		if err := b.db.Sync(); err != nil {
+			return err
+		}
+		err = b.mem.Put(key, data)
+	}
+	if err == memdb.ErrMemFull {
+		return ErrMemdbFull
+	}
+	return err
 }
 
 // Commit commits changes to the DB. In batch operation commit is managed and client is not allowed to call Commit.
@@ -260,6 +301,17 @@ func (b *Batch) reset() {
 	b.index = b.index[:0]
 	b.size = 0
 	b.buffer.Reset()
+	for topicHash, n := range b.pending {
+		b.release(topicHash, n, false)
+	}
+}
+
+// release releases the entries of the batch marked as being written to the topic.
+func (b *Batch) release(topicHash uint64, n int, written bool) {
+	b.db.internal.trie.release(topicHash, n, written)
+	if b.pending[topicHash] -= n; b.pending[topicHash] <= 0 {
+		delete(b.pending, topicHash)
+	}
 }
 
 //Abort abort is a batch cleanup operation on batch complete.
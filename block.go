@@ -38,6 +38,8 @@ type (
 		entries  [entriesPerIndexBlock]_IndexEntry
 		baseSeq  uint64
 		entryIdx uint16
+		// dropped is the number of deleted entries dropped from the block by the compaction.
+		dropped uint16
 
 		dirty  bool
 		leased bool
@@ -55,8 +57,38 @@ func blockOffset(idx int32) int64 {
 	return int64(blockSize * idx)
 }
 
-func (e _IndexEntry) mSize() uint32 {
-	return idSize + uint32(e.topicSize) + e.valueSize
+// deletedOffset returns the offset recorded in the index for the deleted entry. The record
+// of an entry packing the raw topic is kept on delete so the topic is loaded on open, its
+// offset is kept in the index as -(offset)-2. The other deleted entries are recorded as -1.
+func (e _IndexEntry) deletedOffset() int64 {
+	if e.topicSize == 0 {
+		return -1
+	}
+	return -e.msgOffset - 2
+}
+
+// isDeleted returns true if the entry is deleted.
+func (e _IndexEntry) isDeleted() bool {
+	return e.msgOffset < 0
+}
+
+// keptOffset returns the offset of the record kept for a deleted entry packing the raw topic.
+// It returns false if the record of the entry is not kept.
+func (e _IndexEntry) keptOffset() (int64, bool) {
+	if e.msgOffset >= -1 {
+		return 0, false
+	}
+	return -e.msgOffset - 2, true
+}
+
+// mSize returns the size of the data record of the entry in the file format version, the record holds
+// the message ID, the topic and the value followed by their checksum. The records of the file format
+// versions before the checksumVersion have no checksum.
+func (e _IndexEntry) mSize(version uint32) uint32 {
+	if version < checksumVersion {
+		return idSize + uint32(e.topicSize) + e.valueSize
+	}
+	return idSize + uint32(e.topicSize) + e.valueSize + checksumSize
 }
 
 func (b _IndexBlock) validation(blockIdx int32) error {
@@ -88,6 +120,7 @@ func (b _IndexBlock) marshalBinary() []byte {
 		buf = buf[16:]
 	}
 	binary.LittleEndian.PutUint16(buf[:2], b.entryIdx)
+	binary.LittleEndian.PutUint16(buf[2:4], b.dropped)
 	return data
 }
 
@@ -109,5 +142,6 @@ func (b *_IndexBlock) unmarshalBinary(data []byte) error {
 		data = data[16:]
 	}
 	b.entryIdx = binary.LittleEndian.Uint16(data[:2])
+	b.dropped = binary.LittleEndian.Uint16(data[2:4])
 	return nil
 }
@@ -16,15 +16,22 @@
 
 package unitdb
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
 type _BlockReader struct {
 	indexBlock          _IndexBlock
 	fs                  *_FileSet
 	indexFile, dataFile *_File
 	offset              int64
+	// File format version of the data records
+	version uint32
 }
 
-func newBlockReader(fs *_FileSet) *_BlockReader {
-	r := &_BlockReader{fs: fs}
+func newBlockReader(fs *_FileSet, version uint32) *_BlockReader {
+	r := &_BlockReader{fs: fs, version: version}
 
 	indexFile, err := fs.getFile(_FileDesc{fileType: typeIndex})
 	if err != nil {
@@ -54,6 +61,35 @@ func (r *_BlockReader) readIndexBlock() (_IndexBlock, error) {
 }
 
 func (r *_BlockReader) readEntry(seq uint64) (_IndexEntry, error) {
+	e, err := r.readIndexEntry(seq)
+	if err != nil {
+		return _IndexEntry{}, err
+	}
+	if e.isDeleted() {
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+	return e, nil
+}
+
+// readTopicEntry reads the index entry of the seq to read the raw topic from its record. A deleted
+// entry is returned with the offset of its record if the record is kept.
+func (r *_BlockReader) readTopicEntry(seq uint64) (_IndexEntry, error) {
+	e, err := r.readIndexEntry(seq)
+	if err != nil {
+		return _IndexEntry{}, err
+	}
+	if off, ok := e.keptOffset(); ok {
+		e.msgOffset = off
+		return e, nil
+	}
+	if e.isDeleted() {
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+	return e, nil
+}
+
+// readIndexEntry reads the index entry of the seq including a deleted entry.
+func (r *_BlockReader) readIndexEntry(seq uint64) (_IndexEntry, error) {
 	bIdx := blockIndex(seq)
 	r.offset = blockOffset(bIdx)
 	b, err := r.readIndexBlock()
@@ -64,25 +100,52 @@ func (r *_BlockReader) readEntry(seq uint64) (_IndexEntry, error) {
 	for i := 0; i < entriesPerIndexBlock; i++ {
 		e := b.entries[i]
 		if e.seq == seq { //topic exist in db
-			if e.msgOffset == -1 {
-				return _IndexEntry{}, errMsgIDDeleted
-			}
 			entryIdx = i
 			break
 		}
 	}
 	if entryIdx == -1 {
+		// The entries of a compacted block may have been dropped on delete.
+		if b.dropped > 0 {
+			return _IndexEntry{}, errMsgIDDeleted
+		}
 		return _IndexEntry{}, errEntryInvalid
 	}
 
 	return b.entries[entryIdx], nil
 }
 
-func (r *_BlockReader) readMessage(e _IndexEntry) ([]byte, []byte, error) {
+// readRecord reads the data record of the entry without its checksum. It returns ErrCorruptRecord
+// if the record does not match its checksum. The records of a file format version without the
+// checksum are not checked.
+func (r *_BlockReader) readRecord(e _IndexEntry) ([]byte, error) {
+	if e.cache != nil {
+		return e.cache, nil
+	}
+	data, err := r.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize(r.version)))
+	if err != nil {
+		return nil, err
+	}
+	if r.version < checksumVersion {
+		return data, nil
+	}
+	n := len(data) - checksumSize
+	if n < 0 || crc32.ChecksumIEEE(data[:n]) != binary.LittleEndian.Uint32(data[n:]) {
+		return nil, ErrCorruptRecord
+	}
+	return data[:n], nil
+}
+
+// readID reads the message ID of the entry without reading the rest of its data record.
+func (r *_BlockReader) readID(e _IndexEntry) ([]byte, error) {
 	if e.cache != nil {
-		return e.cache[:idSize], e.cache[e.topicSize+idSize:], nil
+		return e.cache[:idSize], nil
 	}
-	message, err := r.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+	return r.dataFile.slice(e.msgOffset, e.msgOffset+idSize)
+}
+
+func (r *_BlockReader) readMessage(e _IndexEntry) ([]byte, []byte, error) {
+	message, err := r.readRecord(e)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -90,8 +153,9 @@ func (r *_BlockReader) readMessage(e _IndexEntry) ([]byte, []byte, error) {
 }
 
 func (r *_BlockReader) readTopic(e _IndexEntry) ([]byte, error) {
-	if e.cache != nil {
-		return e.cache[idSize : e.topicSize+idSize], nil
+	message, err := r.readRecord(e)
+	if err != nil {
+		return nil, err
 	}
-	return r.dataFile.slice(e.msgOffset+int64(idSize), e.msgOffset+int64(e.topicSize)+int64(idSize))
+	return message[idSize : e.topicSize+idSize], nil
 }
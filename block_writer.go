@@ -17,7 +17,9 @@
 package unitdb
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"sort"
 
 	"github.com/unit-io/bpool"
@@ -35,10 +37,12 @@ type _BlockWriter struct {
 	dataLeases                      map[int64]uint32    // map[offset]size
 	indexFile, dataFile             *_File
 	offset, indexOffset, dataOffset int64
+	// File format version of the data records
+	version uint32
 }
 
-func newBlockWriter(fs *_FileSet, lease *_Lease, buf *bpool.Buffer) (*_BlockWriter, error) {
-	w := &_BlockWriter{blockIdx: -1, indexBlocks: make(map[int32]_IndexBlock), fs: fs, lease: lease, buffer: buf}
+func newBlockWriter(fs *_FileSet, version uint32, lease *_Lease, buf *bpool.Buffer) (*_BlockWriter, error) {
+	w := &_BlockWriter{blockIdx: -1, indexBlocks: make(map[int32]_IndexBlock), fs: fs, lease: lease, buffer: buf, version: version}
 	w.indexLeases = make(map[uint64]struct{})
 	w.dataLeases = make(map[int64]uint32)
 
@@ -85,10 +89,14 @@ func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
 	if bIdx > w.blockIdx {
 		return delEntry, nil // no entry in db to delete
 	}
-	r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
-	b, err := r.readIndexBlock()
-	if err != nil {
-		return _IndexEntry{}, err
+	// The block is read once so the entries deleted from the block are kept until it is written.
+	b, ok := w.indexBlocks[bIdx]
+	if !ok {
+		r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
+		var err error
+		if b, err = r.readIndexBlock(); err != nil {
+			return _IndexEntry{}, err
+		}
 	}
 	entryIdx := -1
 	for i := 0; i < int(b.entryIdx); i++ {
@@ -98,18 +106,33 @@ func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
 			break
 		}
 	}
-	if entryIdx == -1 {
+	if entryIdx == -1 || b.entries[entryIdx].isDeleted() {
 		return delEntry, nil // no entry in db to delete
 	}
+	// The deleted entry is returned with its data offset so its data block is freed.
 	delEntry = b.entries[entryIdx]
-	delEntry.msgOffset = -1
-	b.entries[entryIdx] = delEntry
+	b.entries[entryIdx].msgOffset = delEntry.deletedOffset()
 	b.dirty = true
 	w.indexBlocks[bIdx] = b
 
 	return delEntry, nil
 }
 
+// writeIndex writes the index blocks updated by del.
+func (w *_BlockWriter) writeIndex() error {
+	for bIdx, b := range w.indexBlocks {
+		if !b.dirty {
+			continue
+		}
+		if _, err := w.indexFile.WriteAt(b.marshalBinary(), blockOffset(bIdx)); err != nil {
+			return err
+		}
+		b.dirty = false
+		w.indexBlocks[bIdx] = b
+	}
+	return nil
+}
+
 func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 	var b _IndexBlock
 	var ok bool
@@ -143,11 +166,16 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 		return errEntryInvalid
 	}
 
-	dataLen := len(e.cache)
+	// The record is written with the checksum of the message ID, the topic and the value, unless
+	// the file format version has no checksum.
+	dataLen := int(e.mSize(w.version))
+	buf := make([]byte, dataLen)
+	copy(buf, e.cache)
+	if w.version >= checksumVersion {
+		binary.LittleEndian.PutUint32(buf[len(e.cache):], crc32.ChecksumIEEE(e.cache))
+	}
 	off := w.lease.allocate(uint32(dataLen))
 	if off != -1 {
-		buf := make([]byte, dataLen)
-		copy(buf, e.cache)
 		if _, err = w.dataFile.WriteAt(buf, off); err != nil {
 			return err
 		}
@@ -158,7 +186,7 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 		if err != nil {
 			return err
 		}
-		if _, err := w.buffer.WriteAt(e.cache, offset); err != nil {
+		if _, err := w.buffer.WriteAt(buf, offset); err != nil {
 			return err
 		}
 		w.offset += int64(dataLen)
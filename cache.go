@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// _ReadCache is a LRU cache of entries read from the data file. Its capacity is
+// the memdb size, the cache is held in addition to the memdb so entries cached on
+// read and entries waiting to sync take up to twice the memdb size.
+type _ReadCache struct {
+	sync.Mutex
+	size     int64 // size of the cached messages in bytes.
+	capacity int64
+	ll       *list.List
+	entries  map[uint64]*list.Element
+}
+
+func newReadCache(capacity int64) *_ReadCache {
+	return &_ReadCache{
+		capacity: capacity,
+		ll:       list.New(),
+		entries:  make(map[uint64]*list.Element),
+	}
+}
+
+// get returns a copy of the cached entry for the seq and marks it as recently used.
+// The message is copied as reads decrypt it in place.
+func (c *_ReadCache) get(seq uint64) (_IndexEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[seq]
+	if !ok {
+		return _IndexEntry{}, false
+	}
+	c.ll.MoveToFront(el)
+	e := el.Value.(_IndexEntry)
+	e.cache = append([]byte(nil), e.cache...)
+	return e, true
+}
+
+// set adds a copy of the entry to the cache, evicting least recently used entries
+// when cache is full. The entry cache must hold the message.
+func (c *_ReadCache) set(e _IndexEntry) {
+	size := int64(len(e.cache))
+	if size > c.capacity {
+		return
+	}
+	e.cache = append([]byte(nil), e.cache...)
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[e.seq]; ok {
+		c.size -= int64(len(el.Value.(_IndexEntry).cache))
+		el.Value = e
+		c.ll.MoveToFront(el)
+	} else {
+		c.entries[e.seq] = c.ll.PushFront(e)
+	}
+	c.size += size
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// delete removes the entry for the seq from the cache.
+func (c *_ReadCache) delete(seq uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[seq]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *_ReadCache) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(_IndexEntry)
+	delete(c.entries, e.seq)
+	c.size -= int64(len(e.cache))
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+const (
+	compactPostfix = ".compact"
+	// compactCommitPostfix marks the compacted data and index files as complete. The files are
+	// swapped in once the marker is written, so a compaction interrupted by a crash is rolled
+	// forward on open if the marker is found and dropped otherwise.
+	compactCommitPostfix = ".commit"
+	// defaultCompactOnCloseThreshold is the fraction of the data file held by free blocks above
+	// which the DB is compacted on close if no compaction threshold is set.
+	defaultCompactOnCloseThreshold = 0.25
+)
+
+// _FreeRanges holds free blocks of the data file sorted by offset with overlaps merged.
+type _FreeRanges []_FreeBlock
+
+// contains checks whether the data at the offset lies within a free block.
+func (r _FreeRanges) contains(off int64, size uint32) bool {
+	i := sort.Search(len(r), func(i int) bool {
+		return r[i].offset+int64(r[i].size) > off
+	})
+	return i < len(r) && r[i].offset <= off && off+int64(size) <= r[i].offset+int64(r[i].size)
+}
+
+// autoCompact compacts the DB if the free blocks exceed the compaction threshold of the data file.
+func (db *DB) autoCompact() error {
+	if db.opts.compactionThreshold == 0 {
+		return nil
+	}
+	if ok, err := db.exceedsThreshold(db.opts.compactionThreshold); !ok || err != nil {
+		return err
+	}
+	return db.compact()
+}
+
+// compactOnClose compacts the DB on close if the free blocks exceed the compaction threshold of
+// the data file. A compaction not complete within the timeout is abandoned and the data file is
+// left as is. The caller must hold the sync lock.
+func (db *DB) compactOnClose() error {
+	threshold := db.opts.compactionThreshold
+	if threshold == 0 {
+		threshold = defaultCompactOnCloseThreshold
+	}
+	if ok, err := db.exceedsThreshold(threshold); !ok || err != nil {
+		return err
+	}
+	var deadline time.Time
+	if db.opts.compactOnCloseTimeout > 0 {
+		deadline = time.Now().Add(db.opts.compactOnCloseTimeout)
+	}
+	if err := db.compactFile(deadline); err != errCompactTimeout {
+		return err
+	}
+	logger.Info().Str("context", "db.compactOnClose").Msg("compaction skipped on close, timeout exceeded")
+	return nil
+}
+
+// exceedsThreshold returns true if the free blocks exceed the fraction of the data file.
+func (db *DB) exceedsThreshold(threshold float64) (bool, error) {
+	stats, err := db.CompactionStats()
+	if err != nil {
+		return false, err
+	}
+	size := stats.LiveBytes + stats.ReclaimableBytes
+	return stats.ReclaimableBytes != 0 && float64(stats.ReclaimableBytes) >= threshold*float64(size), nil
+}
+
+// compact rewrites the live entries into a new data file and swaps it with the current data file.
+func (db *DB) compact() error {
+	// Compaction does not run concurrently with sync or expiry.
+	select {
+	case db.internal.syncLockC <- struct{}{}:
+	case <-db.internal.closeC:
+		return errClosed
+	}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	return db.compactFile(time.Time{})
+}
+
+// compactFile compacts the data file. If the deadline is non zero and the live entries are not
+// copied by the deadline, the compaction is abandoned with errCompactTimeout. The caller must hold
+// the sync lock.
+func (db *DB) compactFile(deadline time.Time) error {
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
+	}
+	free := db.internal.freeList.ranges()
+	if len(free) == 0 {
+		// The tombstones are dropped from the index even if there is no data to reclaim.
+		if ok, err := db.hasTombstones(indexFile); !ok || err != nil {
+			return err
+		}
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return err
+	}
+	tmpPath := dataFile.Name() + compactPostfix
+	tmp, err := db.internal.fsys.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			tmp.Close()
+			db.internal.fsys.Remove(tmpPath)
+		}
+	}()
+
+	// Copy live entries to the new data file, reads continue from the current data file.
+	db.internal.compactLock.RLock()
+	blocks := make(map[int32]_IndexBlock)
+	var off int64
+	r := _BlockReader{indexFile: indexFile}
+	nIndexBlocks := int32(indexFile.currSize() / int64(blockSize))
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			db.internal.compactLock.RUnlock()
+			return errCompactTimeout
+		}
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			db.internal.compactLock.RUnlock()
+			return err
+		}
+		// Deleted and expired entries are dropped from the index block and the live entries
+		// are moved up, so the tombstones do not hold the index slots. The deleted entries
+		// packing the raw topic are kept with their records so the topic is loaded on open.
+		dirty := false
+		n := 0
+		for i := 0; i < int(b.entryIdx); i++ {
+			e := b.entries[i]
+			keptOff, kept := e.keptOffset()
+			if kept {
+				e.msgOffset = keptOff
+			}
+			if e.seq == 0 || e.isDeleted() {
+				dirty = true
+				continue
+			}
+			if free.contains(e.msgOffset, e.mSize(db.fileVersion())) {
+				// The entry has expired and its data is not copied.
+				dirty = true
+				continue
+			}
+			data, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize(db.fileVersion())))
+			if err != nil {
+				db.internal.compactLock.RUnlock()
+				return err
+			}
+			if _, err := tmp.WriteAt(data, off); err != nil {
+				db.internal.compactLock.RUnlock()
+				return err
+			}
+			if e.msgOffset != off || n != i {
+				e.msgOffset = off
+				if kept {
+					e.msgOffset = e.deletedOffset()
+				}
+				b.entries[n] = e
+				dirty = true
+			}
+			n++
+			off += int64(len(data))
+		}
+		for i := n; i < int(b.entryIdx); i++ {
+			b.entries[i] = _IndexEntry{}
+		}
+		b.dropped += b.entryIdx - uint16(n)
+		b.entryIdx = uint16(n)
+		if dirty {
+			blocks[bIdx] = b
+		}
+	}
+	db.internal.compactLock.RUnlock()
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Write the index with new offsets to a new index file, reads wait for the swap.
+	db.internal.compactLock.Lock()
+	defer db.internal.compactLock.Unlock()
+	tmpIndexPath := indexFile.Name() + compactPostfix
+	if err := writeCompactIndex(db.internal.fsys, indexFile, tmpIndexPath, blocks); err != nil {
+		db.internal.fsys.Remove(tmpIndexPath)
+		return err
+	}
+	commitPath := dataFile.Name() + compactCommitPostfix
+	if err := writeCompactCommit(db.internal.fsys, commitPath, dataFile.Name(), indexFile.Name()); err != nil {
+		db.internal.fsys.Remove(tmpIndexPath)
+		return err
+	}
+
+	// The compaction is committed, the files are swapped in and the swap is rolled forward on
+	// open if it does not complete.
+	swapped = true
+	if err := db.fs.replace(db.internal.fsys, _FileDesc{fileType: typeData}, tmpPath); err != nil {
+		return err
+	}
+	if err := db.fs.replace(db.internal.fsys, _FileDesc{fileType: typeIndex}, tmpIndexPath); err != nil {
+		return err
+	}
+
+	// Free blocks refer to the old data file.
+	db.internal.freeList.reset()
+	if err := db.internal.freeList.write(); err != nil {
+		return err
+	}
+	if err := db.internal.fsys.Remove(commitPath); err != nil {
+		return err
+	}
+	db.internal.meter.Compacts.Inc(1)
+
+	return db.sync()
+}
+
+// hasTombstones returns true if the index holds zero seq or deleted entries dropped by compaction.
+func (db *DB) hasTombstones(indexFile *_File) (bool, error) {
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+
+	r := _BlockReader{indexFile: indexFile}
+	nIndexBlocks := int32(indexFile.currSize() / int64(blockSize))
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return false, err
+		}
+		for i := 0; i < int(b.entryIdx); i++ {
+			e := b.entries[i]
+			if _, kept := e.keptOffset(); e.seq == 0 || (e.isDeleted() && !kept) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// writeCompactIndex copies the index file to the named file with the rewritten index blocks in place.
+func writeCompactIndex(fsys fs.FileSystem, indexFile *_File, name string, blocks map[int32]_IndexBlock) error {
+	tmp, err := fsys.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	size := indexFile.currSize()
+	for off := int64(0); off < size; off += int64(blockSize) {
+		end := off + int64(blockSize)
+		if end > size {
+			end = size
+		}
+		var data []byte
+		if b, ok := blocks[int32(off/int64(blockSize))]; ok {
+			data = b.marshalBinary()
+		} else if data, err = indexFile.slice(off, end); err != nil {
+			return err
+		}
+		if _, err := tmp.WriteAt(data, off); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	return tmp.Close()
+}
+
+// writeCompactCommit writes the commit marker once the compacted files are flushed to the file system.
+func writeCompactCommit(fsys fs.FileSystem, name string, files ...string) error {
+	for _, file := range files {
+		if err := fsys.SyncDir(path.Dir(file)); err != nil {
+			return err
+		}
+	}
+	f, err := fsys.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fsys.SyncDir(path.Dir(name))
+}
+
+// recoverCompaction completes a compaction interrupted by a crash. A committed compaction
+// is rolled forward and the free blocks of the old data file are dropped, the files of an
+// uncommitted compaction are removed.
+func recoverCompaction(fsys fs.FileSystem, dirName string) error {
+	dataPath := filePath(fsys, dirName, _FileDesc{fileType: typeData})
+	indexPath := filePath(fsys, dirName, _FileDesc{fileType: typeIndex})
+	commitPath := dataPath + compactCommitPostfix
+	_, err := fsys.Stat(commitPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	committed := err == nil
+	for _, name := range []string{dataPath, indexPath} {
+		if committed {
+			err = fsys.Rename(name+compactPostfix, name)
+		} else {
+			err = fsys.Remove(name + compactPostfix)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !committed {
+		return nil
+	}
+	leaseFile, err := fsys.OpenFile(filePath(fsys, dirName, _FileDesc{fileType: typeLease}), os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	if err := leaseFile.Close(); err != nil {
+		return err
+	}
+	return fsys.Remove(commitPath)
+}
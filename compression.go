@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+)
+
+// Codec compresses entry payloads written to the data file. Codec ID is stored
+// with each entry so entries are decoded using the codec they were encoded with.
+// IDs 0 and 1 are reserved for the snappy and no compression codecs, Open returns
+// an error for another codec with a reserved ID.
+type Codec interface {
+	// ID identifies the codec. ID must be less than 128.
+	ID() uint8
+	Encode(dst, src []byte) []byte
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+const (
+	codecSnappy uint8 = iota
+	codecNone
+
+	maxCodecID = 1<<7 - 1
+)
+
+var (
+	// SnappyCompression compresses payloads using snappy.
+	SnappyCompression Codec = _SnappyCodec{}
+
+	// NoCompression stores payloads as is.
+	NoCompression Codec = _NoCodec{}
+
+	errCodecUnknown = errors.New("value compression codec is unknown")
+)
+
+type (
+	_SnappyCodec struct{}
+	_NoCodec     struct{}
+)
+
+func (_SnappyCodec) ID() uint8 { return codecSnappy }
+
+func (_SnappyCodec) Encode(dst, src []byte) []byte { return snappy.Encode(dst, src) }
+
+func (_SnappyCodec) Decode(dst, src []byte) ([]byte, error) { return snappy.Decode(dst, src) }
+
+func (_NoCodec) ID() uint8 { return codecNone }
+
+func (_NoCodec) Encode(dst, src []byte) []byte { return append(dst[:0], src...) }
+
+func (_NoCodec) Decode(dst, src []byte) ([]byte, error) { return append(dst[:0], src...), nil }
+
+// validCodec reports whether the codec ID is valid, the IDs reserved for the snappy and
+// no compression codecs are valid only for these codecs.
+func validCodec(codec Codec) bool {
+	if codec == nil {
+		return false
+	}
+	switch codec.(type) {
+	case _SnappyCodec, _NoCodec:
+		return true
+	}
+	id := codec.ID()
+	return id != codecSnappy && id != codecNone && id <= maxCodecID
+}
+
+// encodeValue compresses the payload if it is larger than the compression threshold.
+// It returns the entry flags with the codec ID and the encoded payload.
+func (db *DB) encodeValue(payload []byte) (uint8, []byte) {
+	codec := NoCompression
+	if len(payload) > db.opts.compressionThreshold {
+		codec = db.opts.valueCodec
+	}
+	return codec.ID() << 1, codec.Encode(nil, payload)
+}
+
+// decodeValue decompresses the payload using the codec from the entry flags.
+func (db *DB) decodeValue(flags uint8, val []byte) ([]byte, error) {
+	var codec Codec
+	switch id := flags >> 1; id {
+	case db.opts.valueCodec.ID():
+		codec = db.opts.valueCodec
+	case codecSnappy:
+		codec = SnappyCompression
+	case codecNone:
+		codec = NoCompression
+	default:
+		return nil, errCodecUnknown
+	}
+	return codec.Decode(nil, val)
+}
@@ -18,8 +18,10 @@ package unitdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"sort"
@@ -27,12 +29,12 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/crypto"
-	fltr "github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/wal"
 )
 
 // DB represents the message storage for topic->keys-values.
@@ -40,7 +42,7 @@ import (
 type DB struct {
 	opts *_Options
 
-	lock _LockFile
+	lock *_LockFile
 	fs   *_FileSet
 
 	internal *_DB
@@ -48,6 +50,12 @@ type DB struct {
 
 // Open opens or creates a new DB.
 func Open(path string, opts ...Options) (*DB, error) {
+	return OpenWithFS(path, fs.OS, opts...)
+}
+
+// OpenWithFS opens or creates a new DB on the file system. The index, data and
+// write ahead log files of the DB are all created on the file system.
+func OpenWithFS(path string, fsys fs.FileSystem, opts ...Options) (*DB, error) {
 	options := &_Options{}
 	WithDefaultOptions().set(options)
 	WithDefaultFlags().set(options)
@@ -57,8 +65,33 @@ func Open(path string, opts ...Options) (*DB, error) {
 			opt.set(options)
 		}
 	}
+	if !validCodec(options.valueCodec) {
+		return nil, errCodecUnknown
+	}
+	if options.filterFalsePositiveRate < 0 || options.filterFalsePositiveRate >= 1 {
+		return nil, errFilterRateInvalid
+	}
+	if options.maxPayloadSize < 0 || options.maxPayloadSize > maxValueLength {
+		return nil, errValueTooLarge
+	}
+	if options.maxTopicLength < 0 || options.maxTopicLength > maxTopicLength {
+		return nil, errTopicTooLarge
+	}
+	if !wal.ValidPoolSize(options.walPoolSize, options.walPoolBufferSize) {
+		return nil, errPoolSizeInvalid
+	}
+	if options.compactionThreshold < 0 || options.compactionThreshold > 1 {
+		return nil, errThresholdInvalid
+	}
+	if options.expiryInterval <= 0 || options.expiryBatchSize <= 0 {
+		return nil, errExpiryInvalid
+	}
+	if options.topicRateWindow <= 0 || options.maxTopTopics <= 0 {
+		return nil, errTopTopicsInvalid
+	}
 
-	lock, err := createLockFile(path)
+	readOnly := options.flags.readOnly
+	lock, err := createLockFile(fsys, path, readOnly, options.staleLockTimeout)
 	if err != nil {
 		if err == os.ErrExist {
 			err = errLocked
@@ -66,7 +99,7 @@ func Open(path string, opts ...Options) (*DB, error) {
 		return nil, err
 	}
 
-	infoFile, err := newFile(path, 1, _FileDesc{fileType: typeInfo})
+	infoFile, err := newFile(fsys, path, 1, _FileDesc{fileType: typeInfo}, readOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -76,24 +109,36 @@ func Open(path string, opts ...Options) (*DB, error) {
 		expDurationType:     time.Minute,
 		maxExpDurations:     maxExpDur,
 		backgroundKeyExpiry: options.flags.backgroundKeyExpiry,
+		expiryInterval:      options.expiryInterval,
+		expiryBatchSize:     options.expiryBatchSize,
+		keyHash:             options.keyHash,
 	}
-	winFile, err := newFile(path, 1, _FileDesc{fileType: typeTimeWindow})
+	winFile, err := newFile(fsys, path, 1, _FileDesc{fileType: typeTimeWindow}, readOnly)
 	if err != nil {
 		return nil, err
 	}
+	// First window block is reserved for the header as zero offset marks a topic without window blocks.
+	if err := initWindowFile(winFile._File, readOnly); err != nil {
+		return nil, err
+	}
 
-	indexFile, err := newFile(path, 1, _FileDesc{fileType: typeIndex})
+	if !readOnly {
+		if err := recoverCompaction(fsys, path); err != nil {
+			return nil, err
+		}
+	}
+	indexFile, err := newFile(fsys, path, 1, _FileDesc{fileType: typeIndex}, readOnly)
 	if err != nil {
 		return nil, err
 	}
 
-	dataFile, err := newFile(path, 1, _FileDesc{fileType: typeData})
+	dataFile, err := newFile(fsys, path, 1, _FileDesc{fileType: typeData}, readOnly)
 	if err != nil {
 		return nil, err
 	}
 
 	dbInfo := _DBInfo{}
-	if infoFile.currSize() == 0 {
+	if infoFile.currSize() == 0 && !readOnly {
 		dbInfo = _DBInfo{
 			header: _Header{
 				signature: signature,
@@ -108,46 +153,95 @@ func Open(path string, opts ...Options) (*DB, error) {
 		}
 	}
 
+	// invalidHeader releases the DB files so the DB can be reopened once the header is repaired.
+	invalidHeader := func() (*DB, error) {
+		fs := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile}}
+		fs.close()
+		lock.unlock()
+		return nil, ErrInvalidDatabase
+	}
+	// A short header is a torn write or a foreign file, the header is never zero filled.
+	if infoFile.currSize() < int64(fixed) {
+		return invalidHeader()
+	}
 	if err := infoFile.readUnmarshalableAt(&dbInfo, fixed, 0); err != nil {
 		logger.Error().Err(err).Str("context", "db.readHeader")
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return invalidHeader()
+		}
 		return nil, err
 	}
-	if !bytes.Equal(dbInfo.header.signature[:], signature[:]) {
-		return nil, errCorrupted
+	// A DB of an earlier file format version is kept in its version, a later version is not known.
+	if !bytes.Equal(dbInfo.header.signature[:], signature[:]) || dbInfo.header.version == 0 || dbInfo.header.version > version {
+		return invalidHeader()
 	}
 
-	leaseFile, err := newFile(path, 1, _FileDesc{fileType: typeLease})
+	leaseFile, err := newFile(fsys, path, 1, _FileDesc{fileType: typeLease}, readOnly)
 	if err != nil {
 		return nil, err
 	}
 	lease := newLease(leaseFile, options.freeBlockSize)
 
-	filterFile, err := newFile(path, 1, _FileDesc{fileType: typeFilter})
+	filterFile, err := newFile(fsys, path, 1, _FileDesc{fileType: typeFilter}, readOnly)
 	if err != nil {
 		return nil, err
 	}
+	// filter is rebuilt from the index if the filter file is new on an existing DB or written with an earlier hash.
+	rebuildFilter := filterFile.currSize() == 0 && dbInfo.sequence > 0
+	filter, stale, err := newFilter(filterFile, options)
+	if err != nil {
+		return nil, err
+	}
+	rebuildFilter = rebuildFilter || (stale && dbInfo.sequence > 0)
 
 	fileset := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile, leaseFile, filterFile}}
+	var topicDict *_TopicDictionary
+	if options.flags.topicDictionary {
+		topicFile, err := newFile(fsys, path, 1, _FileDesc{fileType: typeTopic}, readOnly)
+		switch {
+		case err == nil:
+			if topicDict, err = newTopicDictionary(topicFile, readOnly); err != nil {
+				return nil, err
+			}
+			fileset.list = append(fileset.list, topicFile)
+		// A read-only DB reads the topics from the data file if the topic file is not created yet.
+		case !(readOnly && os.IsNotExist(err)):
+			return nil, err
+		}
+	}
+	var topicIndex *_TopicIndex
+	if options.flags.sortedTopics {
+		topicIndex = newTopicIndex()
+	}
 	internal := &_DB{
-		mutex: newMutex(),
-		start: time.Now(),
-		meter: NewMeter(),
+		mutex:     newMutex(),
+		path:      path,
+		fsys:      fsys,
+		start:     time.Now(),
+		meter:     NewMeter(),
+		topics:    newTopicMeter(options.topicRateWindow),
+		retention: newRetention(),
 
 		dbInfo: dbInfo,
 
 		bufPool: bpool.NewBufferPool(options.bufferSize, &bpool.Options{MaxElapsedTime: 10 * time.Second}),
 
 		info:     infoFile,
-		filter:   Filter{file: filterFile, filterBlock: fltr.NewFilterGenerator()},
+		filter:   filter,
 		freeList: lease,
 
+		topicDict:  topicDict,
+		topicIndex: topicIndex,
+
 		timeWindow: newTimeWindowBucket(timeOptions),
 
+		acks: newAckTable(),
+
 		// Trie
 		trie: newTrie(),
 
 		// Block reader
-		reader: newBlockReader(fileset),
+		reader: newBlockReader(fileset, dbInfo.header.version),
 
 		// Sync Handler
 		syncLockC: make(chan struct{}, 1),
@@ -155,6 +249,7 @@ func Open(path string, opts ...Options) (*DB, error) {
 		// Close
 		closeC: make(chan struct{}),
 	}
+	internal.watchers = newWatchers(options.watchBufferSize, options.watchPolicy, internal.closeC)
 
 	// Create a new MAC from the key.
 	if internal.mac, err = crypto.New(options.encryptionKey); err != nil {
@@ -167,13 +262,38 @@ func Open(path string, opts ...Options) (*DB, error) {
 	}
 
 	// Create a blockcache.
-	memdb, err := memdb.Open(memdb.WithLogFilePath(path), memdb.WithMemdbSize(options.memdbSize), memdb.WithBufferSize(options.bufferSize))
-	if err != nil {
-		return nil, err
+	fullPolicy := memdb.FullAllow
+	switch options.memdbFullPolicy {
+	case MemdbFullReject, MemdbFullShrink:
+		fullPolicy = memdb.FullReject
+	case MemdbFullBlock:
+		fullPolicy = memdb.FullBlock
+	}
+	if options.sharedMemdb != nil {
+		if internal.mem, err = newSharedMemDB(options.sharedMemdb, options.memdbID); err != nil {
+			return nil, err
+		}
+	} else {
+		memOpts := []memdb.Options{memdb.WithFileSystem(fsys), memdb.WithLogFilePath(path), memdb.WithMemdbSize(options.memdbSize), memdb.WithBufferSize(options.bufferSize), memdb.WithWALBufferPool(options.walPoolSize, options.walPoolBufferSize), memdb.WithFullPolicy(fullPolicy)}
+		if options.flags.noWAL {
+			memOpts = append(memOpts, memdb.WithNoWAL())
+		}
+		// A read-only DB does not open the write ahead log, so the logs are left unchanged.
+		if readOnly {
+			memOpts = append(memOpts, memdb.WithReadOnly())
+		}
+		if options.keyHash != nil {
+			memOpts = append(memOpts, memdb.WithKeyHash(options.keyHash))
+		}
+		mem, err := memdb.Open(memOpts...)
+		if err != nil {
+			return nil, err
+		}
+		internal.mem = &_MemDB{DB: mem}
+	}
+	if options.flags.readCache {
+		internal.cache = newReadCache(options.memdbSize)
 	}
-	internal.mem = memdb
-
-	internal.filter.blockCache = internal.mem
 
 	db := &DB{
 		opts: options,
@@ -188,22 +308,38 @@ func Open(path string, opts ...Options) (*DB, error) {
 		logger.Error().Err(err).Str("context", "db.loadTrie")
 	}
 
+	if rebuildFilter {
+		if err := db.rebuildFilter(); err != nil {
+			// The ID of a shared memdb is released.
+			internal.mem.Close()
+			return nil, err
+		}
+	}
+
 	// Read freeList.
 	if err := db.internal.freeList.read(); err != nil {
 		logger.Error().Err(err).Str("context", "db.readHeader")
+		internal.mem.Close()
 		return nil, err
 	}
 
+	db.internal.syncHandle = _SyncHandle{DB: db}
+	// A read-only DB leaves the write ahead log to be recovered by the next writer.
+	if readOnly {
+		db.setVisible(db.seq())
+		return db, nil
+	}
+
 	if err := db.recoverLog(); err != nil {
 		// if unable to recover db then close db.
 		panic(fmt.Sprintf("Unable to recover db on sync error %v. Closing db...", err))
 	}
+	db.setVisible(db.seq())
 
-	db.internal.syncHandle = _SyncHandle{DB: db}
 	db.startSyncer(options.syncDurationType * time.Duration(options.maxSyncDurations))
 
 	if db.opts.flags.backgroundKeyExpiry {
-		db.startExpirer(time.Minute, maxExpDur)
+		db.startExpirer(timeOptions.expiryInterval, timeOptions.expiryBatchSize)
 	}
 
 	return db, nil
@@ -219,103 +355,268 @@ func (db *DB) Close() error {
 }
 
 // Get return items matching the query paramater.
+// Once Get returns q.Next gives the token to fetch the following page using WithCursor.
 func (db *DB) Get(q *Query) (items [][]byte, err error) {
+	return db.GetContext(context.Background(), q)
+}
+
+// GetContext return items matching the query paramater. It returns the context
+// error if the context is done before the query is complete.
+func (db *DB) GetContext(ctx context.Context, q *Query) (items [][]byte, err error) {
+	its, err := db.getItems(ctx, q)
+	return values(its), err
+}
+
+// GetItems return items matching the query paramater along with the message ID and insertion time.
+func (db *DB) GetItems(q *Query) ([]Item, error) {
+	return db.getItems(context.Background(), q)
+}
+
+func (db *DB) getItems(ctx context.Context, q *Query) ([]Item, error) {
 	if err := db.ok(); err != nil {
 		return nil, err
 	}
-	switch {
-	case len(q.Topic) == 0:
-		return nil, errTopicEmpty
-	case len(q.Topic) > maxTopicLength:
-		return nil, errTopicTooLarge
-	}
 	// // CPU profiling by default
 	// defer profile.Start().Stop()
-	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
-	if err := q.parse(); err != nil {
+	if err := db.parseQuery(q); err != nil {
 		return nil, err
 	}
 	mu := db.internal.mutex.getMutex(q.internal.prefix)
 	mu.RLock()
 	defer mu.RUnlock()
-	db.lookup(q)
-	if len(q.internal.winEntries) == 0 {
-		return
-	}
-	sort.Slice(q.internal.winEntries[:], func(i, j int) bool {
-		return q.internal.winEntries[i].seq > q.internal.winEntries[j].seq
-	})
-	start := 0
-	limit := q.Limit
-	if len(q.internal.winEntries) < int(q.Limit) {
-		limit = len(q.internal.winEntries)
-	}
-
-	for {
-		invalidCount := 0
-		for _, query := range q.internal.winEntries[start:limit] {
-			err = func() error {
-				if query.seq == 0 {
-					return nil
-				}
-				s, err := db.readEntry(query)
-				if err != nil {
-					if err == errMsgIDDeleted {
-						invalidCount++
-						return nil
-					}
-					logger.Error().Err(err).Str("context", "db.readEntry")
-					return err
-				}
-				id, val, err := db.internal.reader.readMessage(s)
-				if err != nil {
-					logger.Error().Err(err).Str("context", "data.readMessage")
-					return err
-				}
-				msgID := message.ID(id)
-				if !msgID.EvalPrefix(q.Contract, q.internal.cutoff) {
-					invalidCount++
-					return nil
-				}
-
-				// last bit of ID is an encryption flag.
-				if uint8(id[idSize-1]) == 1 {
-					val, err = db.internal.mac.Decrypt(nil, val)
-					if err != nil {
-						logger.Error().Err(err).Str("context", "mac.decrypt")
-						return err
-					}
-				}
-				var buffer []byte
-				val, err = snappy.Decode(buffer, val)
-				if err != nil {
-					logger.Error().Err(err).Str("context", "snappy.Decode")
-					return err
-				}
-				items = append(items, val)
-				db.internal.meter.OutBytes.Inc(int64(s.valueSize))
-				return nil
-			}()
-			if err != nil {
-				return items, err
-			}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	if err := db.lookup(ctx, q); err != nil {
+		return nil, err
+	}
+	return db.read(ctx, q)
+}
+
+// CountQuery returns the number of entries matching the query parameter without reading their payloads,
+// so callers can decide to paginate before running a large Get. The window entries of the matching
+// topics are counted honoring the contract, the From, To and Last time bounds and the topic last
+// duration, but not the query limit.
+func (db *DB) CountQuery(q *Query) (uint64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	if err := db.parseQuery(q); err != nil {
+		return 0, err
+	}
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	return db.count(context.Background(), q)
+}
+
+// Topics returns the names of the concrete topics matching the query topic, so a wildcard query
+// lists the topics it matches. Topics are named by the entries put since the DB was opened or
+// by the topic dictionary, topics without a name are skipped. The topic names are not stored
+// without the WithTopicDictionary option, so Topics returns no names for the topics put before
+// the DB was reopened.
+func (db *DB) Topics(q *Query) ([]string, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if err := db.parseQuery(q); err != nil {
+		return nil, err
+	}
+	topics := db.internal.trie.match(q.internal.parts)
+	names := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if name, ok := db.internal.topics.name(topic.hash); ok {
+			names = append(names, name)
 		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// TopicsWithPrefix returns the names of the topics of the contract under the prefix in lexical
+// order, skipping offset topics and returning at most limit topics, or all the remaining topics
+// if limit is zero. The prefix "a.b" matches "a.b" and "a.b.c" but not "a.bc", an empty prefix
+// matches all topics of the contract. It requires the WithSortedTopics option, the topics put
+// before the DB was reopened are listed only with the WithTopicDictionary option.
+func (db *DB) TopicsWithPrefix(contract uint32, prefix []byte, offset, limit int) ([]string, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if db.internal.topicIndex == nil {
+		return nil, errTopicIndexDisabled
+	}
+	if offset < 0 || limit < 0 {
+		return nil, errBadRequest
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return db.internal.topicIndex.prefix(contract, string(prefix), offset, limit), nil
+}
 
-		if invalidCount == 0 || len(items) == int(q.Limit) || len(q.internal.winEntries) == limit {
-			break
+// GetMulti return items matching each of the queries keyed by the query contract and topic, the
+// master contract if the query has no contract. Window entries are looked up for all the queries
+// together to amortize locking.
+func (db *DB) GetMulti(queries []*Query) (map[TopicKey][][]byte, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	for _, q := range queries {
+		if err := db.parseQuery(q); err != nil {
+			return nil, err
 		}
+	}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	ctx := context.Background()
+	if err := db.lookupMulti(ctx, queries); err != nil {
+		return nil, err
+	}
+	results := make(map[TopicKey][][]byte, len(queries))
+	for _, q := range queries {
+		mu := db.internal.mutex.getMutex(q.internal.prefix)
+		mu.RLock()
+		items, err := db.read(ctx, q)
+		mu.RUnlock()
+		if err != nil {
+			return results, err
+		}
+		results[TopicKey{Contract: q.Contract, Topic: string(q.Topic)}] = values(items)
+	}
+	return results, nil
+}
+
+// Has checks whether an entry with the given ID is stored in DB. It does not read the entry value.
+func (db *DB) Has(id, topic []byte) (bool, error) {
+	if err := db.ok(); err != nil {
+		return false, err
+	}
+	switch {
+	case len(id) == 0:
+		return false, errMsgIDEmpty
+	case len(id) < message.ID(id).Size():
+		return false, errEntryInvalid
+	case len(topic) == 0:
+		return false, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return false, errTopicTooLarge
+	}
+	contract := binary.LittleEndian.Uint32(id[4:8])
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return false, err
+	}
+	t.AddContract(contract)
+	topicHash, _ := db.internal.trie.topicHash(t.GetHash(contract), t.Parts)
 
-		if len(q.internal.winEntries) <= int(q.Limit+invalidCount) {
-			start = limit
-			limit = len(q.internal.winEntries)
-		} else {
-			start = limit
-			limit = limit + invalidCount
+	mu := db.internal.mutex.getMutex(message.Prefix(t.Parts))
+	mu.RLock()
+	defer mu.RUnlock()
+	return db.has(topicHash, contract, message.ID(id).Sequence())
+}
+
+// GetByID returns the payload of the entry with the given ID. The seq and the Contract
+// of the entry are decoded from the ID. It returns an error if the entry does not exist
+// in the topic or has expired.
+func (db *DB) GetByID(id, topic []byte) ([]byte, error) {
+	return db.getByID(id, topic, 0)
+}
+
+// GetAtSeq returns the payload of the entry with the given ID as of the DB seq, so entries
+// put after the seq are not found. The window chain of the topic is walked from the latest
+// entries to the entries at or before the seq. An entry put again with the same ID keeps
+// its seq, the version it replaces is kept with the seq it is replaced at, so the version
+// current as of the seq is returned. The versions are kept under a reserved contract and
+// count as entries of the DB. It returns an error if the entry does not exist in the topic
+// as of the seq or has expired.
+func (db *DB) GetAtSeq(id, topic []byte, seq uint64) ([]byte, error) {
+	if seq == 0 {
+		return nil, errMsgIDDoesNotExist
+	}
+	return db.getByID(id, topic, seq)
+}
+
+// getByID returns the payload of the entry with the given ID as of the atSeq if atSeq is non zero.
+func (db *DB) getByID(id, topic []byte, atSeq uint64) ([]byte, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(id) == 0:
+		return nil, errMsgIDEmpty
+	case len(id) < message.ID(id).Size():
+		return nil, errEntryInvalid
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	contract := binary.LittleEndian.Uint32(id[4:8])
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return nil, err
+	}
+	if t.TopicType != message.TopicStatic {
+		return nil, errBadRequest
+	}
+	t.AddContract(contract)
+	topicHash, _ := db.internal.trie.topicHash(t.GetHash(contract), t.Parts)
+	seq := message.ID(id).Sequence()
+	if seq == 0 || seq > db.seq() || (atSeq != 0 && seq > atSeq) {
+		return nil, errMsgIDDoesNotExist
+	}
+	// Test filter block for the message id presence if entry is not in memdb.
+	if data, _ := db.internal.mem.Get(seq); data == nil && !db.internal.filter.Test(seq) {
+		return nil, errMsgIDDoesNotExist
+	}
+
+	mu := db.internal.mutex.getMutex(message.Prefix(t.Parts))
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	off, ok := db.internal.trie.getOffset(topicHash)
+	if !ok {
+		return nil, errMsgIDDoesNotExist
+	}
+	we, ok, err := db.internal.timeWindow.find(context.Background(), db.fs, topicHash, seq, off)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errMsgIDDoesNotExist
+	}
+	if we.isExpired() {
+		return nil, errMsgExpired
+	}
+	e, err := db.readEntry(_Query{topicHash: topicHash, seq: seq})
+	if err != nil {
+		if err == errMsgIDDeleted || err == errEntryInvalid || err == io.EOF {
+			return nil, errMsgIDDoesNotExist
 		}
+		return nil, err
 	}
-	db.internal.meter.Gets.Inc(int64(len(items)))
-	db.internal.meter.OutMsgs.Inc(int64(len(items)))
-	return items, nil
+	prefix, val, err := db.readValue(e)
+	if err != nil {
+		return nil, err
+	}
+	if !message.ID(prefix).EvalPrefix(contract, 0) {
+		return nil, errMsgIDDoesNotExist
+	}
+	if atSeq != 0 {
+		v, ok, err := db.getVersion(topic, seq, atSeq)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			val = v
+		}
+	}
+	db.internal.meter.Gets.Inc(1)
+	db.internal.meter.OutMsgs.Inc(1)
+	db.internal.meter.OutBytes.Inc(int64(e.valueSize))
+	return val, nil
 }
 
 // NewContract generates a new Contract.
@@ -324,13 +625,30 @@ func (db *DB) NewContract() (uint32, error) {
 	rand.Read(raw)
 
 	contract := uint32(binary.LittleEndian.Uint32(raw[:4]))
+	// The versions of the entries are kept under the versionContract.
+	if contract == versionContract {
+		return db.NewContract()
+	}
 	return contract, nil
 }
 
 // NewID generates new ID that is later used to put entry or delete entry.
-func (db *DB) NewID() []byte {
+// It returns an error if the ID from the generator set using WithIDGenerator is invalid
+// or its sequence is not after the DB sequence.
+func (db *DB) NewID() ([]byte, error) {
+	if db.opts.idGenerator == nil {
+		db.internal.meter.Leases.Inc(1)
+		return message.NewID(db.nextSeq()), nil
+	}
+	id := db.opts.idGenerator()
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	if !db.claimSeq(message.ID(id).Sequence()) {
+		return nil, errMsgIDSeqNotAfter
+	}
 	db.internal.meter.Leases.Inc(1)
-	return message.NewID(db.nextSeq())
+	return id, nil
 }
 
 // Put puts entry into DB. It uses default Contract to put entry into DB.
@@ -341,29 +659,180 @@ func (db *DB) Put(topic, payload []byte) error {
 }
 
 // PutEntry puts entry into the DB, if Contract is not specified then it uses master Contract.
+// On success the entry ID is set to the ID of the entry with the contract, minted by the DB
+// if the entry has no ID, and Seq returns the seq of the entry.
 // It is safe to modify the contents of the argument after PutEntry returns but not
 // before.
 func (db *DB) PutEntry(e *Entry) error {
-	if err := db.ok(); err != nil {
+	return db.PutEntryContext(context.Background(), e)
+}
+
+// PutEntryContext puts entry into the DB. It returns the context error if the context
+// is done before the entry is written.
+// It is safe to modify the contents of the argument after PutEntryContext returns but not
+// before.
+func (db *DB) PutEntryContext(ctx context.Context, e *Entry) error {
+	return db.putEntry(ctx, e, nil)
+}
+
+// putEntry puts entry into the DB, the ack is added to the acknowledgments before the entry
+// is written so it is fired once the time block of the entry is synced. The entry is written
+// under the topic mutex, so the puts to the topic are serialized with PutIf.
+func (db *DB) putEntry(ctx context.Context, e *Entry, ack chan error) error {
+	if err := db.prepareEntry(ctx, e); err != nil {
+		return err
+	}
+	mu := db.internal.mutex.getMutex(e.entry.prefix)
+	mu.Lock()
+	defer mu.Unlock()
+	return db.commitEntry(e, ack)
+}
+
+// prepareEntry validates and packs the entry to put.
+func (db *DB) prepareEntry(ctx context.Context, e *Entry) error {
+	if err := db.okWrite(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
 	switch {
 	case len(e.Topic) == 0:
 		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
-		return errTopicTooLarge
+	case len(e.Topic) > db.opts.maxTopicLength:
+		return ErrEntryTooLarge
 	case len(e.Payload) == 0:
 		return errValueEmpty
-	case len(e.Payload) > maxValueLength:
-		return errValueTooLarge
+	case len(e.Payload) > db.opts.maxPayloadSize:
+		return ErrEntryTooLarge
+	case e.ID != nil && validateID(e.ID) != nil:
+		return errMsgIDInvalid
 	}
 
 	if err := db.setEntry(e); err != nil {
 		return err
 	}
+	// The entry is not written if the context is done while it is encoded.
+	if err := ctx.Err(); err != nil {
+		db.internal.trie.release(e.entry.topicHash, 1, false)
+		return err
+	}
+	return nil
+}
+
+// commitEntry writes the entry packed by prepareEntry and adds the ack to the acknowledgments.
+func (db *DB) commitEntry(e *Entry, ack chan error) error {
+	if ack == nil {
+		return db.writeEntry(e)
+	}
 
+	seq := e.entry.seq
+	db.internal.acks.add(seq, ack)
+	// The pending acknowledgments are fired on close, an entry put while the DB is closing is not acknowledged.
+	err := db.ok()
+	if err == nil {
+		err = db.writeEntry(e)
+	} else {
+		db.internal.trie.release(e.entry.topicHash, 1, false)
+	}
+	if err != nil {
+		db.internal.acks.remove(seq)
+	}
+	return err
+}
+
+// PutIf puts entry into the DB only if the latest entry of the topic has the expected ID, or
+// if the topic has no entries when the expected ID is nil. It returns ErrCASFailed otherwise.
+// The check and the put hold the topic mutex, as the puts of PutEntry, so of the PutIf calls
+// racing on the same latest entry exactly one succeeds. The deleted entries of the topic are
+// skipped, the latest entry is the latest entry not deleted. Entries put to the topic by a
+// batch are not serialized with PutIf.
+func (db *DB) PutIf(e *Entry, expectedPrevID []byte) error {
+	if err := db.okWrite(); err != nil {
+		return err
+	}
+	q := NewQuery(e.Topic).WithContract(e.Contract).WithLimit(1)
+	if err := db.parseQuery(q); err != nil {
+		return err
+	}
+	if q.internal.topicType != message.TopicStatic {
+		return errBadRequest
+	}
+	if err := db.prepareEntry(context.Background(), e); err != nil {
+		return err
+	}
+	mu := db.internal.mutex.getMutex(e.entry.prefix)
+	mu.Lock()
+	defer mu.Unlock()
+
+	latest, err := func() ([]Item, error) {
+		db.internal.compactLock.RLock()
+		defer db.internal.compactLock.RUnlock()
+		for {
+			if err := db.lookup(context.Background(), q); err != nil {
+				return nil, err
+			}
+			items, err := db.read(context.Background(), q)
+			if len(items) != 0 || len(q.internal.winEntries) == 0 || err != nil {
+				return items, err
+			}
+			// The latest entries are deleted, the entries before them are looked up.
+			q.internal.cursor = q.internal.winEntries[len(q.internal.winEntries)-1].seq
+			q.internal.winEntries = q.internal.winEntries[:0]
+		}
+	}()
+	if err == nil {
+		switch {
+		case len(latest) == 0 && expectedPrevID != nil:
+			err = ErrCASFailed
+		case len(latest) != 0 && !bytes.Equal(latest[0].ID, expectedPrevID):
+			err = ErrCASFailed
+		}
+	}
+	if err != nil {
+		db.internal.trie.release(e.entry.topicHash, 1, false)
+		return err
+	}
+	return db.commitEntry(e, nil)
+}
+
+// PutEntryWithAck puts entry into the DB like PutEntry and returns a channel that receives
+// nil once the entry is synced to the DB files and released from the WAL, so the entry is
+// durable. The channel receives the error if the put fails, or if the DB is closed before
+// the entry is synced.
+func (db *DB) PutEntryWithAck(e *Entry) <-chan error {
+	ack := make(chan error, 1)
+	if err := db.putEntry(context.Background(), e, ack); err != nil {
+		// The ack is fired already if the DB is closed after the ack is added.
+		select {
+		case ack <- err:
+		default:
+		}
+	}
+	return ack
+}
+
+// writeEntry writes the packed entry to the memdb and adds it to the time window and the trie.
+// The entry marked as being written by setEntry is released once it is written or fails.
+func (db *DB) writeEntry(e *Entry) (err error) {
+	topicHash := e.entry.topicHash
+	defer func() {
+		db.internal.trie.release(topicHash, 1, err == nil)
+	}()
 	timeID, err := db.internal.mem.Put(e.entry.seq, e.entry.cache)
+	if err == memdb.ErrMemFull && db.opts.memdbFullPolicy == MemdbFullShrink {
+		if err := db.Flush(); err != nil {
+			return err
+		}
+		if err := db.Sync(); err != nil {
+			return err
+		}
+		timeID, err = db.internal.mem.Put(e.entry.seq, e.entry.cache)
+	}
+	if err == memdb.ErrMemFull {
+		return ErrMemdbFull
+	}
 	if err != nil {
 		return err
 	}
@@ -371,6 +840,7 @@ func (db *DB) PutEntry(e *Entry) error {
 	if ok := db.internal.timeWindow.add(timeID, e.entry.topicHash, newWinEntry(e.entry.seq, e.entry.expiresAt)); !ok {
 		return errForbidden
 	}
+	db.internal.topics.mark(e.entry.topicHash, 1)
 
 	if e.entry.topicSize != 0 {
 		t := new(message.Topic)
@@ -378,6 +848,7 @@ func (db *DB) PutEntry(e *Entry) error {
 		t.Unmarshal(rawTopic)
 		db.internal.trie.add(newTopic(e.entry.topicHash, 0), t.Parts, t.Depth)
 	}
+	db.setVisible(e.entry.seq)
 
 	db.internal.meter.Puts.Inc(1)
 
@@ -397,6 +868,9 @@ func (db *DB) Delete(id, topic []byte) error {
 // It is safe to modify the contents of the argument after Delete returns but
 // not before.
 func (db *DB) DeleteEntry(e *Entry) error {
+	if err := db.okWrite(); err != nil {
+		return err
+	}
 	switch {
 	case db.opts.flags.immutable:
 		return errImmutable
@@ -408,20 +882,27 @@ func (db *DB) DeleteEntry(e *Entry) error {
 		return errTopicTooLarge
 	}
 	id := message.ID(e.ID)
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
 	topic, _, err := db.parseTopic(e.Contract, e.Topic)
 	if err != nil {
 		return err
 	}
-	if e.Contract == 0 {
-		e.Contract = message.MasterContract
-	}
 	topic.AddContract(e.Contract)
+	topicHash, _ := db.internal.trie.topicHash(topic.GetHash(e.Contract), topic.Parts)
 
-	if err := db.delete(topic.GetHash(e.Contract), message.ID(id).Sequence()); err != nil {
+	seq := message.ID(id).Sequence()
+	// The entry is deleted only if it is an entry of the topic, so the live entries of
+	// another topic are not counted down.
+	if ok, err := db.has(topicHash, e.Contract, seq); !ok || err != nil {
+		return err
+	}
+	if deleted, err := db.delete(topicHash, seq); !deleted || err != nil {
 		return err
 	}
 
-	return nil
+	return db.pruneTopic(topicHash)
 }
 
 // Batch executes a function within the context of a read-write managed transaction.
@@ -430,8 +911,17 @@ func (db *DB) DeleteEntry(e *Entry) error {
 // Any error that is returned from the function or returned from the write is
 // returned from the Batch() method.
 //
+// Batches are isolated from each other and may run concurrently, to the same or to
+// different topics. Each batch writes to its own time block and WAL log, so batches
+// commit independently without waiting for one another. Entries of a batch become
+// visible to queries once the batch writes them, that is on commit or on an earlier
+// write of a large batch, and are synced to the data file only after the batch commits.
+//
 // Attempting to manually commit or rollback within the function will cause a panic.
 func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
+	if err := db.okWrite(); err != nil {
+		return err
+	}
 	b := db.batch()
 
 	b.setManaged()
@@ -450,11 +940,24 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 // Sync write window entries into summary file and write index, and data to respective index and data files.
 // In case of any error during sync operation recovery is performed on log file (write ahead log).
 func (db *DB) Sync() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	// A read-only DB has no entries to sync.
+	if db.opts.flags.readOnly {
+		return nil
+	}
 	// start := time.Now()
 	if ok := db.internal.syncHandle.status(); ok {
 		// sync is in-progress.
 		return nil
 	}
+	// Without the WAL the current time block is sealed so the sync does not leave it behind.
+	if db.opts.flags.noWAL {
+		if err := db.internal.mem.Seal(); err != nil {
+			return err
+		}
+	}
 
 	// Sync happens synchronously.
 	db.internal.syncLockC <- struct{}{}
@@ -462,18 +965,154 @@ func (db *DB) Sync() error {
 		<-db.internal.syncLockC
 	}()
 
+	return db.syncEntries()
+}
+
+// syncEntries syncs the entries of the time blocks committed to the memdb, the sync lock must be held.
+func (db *DB) syncEntries() error {
 	if ok := db.internal.syncHandle.startSync(); !ok {
 		return nil
 	}
 	defer func() {
 		db.internal.syncHandle.finish()
 	}()
-	return db.internal.syncHandle.Sync()
+	err := db.internal.syncHandle.Sync()
+	db.internal.syncErr.Store(_SyncError{err: err})
+	return err
+}
+
+// Flush makes the entries put to the DB durable in the write ahead log without syncing them to
+// the DB files. It is cheaper than Sync and the flushed entries are recovered on Open if the DB
+// is not closed cleanly.
+func (db *DB) Flush() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	return db.internal.mem.Flush()
+}
+
+// Compact reclaims the space of deleted and expired entries. It rewrites live entries into
+// a new data file and swaps it with the current data file. The DB stays open during compaction,
+// reads wait only while the data file is swapped.
+func (db *DB) Compact() error {
+	if err := db.okWrite(); err != nil {
+		return err
+	}
+	return db.compact()
+}
+
+// Backup writes a point-in-time archive of the DB to w. Writes are not stopped during
+// the backup, entries not yet synced to the DB are included from the write ahead logs.
+// The write ahead log of a shared memdb is not archived, the entries of the DB are synced first.
+func (db *DB) Backup(w io.Writer) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return db.backup(w)
 }
 
-// FileSize returns the total size of the disk storage used by the DB.
+// FileSize returns the total size of the disk storage used by the DB,
+// including the write ahead logs not yet applied to the DB.
 func (db *DB) FileSize() (int64, error) {
-	return db.fs.size()
+	size, err := db.fs.size()
+	if err != nil {
+		return 0, err
+	}
+	return size + db.internal.mem.LogFileSize(), nil
+}
+
+// ExpiringEntry is an entry expiring before the time passed to ExpiringBefore.
+type ExpiringEntry struct {
+	Topic     string    // Topic of the entry, empty if the topic has no name.
+	ID        []byte    // Message ID of the entry.
+	ExpiresAt time.Time // Time the entry expires.
+}
+
+// ExpiringBefore returns the entries expiring before the time t sorted by the expiry time,
+// including the entries expired but not yet reclaimed. The entries are not deleted and the
+// expiry is not changed, so it can be used to forecast reclamation.
+func (db *DB) ExpiringBefore(t time.Time) ([]ExpiringEntry, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	entries, err := db.internal.timeWindow.expiringBefore(db.fs, t)
+	if err != nil {
+		return nil, err
+	}
+	var expiring []ExpiringEntry
+	for _, we := range entries {
+		e, err := db.readEntry(_Query{topicHash: we.topicHash, seq: we.seq()})
+		if err != nil {
+			// entry is deleted.
+			if err == errMsgIDDeleted || err == errEntryInvalid || err == io.EOF {
+				continue
+			}
+			return nil, err
+		}
+		prefix, _, err := db.internal.reader.readMessage(e)
+		if err != nil {
+			return nil, err
+		}
+		ex := ExpiringEntry{ID: messageID(prefix, e.seq), ExpiresAt: time.Unix(int64(we.expiryTime()), 0)}
+		if topic, ok := db.internal.topics.name(we.topicHash); ok {
+			ex.Topic = topic
+		}
+		expiring = append(expiring, ex)
+	}
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].ExpiresAt.Before(expiring[j].ExpiresAt) })
+	return expiring, nil
+}
+
+// CompactionStats holds the live and reclaimable bytes of the data file.
+type CompactionStats struct {
+	LiveBytes        int64 // Bytes used by entries in the data file.
+	ReclaimableBytes int64 // Bytes of free blocks released by deleted or expired entries.
+	FreeBlocks       int   // Number of free blocks.
+}
+
+// CompactionStats returns the live and reclaimable bytes of the data file.
+// The stats are computed from running totals of the free blocks and do not scan the DB.
+func (db *DB) CompactionStats() (CompactionStats, error) {
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	stat, err := dataFile.Stat()
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	reclaimable := db.internal.freeList.freeSize()
+	return CompactionStats{
+		LiveBytes:        stat.Size() - reclaimable,
+		ReclaimableBytes: reclaimable,
+		FreeBlocks:       db.internal.freeList.count(),
+	}, nil
+}
+
+// FreeBlock is a free region of the data file released by a deleted or expired entry.
+type FreeBlock struct {
+	Offset int64  // Offset of the region in the data file.
+	Size   uint32 // Size of the region in bytes.
+}
+
+// FreeBlocks returns the free regions of the data file sorted by offset, with adjacent regions
+// reported as one. The DB tracks all free regions rather than a fixed number of slots, and the
+// whole free list is persisted to the lease file on close, so the regions survive a reopen.
+func (db *DB) FreeBlocks() []FreeBlock {
+	ranges := db.internal.freeList.ranges()
+	blocks := make([]FreeBlock, 0, len(ranges))
+	for _, r := range ranges {
+		blocks = append(blocks, FreeBlock{Offset: r.offset, Size: r.size})
+	}
+	return blocks
+}
+
+// Seq returns the seq of the latest entry visible to the queries. The seqs minted by NewID
+// and the entries still being put are not counted. Entries put later get a greater seq, so
+// a consumer records the seq as a checkpoint and resumes with Query.WithSinceSeq.
+func (db *DB) Seq() uint64 {
+	return atomic.LoadUint64(&db.internal.visibleSeq)
 }
 
 // Count returns the number of items in the DB.
@@ -52,6 +52,9 @@ func (inf _DBInfo) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary de-serializes db info from binary data.
 func (inf *_DBInfo) UnmarshalBinary(data []byte) error {
+	if len(data) < int(fixed) {
+		return ErrInvalidDatabase
+	}
 	copy(inf.header.signature[:], data[:7])
 	inf.header.version = binary.LittleEndian.Uint32(data[7:11])
 	inf.encryption = int8(data[7])
@@ -17,6 +17,9 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"math"
@@ -25,28 +28,34 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/crypto"
-	"github.com/unit-io/unitdb/memdb"
+	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 const (
 	entriesPerIndexBlock  = 255 // (4096 i.e blocksize - 14 fixed/16 i.e entry size)
-	entriesPerWindowBlock = 335 // ((4096 i.e. blocksize - 26 fixed)/12 i.e. window entry size)
+	entriesPerWindowBlock = 335 // ((4096 i.e. blocksize - 26 fixed)/12 i.e. window entry size of window file version 1)
+	entriesPerTimeBlock   = 254 // ((4096 i.e. blocksize - 27 fixed)/16 i.e. window entry size with the insertion time)
 	nBlocks               = 100000
 	nShards               = 27
 	nPoolSize             = 27
 	lockPostfix           = ".lock"
 	idSize                = 9 // message ID prefix with additional encryption bit.
-	version               = 1 // file format version.
+	checksumSize          = 4 // checksum of a data record.
+	checksumVersion       = 2 // first file format version with the checksum of the data records.
+	version               = 2 // file format version.
 
 	// maxExpDur expired keys are deleted from DB after durType*maxExpDur.
 	// For example if durType is Minute and maxExpDur then
 	// all expired keys are deleted from db in 1 minutes
 	maxExpDur = 1
 
+	// minExpiryInterval is the shortest interval the expirer runs at while there is a backlog of expired entries.
+	minExpiryInterval = 100 * time.Millisecond
+
 	// maxWindowDur duration in hours to save summary of records to timewindow files
 	maxWindowDur = 24 * 7
 
@@ -64,38 +73,67 @@ const (
 
 	// maxSeq is the maximum number of seq supported.
 	maxSeq = math.MaxUint64
+
+	// versionContract is the contract the prior versions of the entries put again with the
+	// same ID are kept under.
+	versionContract = uint32(0xfffffff0)
 )
 
 type (
 	_DB struct {
 		mutex _Mutex
 
+		// The db directory.
+		path string
+		// The file system the db files are stored in.
+		fsys fs.FileSystem
 		// The db start time.
 		start time.Time
 		// The metrics to measure timeseries on message events.
 		meter *Meter
+		// The write rates per topic.
+		topics *_TopicMeter
+		// The maximum number of entries kept per topic.
+		retention *_Retention
 
 		dbInfo _DBInfo
 		mac    *crypto.MAC
+		// visibleSeq is the seq of the latest entry written to the memdb, so visible to the queries.
+		visibleSeq uint64
 
-		mem      *memdb.DB
+		mem      *_MemDB
+		cache    *_ReadCache
 		bufPool  *bpool.BufferPool
 		info     _FileSet
 		filter   Filter
 		freeList *_Lease
 
+		// topicDict is nil unless the DB keeps a topic dictionary.
+		topicDict *_TopicDictionary
+		// topicIndex is nil unless the DB keeps the topics sorted.
+		topicIndex *_TopicIndex
+
 		timeWindow *_TimeWindowBucket
 
+		// acks are the acknowledgments of the entries waiting for the sync.
+		acks *_AckTable
+		// watchers are the watchers of the write events of the entries synced.
+		watchers *_Watchers
+
 		// Trie
 		trie *_Trie
 
 		// Block reader
 		reader *_BlockReader
+		// compactLock guards reads from the data file when it is swapped on compaction.
+		compactLock sync.RWMutex
 
 		// sync handler
 		syncLockC  chan struct{}
 		syncWrites bool
 		syncHandle _SyncHandle
+		// syncErr is the error of the last sync reported by Health.
+		syncErr atomic.Value
 
 		// Close.
 		closeW sync.WaitGroup
@@ -109,7 +147,7 @@ func (db *DB) writeInfo() error {
 	inf := _DBInfo{
 		header: _Header{
 			signature: signature,
-			version:   version,
+			version:   db.fileVersion(),
 		},
 		encryption: db.internal.dbInfo.encryption,
 		sequence:   atomic.LoadUint64(&db.internal.dbInfo.sequence),
@@ -128,21 +166,57 @@ func (db *DB) close() error {
 	// Signal all goroutines.
 	close(db.internal.closeC)
 
-	// Acquire lock.
-	db.internal.syncLockC <- struct{}{}
-
 	// Wait for all goroutines to exit.
 	db.internal.closeW.Wait()
 
+	// Acquire lock, a sync in progress completes before the lock is acquired.
+	db.internal.syncLockC <- struct{}{}
+
+	// Without the WAL the entries of the current time block are lost unless the final sync
+	// syncs them, so the time block is sealed first.
+	if db.opts.flags.noWAL && !db.opts.flags.readOnly {
+		if err := db.internal.mem.Seal(); err != nil {
+			logger.Error().Err(err).Str("context", "db.close").Msg("Error sealing memdb")
+		}
+	}
+
+	// Run a final sync so entries committed to the log are synced to DB.
+	var syncErr error
+	if ok := !db.opts.flags.readOnly && db.internal.syncHandle.startSync(); ok {
+		if err := db.internal.syncHandle.Sync(); err != nil {
+			logger.Error().Err(err).Str("context", "db.close").Msg("Error syncing to db")
+			syncErr = err
+		}
+		db.internal.syncHandle.finish()
+	}
+
+	// Compact once the entries are synced so the space is reclaimed before the files are closed.
+	var compactErr error
+	if db.opts.flags.compactOnClose && !db.opts.flags.readOnly && syncErr == nil {
+		if err := db.compactOnClose(); err != nil {
+			logger.Error().Err(err).Str("context", "db.close").Msg("Error compacting db")
+			compactErr = err
+		}
+	}
+
+	// Entries not synced by the final sync are not acknowledged as durable.
+	db.internal.acks.doneAll(errClosed)
+	db.internal.watchers.close()
+
 	// close memdb.
 	db.internal.mem.Close()
 
-	if err := db.writeInfo(); err != nil {
-		return err
-	}
-	db.internal.freeList.defrag()
-	if err := db.internal.freeList.write(); err != nil {
-		return err
+	if !db.opts.flags.readOnly {
+		if err := db.writeInfo(); err != nil {
+			return err
+		}
+		if err := db.internal.filter.sync(); err != nil {
+			return err
+		}
+		db.internal.freeList.defrag()
+		if err := db.internal.freeList.write(); err != nil {
+			return err
+		}
 	}
 	if err := db.fs.close(); err != nil {
 		return err
@@ -161,6 +235,12 @@ func (db *DB) close() error {
 
 	db.internal.meter.UnregisterAll()
 
+	if syncErr != nil {
+		return syncErr
+	}
+	if compactErr != nil {
+		return compactErr
+	}
 	return err
 }
 
@@ -168,17 +248,18 @@ func (db *DB) close() error {
 func (db *DB) loadTrie() error {
 	r := newWindowReader(db.fs)
 	err := r.blockIterator(func(startSeq, topicHash uint64, off int64) (bool, error) {
-		e, err := db.internal.reader.readEntry(startSeq)
-		if err != nil {
-			return true, err
-		}
-		if e.topicSize == 0 {
+		rawtopic, err := db.loadTopic(startSeq, topicHash)
+		if err == errMsgIDDeleted || err == errEntryInvalid {
+			// The entry packing the raw topic was dropped, the topic is not loaded.
+			logger.Error().Err(err).Str("context", "db.loadTrie").Msg("Error loading topic")
 			return false, nil
 		}
-		rawtopic, err := db.internal.reader.readTopic(e)
 		if err != nil {
 			return true, err
 		}
+		if rawtopic == nil {
+			return false, nil
+		}
 		t := new(message.Topic)
 		err = t.Unmarshal(rawtopic)
 		if err != nil {
@@ -188,46 +269,385 @@ func (db *DB) loadTrie() error {
 			logger.Info().Str("context", "db.loadTrie: topic exist in the trie")
 			return false, nil
 		}
+		if name, ok := db.internal.topics.name(topicHash); ok && db.internal.topicIndex != nil && staticTopic(t) {
+			db.internal.topicIndex.add(t.Parts[0].Hash, name, topicHash)
+		}
 		return false, nil
 	})
 	return err
 }
 
+// loadTopic returns the raw topic from the topic dictionary, or reads it from the first entry
+// of the topic in the data file and adds it to the topic dictionary.
+func (db *DB) loadTopic(startSeq, topicHash uint64) ([]byte, error) {
+	if db.internal.topicDict != nil {
+		if r, ok := db.internal.topicDict.get(topicHash); ok {
+			db.setTopicName(topicHash, r)
+			return r.rawTopic, nil
+		}
+	}
+	e, err := db.internal.reader.readTopicEntry(startSeq)
+	if err != nil {
+		return nil, err
+	}
+	if e.topicSize == 0 {
+		return nil, nil
+	}
+	db.internal.meter.TopicReads.Inc(1)
+	rawtopic, err := db.internal.reader.readTopic(e)
+	if err != nil {
+		return nil, err
+	}
+	if !db.opts.flags.readOnly {
+		if err := db.putTopic(topicHash, rawtopic, ""); err != nil {
+			return nil, err
+		}
+	}
+	return rawtopic, nil
+}
+
 func (db *DB) readEntry(q _Query) (_IndexEntry, error) {
-	data, _ := db.internal.mem.Get(q.seq)
-	if data != nil {
-		var m _Entry
-		m.UnmarshalBinary(data[:entrySize])
-		e := _IndexEntry{
-			seq:       m.seq,
-			topicSize: m.topicSize,
-			valueSize: m.valueSize,
+	if e, ok := db.memEntry(q.seq); ok {
+		return e, nil
+	}
+	// The entry deleted from the memdb before it is synced is not in the index.
+	if !db.internal.filter.Test(q.seq) {
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+	if db.internal.cache == nil {
+		return db.internal.reader.readEntry(q.seq)
+	}
+	if e, ok := db.internal.cache.get(q.seq); ok {
+		db.internal.meter.Hits.Inc(1)
+		return e, nil
+	}
+	db.internal.meter.Misses.Inc(1)
+	e, err := db.internal.reader.readEntry(q.seq)
+	if err != nil {
+		return e, err
+	}
+	if e.cache, err = db.internal.reader.readRecord(e); err != nil {
+		return _IndexEntry{}, err
+	}
+	db.internal.cache.set(e)
 
-			cache: data[entrySize:],
-		}
+	return e, nil
+}
+
+// readIndexEntry reads the entry from the memdb or the index entry of the seq. Unlike readEntry the
+// data record of the entry is not read and the entry is not cached.
+func (db *DB) readIndexEntry(seq uint64) (_IndexEntry, error) {
+	if e, ok := db.memEntry(seq); ok {
 		return e, nil
 	}
+	if !db.internal.filter.Test(seq) {
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+	return db.internal.reader.readEntry(seq)
+}
+
+// memEntry returns the entry of the seq from the memdb. It returns false if the entry is not in the memdb.
+func (db *DB) memEntry(seq uint64) (_IndexEntry, bool) {
+	data, _ := db.internal.mem.Get(seq)
+	if data == nil {
+		return _IndexEntry{}, false
+	}
+	var m _Entry
+	m.UnmarshalBinary(data[:entrySize])
+	e := _IndexEntry{
+		seq:       m.seq,
+		topicSize: m.topicSize,
+		valueSize: m.valueSize,
+
+		cache: data[entrySize:],
+	}
+	return e, true
+}
+
+// readValue reads the message of the entry and returns the ID prefix and the decrypted and decompressed payload.
+func (db *DB) readValue(e _IndexEntry) ([]byte, []byte, error) {
+	id, val, err := db.internal.reader.readMessage(e)
+	if err != nil {
+		logger.Error().Err(err).Str("context", "data.readMessage")
+		return nil, nil, err
+	}
+	// last byte of ID holds the encryption flag and the compression codec.
+	flags := uint8(id[idSize-1])
+	if flags&1 == 1 {
+		val, err = db.internal.mac.Decrypt(nil, val)
+		if err != nil {
+			logger.Error().Err(err).Str("context", "mac.decrypt")
+			return nil, nil, err
+		}
+	}
+	val, err = db.decodeValue(flags, val)
+	if err != nil {
+		logger.Error().Err(err).Str("context", "db.decodeValue")
+		return nil, nil, err
+	}
+	return id, val, nil
+}
 
-	return db.internal.reader.readEntry(q.seq)
+// parseQuery validates and parses the query.
+func (db *DB) parseQuery(q *Query) error {
+	switch {
+	case len(q.Topic) == 0:
+		return errTopicEmpty
+	case len(q.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
+	return q.parse()
+}
+
+// read reads items for the window entries of the query. The window entries are looked up to the
+// query limit, if the entries read are filtered out by the query the entries following the last
+// entry reached are looked up until the limit is met or the entries are exhausted.
+func (db *DB) read(ctx context.Context, q *Query) (items []Item, err error) {
+	if len(q.internal.winEntries) == 0 {
+		return
+	}
+	q.sortEntries()
+	full := len(q.internal.winEntries) >= int(q.Limit)
+	start := 0
+	limit := q.Limit
+	if len(q.internal.winEntries) < int(q.Limit) {
+		limit = len(q.internal.winEntries)
+	}
+
+	for {
+		invalidCount := 0
+		for _, query := range q.internal.winEntries[start:limit] {
+			select {
+			case <-ctx.Done():
+				return items, ctx.Err()
+			default:
+			}
+			err = func() error {
+				if query.seq == 0 {
+					return nil
+				}
+				q.internal.next = query.seq
+				s, err := db.readEntry(query)
+				if err != nil {
+					if err == errMsgIDDeleted {
+						invalidCount++
+						return nil
+					}
+					logger.Error().Err(err).Str("context", "db.readEntry")
+					return err
+				}
+				// The space of an expired entry is reclaimed once it is freed.
+				if s.cache == nil && query.expiresAt != 0 && query.expiresAt <= uint32(time.Now().Unix()) && db.internal.freeList.isFree(s.msgOffset) {
+					invalidCount++
+					return nil
+				}
+				id, val, err := db.readValue(s)
+				if err != nil {
+					return err
+				}
+				msgID := message.ID(id)
+				if !msgID.EvalPrefix(q.Contract, q.internal.cutoff) {
+					invalidCount++
+					return nil
+				}
+				if q.internal.to != 0 && uid.Time(id[:4]) > q.internal.to {
+					invalidCount++
+					return nil
+				}
+				items = append(items, newItem(id, query, val))
+				db.internal.meter.OutBytes.Inc(int64(s.valueSize))
+				return nil
+			}()
+			if err != nil {
+				return items, err
+			}
+		}
+
+		if invalidCount == 0 || len(items) == int(q.Limit) {
+			break
+		}
+		if len(q.internal.winEntries) == limit {
+			if !full || q.internal.next == 0 {
+				break
+			}
+			q.internal.cursor = q.internal.next
+			q.internal.winEntries = q.internal.winEntries[:0]
+			if err := db.lookup(ctx, q); err != nil {
+				return items, err
+			}
+			q.sortEntries()
+			full = len(q.internal.winEntries) >= int(q.Limit)
+			start = 0
+			limit = q.Limit - len(items)
+			if len(q.internal.winEntries) < limit {
+				limit = len(q.internal.winEntries)
+			}
+			if limit == 0 {
+				break
+			}
+			continue
+		}
+
+		if len(q.internal.winEntries) <= int(q.Limit+invalidCount) {
+			start = limit
+			limit = len(q.internal.winEntries)
+		} else {
+			start = limit
+			limit = limit + invalidCount
+		}
+	}
+	// More entries may follow if the page is full.
+	if len(items) < int(q.Limit) {
+		q.internal.next = 0
+	}
+	db.internal.meter.Gets.Inc(int64(len(items)))
+	db.internal.meter.OutMsgs.Inc(int64(len(items)))
+	return items, nil
+}
+
+// count counts the window entries of the query topics whose message IDs satisfy the query.
+func (db *DB) count(ctx context.Context, q *Query) (uint64, error) {
+	topics := db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
+	var count uint64
+	for _, topic := range topics {
+		var wEntries _WindowEntries
+		var err error
+		if q.Ascending {
+			wEntries, err = db.internal.timeWindow.lookupAscending(ctx, db.fs, topic.hash, q.internal.after(), topic.offset, q.internal.cutoff, math.MaxInt32, q.Expired)
+		} else {
+			wEntries, err = db.internal.timeWindow.lookup(ctx, db.fs, topic.hash, q.internal.cursor, q.internal.since, topic.offset, q.internal.cutoff, math.MaxInt32, q.Expired)
+		}
+		if err != nil {
+			return count, err
+		}
+		for _, we := range wEntries {
+			select {
+			case <-ctx.Done():
+				return count, ctx.Err()
+			default:
+			}
+			if we.seq() == 0 {
+				continue
+			}
+			// Only the message ID of the entry is read, the entry is not cached.
+			s, err := db.readIndexEntry(we.seq())
+			if err != nil {
+				if err == errMsgIDDeleted || err == errEntryInvalid {
+					continue
+				}
+				return count, err
+			}
+			if s.cache == nil && we.expiryTime() != 0 && we.expiryTime() <= uint32(time.Now().Unix()) && db.internal.freeList.isFree(s.msgOffset) {
+				continue
+			}
+			id, err := db.internal.reader.readID(s)
+			if err != nil {
+				return count, err
+			}
+			if !message.ID(id).EvalPrefix(q.Contract, q.internal.cutoff) {
+				continue
+			}
+			if q.internal.to != 0 && uid.Time(id[:4]) > q.internal.to {
+				continue
+			}
+			count++
+		}
+	}
+
+	return count, nil
 }
 
 // lookups are performed in following order
 // ilookup lookups in memory entries from timeWindow
 // lookup lookups persisted entries from timeWindow file.
-func (db *DB) lookup(q *Query) error {
+func (db *DB) lookup(ctx context.Context, q *Query) error {
 	topics := db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
 	sort.Slice(topics[:], func(i, j int) bool {
 		return topics[i].offset > topics[j].offset
 	})
+	// Each topic is looked up to the query limit, the limit is applied across the topics once
+	// the entries of all topics are sorted.
 	for _, topic := range topics {
-		if len(q.internal.winEntries) > q.Limit {
-			break
+		var wEntries _WindowEntries
+		var err error
+		if q.Ascending {
+			wEntries, err = db.internal.timeWindow.lookupAscending(ctx, db.fs, topic.hash, q.internal.after(), topic.offset, q.internal.cutoff, q.Limit, q.Expired)
+		} else {
+			wEntries, err = db.internal.timeWindow.lookup(ctx, db.fs, topic.hash, q.internal.cursor, q.internal.since, topic.offset, q.internal.cutoff, q.Limit, q.Expired)
+		}
+		if err != nil {
+			return err
 		}
-		limit := q.Limit - len(q.internal.winEntries)
-		wEntries := db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, q.internal.cutoff, limit)
 		for _, we := range wEntries {
-			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq()})
+			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime(), insertedAt: we.insertionTime()})
+		}
+	}
+	q.limitEntries()
+
+	return nil
+}
+
+// lookupMulti lookups window entries for multiple queries. In memory entries are looked up
+// for all topics under a window block shard together before the window file is read.
+func (db *DB) lookupMulti(ctx context.Context, queries []*Query) error {
+	type _TopicEntries struct {
+		topic      _Topic
+		before     uint64
+		since      uint64
+		limit      int
+		expired    bool
+		winEntries _WindowEntries
+	}
+	topics := make([][]*_TopicEntries, len(queries))
+	shards := make(map[*_TimeWindow][]*_TopicEntries)
+	for i, q := range queries {
+		qtopics := db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
+		sort.Slice(qtopics[:], func(i, j int) bool {
+			return qtopics[i].offset > qtopics[j].offset
+		})
+		for _, topic := range qtopics {
+			te := &_TopicEntries{topic: topic, before: q.internal.cursor, since: q.internal.since, limit: q.Limit, expired: q.Expired}
+			topics[i] = append(topics[i], te)
+			if q.Ascending {
+				continue
+			}
+			b := db.internal.timeWindow.windowBlocks.getWindowBlock(topic.hash)
+			shards[b] = append(shards[b], te)
+		}
+	}
+	for b, tes := range shards {
+		var expired []_ExpiryEntry
+		b.mu.RLock()
+		for _, te := range tes {
+			var exp []_ExpiryEntry
+			te.winEntries, exp = db.internal.timeWindow.ilookupBlock(b, te.topic.hash, te.before, te.since, te.limit, te.expired)
+			expired = append(expired, exp...)
 		}
+		b.mu.RUnlock()
+		db.internal.timeWindow.addExpiry(expired)
+	}
+	for i, q := range queries {
+		for _, te := range topics[i] {
+			limit := q.Limit
+			var wEntries _WindowEntries
+			var err error
+			if q.Ascending {
+				wEntries, err = db.internal.timeWindow.lookupAscending(ctx, db.fs, te.topic.hash, q.internal.after(), te.topic.offset, q.internal.cutoff, limit, q.Expired)
+			} else {
+				if len(te.winEntries) > limit {
+					te.winEntries = te.winEntries[:limit]
+				}
+				wEntries, err = db.internal.timeWindow.flookup(ctx, db.fs, te.topic.hash, te.before, te.since, te.topic.offset, q.internal.cutoff, limit, q.Expired, te.winEntries)
+			}
+			if err != nil {
+				return err
+			}
+			for _, we := range wEntries {
+				q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: te.topic.hash, seq: we.seq(), expiresAt: we.expiryTime(), insertedAt: we.insertionTime()})
+			}
+		}
+		q.limitEntries()
 	}
 
 	return nil
@@ -251,10 +671,14 @@ func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32,
 }
 
 func (db *DB) setEntry(e *Entry) error {
-	var id message.ID
-	var eBit uint8
-	var seq uint64
+	if e.entry.ttlErr != nil {
+		return e.entry.ttlErr
+	}
 	var rawTopic []byte
+	// The topic of an entry parsed before is resolved again if the topic was pruned since.
+	if e.entry.parsed && !db.internal.trie.pin(e.entry.topicHash) {
+		e.entry.parsed = false
+	}
 	if !e.entry.parsed {
 		if e.Contract == 0 {
 			e.Contract = message.MasterContract
@@ -267,15 +691,122 @@ func (db *DB) setEntry(e *Entry) error {
 			e.ExpiresAt = ttl
 		}
 		t.AddContract(e.Contract)
-		e.entry.topicHash = t.GetHash(e.Contract)
+		topicHash, ok := db.internal.trie.reserveHash(t.GetHash(e.Contract), t.Parts)
+		e.entry.topicHash = topicHash
+		e.entry.prefix = message.Prefix(t.Parts)
+		db.internal.topics.setName(e.entry.topicHash, e.Contract, string(t.Topic))
+		if db.internal.topicIndex != nil && staticTopic(t) {
+			db.internal.topicIndex.add(e.Contract, string(t.Topic), e.entry.topicHash)
+		}
 		// topic is packed if it is new topic entry
-		if _, ok := db.internal.trie.getOffset(e.entry.topicHash); !ok {
+		if !ok {
 			rawTopic = t.Marshal()
 			e.entry.topicSize = uint16(len(rawTopic))
+			if err := db.putTopic(topicHash, rawTopic, string(t.Topic)); err != nil {
+				db.internal.trie.release(topicHash, 1, false)
+				return err
+			}
 		}
 		e.entry.parsed = true
 	}
-	if e.ID != nil {
+	if e.MaxCount != 0 {
+		db.internal.retention.set(e.entry.topicHash, e.MaxCount)
+	}
+	if err := db.putVersion(e); err != nil {
+		db.internal.trie.release(e.entry.topicHash, 1, false)
+		return err
+	}
+	if err := db.packEntry(e, rawTopic); err != nil {
+		db.internal.trie.release(e.entry.topicHash, 1, false)
+		return err
+	}
+	return nil
+}
+
+// putVersion keeps the version of the entry replaced by an entry put again with the same ID,
+// so GetAtSeq returns the version current as of a seq. The replaced version is put to the topic
+// under the versionContract with a new seq, the seq the replacing entry is put at, and the
+// payload prefixed with the seq of the ID.
+func (db *DB) putVersion(e *Entry) error {
+	if e.ID == nil || bytes.Equal(e.ID, e.entry.putID) {
+		return nil
+	}
+	seq := message.ID(e.ID).Sequence()
+	if id, err := db.lookupID(e.entry.topicHash, seq); id == nil || err != nil {
+		return err
+	}
+	ie, err := db.readEntry(_Query{topicHash: e.entry.topicHash, seq: seq})
+	switch err {
+	case nil:
+	case errMsgIDDeleted, errEntryInvalid, io.EOF:
+		return nil
+	default:
+		return err
+	}
+	_, val, err := db.readValue(ie)
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, 8+len(val))
+	binary.LittleEndian.PutUint64(payload[:8], seq)
+	copy(payload[8:], val)
+	v := &Entry{Topic: e.Topic, Payload: payload, Contract: versionContract, Encryption: e.Encryption}
+	if err := db.setEntry(v); err != nil {
+		return err
+	}
+	return db.writeEntry(v)
+}
+
+// getVersion returns the payload of the version of the entry with the seq current as of the
+// atSeq, it returns false if the entry was not put again after the atSeq.
+func (db *DB) getVersion(topic []byte, seq, atSeq uint64) ([]byte, bool, error) {
+	t, _, err := db.parseTopic(versionContract, topic)
+	if err != nil {
+		return nil, false, err
+	}
+	t.AddContract(versionContract)
+	topicHash, _ := db.internal.trie.topicHash(t.GetHash(versionContract), t.Parts)
+	off, ok := db.internal.trie.getOffset(topicHash)
+	if !ok {
+		return nil, false, nil
+	}
+	wEntries, err := db.internal.timeWindow.lookup(context.Background(), db.fs, topicHash, 0, atSeq, off, 0, math.MaxInt32, true)
+	if err != nil {
+		return nil, false, err
+	}
+	// The version replaced first after the atSeq is the version current as of the atSeq.
+	sort.Slice(wEntries, func(i, j int) bool { return wEntries[i].seq() < wEntries[j].seq() })
+	for _, we := range wEntries {
+		if we.seq() <= atSeq {
+			continue
+		}
+		e, err := db.readEntry(_Query{topicHash: topicHash, seq: we.seq()})
+		if err != nil {
+			if err == errMsgIDDeleted || err == errEntryInvalid || err == io.EOF {
+				continue
+			}
+			return nil, false, err
+		}
+		_, val, err := db.readValue(e)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(val) < 8 || binary.LittleEndian.Uint64(val[:8]) != seq {
+			continue
+		}
+		return val[8:], true, nil
+	}
+	return nil, false, nil
+}
+
+// packEntry packs the message ID, the raw topic if it is the first entry of the topic,
+// and the encoded payload into the entry. The entry ID is set to the packed ID, so the ID
+// minted for an entry put without an ID is returned to the caller. An entry put again
+// without a new ID gets a new ID.
+func (db *DB) packEntry(e *Entry, rawTopic []byte) error {
+	var id message.ID
+	var seq uint64
+	if e.ID != nil && !bytes.Equal(e.ID, e.entry.putID) {
 		id = message.ID(e.ID)
 		seq = id.Sequence()
 	} else {
@@ -287,11 +818,12 @@ func (db *DB) setEntry(e *Entry) error {
 	}
 
 	id.SetContract(e.Contract)
+	e.ID = id
 	e.entry.seq = seq
 	e.entry.expiresAt = e.ExpiresAt
-	val := snappy.Encode(nil, e.Payload)
+	flags, val := db.encodeValue(e.Payload)
 	if db.internal.dbInfo.encryption == 1 || e.Encryption {
-		eBit = 1
+		flags |= 1
 		val = db.internal.mac.Encrypt(nil, val)
 	}
 	e.entry.valueSize = uint32(len(val))
@@ -303,7 +835,7 @@ func (db *DB) setEntry(e *Entry) error {
 	}
 	copy(e.entry.cache, entryData)
 	copy(e.entry.cache[entrySize:], id.Prefix())
-	e.entry.cache[entrySize+idSize-1] = byte(eBit)
+	e.entry.cache[entrySize+idSize-1] = byte(flags)
 	// topic data is added on first entry for the topic.
 	if e.entry.topicSize != 0 {
 		copy(e.entry.cache[entrySize+idSize:], rawTopic)
@@ -312,32 +844,140 @@ func (db *DB) setEntry(e *Entry) error {
 	return nil
 }
 
-// delete deletes the given key from the DB.
-func (db *DB) delete(topicHash, seq uint64) error {
-	if db.opts.flags.immutable {
-		return nil
+// has checks presence of the seq of the topic and the contract in memdb or in the index block.
+func (db *DB) has(topicHash uint64, contract uint32, seq uint64) (bool, error) {
+	id, err := db.lookupID(topicHash, seq)
+	if id == nil || err != nil {
+		return false, err
+	}
+	return id.EvalPrefix(contract, 0), nil
+}
+
+// lookupID returns the message ID prefix of the entry for the topic with the given seq,
+// or nil if the topic does not have an entry with the seq.
+func (db *DB) lookupID(topicHash uint64, seq uint64) (message.ID, error) {
+	if seq == 0 || seq > db.seq() {
+		return nil, nil
+	}
+	// Test filter block for the message id presence. The filter may report
+	// false positives so presence is confirmed from the index block.
+	data, _ := db.internal.mem.Get(seq)
+	if data == nil && !db.internal.filter.Test(seq) {
+		return nil, nil
+	}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	// The entry is in the topic if the seq is in the window of the topic.
+	off, ok := db.internal.trie.getOffset(topicHash)
+	if !ok {
+		return nil, nil
+	}
+	if _, ok, err := db.internal.timeWindow.find(context.Background(), db.fs, topicHash, seq, off); !ok || err != nil {
+		return nil, err
+	}
+	// The ID is read without caching the entry.
+	if data != nil {
+		return message.ID(data[entrySize : entrySize+idSize]), nil
+	}
+	e, err := db.internal.reader.readEntry(seq)
+	switch err {
+	case nil:
+	case errMsgIDDeleted, errEntryInvalid, io.EOF:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	id, err := db.internal.reader.readID(e)
+	if err != nil {
+		return nil, err
+	}
+	return message.ID(id), nil
+}
+
+// delete deletes the given key from the DB. It returns true if the entry is deleted from
+// the memdb or from the index block, and false if the entry was not found or deleted before.
+func (db *DB) delete(topicHash, seq uint64) (bool, error) {
+	if db.opts.flags.immutable || db.opts.flags.readOnly {
+		return false, nil
 	}
 
 	db.internal.meter.Dels.Inc(1)
-	db.internal.mem.Delete(seq)
+	deleted := db.internal.mem.Delete(seq) == nil
+	if db.internal.cache != nil {
+		db.internal.cache.delete(seq)
+	}
 
 	// Test filter block for the message id presence.
 	if !db.internal.filter.Test(seq) {
-		return nil
+		return deleted, nil
 	}
 
-	w, err := newBlockWriter(db.fs, db.internal.freeList, nil)
+	// Index blocks are not updated concurrently with sync or compaction.
+	select {
+	case db.internal.syncLockC <- struct{}{}:
+	case <-db.internal.closeC:
+		return deleted, errClosed
+	}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	w, err := newBlockWriter(db.fs, db.fileVersion(), db.internal.freeList, nil)
 	if err != nil {
-		return err
+		return deleted, err
 	}
 	e, err := w.del(seq)
 	if err != nil {
-		return err
+		return deleted, err
+	}
+	if e.seq == 0 || e.isDeleted() {
+		return deleted, nil
+	}
+	if err := w.writeIndex(); err != nil {
+		return deleted, err
+	}
+	// The record of an entry packing the raw topic is kept.
+	if e.topicSize == 0 {
+		db.internal.freeList.freeBlock(e.msgOffset, e.mSize(db.fileVersion()))
 	}
-	db.internal.freeList.freeBlock(e.msgOffset, e.mSize())
 	db.decount(1)
 	if db.internal.syncWrites {
-		return db.sync()
+		return true, db.sync()
+	}
+	return true, nil
+}
+
+// pruneTopic removes the topic from the trie once its last entry is deleted. The live entries
+// of the topic are counted by the trie, the entries of a topic loaded on open are counted
+// once from the window entries of the topic.
+func (db *DB) pruneTopic(topicHash uint64) error {
+	if db.opts.flags.immutable || db.opts.flags.readOnly {
+		return nil
+	}
+	count := func(off int64) (int, error) {
+		wEntries, err := db.internal.timeWindow.lookup(context.Background(), db.fs, topicHash, 0, 0, off, 0, math.MaxInt32, false)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for _, we := range wEntries {
+			// The entry is read without caching it.
+			if data, _ := db.internal.mem.Get(we.seq()); data != nil {
+				n++
+				continue
+			}
+			if _, err := db.internal.reader.readEntry(we.seq()); err == nil {
+				n++
+			}
+		}
+		return n, nil
+	}
+	if removed, err := db.internal.trie.prune(topicHash, count); !removed || err != nil {
+		return err
+	}
+	db.internal.topics.remove(topicHash)
+	if db.internal.topicIndex != nil {
+		db.internal.topicIndex.remove(topicHash)
 	}
 	return nil
 }
@@ -347,7 +987,7 @@ func (db *DB) batch() *Batch {
 	opts := &_Options{}
 	WithDefaultBatchOptions().set(opts)
 	opts.batchOptions.encryption = db.internal.dbInfo.encryption == 1
-	b := &Batch{db: db, opts: opts, writeLockC: make(chan struct{}, 1), buffer: db.internal.bufPool.Get()}
+	b := &Batch{db: db, opts: opts, writeLockC: make(chan struct{}, 1), buffer: db.internal.bufPool.Get(), pending: make(map[uint64]int)}
 	b.mem = db.internal.mem.NewBatch()
 	b.commitComplete = make(chan struct{})
 
@@ -359,10 +999,57 @@ func (db *DB) seq() uint64 {
 	return atomic.LoadUint64(&db.internal.dbInfo.sequence)
 }
 
+// fileVersion returns the file format version of the DB, the DB is written in the version it is created with.
+func (db *DB) fileVersion() uint32 {
+	return db.internal.dbInfo.header.version
+}
+
 func (db *DB) nextSeq() uint64 {
 	return atomic.AddUint64(&db.internal.dbInfo.sequence, 1)
 }
 
+// advanceSeq advances the DB seq to the given seq if it is behind.
+func (db *DB) advanceSeq(seq uint64) {
+	advance(&db.internal.dbInfo.sequence, seq)
+}
+
+// claimSeq advances the DB seq to the generated seq, it returns false if the seq is not after
+// the DB seq so the seq is not reused.
+func (db *DB) claimSeq(seq uint64) bool {
+	for {
+		cur := atomic.LoadUint64(&db.internal.dbInfo.sequence)
+		if cur >= seq {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&db.internal.dbInfo.sequence, cur, seq) {
+			return true
+		}
+	}
+}
+
+// setVisible advances the visible seq to the seq of the entry written to the memdb if it is behind.
+func (db *DB) setVisible(seq uint64) {
+	advance(&db.internal.visibleSeq, seq)
+}
+
+// advance advances the seq at addr to the given seq if it is behind.
+func advance(addr *uint64, seq uint64) {
+	for {
+		cur := atomic.LoadUint64(addr)
+		if cur >= seq || atomic.CompareAndSwapUint64(addr, cur, seq) {
+			return
+		}
+	}
+}
+
+// validateID validates the length and sequence of the message ID.
+func validateID(id []byte) error {
+	if len(id) != message.ID(id).Size() || message.ID(id).Sequence() == 0 {
+		return errMsgIDInvalid
+	}
+	return nil
+}
+
 func (db *DB) incount(count uint64) uint64 {
 	return atomic.AddUint64(&db.internal.dbInfo.count, count)
 }
@@ -388,3 +1075,14 @@ func (db *DB) ok() error {
 	}
 	return nil
 }
+
+// okWrite checks the DB is open for writes.
+func (db *DB) okWrite() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.opts.flags.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -17,19 +17,38 @@
 package unitdb
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/bpool"
 )
 
+const (
+	// maxSyncWorkers sets maximum number of workers to lookup entries from memdb during sync.
+	maxSyncWorkers = 8
+	// minSyncWorkerEntries sets minimum number of entries looked up by a sync worker.
+	minSyncWorkerEntries = 64
+	// minSyncWorkerBlocks sets minimum number of window blocks read by a sync worker.
+	minSyncWorkerBlocks = 8
+)
+
 type (
+	_SyncEntry struct {
+		entry _Entry
+		data  []byte
+		err   error
+	}
 	_SyncInfo struct {
 		lastSyncSeq    uint64
 		upperSeq       uint64
-		syncStatusOk   bool
+		syncStatusOk   int32 // set atomically as status is read outside syncLockC.
 		syncComplete   bool
 		inBytes        int64
 		count          int64
@@ -49,8 +68,8 @@ type (
 
 func (db *_SyncHandle) startSync() bool {
 	if db.syncInfo.lastSyncSeq == db.seq() {
-		db.syncInfo.syncStatusOk = false
-		return db.syncInfo.syncStatusOk
+		atomic.StoreInt32(&db.syncInfo.syncStatusOk, 0)
+		return false
 	}
 
 	db.rawWindow = db.internal.bufPool.Get()
@@ -62,30 +81,30 @@ func (db *_SyncHandle) startSync() bool {
 		logger.Error().Err(err).Str("context", "startSync").Msg("Error syncing to db")
 		return false
 	}
-	db.blockWriter, err = newBlockWriter(db.fs, db.internal.freeList, db.rawBlock)
+	db.blockWriter, err = newBlockWriter(db.fs, db.fileVersion(), db.internal.freeList, db.rawBlock)
 	if err != nil {
 		logger.Error().Err(err).Str("context", "startSync").Msg("Error syncing to db")
 		return false
 	}
-	db.syncInfo.syncStatusOk = true
+	atomic.StoreInt32(&db.syncInfo.syncStatusOk, 1)
 
-	return db.syncInfo.syncStatusOk
+	return true
 }
 
 func (db *_SyncHandle) finish() error {
-	if !db.syncInfo.syncStatusOk {
+	if !db.status() {
 		return nil
 	}
 
 	db.internal.bufPool.Put(db.rawWindow)
 	db.internal.bufPool.Put(db.rawBlock)
 
-	db.syncInfo.syncStatusOk = false
+	atomic.StoreInt32(&db.syncInfo.syncStatusOk, 0)
 	return nil
 }
 
 func (db *_SyncHandle) status() (ok bool) {
-	return db.syncInfo.syncStatusOk
+	return atomic.LoadInt32(&db.syncInfo.syncStatusOk) == 1
 }
 
 func (db *_SyncHandle) reset() error {
@@ -125,35 +144,53 @@ func (db *_SyncHandle) abort() error {
 
 func (db *DB) startSyncer(interval time.Duration) {
 	db.internal.closeW.Add(1)
-	defer db.internal.closeW.Done()
 	syncTicker := time.NewTicker(interval)
 	go func() {
 		defer func() {
 			syncTicker.Stop()
+			db.internal.closeW.Done()
 		}()
 		for {
 			select {
 			case <-db.internal.closeC:
 				return
 			case <-syncTicker.C:
+				// A failed sync is reported by Health, the entries are synced on the next sync.
 				if err := db.Sync(); err != nil {
 					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error syncing to db")
-					panic(err)
+				}
+				if err := db.autoCompact(); err != nil {
+					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error compacting db")
 				}
 			}
 		}
 	}()
 }
 
-func (db *DB) startExpirer(durType time.Duration, maxDur int) {
-	expirerTicker := time.NewTicker(durType * time.Duration(maxDur))
+func (db *DB) startExpirer(interval time.Duration, batchSize int) {
+	db.internal.closeW.Add(1)
+	expirerTimer := time.NewTimer(interval)
 	go func() {
+		defer db.internal.closeW.Done()
+		wait := interval
 		for {
 			select {
-			case <-expirerTicker.C:
-				db.expireEntries()
+			case <-expirerTimer.C:
+				n, err := db.expireEntries()
+				if err != nil {
+					logger.Error().Err(err).Str("context", "startExpirer").Msg("Error expiring entries")
+				}
+				// Tighten the interval while there is a backlog of expired entries.
+				if err == nil && n >= batchSize {
+					if wait /= 2; wait < minExpiryInterval {
+						wait = minExpiryInterval
+					}
+				} else {
+					wait = interval
+				}
+				expirerTimer.Reset(wait)
 			case <-db.internal.closeC:
-				expirerTicker.Stop()
+				expirerTimer.Stop()
 				return
 			}
 		}
@@ -165,6 +202,14 @@ func (db *DB) sync() error {
 	if err := db.writeInfo(); err != nil {
 		return err
 	}
+	if err := db.internal.filter.sync(); err != nil {
+		return err
+	}
+	if db.internal.topicDict != nil {
+		if err := db.internal.topicDict.sync(); err != nil {
+			return err
+		}
+	}
 	if err := db.fs.sync(); err != nil {
 		return nil
 	}
@@ -213,29 +258,30 @@ func (db *_SyncHandle) Sync() error {
 	// // CPU profiling by default
 	// defer profile.Start().Stop()
 	var err1 error
+	// appended holds the number of window entries appended per topic with a retention limit.
+	appended := make(map[uint64]int)
 	timeRelease := db.internal.timeWindow.release()
 	err := db.internal.mem.BlockIterator(func(timeID int64, seqs []uint64) (bool, error) {
 		winEntries := make(map[uint64]_WindowEntries)
+		var events []WriteEvent
+		watched := db.internal.watchers.len() != 0
 		sort.Slice(seqs[:], func(i, j int) bool {
 			return seqs[i] < seqs[j]
 		})
 		if seqs[len(seqs)-1] > db.syncInfo.upperSeq {
 			db.syncInfo.upperSeq = seqs[len(seqs)-1]
 		}
-		for _, seq := range seqs {
-			memdata, err := db.internal.mem.Lookup(timeID, seq)
-			if err != nil || memdata == nil {
+		entries := db.lookupEntries(timeID, seqs)
+		// The insertion times of the entries are kept by the window entries of the time block.
+		times := make(map[uint64]map[uint64]uint32)
+		for i, seq := range seqs {
+			memdata, m := entries[i].data, entries[i].entry
+			if err := entries[i].err; err != nil || memdata == nil {
 				db.syncInfo.entriesInvalid++
 				logger.Error().Err(err).Str("context", "mem.Get")
 				err1 = err
 				continue
 			}
-			var m _Entry
-			if err = m.UnmarshalBinary(memdata[:entrySize]); err != nil {
-				db.syncInfo.entriesInvalid++
-				err1 = err
-				continue
-			}
 			e := _IndexEntry{
 				seq:       m.seq,
 				topicSize: m.topicSize,
@@ -251,6 +297,10 @@ func (db *_SyncHandle) Sync() error {
 			}
 
 			we := newWinEntry(seq, m.expiresAt)
+			if _, ok := times[m.topicHash]; !ok {
+				times[m.topicHash] = db.internal.timeWindow.insertionTimes(timeID, m.topicHash)
+			}
+			we.insertedAt = times[m.topicHash][seq]
 			if _, ok := winEntries[m.topicHash]; ok {
 				winEntries[m.topicHash] = append(winEntries[m.topicHash], we)
 			} else {
@@ -260,19 +310,34 @@ func (db *_SyncHandle) Sync() error {
 			db.internal.filter.Append(we.seq())
 			db.syncInfo.count++
 			db.syncInfo.inBytes += int64(e.valueSize)
+			if watched {
+				// The contract is packed in the message ID following the entry.
+				contract := binary.LittleEndian.Uint32(memdata[entrySize+4 : entrySize+8])
+				events = append(events, WriteEvent{TopicHash: m.topicHash, Seq: seq, Contract: contract})
+			}
 		}
+		topicOffs := make(map[uint64]int64, len(winEntries))
 		for h := range winEntries {
 			topicOff, ok := db.internal.trie.getOffset(h)
 			if !ok {
 				return true, errors.New("db.Sync: timeWindow sync error: unable to get topic offset from trie")
 			}
+			topicOffs[h] = topicOff
+		}
+		if err := db.windowWriter.readBlocks(topicOffs); err != nil {
+			return true, err
+		}
+		for h, topicOff := range topicOffs {
 			wOff, err := db.windowWriter.append(h, topicOff, winEntries[h])
 			if err != nil {
 				return true, err
 			}
-			if ok := db.internal.trie.setOffset(_Topic{hash: h, offset: wOff}); !ok {
+			if ok := db.internal.trie.setOffset(h, wOff); !ok {
 				return true, errors.New("db:Sync: timeWindow sync error: unable to set topic offset in trie")
 			}
+			if _, ok := db.internal.retention.get(h); ok {
+				appended[h] += len(winEntries[h])
+			}
 		}
 		if err1 != nil {
 			fmt.Println("db.sync: error ", err1)
@@ -287,9 +352,11 @@ func (db *_SyncHandle) Sync() error {
 			if err := timeRelease(timeID); err != nil {
 				return false, err
 			}
-			if err := db.internal.mem.Free(timeID); err != nil {
+			if err := db.internal.mem.free(timeID, seqs); err != nil {
 				return true, err
 			}
+			db.internal.acks.done(seqs, nil)
+			db.internal.watchers.send(events)
 		}
 
 		return false, nil
@@ -298,31 +365,129 @@ func (db *_SyncHandle) Sync() error {
 		db.syncInfo.syncComplete = false
 		db.abort()
 	}
+	if err != nil {
+		return err
+	}
+	if err := db.trimTopics(appended); err != nil {
+		return err
+	}
 
 	return db.sync(false)
 }
 
+// syncWorkers returns number of workers to lookup n items during sync, each worker looks up
+// at least min items.
+func syncWorkers(n, min int) int {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > maxSyncWorkers {
+		workers = maxSyncWorkers
+	}
+	if workers > n/min {
+		workers = n / min
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// lookupEntries reads and decodes entries of a time block from memdb using a bounded pool of workers.
+// Entries are returned in the order of seqs so blocks are allocated and appended in sequence order.
+func (db *_SyncHandle) lookupEntries(timeID int64, seqs []uint64) []_SyncEntry {
+	entries := make([]_SyncEntry, len(seqs))
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for w := syncWorkers(len(seqs), minSyncWorkerEntries); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(seqs) {
+					return
+				}
+				se := &entries[i]
+				se.data, se.err = db.internal.mem.Lookup(timeID, seqs[i])
+				if se.err != nil || se.data == nil {
+					continue
+				}
+				se.err = se.entry.UnmarshalBinary(se.data[:entrySize])
+			}
+		}()
+	}
+	wg.Wait()
+	return entries
+}
+
 // expireEntries run expirer to delete entries from db if ttl was set on entries and that has expired.
-func (db *DB) expireEntries() error {
-	// sync happens synchronously.
-	db.internal.syncLockC <- struct{}{}
-	defer func() {
-		<-db.internal.syncLockC
-	}()
-	expiredEntries := db.internal.timeWindow.expiryWindowBucket.getExpiredEntries(db.opts.queryOptions.defaultQueryLimit)
-	for _, expiredEntry := range expiredEntries {
-		we := expiredEntry.(_WinEntry)
-		/// Test filter block if message hash presence.
-		if !db.internal.filter.Test(we.seq()) {
-			continue
+// It returns the number of expired entries processed.
+func (db *DB) expireEntries() (int, error) {
+	type _Expired struct {
+		topic []byte
+		id    []byte
+	}
+	var expired []_Expired
+	n, err := func() (int, error) {
+		// sync happens synchronously.
+		db.internal.syncLockC <- struct{}{}
+		defer func() {
+			<-db.internal.syncLockC
+		}()
+		expiredEntries := db.internal.timeWindow.expiryWindowBucket.getExpiredEntries(db.internal.timeWindow.opts.expiryBatchSize)
+		// The entries not yet freed are added back to the expiry window if the run fails, so the
+		// next run expires them.
+		done := 0
+		defer func() {
+			for _, expiredEntry := range expiredEntries[done:] {
+				if err := db.internal.timeWindow.expiryWindowBucket.addExpiry(expiredEntry); err != nil {
+					logger.Error().Err(err).Str("context", "db.expireEntries")
+				}
+			}
+		}()
+		for i, expiredEntry := range expiredEntries {
+			done = i
+			we := expiredEntry.(_ExpiryEntry)
+			/// Test filter block if message hash presence.
+			if !db.internal.filter.Test(we.seq()) {
+				continue
+			}
+			e, err := db.internal.reader.readEntry(we.seq())
+			if err != nil {
+				// entry is deleted or not yet synced to DB.
+				if err == errMsgIDDeleted || err == errEntryInvalid || err == io.EOF {
+					continue
+				}
+				return 0, err
+			}
+			var ex _Expired
+			if db.opts.expiryCallback != nil {
+				prefix, _, err := db.internal.reader.readMessage(e)
+				if err != nil {
+					return 0, err
+				}
+				ex.id = messageID(prefix, e.seq)
+				if topic, ok := db.internal.topics.name(we.topicHash); ok {
+					ex.topic = []byte(topic)
+				}
+			}
+			if db.internal.cache != nil {
+				db.internal.cache.delete(e.seq)
+			}
+			db.internal.freeList.free(e.seq, e.msgOffset, e.mSize(db.fileVersion()))
+			expired = append(expired, ex)
 		}
-		e, err := db.internal.reader.readEntry(we.seq())
-		if err != nil {
-			return err
+		done = len(expiredEntries)
+		return len(expiredEntries), nil
+	}()
+
+	// callback runs without holding the sync lock so it can use the DB.
+	if db.opts.expiryCallback != nil {
+		for _, ex := range expired {
+			db.opts.expiryCallback(ex.topic, ex.id)
 		}
-		db.internal.freeList.free(e.seq, e.msgOffset, e.mSize())
-		db.decount(1)
 	}
+	db.decount(uint64(len(expired)))
+	db.internal.meter.Expires.Inc(int64(len(expired)))
 
-	return nil
+	return n, err
 }
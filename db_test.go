@@ -17,11 +17,30 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/hash"
+	"github.com/unit-io/unitdb/memdb"
+	"github.com/unit-io/unitdb/message"
 )
 
 var (
@@ -79,9 +98,9 @@ func TestSimple(t *testing.T) {
 		if !reflect.DeepEqual(vals, v) {
 			t.Fatalf("expected %v; got %v", vals, v)
 		}
-		// if size, err := db.FileSize(); err != nil || size == 0 {
-		// 	t.Fatal(err)
-		// }
+		if size, err := db.FileSize(); err != nil || size == 0 {
+			t.Fatal(err)
+		}
 		if _, err = db.Varz(); err != nil {
 			t.Fatal(err)
 		}
@@ -94,7 +113,10 @@ func TestSimple(t *testing.T) {
 	entry := NewEntry(topic, nil)
 	entry.WithContract(contract).WithTTL("1m")
 	for i = 0; i < n; i++ {
-		messageID := db.NewID()
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
 		entry.WithID(messageID)
 		val := []byte(fmt.Sprintf("msg.%2d", i))
 		if err := db.PutEntry(entry.WithPayload(val)); err != nil {
@@ -116,7 +138,10 @@ func TestSimple(t *testing.T) {
 	}
 
 	for i = 0; i < n; i++ {
-		messageID := db.NewID()
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
 		val := []byte(fmt.Sprintf("msg.%2d", i))
 		if err := db.Put(topic, val); err != nil {
 			t.Fatal(err)
@@ -177,7 +202,10 @@ func TestBatch(t *testing.T) {
 	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
 		var ids [][]byte
 		for i = 0; i < n; i++ {
-			messageID := db.NewID()
+			messageID, err := db.NewID()
+			if err != nil {
+				t.Fatal(err)
+			}
 			topic := append(topic, []byte("?ttl=1h")...)
 			val := []byte(fmt.Sprintf("msg.%2d", i))
 			if err := b.PutEntry(NewEntry(topic, val).WithID(messageID).WithContract(contract)); err != nil {
@@ -253,7 +281,10 @@ func TestLeasing(t *testing.T) {
 	topic := []byte("unit1.test")
 	var ids [][]byte
 	for i = 0; i < n; i++ {
-		messageID := db.NewID()
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
 		val := []byte(fmt.Sprintf("msg.%2d", i))
 		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
 			t.Fatal(err)
@@ -267,7 +298,10 @@ func TestLeasing(t *testing.T) {
 		db.Delete(id, topic)
 	}
 	for i = 0; i < n; i++ {
-		messageID := db.NewID()
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
 		val := []byte(fmt.Sprintf("msg.%2d", i))
 		if err := db.Put(topic, val); err != nil {
 			t.Fatal(err)
@@ -316,3 +350,5099 @@ func TestWildcardTopics(t *testing.T) {
 		}
 	}
 }
+
+func TestTopTopics(t *testing.T) {
+	cleanup()
+	for _, opt := range []Options{WithTopicRateWindow(0), WithTopicRateWindow(-time.Second), WithMaxTopTopics(0), WithMaxTopTopics(-1)} {
+		if _, err := Open(dbPath, opt); err != errTopTopicsInvalid {
+			t.Fatalf("expected error %v; got %v", errTopTopicsInvalid, err)
+		}
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxTopTopics(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	hot := []byte("unit5.hot")
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(hot, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		topic := []byte(fmt.Sprintf("unit5.cold%d", i))
+		for j := 0; j < 10; j++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", j))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	v, err := db.Varz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.TopTopics) != 3 {
+		t.Fatalf("expected 3 top topics; got %v", v.TopTopics)
+	}
+	rate, ok := v.TopTopics[string(hot)]
+	if !ok {
+		t.Fatalf("expected %s in top topics; got %v", hot, v.TopTopics)
+	}
+	for topic, r := range v.TopTopics {
+		if r > rate {
+			t.Fatalf("topic %s rate %f is higher than hot topic rate %f", topic, r, rate)
+		}
+	}
+
+	// The same topic of another contract is reported apart.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := db.PutEntry(NewEntry(hot, []byte(fmt.Sprintf("msg.%2d", i))).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err = db.Varz(); err != nil {
+		t.Fatal(err)
+	}
+	other := fmt.Sprintf("%d/%s", contract, hot)
+	if _, ok := v.TopTopics[other]; !ok {
+		t.Fatalf("expected %s in top topics; got %v", other, v.TopTopics)
+	}
+	if _, ok := v.TopTopics[string(hot)]; !ok {
+		t.Fatalf("expected %s in top topics; got %v", hot, v.TopTopics)
+	}
+
+	// The rates of the coldest topics are dropped once too many topics are tracked.
+	m := newTopicMeter(time.Minute)
+	m.max = 4
+	for hash := uint64(1); hash <= 5; hash++ {
+		m.mark(hash, int64(hash))
+	}
+	if len(m.topics) != 3 {
+		t.Fatalf("expected 3 topic rates; got %d", len(m.topics))
+	}
+	for hash := uint64(1); hash <= 5; hash++ {
+		if _, ok := m.topics[hash]; ok != (hash > 2) {
+			t.Fatalf("expected only the rates of the coldest topics dropped; got %v", m.topics)
+		}
+	}
+}
+
+func TestCompactionStats(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	topic := []byte("unit6.test")
+	var ids [][]byte
+	for i = 0; i < n; i++ {
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	// Entries are synced once their time block is committed to the log.
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := db.CompactionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LiveBytes == 0 || stats.ReclaimableBytes != 0 {
+		t.Fatalf("unexpected stats before delete %+v", stats)
+	}
+	if size, err := db.FileSize(); err != nil || size < stats.LiveBytes {
+		t.Fatalf("file size %d smaller than live bytes %d", size, stats.LiveBytes)
+	}
+
+	for _, id := range ids[:n/2] {
+		if err := db.Delete(id, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := db.CompactionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.ReclaimableBytes <= stats.ReclaimableBytes || after.LiveBytes >= stats.LiveBytes {
+		t.Fatalf("expected reclaimable bytes to grow; before %+v, after %+v", stats, after)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	topic := []byte("unit7.test")
+	var ids [][]byte
+	for i = 0; i < n; i++ {
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Delete the older half of the entries.
+	for _, id := range ids[:n/2] {
+		if err := db.Delete(id, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, err := db.CompactionStats(); err != nil || stats.ReclaimableBytes == 0 {
+		t.Fatalf("unexpected stats before compaction %+v, %v", stats, err)
+	}
+	before, err := db.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("expected file size to shrink; before %d, after %d", before, after)
+	}
+	if stats, err := db.CompactionStats(); err != nil || stats.ReclaimableBytes != 0 {
+		t.Fatalf("unexpected stats after compaction %+v, %v", stats, err)
+	}
+
+	var vals [][]byte
+	for i = n - 1; i >= n/2; i-- {
+		vals = append(vals, []byte(fmt.Sprintf("msg.%2d", i)))
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(int(n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+}
+
+func TestCompactRecover(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n uint64 = 100
+	topic := []byte("unit48.recover")
+	var ids [][]byte
+	for i := uint64(0); i < n; i++ {
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("recover msg.%3d", i))).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range ids[n/2:] {
+		if err := db.Delete(id, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash leaves the DB files as before the compaction along with the compacted files of an
+	// uncommitted compaction, or the compacted index next to the swapped data file once committed.
+	crash := func(commit bool) {
+		old := make(map[string][]byte)
+		err := filepath.Walk(dbPath, func(name string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || filepath.Ext(name) == ".lock" {
+				return err
+			}
+			data, err := ioutil.ReadFile(name)
+			old[name] = data
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(dbPath, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dataPath := filePath(fs.OS, dbPath, _FileDesc{fileType: typeData})
+		indexPath := filePath(fs.OS, dbPath, _FileDesc{fileType: typeIndex})
+		for _, name := range []string{dataPath, indexPath} {
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit && name == dataPath {
+				old[name] = data
+				continue
+			}
+			if err := ioutil.WriteFile(name+compactPostfix, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if commit {
+			old[dataPath+compactCommitPostfix] = nil
+		}
+		for name, data := range old {
+			if err := ioutil.WriteFile(name, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var vals [][]byte
+	for i := n / 2; i > 0; i-- {
+		vals = append(vals, []byte(fmt.Sprintf("recover msg.%3d", i-1)))
+	}
+	for _, commit := range []bool{false, true} {
+		crash(commit)
+		db, err := Open(dbPath, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := db.Get(NewQuery(topic).WithLimit(int(n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, v) {
+			t.Fatalf("commit %v: expected %v; got %v", commit, vals, v)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		matches, err := filepath.Glob(filepath.Join(dbPath, "*", "*"+compactPostfix+"*"))
+		if err != nil || len(matches) != 0 {
+			t.Fatalf("commit %v: expected compaction files removed; got %v, %v", commit, matches, err)
+		}
+	}
+}
+
+func TestWindowFileLegacy(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := entriesPerWindowBlock + 100
+	topic := []byte("unit49.legacy")
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("legacy msg.%3d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A window file without the header holds the first window block of the topic in the first block.
+	name := filePath(fs.OS, dbPath, _FileDesc{fileType: typeTimeWindow})
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:blockSize], winHeader()) {
+		t.Fatalf("expected window file header; got %v", data[:11])
+	}
+	size := int(blockSize)
+	head := -1
+	for off := size; off+size <= len(data); off += size {
+		var b _WinBlock
+		if err := b.unmarshalBinary(data[off : off+size]); err != nil {
+			t.Fatal(err)
+		}
+		if b.entryIdx != 0 && b.next == 0 {
+			head = off
+		}
+	}
+	if head == -1 {
+		t.Fatal("expected first window block of the topic")
+	}
+	for off := size; off+size <= len(data); off += size {
+		var b _WinBlock
+		if err := b.unmarshalBinary(data[off : off+size]); err != nil {
+			t.Fatal(err)
+		}
+		if b.next == int64(head) {
+			b.next = 0
+			copy(data[off:off+size], b.marshalBinary())
+		}
+	}
+	copy(data[:size], data[head:head+size])
+	copy(data[head:head+size], make([]byte, size))
+	if err := ioutil.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	v, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != n {
+		t.Fatalf("expected %d messages after upgrade; got %d", n, len(v))
+	}
+	if !bytes.Equal(v[n-1], []byte("legacy msg.  0")) {
+		t.Fatalf("expected the oldest message from the moved block; got %s", v[n-1])
+	}
+}
+
+func TestCompactTombstones(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n uint64 = 200
+	topic := []byte("unit47.tombstone")
+	var ids [][]byte
+	for i := uint64(0); i < n; i++ {
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("tombstone msg.%3d", i))).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexEntries := func() int {
+		indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := _BlockReader{indexFile: indexFile}
+		count := 0
+		for off := int64(0); off+int64(blockSize) <= indexFile.currSize(); off += int64(blockSize) {
+			r.offset = off
+			b, err := r.readIndexBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			count += int(b.entryIdx)
+		}
+		return count
+	}
+
+	// Delete every other entry, the deleted entries are kept in the index as tombstones.
+	for i := 0; i < len(ids); i += 2 {
+		if err := db.Delete(ids[i], topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if before := indexEntries(); before != int(n) {
+		t.Fatalf("expected %d index entries before compaction; got %d", n, before)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// The deleted first entry packs the raw topic and it is kept as a tombstone.
+	if after := indexEntries(); after != int(n/2)+1 {
+		t.Fatalf("expected %d index entries after compaction; got %d", n/2+1, after)
+	}
+	if _, err := db.internal.reader.readEntry(message.ID(ids[0]).Sequence()); err != errMsgIDDeleted {
+		t.Fatalf("expected first entry kept as a tombstone; got %v", err)
+	}
+
+	for i := 1; i < len(ids); i++ {
+		_, err := db.internal.reader.readEntry(message.ID(ids[i]).Sequence())
+		if deleted := i%2 == 0; deleted && err != errMsgIDDeleted {
+			t.Fatalf("expected entry %d dropped from the index; got %v", i, err)
+		} else if !deleted && err != nil {
+			t.Fatalf("expected entry %d in the index; got %v", i, err)
+		}
+	}
+	var vals [][]byte
+	for i := int(n) - 1; i >= 0; i -= 2 {
+		vals = append(vals, []byte(fmt.Sprintf("tombstone msg.%3d", i)))
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(int(n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %d live entries; got %d", len(vals), len(v))
+	}
+
+	// The tombstones are dropped if the free blocks of the deleted entries are leased.
+	for i := 1; i < len(ids); i += 2 {
+		if err := db.Delete(ids[i], topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.internal.freeList.reset()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if after := indexEntries(); after != 1 {
+		t.Fatalf("expected the kept tombstone in the index after compaction; got %d index entries", after)
+	}
+}
+
+func TestDeleteUnsynced(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit48.unsynced")
+	var ids [][]byte
+	for i := 0; i < 2; i++ {
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("unsynced msg.%d", i))).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	// The entry is deleted from the memdb before it is synced to the index.
+	if err := db.Delete(ids[1], topic); err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, [][]byte{[]byte("unsynced msg.0")}) {
+		t.Fatalf("expected the entry deleted before sync skipped; got %q", v)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n uint64 = 100
+	topics := [][]byte{[]byte("unit50.verify.a"), []byte("unit50.verify.b")}
+	var ids [][]byte
+	for i := uint64(0); i < n; i++ {
+		messageID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topics[i%2], []byte(fmt.Sprintf("verify msg.%3d", i))).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The deleted entries are not reported.
+	if err := db.Delete(ids[0], topics[0]); err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() || report.Entries != int(n-1) || report.Topics != len(topics) {
+		t.Fatalf("expected consistent report of %d entries and %d topics; got %+v", n-1, len(topics), report)
+	}
+
+	// Point the index entry of a seq past the end of the data file.
+	seq := message.ID(ids[9]).Sequence()
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := _BlockReader{indexFile: indexFile, offset: blockOffset(blockIndex(seq))}
+	b, err := r.readIndexBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := false
+	for i := range b.entries {
+		if b.entries[i].seq == seq {
+			b.entries[i].msgOffset = 1 << 40
+			corrupted = true
+		}
+	}
+	if !corrupted {
+		t.Fatalf("expected index entry of seq %d", seq)
+	}
+	if _, err := indexFile.WriteAt(b.marshalBinary(), blockOffset(blockIndex(seq))); err != nil {
+		t.Fatal(err)
+	}
+	report, err = db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.DanglingOffsets, []uint64{seq}) {
+		t.Fatalf("expected dangling offset of seq %d; got %v", seq, report.DanglingOffsets)
+	}
+	if len(report.MismatchedTopics) != 0 || len(report.UnresolvedTopics) != 0 || len(report.MissingEntries) != 0 || len(report.OrphanedEntries) != 0 {
+		t.Fatalf("expected only the dangling offset; got %+v", report)
+	}
+
+	// Drop the index entry of a seq from a block not compacted, unlike a deleted entry it is missing.
+	missing := message.ID(ids[11]).Sequence()
+	r.offset = blockOffset(blockIndex(missing))
+	if b, err = r.readIndexBlock(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < int(b.entryIdx); i++ {
+		if b.entries[i].seq == missing {
+			b.entryIdx--
+			b.entries[i], b.entries[b.entryIdx] = b.entries[b.entryIdx], _IndexEntry{}
+			break
+		}
+	}
+	if _, err := indexFile.WriteAt(b.marshalBinary(), blockOffset(blockIndex(missing))); err != nil {
+		t.Fatal(err)
+	}
+	report, err = db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.MissingEntries, []uint64{missing}) {
+		t.Fatalf("expected missing entry of seq %d; got %v", missing, report.MissingEntries)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	cleanup()
+	restorePath := dbPath + "-restore"
+	os.RemoveAll(restorePath)
+	defer os.RemoveAll(restorePath)
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	topic := []byte("unit8.test")
+	for i = 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		if i == n/2 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Wait for the entries to be written to the log.
+	time.Sleep(100 * time.Millisecond)
+
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	// Writes continue after the backup.
+	if err := db.Put(topic, []byte("msg.after")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RestoreBackup(&backup, restorePath); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(restorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if count := restored.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries restored; got %d", n, count)
+	}
+	v, err := restored.Get(NewQuery(topic).WithLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{[]byte(fmt.Sprintf("msg.%2d", n-1))}; !reflect.DeepEqual(expected, v) {
+		t.Fatalf("expected %v; got %v", expected, v)
+	}
+}
+
+func TestGetContext(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 1000
+
+	topic := []byte("unit9.test")
+	for i = 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if _, err := db.GetContext(ctx, NewQuery(topic).WithLimit(int(n))); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("cancelled get took %v", elapsed)
+	}
+	if err := db.PutEntryContext(ctx, NewEntry(topic, []byte("msg.cancelled"))); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+
+	v, err := db.GetContext(context.Background(), NewQuery(topic).WithLimit(int(n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != int(n) {
+		t.Fatalf("expected %d items; got %d", n, len(v))
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i, j int
+	n := 50
+
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []*Query
+	for i = 0; i < 10; i++ {
+		topic := []byte(fmt.Sprintf("unit10.test%d", i))
+		for j = 0; j < n; j++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d.%2d", i, j))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 5 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		queries = append(queries, NewQuery(topic).WithLimit(10+i))
+	}
+	// The same topic of another contract is keyed apart.
+	topic := []byte("unit10.test0")
+	for j = 0; j < n; j++ {
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("contract msg.%2d", j))).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queries = append(queries, NewQuery(topic).WithContract(contract).WithLimit(n))
+
+	results, err := db.GetMulti(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(queries) {
+		t.Fatalf("expected %d results; got %d", len(queries), len(results))
+	}
+	for _, q := range queries {
+		v, err := db.Get(NewQuery(q.Topic).WithContract(q.Contract).WithLimit(q.Limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		items := results[TopicKey{Contract: q.Contract, Topic: string(q.Topic)}]
+		if len(items) != len(v) {
+			t.Fatalf("topic %s: expected %d items; got %d", q.Topic, len(v), len(items))
+		}
+		for k := range v {
+			if !bytes.Equal(items[k], v[k]) {
+				t.Fatalf("topic %s: expected %s; got %s", q.Topic, v[k], items[k])
+			}
+		}
+	}
+}
+
+func TestHas(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit11.test")
+	var ids [][]byte
+	for i := 0; i < 100; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if ok, err := db.Has(ids[0], topic); err != nil || !ok {
+		t.Fatalf("expected id in memdb; got %v, %v", ok, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(len(ids)); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", len(ids), db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range ids {
+		if ok, err := db.Has(id, topic); err != nil || !ok {
+			t.Fatalf("expected id %v to exist; got %v, %v", id, ok, err)
+		}
+	}
+	randID := make([]byte, 16)
+	rand.Read(randID)
+	if ok, err := db.Has(randID, topic); err != nil || ok {
+		t.Fatalf("expected random id to not exist; got %v, %v", ok, err)
+	}
+	unusedID, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Has(unusedID, topic); err != nil || ok {
+		t.Fatalf("expected unused id to not exist; got %v, %v", ok, err)
+	}
+	if ok, err := db.Has(ids[0], []byte("unit11.other")); err != nil || ok {
+		t.Fatalf("expected id to not exist in another topic; got %v, %v", ok, err)
+	}
+
+	// The entry of a contract is not found with the ID of another contract.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("contract msg")).WithID(id).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	contractID := message.ID(id)
+	contractID.SetContract(contract)
+	if ok, err := db.Has(contractID, topic); err != nil || !ok {
+		t.Fatalf("expected contract id to exist; got %v, %v", ok, err)
+	}
+	if ok, err := db.Has(id, topic); err != nil || ok {
+		t.Fatalf("expected id of the master contract to not exist; got %v, %v", ok, err)
+	}
+}
+
+func TestQueryOptions(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit52.options")
+	for i := 0; i < 6; i++ {
+		if i == 3 {
+			// Insertion time has a resolution of a second.
+			time.Sleep(1100 * time.Millisecond)
+		}
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := db.GetItems(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 6 {
+		t.Fatalf("expected 6 items; got %d", len(items))
+	}
+	older, newer := items[5].InsertedAt, items[0].InsertedAt
+
+	vals := func(from, to int) [][]byte {
+		var v [][]byte
+		for i := to - 1; i >= from; i-- {
+			v = append(v, []byte(fmt.Sprintf("msg.%2d", i)))
+		}
+		return v
+	}
+	tests := []struct {
+		name string
+		q    *Query
+		want [][]byte
+		err  error
+	}{
+		{"last", NewQuery(topic).WithLastDuration(time.Hour), vals(0, 6), nil},
+		{"last string", NewQuery(topic).WithLast("1h"), vals(0, 6), nil},
+		{"last topic", NewQuery([]byte("unit52.options?last=1h")), vals(0, 6), nil},
+		{"last count topic", NewQuery([]byte("unit52.options?last=2")).WithFrom(newer), vals(4, 6), nil},
+		{"from", NewQuery(topic).WithFrom(newer), vals(3, 6), nil},
+		{"to", NewQuery(topic).WithTo(older), vals(0, 3), nil},
+		{"to limit", NewQuery(topic).WithTo(older).WithLimit(2), vals(1, 3), nil},
+		{"from to", NewQuery(topic).WithFrom(older).WithTo(newer).WithLimit(4), vals(2, 6), nil},
+		{"last and from", NewQuery(topic).WithLastDuration(time.Hour).WithFrom(older), nil, errQueryConflict},
+		{"last and to", NewQuery(topic).WithLastDuration(time.Hour).WithTo(newer), nil, errQueryConflict},
+		{"from after to", NewQuery(topic).WithFrom(newer).WithTo(older), nil, errQueryConflict},
+		{"last topic and from", NewQuery([]byte("unit52.options?last=1h")).WithFrom(older), nil, errQueryConflict},
+		{"last topic and last", NewQuery([]byte("unit52.options?last=1h")).WithLastDuration(time.Hour), nil, errQueryConflict},
+		{"negative last", NewQuery(topic).WithLastDuration(-time.Hour), nil, errBadRequest},
+		{"negative limit", NewQuery(topic).WithLimit(-1), nil, errBadRequest},
+	}
+	for _, tt := range tests {
+		v, err := db.Get(tt.q)
+		if err != tt.err {
+			t.Fatalf("%s: expected error %v; got %v", tt.name, tt.err, err)
+		}
+		if !reflect.DeepEqual(tt.want, v) {
+			t.Fatalf("%s: expected %d entries; got %d", tt.name, len(tt.want), len(v))
+		}
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 1000
+
+	topic := []byte("unit12.test")
+	for i = 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == n/2 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	seen := make(map[string]int)
+	var cursor []byte
+	for pages := 0; ; pages++ {
+		if pages > int(n)/100 {
+			t.Fatalf("expected %d pages; got more", n/100)
+		}
+		q := NewQuery(topic).WithLimit(100).WithCursor(cursor)
+		v, err := db.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, val := range v {
+			seen[string(val)]++
+		}
+		// A write between pages must not shift the next page.
+		if pages == 0 {
+			if err := db.Put(topic, []byte("msg.new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cursor = q.Next(); cursor == nil {
+			break
+		}
+	}
+	if len(seen) != int(n) {
+		t.Fatalf("expected %d items; got %d", n, len(seen))
+	}
+	for i = 0; i < n; i++ {
+		if c := seen[fmt.Sprintf("msg.%2d", i)]; c != 1 {
+			t.Fatalf("expected msg.%2d once; got %d", i, c)
+		}
+	}
+}
+
+func TestQueryCursorTopics(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The query topic matches the static and the wildcard topic, the seqs of the
+	// entries of the two topics are interleaved.
+	n := 20
+	for i := 0; i < n; i++ {
+		topic := []string{"unit12.cursor.a", "unit12.cursor.*"}[i%2]
+		if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ascending := range []bool{false, true} {
+		seen := make(map[string]int)
+		var cursor []byte
+		for pages := 0; ; pages++ {
+			if pages > n/3 {
+				t.Fatalf("expected %d pages; got more", n/3+1)
+			}
+			q := NewQuery([]byte("unit12.cursor.a")).WithLimit(3).WithCursor(cursor)
+			if ascending {
+				q = q.WithAscending()
+			}
+			v, err := db.Get(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, val := range v {
+				seen[string(val)]++
+			}
+			if cursor = q.Next(); cursor == nil {
+				break
+			}
+		}
+		for i := 0; i < n; i++ {
+			if c := seen[fmt.Sprintf("msg.%2d", i)]; c != 1 {
+				t.Fatalf("ascending %v: expected msg.%2d once; got %d", ascending, i, c)
+			}
+		}
+	}
+}
+
+func TestQuerySinceSeq(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit48.since")
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	syncEntries := func() {
+		// Entries are synced once their memdb time block is released.
+		time.Sleep(1100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(0, 50)
+	syncEntries()
+	seq := db.Seq()
+	// The seq minted for an ID not yet put is not visible.
+	if _, err := db.NewID(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Seq() != seq {
+		t.Fatalf("expected seq %d kept until an entry is put; got %d", seq, db.Seq())
+	}
+	put(50, 70)
+
+	var vals, ascVals [][]byte
+	for i := 69; i >= 50; i-- {
+		vals = append(vals, []byte(fmt.Sprintf("msg.%2d", i)))
+		ascVals = append([][]byte{[]byte(fmt.Sprintf("msg.%2d", i))}, ascVals...)
+	}
+	check := func() {
+		v, err := db.Get(NewQuery(topic).WithLimit(100).WithSinceSeq(seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, v) {
+			t.Fatalf("expected %d entries after the seq; got %d", len(vals), len(v))
+		}
+		v, err = db.Get(NewQuery(topic).WithLimit(100).WithSinceSeq(seq).WithAscending())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ascVals, v) {
+			t.Fatalf("expected %d entries after the seq in ascending order; got %d", len(ascVals), len(v))
+		}
+	}
+	// The newer entries are in memory and the older entries are in the window file.
+	check()
+	// All of the entries are in the window file.
+	syncEntries()
+	check()
+
+	if v, err := db.Get(NewQuery(topic).WithLimit(100).WithSinceSeq(db.Seq())); err != nil || len(v) != 0 {
+		t.Fatalf("expected no entries after the latest seq; got %d, %v", len(v), err)
+	}
+
+	// The entry with the lower seq is put last, the entry after the seq is still found.
+	before, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.after")).WithID(after)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.before")).WithID(before)); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*Query{NewQuery(topic), NewQuery(topic).WithAscending()} {
+		v, err := db.Get(q.WithLimit(100).WithSinceSeq(message.ID(before).Sequence()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, [][]byte{[]byte("msg.after")}) {
+			t.Fatalf("expected the entry after the seq; got %q", v)
+		}
+	}
+	syncEntries()
+	v, err := db.Get(NewQuery(topic).WithLimit(100).WithSinceSeq(message.ID(before).Sequence()))
+	if err != nil || !reflect.DeepEqual(v, [][]byte{[]byte("msg.after")}) {
+		t.Fatalf("expected the synced entry after the seq; got %q, %v", v, err)
+	}
+}
+
+func TestValueCompression(t *testing.T) {
+	var n = 200
+	val := bytes.Repeat([]byte(`{"unit":"test","value":0}`), 100)
+	dataSize := func(codec Codec) int64 {
+		cleanup()
+		db, err := Open(dbPath, WithBufferSize(1<<20), WithMemdbSize(1<<20), WithFreeBlockSize(1<<16), WithValueCompression(codec), WithCompressionThreshold(64))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		topic := []byte("unit13.test")
+		for i := 0; i < n; i++ {
+			if err := db.Put(topic, val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Payloads below the threshold are stored uncompressed.
+		if err := db.Put(topic, []byte("msg.small")); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n+1); {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d entries synced; got %d", n+1, db.Count())
+			}
+			time.Sleep(100 * time.Millisecond)
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		v, err := db.Get(NewQuery(topic).WithLimit(n + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != n+1 {
+			t.Fatalf("expected %d items; got %d", n+1, len(v))
+		}
+		if !bytes.Equal(v[0], []byte("msg.small")) {
+			t.Fatalf("expected msg.small; got %s", v[0])
+		}
+		for _, item := range v[1:] {
+			if !bytes.Equal(item, val) {
+				t.Fatalf("expected %s; got %s", val, item)
+			}
+		}
+		stats, err := db.CompactionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.LiveBytes
+	}
+
+	uncompressed := dataSize(NoCompression)
+	compressed := dataSize(SnappyCompression)
+	if compressed >= uncompressed {
+		t.Fatalf("expected compressed data size %d smaller than %d", compressed, uncompressed)
+	}
+	custom := dataSize(_TestCodec{id: 2})
+	if custom != uncompressed {
+		t.Fatalf("expected custom codec data size %d; got %d", uncompressed, custom)
+	}
+
+	// The IDs reserved for the built in codecs are rejected for a custom codec.
+	for _, id := range []uint8{codecSnappy, codecNone, maxCodecID + 1} {
+		if _, err := Open(dbPath, WithValueCompression(_TestCodec{id: id})); err != errCodecUnknown {
+			t.Fatalf("expected error %v for codec ID %d; got %v", errCodecUnknown, id, err)
+		}
+	}
+}
+
+// _TestCodec stores payloads as is under the codec ID.
+type _TestCodec struct {
+	id uint8
+}
+
+func (c _TestCodec) ID() uint8 { return c.id }
+
+func (_TestCodec) Encode(dst, src []byte) []byte { return append(dst[:0], src...) }
+
+func (_TestCodec) Decode(dst, src []byte) ([]byte, error) { return append(dst[:0], src...), nil }
+
+func TestIDGenerator(t *testing.T) {
+	cleanup()
+	var seq uint64 = 1000
+	gen := func() []byte {
+		seq++
+		return message.NewID(seq)
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithIDGenerator(gen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit14.test")
+	var ids [][]byte
+	for i := 0; i < 10; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := message.ID(id).Sequence(); s != seq {
+			t.Fatalf("expected seq %d; got %d", seq, s)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if ok, err := db.Has(id, topic); err != nil || !ok {
+			t.Fatalf("expected id %v to exist; got %v, %v", id, ok, err)
+		}
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 10 {
+		t.Fatalf("expected 10 items; got %d", len(v))
+	}
+	for i, val := range v {
+		if msg := fmt.Sprintf("msg.%2d", 9-i); string(val) != msg {
+			t.Fatalf("expected %s; got %s", msg, val)
+		}
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.invalid")).WithID([]byte("invalid"))); err != errMsgIDInvalid {
+		t.Fatalf("expected %v; got %v", errMsgIDInvalid, err)
+	}
+	if s := db.seq(); s != seq {
+		t.Fatalf("expected db seq %d; got %d", seq, s)
+	}
+
+	// A generated seq not after the DB seq is not reused.
+	want := db.seq()
+	seq -= 2
+	if _, err := db.NewID(); err != errMsgIDSeqNotAfter {
+		t.Fatalf("expected %v; got %v", errMsgIDSeqNotAfter, err)
+	}
+	if s := db.seq(); s != want {
+		t.Fatalf("expected db seq %d; got %d", want, s)
+	}
+	// The generated seq wraps to zero.
+	seq = ^uint64(0)
+	if _, err := db.NewID(); err != errMsgIDInvalid {
+		t.Fatalf("expected %v; got %v", errMsgIDInvalid, err)
+	}
+}
+
+func TestGetItems(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxSyncDuration(time.Minute, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n := 3
+	topic := []byte("unit15.test")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			// Insertion time has a resolution of a second.
+			time.Sleep(1100 * time.Millisecond)
+		}
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := db.GetItems(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items; got %d", n, len(items))
+	}
+	// Items are returned in reverse write order.
+	for i := 1; i < n; i++ {
+		if !items[i].InsertedAt.Before(items[i-1].InsertedAt) {
+			t.Fatalf("expected item %d inserted before %v; got %v", i, items[i-1].InsertedAt, items[i].InsertedAt)
+		}
+		if message.ID(items[i].ID).Sequence() >= message.ID(items[i-1].ID).Sequence() {
+			t.Fatalf("expected item %d seq before %d", i, message.ID(items[i-1].ID).Sequence())
+		}
+	}
+	if since := time.Since(items[0].InsertedAt); since < 0 || since > 5*time.Second {
+		t.Fatalf("unexpected insertion time %v", items[0].InsertedAt)
+	}
+	if ok, err := db.Has(items[0].ID, topic); err != nil || !ok {
+		t.Fatalf("expected item id to exist; got %v, %v", ok, err)
+	}
+}
+
+func TestItemInsertedAt(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID is put later than it is generated.
+	topic := []byte("unit15.inserted")
+	id, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	put := time.Now()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id)); err != nil {
+		t.Fatal(err)
+	}
+	// Insertion time has a resolution of a second.
+	check := func() {
+		items, err := db.GetItems(NewQuery(topic).WithLimit(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 {
+			t.Fatalf("expected 1 item; got %d", len(items))
+		}
+		if at := items[0].InsertedAt; at.Before(put.Truncate(time.Second)) || time.Since(at) > 5*time.Second {
+			t.Fatalf("expected item inserted at %v; got %v", put, at)
+		}
+	}
+	check()
+
+	// The insertion time is kept once the entry is synced and the DB is reopened.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestItemExpiry(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n := 10
+	topic := []byte("unit49.expiry")
+	expiredAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	liveAt := uint32(time.Now().Add(1 * time.Hour).Unix())
+	for i := 0; i < n; i++ {
+		e := &Entry{Topic: topic, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: liveAt}
+		if i%2 == 0 {
+			e.ExpiresAt = expiredAt
+		}
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		items, err := db.GetItems(NewQuery(topic).WithLimit(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != n/2 {
+			t.Fatalf("expected %d live items; got %d", n/2, len(items))
+		}
+		for _, it := range items {
+			if it.IsExpired() || it.ExpiresAt() != liveAt {
+				t.Fatalf("expected live item %s to expire at %d; got %d", it.Value, liveAt, it.ExpiresAt())
+			}
+		}
+		items, err = db.GetItems(NewQuery(topic).WithLimit(n).WithExpired())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != n {
+			t.Fatalf("expected %d items with expired; got %d", n, len(items))
+		}
+		// Items are returned in reverse write order.
+		for i, it := range items {
+			expired := (n-1-i)%2 == 0
+			if it.IsExpired() != expired {
+				t.Fatalf("expected item %s expired %v; got %v", it.Value, expired, it.IsExpired())
+			}
+			if expired && it.ExpiresAt() != expiredAt {
+				t.Fatalf("expected expired item %s to expire at %d; got %d", it.Value, expiredAt, it.ExpiresAt())
+			}
+		}
+	}
+	// The entries are in memory.
+	check()
+	// The entries are in the window file.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestMaxCount(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n, maxCount := 200, 50
+	topic := []byte("unit51.retention")
+	other := []byte("unit51.other")
+	for i := 0; i < n; i++ {
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%3d", i))).WithMaxCount(uint32(maxCount))); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(other, []byte(fmt.Sprintf("msg.%3d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == n/2 {
+			// Entries are synced once their memdb time block is released.
+			time.Sleep(1100 * time.Millisecond)
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	var vals [][]byte
+	for i := n - 1; i >= n-maxCount; i-- {
+		vals = append(vals, []byte(fmt.Sprintf("msg.%3d", i)))
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected the newest %d entries; got %d", maxCount, len(v))
+	}
+	// The topic without a limit keeps all of its entries.
+	if v, err := db.Get(NewQuery(other).WithLimit(n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d entries of the topic without a limit; got %d, %v", n, len(v), err)
+	}
+	if count := db.Count(); count != uint64(n+maxCount) {
+		t.Fatalf("expected %d entries; got %d", n+maxCount, count)
+	}
+}
+
+func TestMaxCountDeleted(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	maxCount := 10
+	topic := []byte("unit51.deleted")
+	var ids [][]byte
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			messageID, err := db.NewID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(messageID).WithMaxCount(uint32(maxCount))); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, messageID)
+		}
+		// Entries are synced once their memdb time block is released.
+		time.Sleep(1100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(vals ...int) {
+		var want [][]byte
+		for _, i := range vals {
+			want = append(want, []byte(fmt.Sprintf("msg.%2d", i)))
+		}
+		v, err := db.Get(NewQuery(topic).WithLimit(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, v) {
+			t.Fatalf("expected %q; got %q", want, v)
+		}
+	}
+	put(0, maxCount)
+	// The deleted entries are not counted, the topic is below the limit.
+	for i := 5; i < maxCount; i++ {
+		if err := db.Delete(ids[i], topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(10, 13)
+	get(12, 11, 10, 4, 3, 2, 1, 0)
+	// The oldest live entries are trimmed once the live entries pass the limit.
+	put(13, 18)
+	get(17, 16, 15, 14, 13, 12, 11, 10, 4, 3)
+}
+
+func TestWatch(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithWatchBufferSize(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var contract uint32 = 7
+	topics := [][]byte{[]byte("unit53.watch.a"), []byte("unit53.watch.b")}
+	eventC, cancel := db.Watch()
+	otherC, otherCancel := db.Watch()
+	defer otherCancel()
+
+	n := 30
+	var seqs []uint64
+	for i := 0; i < n; i++ {
+		e := NewEntry(topics[i%2], []byte(fmt.Sprintf("msg.%2d", i))).WithContract(contract)
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, e.Seq())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The watch buffer holds the first 20 events, the later events are dropped.
+	for _, c := range []<-chan WriteEvent{eventC, otherC} {
+		hashes := make(map[uint64]bool)
+		for i := 0; i < 20; i++ {
+			select {
+			case ev := <-c:
+				if ev.Seq != seqs[i] || ev.Contract != contract {
+					t.Fatalf("expected event of seq %d and contract %d; got %+v", seqs[i], contract, ev)
+				}
+				hashes[ev.TopicHash] = true
+			case <-time.After(time.Second):
+				t.Fatalf("expected event %d", i)
+			}
+		}
+		if len(hashes) != len(topics) {
+			t.Fatalf("expected events of %d topics; got %d", len(topics), len(hashes))
+		}
+		select {
+		case ev := <-c:
+			t.Fatalf("expected events past the watch buffer dropped; got %+v", ev)
+		default:
+		}
+	}
+
+	// The channel is closed once the watch is cancelled.
+	cancel()
+	if err := db.Put(topics[0], []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-eventC; ok {
+		t.Fatal("expected event channel closed once the watch is cancelled")
+	}
+	if ev := <-otherC; ev.Seq != db.Seq() {
+		t.Fatalf("expected event of seq %d; got %+v", db.Seq(), ev)
+	}
+	// The channel is closed once the DB is closed.
+	db.Close()
+	if _, ok := <-otherC; ok {
+		t.Fatal("expected event channel closed once the DB is closed")
+	}
+
+	// A watch buffer size that is not positive falls back to the default.
+	for _, size := range []int{0, -1} {
+		db, err := Open(dbPath, WithWatchBufferSize(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventC, cancel := db.Watch()
+		if cap(eventC) != defaultWatchBufferSize {
+			t.Fatalf("expected watch buffer size %d; got %d", defaultWatchBufferSize, cap(eventC))
+		}
+		cancel()
+		db.Close()
+	}
+}
+
+func TestWatchBlock(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithWatchBufferSize(1), WithWatchPolicy(WatchBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	eventC, cancel := db.Watch()
+	defer cancel()
+	n := 50
+	received := make(chan int)
+	go func() {
+		count := 0
+		for range eventC {
+			if count++; count == n {
+				break
+			}
+		}
+		received <- count
+	}()
+	topic := []byte("unit53.block")
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// The sync waits for the watcher so no event is dropped.
+	if count := <-received; count != n {
+		t.Fatalf("expected %d events; got %d", n, count)
+	}
+}
+
+func TestCloseSync(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var i uint16
+	var n uint16 = 1000
+
+	topic := []byte("unit16.test")
+	for i = 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err == nil {
+		t.Fatal("expected sync on closed db to fail")
+	}
+
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries; got %d", n, count)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(int(n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != int(n) {
+		t.Fatalf("expected %d items; got %d", n, len(v))
+	}
+}
+
+func TestFilterFalsePositiveRate(t *testing.T) {
+	cleanup()
+	var n uint64 = 10000
+	p := 0.01
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithFilterFalsePositiveRate(p), WithFilterExpectedEntries(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seq uint64
+	for seq = 1; seq <= n; seq++ {
+		db.internal.filter.Append(seq)
+	}
+	falsePositives := 0
+	tests := 10 * n
+	for seq = n + 1; seq <= n+tests; seq++ {
+		if db.internal.filter.Test(seq) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / float64(tests); rate > 1.5*p {
+		t.Fatalf("expected false positive rate near %v; got %v", p, rate)
+	}
+	bits, hashes := db.internal.filter.bits, db.internal.filter.hashes
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Filter parameters are loaded from the filter file on reopen.
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithFilterFalsePositiveRate(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.internal.filter.bits != bits || db.internal.filter.hashes != hashes {
+		t.Fatalf("expected filter bits %d hashes %d; got %d, %d", bits, hashes, db.internal.filter.bits, db.internal.filter.hashes)
+	}
+	for seq = 1; seq <= n; seq++ {
+		if !db.internal.filter.Test(seq) {
+			t.Fatalf("expected seq %d in filter", seq)
+		}
+	}
+}
+
+func TestFilterLegacy(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 100
+	topic := []byte("unit50.filter")
+	var ids [][]byte
+	for i := 0; i < n; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("filter msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A filter block written by earlier versions has no header and hashes the entries with an
+	// earlier hash, the filter is rebuilt from the index blocks.
+	name := filePath(fs.OS, dbPath, _FileDesc{fileType: typeFilter})
+	if err := ioutil.WriteFile(name, make([]byte, filter.Size(filter.DefaultParams())), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if ok, err := db.Has(id, topic); err != nil || !ok {
+			t.Fatalf("expected id %v to exist; got %v, %v", id, ok, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < filterHeaderSize || binary.LittleEndian.Uint64(data[16:24]) != filterVersion {
+		t.Fatalf("expected filter block of version %d", filterVersion)
+	}
+}
+
+func TestExpiryBacklog(t *testing.T) {
+	cleanup()
+	batchSize := 100
+	for _, opt := range []Options{WithExpiryInterval(-time.Second), WithExpiryInterval(0), WithExpiryBatchSize(-1)} {
+		if _, err := Open(dbPath, WithBackgroundKeyExpiry(), opt); err != errExpiryInvalid {
+			t.Fatalf("expected error %v; got %v", errExpiryInvalid, err)
+		}
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<20), WithFreeBlockSize(1<<16), WithMutable(), WithBackgroundKeyExpiry(), WithExpiryInterval(time.Hour), WithExpiryBatchSize(batchSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 1000
+
+	topic := []byte("unit17.test")
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	for i = 0; i < n; i++ {
+		if err := db.PutEntry(&Entry{Topic: topic, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lookup adds expired entries to the expiry window.
+	if v, err := db.Get(NewQuery(topic).WithLimit(int(n))); len(v) != 0 || err != nil {
+		t.Fatalf("expected no items; got %d, %v", len(v), err)
+	}
+
+	cycles := 0
+	for {
+		count, err := db.expireEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count > batchSize {
+			t.Fatalf("expected at most %d entries per run; got %d", batchSize, count)
+		}
+		if count == 0 {
+			break
+		}
+		if cycles++; cycles > int(n)/batchSize {
+			t.Fatalf("expected backlog drained in %d runs", int(n)/batchSize)
+		}
+	}
+	if count := db.Count(); count != 0 {
+		t.Fatalf("expected all entries expired; got %d", count)
+	}
+}
+
+func TestExpiryRequeue(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<20), WithFreeBlockSize(1<<16), WithMutable(), WithBackgroundKeyExpiry(), WithExpiryInterval(time.Hour), WithExpiryCallback(func(topic, id []byte) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n := 100
+	topic := []byte("unit51.requeue")
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	var ids [][]byte
+	for i := 0; i < n; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(&Entry{ID: id, Topic: topic, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lookup adds expired entries to the expiry window.
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); len(v) != 0 || err != nil {
+		t.Fatalf("expected no items; got %d, %v", len(v), err)
+	}
+	pending := func() int {
+		count := 0
+		for _, ws := range db.internal.timeWindow.expiryWindowBucket.expiryWindows.expiry {
+			ws.mu.RLock()
+			for _, entries := range ws.windows {
+				count += len(entries)
+			}
+			ws.mu.RUnlock()
+		}
+		return count
+	}
+	if count := pending(); count != n {
+		t.Fatalf("expected %d entries in the expiry window; got %d", n, count)
+	}
+
+	// A corrupt record fails the expiry run, the entries not expired are kept in the expiry window.
+	e, err := db.internal.reader.readEntry(message.ID(ids[n/2]).Sequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataFile.WriteAt([]byte("corrupt"), e.msgOffset+idSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.expireEntries(); err != ErrCorruptRecord {
+		t.Fatalf("expected error %v; got %v", ErrCorruptRecord, err)
+	}
+	if count := pending(); count == 0 || uint64(count) != db.Count() {
+		t.Fatalf("expected %d entries in the expiry window; got %d", db.Count(), count)
+	}
+}
+func TestExpiryCallback(t *testing.T) {
+	cleanup()
+	var db *DB
+	expired := make(map[string]int)
+	var ids [][]byte
+	callback := func(topic, id []byte) {
+		expired[string(topic)]++
+		ids = append(ids, id)
+		// Callback may use the DB.
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithBackgroundKeyExpiry(), WithExpiryInterval(time.Hour), WithExpiryCallback(callback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topics := [][]byte{[]byte("unit18.test1"), []byte("unit18.test2")}
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	var n = 10
+	puts := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(&Entry{ID: id, Topic: topics[i%2], Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		puts[string(id)] = true
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lookup adds expired entries to the expiry window.
+	for _, topic := range topics {
+		if _, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := db.expireEntries(); err != nil || count != n {
+		t.Fatalf("expected %d entries expired; got %d, %v", n, count, err)
+	}
+	for _, topic := range topics {
+		if c := expired[string(topic)]; c != n/2 {
+			t.Fatalf("expected %d callbacks for topic %s; got %d", n/2, topic, c)
+		}
+	}
+	for _, id := range ids {
+		if !puts[string(id)] {
+			t.Fatalf("unexpected expired id %v", id)
+		}
+	}
+	if count := db.Count(); count != 0 {
+		t.Fatalf("expected all entries expired; got %d", count)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit19.test")
+	var n = 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(db.MetricsHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE unitdb_syncs_total counter",
+		fmt.Sprintf("unitdb_syncs_total %d", n),
+		fmt.Sprintf("unitdb_puts_total %d", n),
+		fmt.Sprintf("unitdb_entries %d", n),
+		"# TYPE unitdb_entries gauge",
+		"unitdb_in_bytes_total ",
+		"unitdb_out_bytes_total ",
+		"unitdb_memdb_entries ",
+		"unitdb_wal_pending_logs ",
+		"unitdb_expires_total 0",
+	} {
+		if !bytes.Contains(body, []byte(line)) {
+			t.Fatalf("expected metric line %q; got\n%s", line, body)
+		}
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithReadCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit20.test")
+	var n = 10
+	var ids [][]byte
+	for i := 0; i < n; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if misses := db.internal.meter.Misses.Count(); misses != int64(n) {
+		t.Fatalf("expected %d reads from data file; got %d", n, misses)
+	}
+	second, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected cached read %v; got %v", first, second)
+	}
+	if misses := db.internal.meter.Misses.Count(); misses != int64(n) {
+		t.Fatalf("expected second read served from cache; got %d reads from data file", misses)
+	}
+	if hits := db.internal.meter.Hits.Count(); hits != int64(n) {
+		t.Fatalf("expected %d cache hits; got %d", n, hits)
+	}
+
+	// Deleted entries are removed from cache.
+	if err := db.Delete(ids[0], topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.internal.cache.get(message.ID(ids[0]).Sequence()); ok {
+		t.Fatal("expected deleted entry removed from cache")
+	}
+}
+
+func TestTrieOffset(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic, _, err := db.parseTopic(message.MasterContract, []byte("unit21.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.AddContract(message.MasterContract)
+	h := topic.GetHash(message.MasterContract)
+	trie := newTrie()
+	if _, ok := trie.getOffset(h); ok {
+		t.Fatal("expected offset of unknown topic not found")
+	}
+	if ok := trie.setOffset(h, 1); ok {
+		t.Fatal("expected set offset of unknown topic to fail")
+	}
+	if ok := trie.add(newTopic(h, 0), topic.Parts, topic.Depth); !ok {
+		t.Fatal("expected topic added to trie")
+	}
+	if ok := trie.setOffset(h, 4096); !ok {
+		t.Fatal("expected set offset of topic to succeed")
+	}
+	if off, ok := trie.getOffset(h); !ok || off != 4096 {
+		t.Fatalf("expected offset 4096; got %d, %v", off, ok)
+	}
+}
+
+func TestGetByID(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit22.test")
+	var n = 10
+	ids := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		if ids[i], err = db.NewID(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(ids[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiredID, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(&Entry{ID: expiredID, Topic: topic, Payload: []byte("expired"), ExpiresAt: uint32(time.Now().Add(-1 * time.Hour).Unix())}); err != nil {
+		t.Fatal(err)
+	}
+	verify := func() {
+		for i, id := range ids {
+			val, err := db.GetByID(id, topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("msg.%2d", i); string(val) != want {
+				t.Fatalf("expected %s; got %s", want, val)
+			}
+		}
+		if _, err := db.GetByID(expiredID, topic); err != errMsgExpired {
+			t.Fatalf("expected expired error; got %v", err)
+		}
+		if _, err := db.GetByID(ids[0], []byte("unit22.other")); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected not found error for other topic; got %v", err)
+		}
+		newID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetByID(newID, topic); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected not found error for new id; got %v", err)
+		}
+	}
+	verify()
+
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n+1); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n+1, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify()
+}
+
+func TestQueryAscending(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxSyncDuration(time.Minute, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit23.test")
+	var n = 30
+	// Entries are synced in separate window blocks and the last entries remain in memory.
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i != 9 && i != 19 {
+			continue
+		}
+		for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(i+1); {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d entries synced; got %d", i+1, db.Count())
+			}
+			time.Sleep(100 * time.Millisecond)
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var got []string
+	q := NewQuery(topic).WithAscending().WithLimit(7)
+	for {
+		items, err := db.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range items {
+			got = append(got, string(item))
+		}
+		next := q.Next()
+		if next == nil {
+			break
+		}
+		q = NewQuery(topic).WithAscending().WithLimit(7).WithCursor(next)
+	}
+	if len(got) != n {
+		t.Fatalf("expected %d items; got %d", n, len(got))
+	}
+	for i, v := range got {
+		if want := fmt.Sprintf("msg.%2d", i); v != want {
+			t.Fatalf("expected %s at %d; got %s", want, i, v)
+		}
+	}
+
+	// Default order is unchanged.
+	items, err := db.Get(NewQuery(topic).WithLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("msg.%2d", n-1); len(items) != 1 || string(items[0]) != want {
+		t.Fatalf("expected %s; got %s", want, items)
+	}
+}
+
+func TestEntryTooLarge(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxPayloadSize(64), WithMaxTopicLength(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit24.test")
+	if err := db.Put(topic, make([]byte, 65)); err != ErrEntryTooLarge {
+		t.Fatalf("expected payload rejected; got %v", err)
+	}
+	if err := db.Put([]byte("unit24.test.too.long"), []byte("msg")); err != ErrEntryTooLarge {
+		t.Fatalf("expected topic rejected; got %v", err)
+	}
+	if err := db.Put(topic, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		if err := b.Put(topic, make([]byte, 65)); err != ErrEntryTooLarge {
+			t.Fatalf("expected batch payload rejected; got %v", err)
+		}
+		if err := b.Put([]byte("unit24.test.too.long"), []byte("msg")); err != ErrEntryTooLarge {
+			t.Fatalf("expected batch topic rejected; got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := db.seq(); seq != 1 {
+		t.Fatalf("expected rejected entries not assigned a seq; got seq %d", seq)
+	}
+}
+
+// copyDB copies the DB files as they are on disk.
+func copyDB(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), data, info.Mode())
+	})
+}
+
+func TestFlush(t *testing.T) {
+	cleanup()
+	crashPath := dbPath + "-crash"
+	os.RemoveAll(crashPath)
+	defer os.RemoveAll(crashPath)
+	// Disable the background sync so the entries are only in the log.
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxSyncDuration(time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	topic := []byte("unit25.test")
+	for i = 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy the DB files as they are on disk to simulate a crash before the entries are synced.
+	if err := copyDB(dbPath, crashPath); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := Open(crashPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if count := recovered.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries; got %d", n, count)
+	}
+	v, err := recovered.Get(NewQuery(topic).WithLimit(int(n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != int(n) {
+		t.Fatalf("expected %d entries recovered from the log; got %d", n, len(v))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err == nil {
+		t.Fatal("expected flush on closed db to fail")
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	infoPath := filePath(fs.OS, dbPath, _FileDesc{fileType: typeInfo})
+	header, err := ioutil.ReadFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated header.
+	if err := ioutil.WriteFile(infoPath, header[:fixed/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath); err != ErrInvalidDatabase {
+		t.Fatalf("expected ErrInvalidDatabase for a truncated header; got %v", err)
+	}
+
+	// Wrong magic.
+	foreign := append([]byte{}, header...)
+	copy(foreign, "tracedb")
+	if err := ioutil.WriteFile(infoPath, foreign, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath); err != ErrInvalidDatabase {
+		t.Fatalf("expected ErrInvalidDatabase for a wrong magic; got %v", err)
+	}
+
+	// The DB opens once the header is restored.
+	if err := ioutil.WriteFile(infoPath, header, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWindowTailBlock(t *testing.T) {
+	cleanup()
+	topic := []byte("unit26.test")
+	put := func(from, to int) {
+		db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Wait for the time block to be released so entries are synced to window blocks.
+		time.Sleep(1100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	winSize := func() int64 {
+		fi, err := os.Stat(filePath(fs.OS, dbPath, _FileDesc{fileType: typeTimeWindow}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	// Fill the first window block and write a partial tail block.
+	n := entriesPerWindowBlock + 10
+	put(0, n)
+	size := winSize()
+
+	// Reopen and write more entries, the tail block is filled rather than a new block allocated.
+	put(n, n+10)
+	if winSize() != size {
+		t.Fatalf("expected window file size %d; got %d", size, winSize())
+	}
+
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	v, err := db.Get(NewQuery(topic).WithLimit(n + 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != n+10 {
+		t.Fatalf("expected %d entries; got %d", n+10, len(v))
+	}
+}
+
+func TestSyncManyTopics(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<20), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	nTopics, n := 64, 50
+	for i := 0; i < n; i++ {
+		for j := 0; j < nTopics; j++ {
+			topic := []byte(fmt.Sprintf("unit27.test%d", j))
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d.%d", j, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Wait for the time block to be released so entries are synced by the workers.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(nTopics*n) {
+		t.Fatalf("expected %d entries; got %d", nTopics*n, count)
+	}
+	for j := 0; j < nTopics; j++ {
+		topic := []byte(fmt.Sprintf("unit27.test%d", j))
+		v, err := db.Get(NewQuery(topic).WithLimit(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != n {
+			t.Fatalf("expected %d entries for topic %s; got %d", n, topic, len(v))
+		}
+		if expected := fmt.Sprintf("msg.%d.%d", j, n-1); string(v[0]) != expected {
+			t.Fatalf("expected %s; got %s", expected, v[0])
+		}
+	}
+
+	// The window blocks of the topics are read from the window file after reopen.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<20), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for j := 0; j < nTopics; j++ {
+		topic := []byte(fmt.Sprintf("unit27.test%d", j))
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d.%d", j, n))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < nTopics; j++ {
+		topic := []byte(fmt.Sprintf("unit27.test%d", j))
+		v, err := db.Get(NewQuery(topic).WithLimit(n + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != n+1 {
+			t.Fatalf("expected %d entries for topic %s after reopen; got %d", n+1, topic, len(v))
+		}
+		if expected := fmt.Sprintf("msg.%d.%d", j, n); string(v[0]) != expected {
+			t.Fatalf("expected %s; got %s", expected, v[0])
+		}
+	}
+}
+
+func TestVerifyLog(t *testing.T) {
+	cleanup()
+	// Disable the background sync so the entries are only in the log.
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxSyncDuration(time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n := 100
+	topic := []byte("unit28.test")
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// A log that is unreadable is reported as corrupted.
+	if err := ioutil.WriteFile(filepath.Join(dbPath, "logs", "1.log"), []byte("corrupted"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyLog(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Entries != int64(n) {
+		t.Fatalf("expected %d entries; got %d", n, report.Entries)
+	}
+	if report.Logs == 0 {
+		t.Fatal("expected logs to apply")
+	}
+	if seqs := report.LastSeq - report.FirstSeq + 1; seqs != uint64(n) || report.LastSeq != db.seq() {
+		t.Fatalf("expected seq range to end at %d with %d entries; got %d-%d", db.seq(), n, report.FirstSeq, report.LastSeq)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != 1 {
+		t.Fatalf("expected corrupted log 1; got %v", report.Corrupted)
+	}
+	if err := os.Remove(filepath.Join(dbPath, "logs", "1.log")); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != 0 {
+		t.Fatalf("expected no entries synced by VerifyLog; got %d", count)
+	}
+}
+
+func TestImport(t *testing.T) {
+	cleanup()
+	otherPath := dbPath + "-other"
+	os.RemoveAll(otherPath)
+	defer os.RemoveAll(otherPath)
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	other, err := Open(otherPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit29.test")
+	otherTopic := []byte("unit29.other")
+	put := func(db *DB, topic []byte, id []byte, i int) {
+		entry := NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithContract(contract).WithID(id)
+		if err := db.PutEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newID := func(db *DB) []byte {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	// The seqs of the entries of the other DB are also used by unrelated entries of the DB.
+	n := 10
+	for i := 0; i < n; i++ {
+		put(other, otherTopic, newID(other), i)
+	}
+	for i := 0; i < n; i++ {
+		switch {
+		case i < 4:
+			put(db, topic, newID(db), i)
+		case i < 7:
+			// overlapping entries
+			id, err := other.NewID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			put(db, topic, id, i)
+			put(other, topic, id, i)
+		default:
+			put(other, topic, newID(other), i)
+		}
+	}
+	// Entries with a TTL that has expired are not imported.
+	if err := other.PutEntry(NewEntry(otherTopic, []byte("expired")).WithContract(contract).WithTTL("1ms")); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the time block to be released so part of the entries are synced.
+	time.Sleep(1100 * time.Millisecond)
+	if err := other.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := db.Import(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 3+n {
+		t.Fatalf("expected %d entries imported; got %d", 3+n, imported)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(2*n) {
+		t.Fatalf("expected %d entries; got %d", 2*n, count)
+	}
+	v, err := db.Get(NewQuery(topic).WithContract(contract).WithLimit(2 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != n {
+		t.Fatalf("expected %d entries; got %d", n, len(v))
+	}
+	v, err = db.Get(NewQuery(otherTopic).WithContract(contract).WithLimit(2 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != n {
+		t.Fatalf("expected %d entries; got %d", n, len(v))
+	}
+	// Entries of the other topic are not visible without the contract.
+	if v, err := db.Get(NewQuery(otherTopic).WithLimit(2 * n)); err != nil || len(v) != 0 {
+		t.Fatalf("expected no entries for master contract; got %d, %v", len(v), err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit30.test")
+	n := 20
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the time block to be released so the entries are synced before close.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() *DB {
+		db, err := Open(dbPath, WithReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	r1, r2 := open(), open()
+	if _, err := Open(dbPath, WithMutable()); err != errLocked {
+		t.Fatalf("expected errLocked opening for writes; got %v", err)
+	}
+
+	errC := make(chan error, 2)
+	for _, r := range []*DB{r1, r2} {
+		go func(r *DB) {
+			v, err := r.Get(NewQuery(topic).WithLimit(2 * n))
+			if err == nil && len(v) != n {
+				err = fmt.Errorf("expected %d entries; got %d", n, len(v))
+			}
+			errC <- err
+		}(r)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r1.Put(topic, []byte("msg")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly on Put; got %v", err)
+	}
+	if err := r1.PutEntry(NewEntry(topic, []byte("msg"))); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly on PutEntry; got %v", err)
+	}
+	id, err := r1.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.Delete(id, topic); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly on Delete; got %v", err)
+	}
+	if err := r1.Batch(func(b *Batch, completed <-chan struct{}) error { return nil }); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly on Batch; got %v", err)
+	}
+	size, err := r2.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if s, err := db.FileSize(); err != nil || s != size {
+		t.Fatalf("expected file size %d after read-only open; got %d, %v", size, s, err)
+	}
+}
+
+func TestTopicHashCollision(t *testing.T) {
+	// Topics with the same parts in a different order have the same hash.
+	topics := [][]byte{[]byte("unit31.a.b"), []byte("unit31.b.a")}
+	hash := func(topic []byte) uint64 {
+		tp := new(message.Topic)
+		tp.ParseKey(topic)
+		tp.Parse(message.MasterContract, true)
+		tp.AddContract(message.MasterContract)
+		return tp.GetHash(message.MasterContract)
+	}
+	if hash(topics[0]) != hash(topics[1]) {
+		t.Fatal("expected topics with the same hash")
+	}
+
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 5
+	for i := 0; i < n; i++ {
+		for j, topic := range topics {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d.%d", j, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	verify := func(db *DB) {
+		for j, topic := range topics {
+			v, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v) != n {
+				t.Fatalf("expected %d entries for topic %s; got %d", n, topic, len(v))
+			}
+			for _, val := range v {
+				if !bytes.HasPrefix(val, []byte(fmt.Sprintf("msg.%d.", j))) {
+					t.Fatalf("unexpected entry %s for topic %s", val, topic)
+				}
+			}
+		}
+	}
+	verify(db)
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db)
+	if count := db.internal.trie.Count(); count != len(topics) {
+		t.Fatalf("expected %d topics in trie; got %d", len(topics), count)
+	}
+
+	// A topic is chained past the hashes taken by other topics.
+	trie := newTrie()
+	parts := []message.Part{{Hash: 1}, {Hash: 2}}
+	trie.add(newTopic(hash(topics[0]), 0), parts, 2)
+	for i, parts := range [][]message.Part{{{Hash: 2}, {Hash: 1}}, {{Hash: 3}, {Hash: 0}}} {
+		h, ok := trie.topicHash(hash(topics[0]), parts)
+		if ok || h != hash(topics[0])+uint64(i+1)<<32 {
+			t.Fatalf("expected chained hash %d; got %d, %v", hash(topics[0])+uint64(i+1)<<32, h, ok)
+		}
+		trie.add(newTopic(h, 0), parts, 2)
+	}
+	if h, ok := trie.topicHash(hash(topics[0]), parts); !ok || h != hash(topics[0]) {
+		t.Fatalf("expected hash of existing topic %d; got %d, %v", hash(topics[0]), h, ok)
+	}
+
+	// A topic is chained past the hashes reserved by topics not yet added to the trie.
+	trie = newTrie()
+	h1, _ := trie.reserveHash(hash(topics[0]), parts)
+	h2, _ := trie.reserveHash(hash(topics[0]), []message.Part{{Hash: 2}, {Hash: 1}})
+	if h1 == h2 {
+		t.Fatalf("expected distinct hashes for reserved topics; got %d", h1)
+	}
+	if h, ok := trie.reserveHash(hash(topics[0]), parts); ok || h != h1 {
+		t.Fatalf("expected reserved hash %d; got %d, %v", h1, h, ok)
+	}
+}
+
+func TestTopicHashCollisionBatch(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Topics with the same hash are new topics of a single batch.
+	topics := [][]byte{[]byte("unit31.x.unit"), []byte("unit31.unit.x")}
+	n := 5
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for i := 0; i < n; i++ {
+			for j, topic := range topics {
+				if err := b.Put(topic, []byte(fmt.Sprintf("msg.%d.%d", j, i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(db *DB) {
+		for j, topic := range topics {
+			v, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v) != n {
+				t.Fatalf("expected %d entries for topic %s; got %d", n, topic, len(v))
+			}
+			for _, val := range v {
+				if !bytes.HasPrefix(val, []byte(fmt.Sprintf("msg.%d.", j))) {
+					t.Fatalf("unexpected entry %s for topic %s", val, topic)
+				}
+			}
+		}
+	}
+	verify(db)
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db)
+}
+
+func TestAutoCompact(t *testing.T) {
+	cleanup()
+	if _, err := Open(dbPath, WithCompactionThreshold(1.5)); err != errThresholdInvalid {
+		t.Fatalf("expected errThresholdInvalid; got %v", err)
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(),
+		WithMaxSyncDuration(100*time.Millisecond, 1), WithCompactionThreshold(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 100
+	topic := []byte("unit32.test")
+	var ids [][]byte
+	for i := 0; i < n; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Deleting less than the threshold does not compact the DB.
+	for _, id := range ids[:n/4] {
+		if err := db.Delete(id, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	if c := db.internal.meter.Compacts.Count(); c != 0 {
+		t.Fatalf("expected no compaction below the threshold; got %d", c)
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n-n/4 {
+		t.Fatalf("expected %d entries after delete; got %d, %v", n-n/4, len(v), err)
+	}
+
+	for _, id := range ids[n/4 : 3*n/4] {
+		if err := db.Delete(id, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.internal.meter.Compacts.Count() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected compaction once the threshold is crossed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// The compaction may start before the last deletes, Sync waits for the compaction to
+	// finish and the entries deleted after the compaction are below the threshold.
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.exceedsThreshold(0.5); ok || err != nil {
+		stats, _ := db.CompactionStats()
+		t.Fatalf("unexpected stats after compaction %+v, %v", stats, err)
+	}
+	verify := func(db *DB) {
+		v, err := db.Get(NewQuery(topic).WithLimit(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != n/4 {
+			t.Fatalf("expected %d entries; got %d", n/4, len(v))
+		}
+	}
+	verify(db)
+
+	// The topic is loaded on open once its first entry is deleted and the DB is compacted.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db)
+}
+
+func TestTopicDictionary(t *testing.T) {
+	cleanup()
+	expired := make(map[string]int)
+	callback := func(topic, id []byte) {
+		expired[string(topic)]++
+	}
+	open := func() *DB {
+		db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(),
+			WithTopicDictionary(), WithBackgroundKeyExpiry(), WithExpiryInterval(time.Hour), WithExpiryCallback(callback))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+	var topics [][]byte
+	m, n := 20, 5
+	for i := 0; i < m; i++ {
+		topics = append(topics, []byte(fmt.Sprintf("unit33.test%d", i)))
+	}
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	for i := 0; i < n; i++ {
+		for _, topic := range topics {
+			if err := db.PutEntry(&Entry{Topic: topic, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(m*n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", m*n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn record at the end of the topic file is truncated.
+	topicFile := filePath(fs.OS, dbPath, _FileDesc{fileType: typeTopic})
+	f, err := os.OpenFile(topicFile, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{64, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db = open()
+	if reads := db.internal.meter.TopicReads.Count(); reads != 0 {
+		t.Fatalf("expected topics loaded from the topic dictionary; got %d topic reads", reads)
+	}
+	// Lookup adds expired entries to the expiry window.
+	for _, topic := range topics {
+		if _, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := db.expireEntries(); err != nil || count != m*n {
+		t.Fatalf("expected %d entries expired; got %d, %v", m*n, count, err)
+	}
+	for _, topic := range topics {
+		if c := expired[string(topic)]; c != n {
+			t.Fatalf("expected %d callbacks for topic %s; got %d", n, topic, c)
+		}
+	}
+	if reads := db.internal.meter.TopicReads.Count(); reads != 0 {
+		t.Fatalf("expected no topic reads on expiry; got %d", reads)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The topic dictionary is rebuilt from the data file.
+	if err := os.Remove(topicFile); err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	if reads := db.internal.meter.TopicReads.Count(); reads != int64(m) {
+		t.Fatalf("expected %d topic reads to rebuild the topic dictionary; got %d", m, reads)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	defer db.Close()
+	if reads := db.internal.meter.TopicReads.Count(); reads != 0 {
+		t.Fatalf("expected topics loaded from the rebuilt topic dictionary; got %d topic reads", reads)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, topic := range []string{"unit34.b.c", "unit34.b.d.e", "unit34.x.c", "unit34.b..."} {
+		if err := db.Put([]byte(topic), []byte("topics message")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query   string
+		matches []string
+	}{
+		{"unit34.b...", []string{"unit34.b.c", "unit34.b.d.e"}},
+		{"unit34.*.c", []string{"unit34.b.c", "unit34.x.c"}},
+		{"*.*.c", []string{"unit34.b.c", "unit34.x.c"}},
+		{"unit34.b.c", []string{"unit34.b.c"}},
+		{"unit34.a...", []string{}},
+	}
+	for _, tt := range tests {
+		matches, err := db.Topics(NewQuery([]byte(tt.query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(matches, tt.matches) {
+			t.Fatalf("topics %s: expected %v; got %v", tt.query, tt.matches, matches)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if h := db.Health(); !h.Healthy {
+		t.Fatalf("expected healthy DB; got %+v", h)
+	}
+
+	// Simulate a failed sync by swapping the index file for a read-only file.
+	f, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	wf := f.File
+	f.File = rf
+	if err := db.Put([]byte("unit35"), []byte("health message")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err == nil {
+		t.Fatal("expected sync to fail")
+	}
+	h := db.Health()
+	if h.Healthy || h.SyncError == "" {
+		t.Fatalf("expected unhealthy DB after a failed sync; got %+v", h)
+	}
+	w := httptest.NewRecorder()
+	db.HealthzHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d; got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	f.File = wf
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if h := db.Health(); !h.Healthy {
+		t.Fatalf("expected healthy DB after sync; got %+v", h)
+	}
+}
+
+func TestDeleteEntryPrunesTopic(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("unit36.b"), []byte("prune message")); err != nil {
+		t.Fatal(err)
+	}
+	var ids [][]byte
+	for i := 0; i < 2; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry([]byte("unit36.a"), []byte("prune message")).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Delete one of the entries after it is synced.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	count := db.internal.trie.Count()
+
+	if err := db.DeleteEntry(NewEntry([]byte("unit36.a"), nil).WithID(ids[0])); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.internal.trie.Count(); n != count {
+		t.Fatalf("expected topic kept while it has entries; got %d topics, expected %d", n, count)
+	}
+	if err := db.DeleteEntry(NewEntry([]byte("unit36.a"), nil).WithID(ids[1])); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.internal.trie.Count(); n != count-1 {
+		t.Fatalf("expected topic pruned after its last entry is deleted; got %d topics, expected %d", n, count-1)
+	}
+	if matches, err := db.Topics(NewQuery([]byte("unit36..."))); err != nil || !reflect.DeepEqual(matches, []string{"unit36.b"}) {
+		t.Fatalf("expected only unit36.b left in the trie; got %v %v", matches, err)
+	}
+
+	// The topic is added again by a new entry.
+	if err := db.Put([]byte("unit36.a"), []byte("prune message")); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit36.a"))); err != nil || len(items) != 1 {
+		t.Fatalf("expected new entry of the pruned topic; got %d items %v", len(items), err)
+	}
+}
+
+func TestDeleteEntryConcurrentPut(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit37.a")
+	// The entry is reused so its topic is parsed before the topic is pruned.
+	entry := NewEntry(topic, nil)
+	for i := 0; i < 50; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte("prune message")).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := db.DeleteEntry(NewEntry(topic, nil).WithID(id)); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := db.PutEntry(entry.WithPayload([]byte("prune message"))); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		if matches, err := db.Topics(NewQuery([]byte("unit37..."))); err != nil || !reflect.DeepEqual(matches, []string{"unit37.a"}) {
+			t.Fatalf("expected topic kept while an entry is put; got %v %v", matches, err)
+		}
+		if items, err := db.Get(NewQuery(topic).WithLimit(1)); err != nil || len(items) != 1 {
+			t.Fatalf("expected the entry put concurrently with the delete; got %d items %v", len(items), err)
+		}
+		if err := db.DeleteEntry(NewEntry(topic, nil).WithID(entry.ID)); err != nil {
+			t.Fatal(err)
+		}
+		if matches, err := db.Topics(NewQuery([]byte("unit37..."))); err != nil || len(matches) != 0 {
+			t.Fatalf("expected topic pruned after its last entry is deleted; got %v %v", matches, err)
+		}
+	}
+}
+
+func TestExpiringBefore(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable(), WithBackgroundKeyExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit37")
+	expired, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(&Entry{ID: expired, Topic: topic, Payload: []byte("expiring message"), ExpiresAt: uint32(time.Now().Add(-1 * time.Hour).Unix())}); err != nil {
+		t.Fatal(err)
+	}
+	var ids [][]byte
+	for _, ttl := range []string{"1m", "2m", "3m"} {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte("expiring message")).WithID(id).WithTTL(ttl)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.Put(topic, []byte("unexpiring message")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// The entry not yet synced is forecast too.
+	id, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("expiring message")).WithID(id).WithTTL("4m")); err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, id)
+
+	now := time.Now()
+	for i, tc := range []struct {
+		before time.Time
+		ids    [][]byte
+	}{
+		{now, [][]byte{expired}},
+		{now.Add(150 * time.Second), [][]byte{expired, ids[0], ids[1]}},
+		{now.Add(time.Hour), [][]byte{expired, ids[0], ids[1], ids[2], ids[3]}},
+	} {
+		// The forecast is repeatable as it does not reclaim the entries.
+		for j := 0; j < 2; j++ {
+			entries, err := db.ExpiringBefore(tc.before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tc.ids) {
+				t.Fatalf("case %d: expected %d expiring entries; got %d", i, len(tc.ids), len(entries))
+			}
+			for k, e := range entries {
+				if !bytes.Equal(e.ID, tc.ids[k]) || e.Topic != string(topic) || !e.ExpiresAt.Before(tc.before) {
+					t.Fatalf("case %d: unexpected expiring entry %d %v", i, k, e)
+				}
+			}
+		}
+	}
+	if n := db.internal.timeWindow.expiryWindowBucket.getExpiredEntries(10); len(n) != 0 {
+		t.Fatalf("expected expiry windows not changed; got %d expired entries", len(n))
+	}
+}
+
+func TestCompactOnClose(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithFreeBlockSize(1 << 16), WithMutable(), WithBackgroundKeyExpiry()}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n uint64 = 100
+	topic := []byte("unit38")
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	for i := uint64(0); i < n; i++ {
+		e := &Entry{Topic: topic, Payload: []byte(fmt.Sprintf("compact message %2d", i))}
+		if i < n*3/4 {
+			e.ExpiresAt = expiresAt
+		}
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lookup adds expired entries to the expiry window.
+	if _, err := db.Get(NewQuery(topic).WithLimit(int(n))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.expireEntries(); err != nil {
+		t.Fatal(err)
+	}
+	dataSize := func(db *DB) int64 {
+		dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat, err := dataFile.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size()
+	}
+	before := dataSize(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction not complete within the timeout is skipped.
+	db, err = Open(dbPath, append(opts, WithCompactOnClose(time.Nanosecond))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := db.CompactionStats(); err != nil || stats.ReclaimableBytes == 0 {
+		t.Fatalf("expected reclaimable bytes after expiry; got %+v %v", stats, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, append(opts, WithCompactOnClose(time.Minute))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := dataSize(db); size != before {
+		t.Fatalf("expected compaction skipped on timeout; got size %d, expected %d", size, before)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if size := dataSize(db); size >= before {
+		t.Fatalf("expected data file to shrink on close; before %d, after %d", before, size)
+	}
+	if stats, err := db.CompactionStats(); err != nil || stats.ReclaimableBytes != 0 {
+		t.Fatalf("unexpected stats after compaction %+v, %v", stats, err)
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(int(n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != int(n/4) {
+		t.Fatalf("expected %d live entries after compaction; got %d", n/4, len(items))
+	}
+}
+
+func TestGetAtSeq(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit39")
+	// The contract is decoded from the ID.
+	newID := func() []byte {
+		newID, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := message.ID(newID)
+		id.SetContract(contract)
+		return id
+	}
+	var ids [][]byte
+	for i := 0; i < 4; i++ {
+		id := newID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("version message %d", i))).WithID(id).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	at := message.ID(ids[2]).Sequence()
+	// The entry put again with the same ID keeps its seq, the version it replaces is kept.
+	if err := db.PutEntry(NewEntry(topic, []byte("version message 1 updated")).WithID(ids[1]).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	updatedAt := db.seq()
+	if err := db.PutEntry(NewEntry(topic, []byte("version message 1 updated again")).WithID(ids[1]).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	expiredID := newID()
+	if err := db.PutEntry(&Entry{ID: expiredID, Topic: topic, Payload: []byte("expired message"), Contract: contract, ExpiresAt: uint32(time.Now().Add(-1 * time.Hour).Unix())}); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func() {
+		for i, want := range []string{"version message 0", "version message 1", "version message 2"} {
+			val, err := db.GetAtSeq(ids[i], topic, at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(val) != want {
+				t.Fatalf("expected %s; got %s", want, val)
+			}
+		}
+		if _, err := db.GetAtSeq(ids[3], topic, at); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected entry put after the seq not found; got %v", err)
+		}
+		if val, err := db.GetAtSeq(ids[3], topic, db.seq()); err != nil || string(val) != "version message 3" {
+			t.Fatalf("expected entry as of the latest seq; got %s %v", val, err)
+		}
+		if val, err := db.GetAtSeq(ids[1], topic, updatedAt); err != nil || string(val) != "version message 1 updated" {
+			t.Fatalf("expected version as of the first update; got %s %v", val, err)
+		}
+		if val, err := db.GetAtSeq(ids[1], topic, db.seq()); err != nil || string(val) != "version message 1 updated again" {
+			t.Fatalf("expected latest version as of the latest seq; got %s %v", val, err)
+		}
+		if val, err := db.GetByID(ids[1], topic); err != nil || string(val) != "version message 1 updated again" {
+			t.Fatalf("expected latest version; got %s %v", val, err)
+		}
+		if _, err := db.GetAtSeq(expiredID, topic, db.seq()); err != errMsgExpired {
+			t.Fatalf("expected expired error; got %v", err)
+		}
+		other := message.ID(append([]byte(nil), ids[0]...))
+		other.SetContract(message.MasterContract)
+		if _, err := db.GetAtSeq(other, topic, at); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected not found error for other contract; got %v", err)
+		}
+	}
+	verify()
+	// Entries are found from the window file once synced.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	// The versions are kept after the DB is reopened.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+}
+
+func TestBatchWriteSize(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit40")
+	n := 2000
+	const writeSize = 1 << 10
+	var maxSize, writes int64
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		b.SetOptions(WithBatchWriteSize(writeSize))
+		for i := 0; i < n; i++ {
+			size := b.size
+			if err := b.Put(topic, []byte(fmt.Sprintf("batch message %4d", i))); err != nil {
+				return err
+			}
+			if b.size < size {
+				writes++
+			}
+			if b.size > maxSize {
+				maxSize = b.size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The batch holds at most the write size of entries before they are written.
+	if maxSize >= writeSize || writes == 0 {
+		t.Fatalf("expected batch written in parts below %d bytes; got %d bytes in %d writes", writeSize, maxSize, writes)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Count() != uint64(n); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries synced; got %d", n, db.Count())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d entries committed; got %d", n, len(items))
+	}
+}
+
+func TestBatchDeleteNotFound(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit41.delete")
+	// The entries of the batch after a delete of an entry not found are written.
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		id, err := db.NewID()
+		if err != nil {
+			return err
+		}
+		if err := b.Delete(id, topic); err != nil {
+			return err
+		}
+		return b.Put(topic, []byte("batch message"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery(topic)); err != nil || len(items) != 1 {
+		t.Fatalf("expected the entry put after the delete; got %d items %v", len(items), err)
+	}
+}
+
+func TestConcurrentLookupExpiry(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable(), WithBackgroundKeyExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit41")
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	n := 50
+	var wg sync.WaitGroup
+	errC := make(chan error, 8)
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				e := &Entry{Topic: topic, Payload: []byte(fmt.Sprintf("concurrent message %d.%3d", w, i))}
+				if i%2 == 0 {
+					e.ExpiresAt = expiresAt
+				}
+				if err := db.PutEntry(e); err != nil {
+					errC <- err
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				items, err := db.Get(NewQuery(topic).WithLimit(4 * n))
+				if err != nil {
+					errC <- err
+					return
+				}
+				// Expired entries are never returned.
+				for _, item := range items {
+					var w, j int
+					fmt.Sscanf(string(item), "concurrent message %d.%d", &w, &j)
+					if j%2 == 0 {
+						errC <- fmt.Errorf("expired entry returned %s", item)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n/10; i++ {
+			if _, err := db.expireEntries(); err != nil {
+				errC <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		t.Fatal(err)
+	}
+
+	items, err := db.Get(NewQuery(topic).WithLimit(4 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d entries not expired; got %d", n, len(items))
+	}
+}
+
+func TestTopicsWithPrefix(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable(), WithSortedTopics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topics []string
+	for i := 29; i >= 0; i-- {
+		topics = append(topics, fmt.Sprintf("unit42.b.%02d", i))
+	}
+	topics = append(topics, "unit42.b", "unit42.bc", "unit42.a.01", "unit42.b...", "unit42.*.01")
+	for _, topic := range topics {
+		if err := db.Put([]byte(topic), []byte("sorted topics message")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := db.TopicsWithPrefix(0, []byte("unit42.b"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 31 || all[0] != "unit42.b" || !sort.StringsAreSorted(all) {
+		t.Fatalf("expected 31 sorted topics under unit42.b; got %v", all)
+	}
+	var pages []string
+	for offset := 0; ; offset += 7 {
+		page, err := db.TopicsWithPrefix(0, []byte("unit42.b"), offset, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 7 {
+			t.Fatalf("expected at most 7 topics; got %d", len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page...)
+	}
+	if !reflect.DeepEqual(pages, all) {
+		t.Fatalf("expected paginated topics %v; got %v", all, pages)
+	}
+	page, err := db.TopicsWithPrefix(0, []byte("unit42.b"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"unit42.b.02", "unit42.b.03"}; !reflect.DeepEqual(page, expected) {
+		t.Fatalf("expected %v; got %v", expected, page)
+	}
+	if page, err := db.TopicsWithPrefix(0, []byte("unit42.a"), 0, 0); err != nil || !reflect.DeepEqual(page, []string{"unit42.a.01"}) {
+		t.Fatalf("expected [unit42.a.01]; got %v, %v", page, err)
+	}
+	if page, err := db.TopicsWithPrefix(0, []byte("unit42.x"), 0, 0); err != nil || len(page) != 0 {
+		t.Fatalf("expected no topics; got %v, %v", page, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.TopicsWithPrefix(0, []byte("unit42"), 0, 0); err != errTopicIndexDisabled {
+		t.Fatalf("expected error %v; got %v", errTopicIndexDisabled, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutEntryWithAck(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	crashPath := dbPath + "-crash"
+	os.RemoveAll(crashPath)
+	defer os.RemoveAll(crashPath)
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxSyncDuration(time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit42.ack")
+	var acks []<-chan error
+	for i := 0; i < 10; i++ {
+		acks = append(acks, db.PutEntryWithAck(NewEntry(topic, []byte(fmt.Sprintf("ack message.%2d", i)))))
+	}
+	select {
+	case err := <-acks[0]:
+		t.Fatalf("expected no acknowledgment before the sync; got %v", err)
+	default:
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ack := range acks {
+		select {
+		case err := <-ack:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected acknowledgment after the sync")
+		}
+	}
+	if err := <-db.PutEntryWithAck(NewEntry(nil, []byte("ack message"))); err != errTopicEmpty {
+		t.Fatalf("expected error %v; got %v", errTopicEmpty, err)
+	}
+
+	// Copy the DB files as they are on disk to simulate a crash once the entries are acknowledged.
+	if err := copyDB(dbPath, crashPath); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := Open(crashPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	v, err := recovered.Get(NewQuery(topic).WithLimit(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != len(acks) {
+		t.Fatalf("expected %d acknowledged entries; got %d", len(acks), len(v))
+	}
+
+	ack := db.PutEntryWithAck(NewEntry(topic, []byte("ack message on close")))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ack:
+		if err != nil && err != errClosed {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("expected acknowledgment on close")
+	}
+}
+
+func TestEscapedSeparator(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	puts := []struct {
+		topic string
+		msg   string
+	}{
+		{`unit43.a\.b.c`, "escaped separator message"},
+		{`unit43.a.b.c`, "separator message"},
+		{`unit43.x\*.c`, "escaped wildcard message"},
+		{`unit43.d\.`, "escaped trailing separator message"},
+		{`unit43.*.c`, "wildcard message"},
+		{`unit43.a\.b...`, "escaped generic message"},
+		{`unit43.d\....`, "escaped trailing generic message"},
+	}
+	for _, p := range puts {
+		if err := db.Put([]byte(p.topic), []byte(p.msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{`unit43.a\.b.c`, []string{"escaped generic message", "escaped separator message", "wildcard message"}},
+		{`unit43.a.b.c`, []string{"separator message"}},
+		{`unit43.x\*.c`, []string{"escaped wildcard message", "wildcard message"}},
+		{`unit43.d\.`, []string{"escaped trailing separator message"}},
+		{`unit43.d\..e`, []string{"escaped trailing generic message"}},
+		{`unit43.d`, []string{}},
+	}
+	for _, tt := range tests {
+		items, err := db.Get(NewQuery([]byte(tt.query)).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, item := range items {
+			got = append(got, string(item))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Fatalf("query %s: expected %v; got %v", tt.query, tt.expected, got)
+		}
+	}
+	// A backslash before a character that is not escaped is kept in the part, so the
+	// part hashes as it did before the escapes were supported.
+	topic := new(message.Topic)
+	topic.ParseKey([]byte(`unit43.b\x`))
+	topic.Parse(message.MasterContract, false)
+	if len(topic.Parts) != 2 || topic.Parts[1].Hash != hash.WithSalt([]byte(`b\x`), message.MasterContract) {
+		t.Fatalf("expected the backslash kept in the part; got %v", topic.Parts)
+	}
+}
+
+func TestMemdbFullPolicy(t *testing.T) {
+	payload := make([]byte, 1<<10)
+	// fill puts entries until the memdb is full.
+	fill := func(db *DB, topic []byte) {
+		for i := 0; db.internal.mem.Capacity() < 1; i++ {
+			if i >= 1000 {
+				t.Fatal("expected memdb to be full")
+			}
+			if err := db.Put(topic, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	open := func(policy MemdbFullPolicy) *DB {
+		cleanup()
+		// Disable the background sync so the memdb is only freed by the policy.
+		db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMaxSyncDuration(time.Hour, 1), WithMemdbFullPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	// batchPut puts an entry in a batch.
+	batchPut := func(db *DB, topic []byte) error {
+		return db.Batch(func(b *Batch, completed <-chan struct{}) error {
+			return b.Put(topic, payload)
+		})
+	}
+	defer cleanup()
+	topic := []byte("unit44.full")
+
+	db := open(MemdbFullReject)
+	fill(db, topic)
+	// The entries of the current time block are not synced, so the memdb stays full.
+	if err := db.Put(topic, payload); err != ErrMemdbFull {
+		t.Fatalf("expected error %v; got %v", ErrMemdbFull, err)
+	}
+	if err := batchPut(db, topic); err != ErrMemdbFull {
+		t.Fatalf("expected batch error %v; got %v", ErrMemdbFull, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Put(topic, payload); err != ErrMemdbFull {
+		t.Fatalf("expected error %v; got %v", ErrMemdbFull, err)
+	}
+	// The time block is synced once the time block duration passes.
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, payload); err != nil {
+		t.Fatalf("expected put once the memdb is synced; got %v", err)
+	}
+	db.Close()
+
+	db = open(MemdbFullShrink)
+	fill(db, topic)
+	// The entries of the current time block are not synced, so the memdb stays full.
+	if err := db.Put(topic, payload); err != ErrMemdbFull {
+		t.Fatalf("expected error %v; got %v", ErrMemdbFull, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Put(topic, payload); err != nil {
+		t.Fatalf("expected put once the memdb is shrunk; got %v", err)
+	}
+	if capacity := db.internal.mem.Capacity(); capacity >= 1 {
+		t.Fatalf("expected memdb to be shrunk; got capacity %f", capacity)
+	}
+	// The memdb is shrunk for a batch as for a put.
+	fill(db, topic)
+	time.Sleep(1100 * time.Millisecond)
+	if err := batchPut(db, topic); err != nil {
+		t.Fatalf("expected batch put once the memdb is shrunk; got %v", err)
+	}
+	if capacity := db.internal.mem.Capacity(); capacity >= 1 {
+		t.Fatalf("expected memdb to be shrunk for the batch; got capacity %f", capacity)
+	}
+	db.Close()
+
+	db = open(MemdbFullBlock)
+	defer db.Close()
+	fill(db, topic)
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Put(topic, payload)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected put to block while the memdb is full; got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Sync until the blocked put commits the time block and the synced time block frees space.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected put to complete once the memdb is synced")
+		}
+	}
+}
+
+func TestPutEntryID(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit45.id")
+
+	// The DB mints the ID of an entry put without an ID, an entry put again gets a new ID.
+	e := NewEntry(topic, nil).WithContract(contract)
+	ids := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		payload := fmt.Sprintf("minted id message %d", i)
+		if err := db.PutEntry(e.WithPayload([]byte(payload))); err != nil {
+			t.Fatal(err)
+		}
+		if e.ID == nil || message.ID(e.ID).Sequence() != e.Seq() {
+			t.Fatalf("expected entry ID with seq %d; got %v", e.Seq(), e.ID)
+		}
+		ids[string(e.ID)] = payload
+	}
+	// The ID supplied by the caller is populated with the contract of the entry.
+	supplied, err := db.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = NewEntry(topic, []byte("supplied id message")).WithContract(contract).WithID(supplied)
+	if err := db.PutEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if seq := message.ID(supplied).Sequence(); e.Seq() != seq || message.ID(e.ID).Sequence() != seq {
+		t.Fatalf("expected entry seq %d; got %d", seq, e.Seq())
+	}
+	ids[string(e.ID)] = "supplied id message"
+	if len(ids) != 4 {
+		t.Fatalf("expected 4 distinct IDs; got %d", len(ids))
+	}
+	for id, payload := range ids {
+		v, err := db.GetByID([]byte(id), topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != payload {
+			t.Fatalf("expected payload %s; got %s", payload, v)
+		}
+	}
+}
+
+func TestPutIf(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit46.lock")
+
+	// A nil expected ID creates the first entry of the topic.
+	first := NewEntry(topic, []byte("lock holder none"))
+	if err := db.PutIf(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutIf(NewEntry(topic, []byte("lock holder none")), nil); err != ErrCASFailed {
+		t.Fatalf("expected error %v; got %v", ErrCASFailed, err)
+	}
+
+	prevID := first.ID
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		entries := make([]*Entry, 2)
+		for i := range entries {
+			entries[i] = NewEntry(topic, []byte(fmt.Sprintf("lock holder %d round %d", i, round)))
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = db.PutIf(entries[i], prevID)
+			}(i)
+		}
+		wg.Wait()
+		winner := -1
+		for i, err := range errs {
+			switch err {
+			case nil:
+				if winner != -1 {
+					t.Fatalf("round %d: expected exactly one winner", round)
+				}
+				winner = i
+			case ErrCASFailed:
+			default:
+				t.Fatal(err)
+			}
+		}
+		if winner == -1 {
+			t.Fatalf("round %d: expected exactly one winner", round)
+		}
+		items, err := db.GetItems(NewQuery(topic).WithLimit(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || !bytes.Equal(items[0].ID, entries[winner].ID) {
+			t.Fatalf("round %d: expected latest entry put by the winner", round)
+		}
+		prevID = entries[winner].ID
+	}
+
+	// The deleted entries are skipped, the latest entry is the latest entry not deleted.
+	deleted := NewEntry(topic, []byte("lock holder deleted"))
+	if err := db.PutIf(deleted, prevID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(deleted.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutIf(NewEntry(topic, []byte("lock holder after delete")), deleted.ID); err != ErrCASFailed {
+		t.Fatalf("expected error %v; got %v", ErrCASFailed, err)
+	}
+	if err := db.PutIf(NewEntry(topic, []byte("lock holder after delete")), prevID); err != nil {
+		t.Fatalf("expected put with the latest entry not deleted; got %v", err)
+	}
+}
+
+func TestOpenWithFS(t *testing.T) {
+	memfs := fs.NewMemFS()
+	path := "memfs"
+	db, err := OpenWithFS(path, memfs, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit54.memfs")
+	n := 50
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d messages from memdb; got %d, %v", n, len(v), err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d messages after sync; got %d, %v", n, len(v), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The DB files are created on the file system only.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no DB files on disk; got %v", err)
+	}
+	for _, fd := range []_FileDesc{{fileType: typeInfo}, {fileType: typeIndex}, {fileType: typeData}} {
+		if fi, err := memfs.Stat(filePath(memfs, path, fd)); err != nil || fi.Size() == 0 {
+			t.Fatalf("expected DB file %#x on the file system; got %v", fd.fileType, err)
+		}
+	}
+
+	db, err = OpenWithFS(path, memfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := OpenWithFS(path, memfs); err != errLocked {
+		t.Fatalf("expected error %v; got %v", errLocked, err)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != n {
+		t.Fatalf("expected %d messages after reopen; got %d", n, len(v))
+	}
+	// Messages are read newest first.
+	for i, msg := range v {
+		if want := fmt.Sprintf("msg.%2d", n-1-i); string(msg) != want {
+			t.Fatalf("expected message %q; got %q", want, msg)
+		}
+	}
+
+	// The backup is restored on the file system.
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	restorePath := "memfs-restore"
+	if err := RestoreBackupWithFS(&backup, restorePath, memfs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(restorePath); !os.IsNotExist(err) {
+		t.Fatalf("expected no restored files on disk; got %v", err)
+	}
+	restored, err := OpenWithFS(restorePath, memfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if v, err := restored.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d messages restored; got %d, %v", n, len(v), err)
+	}
+}
+
+// _ReadOnlyFS fails the writes to the file system the same as a read-only dir, and counts
+// the writes tried.
+type _ReadOnlyFS struct {
+	fs.FileSystem
+	writes int32
+}
+
+func (fsys *_ReadOnlyFS) denied() error {
+	atomic.AddInt32(&fsys.writes, 1)
+	return os.ErrPermission
+}
+
+func (fsys *_ReadOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, fsys.denied()
+	}
+	return fsys.FileSystem.OpenFile(name, flag, perm)
+}
+
+func (fsys *_ReadOnlyFS) MkdirAll(path string, perm os.FileMode) error {
+	if _, err := fsys.Stat(path); err == nil {
+		return nil
+	}
+	return fsys.denied()
+}
+
+func (fsys *_ReadOnlyFS) Remove(name string) error { return fsys.denied() }
+
+func (fsys *_ReadOnlyFS) Rename(oldName, newName string) error { return fsys.denied() }
+
+func (fsys *_ReadOnlyFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fsys.denied()
+}
+
+func TestReadOnlyDir(t *testing.T) {
+	memfs := fs.NewMemFS()
+	path := "memfs"
+	db, err := OpenWithFS(path, memfs, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit54.readonly")
+	n := 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt log left for the next writer is not renamed by a read-only handle.
+	log := path + "/logs/1.log"
+	f, err := memfs.OpenFile(log, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	rofs := &_ReadOnlyFS{FileSystem: memfs}
+	db, err = OpenWithFS(path, rofs, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(2 * n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d messages from read-only dir; got %d, %v", n, len(v), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memfs.Stat(log); err != nil {
+		t.Fatalf("expected log left in place; got %v", err)
+	}
+	if writes := atomic.LoadInt32(&rofs.writes); writes != 0 {
+		t.Fatalf("expected no writes to read-only dir; got %d", writes)
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	// The lock is held by a process that stopped the heartbeat.
+	stale, err := createLockFile(fs.OS, dbPath, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(stale.stopC)
+	stale.wg.Wait()
+
+	if _, err := Open(dbPath); err != errLocked {
+		t.Fatalf("expected error %v; got %v", errLocked, err)
+	}
+	if _, err := Open(dbPath, WithStaleLockTimeout(500*time.Millisecond)); err != errLocked {
+		t.Fatalf("expected error %v before the timeout; got %v", errLocked, err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	// The process of the holder is running, the lock is not taken over.
+	if _, err := Open(dbPath, WithStaleLockTimeout(500*time.Millisecond)); err != errLocked {
+		t.Fatalf("expected error %v while the holder runs; got %v", errLocked, err)
+	}
+
+	// The lock is held for a process that is not running, e.g. on a file system shared by the hosts.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(cmd.Process.Pid))
+	if _, err := stale.f.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dbPath, WithStaleLockTimeout(500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The stale holder leaves the lock file taken over in place on unlock.
+	stale.f.Close()
+	if err := stale.LockFile.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath); err != errLocked {
+		t.Fatalf("expected error %v after the stale holder unlocks; got %v", errLocked, err)
+	}
+
+	// The lock of a live DB is not taken over as the heartbeat is refreshed.
+	time.Sleep(lockHeartbeat + 200*time.Millisecond)
+	if _, err := Open(dbPath, WithStaleLockTimeout(900*time.Millisecond)); err != errLocked {
+		t.Fatalf("expected error %v; got %v", errLocked, err)
+	}
+}
+
+func TestFreeBlocks(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit55.free")
+	var ids [][]byte
+	for i := 0; i < 5; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, bytes.Repeat([]byte("m"), 10*(i+1))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if blocks := db.FreeBlocks(); len(blocks) != 0 {
+		t.Fatalf("expected no free blocks; got %v", blocks)
+	}
+
+	// The entries deleted are not adjacent, so each is reported as a region.
+	var want []FreeBlock
+	for _, i := range []int{1, 3} {
+		e, err := db.internal.reader.readEntry(message.ID(ids[i]).Sequence())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, FreeBlock{Offset: e.msgOffset, Size: e.mSize(db.fileVersion())})
+		if err := db.Delete(ids[i], topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := db.FreeBlocks(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected free blocks %v; got %v", want, got)
+	}
+}
+
+func TestEntrySetTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  string
+		want time.Duration
+		err  error
+	}{
+		{"seconds", "60", time.Minute, nil},
+		{"duration", "1h", time.Hour, nil},
+		{"days", "30d", 30 * 24 * time.Hour, nil},
+		{"weeks", "2w", 14 * 24 * time.Hour, nil},
+		{"empty", "", 0, errTtlInvalid},
+		{"invalid", "30x", 0, errTtlInvalid},
+		{"invalid days", "1.5d", 0, errTtlInvalid},
+		{"zero", "0", 0, errTtlInvalid},
+		{"negative", "-1h", 0, errTtlInvalid},
+		{"too large", "999999999999w", 0, errTtlTooLarge},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewEntry([]byte("unit56.ttl"), []byte("msg"))
+			before := time.Now()
+			err := e.SetTTL(tc.ttl)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v; got %v", tc.err, err)
+			}
+			if err != nil {
+				if e.ExpiresAt != 0 {
+					t.Fatalf("expected no expiry; got %d", e.ExpiresAt)
+				}
+				return
+			}
+			min, max := before.Add(tc.want).Unix(), time.Now().Add(tc.want).Unix()
+			if at := int64(e.ExpiresAt); at < min || at > max {
+				t.Fatalf("expected expiry in [%d, %d]; got %d", min, max, at)
+			}
+		})
+	}
+
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutEntry(NewEntry([]byte("unit56.ttl"), []byte("msg")).WithTTL("30x")); !errors.Is(err, errTtlInvalid) {
+		t.Fatalf("expected error %v; got %v", errTtlInvalid, err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit56.ttl"), []byte("msg")).WithTTL("30d")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoWAL(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath, WithNoWAL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit57.import")
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%4d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if logs := db.internal.mem.LogFiles(); len(logs) != 0 {
+		t.Fatalf("expected nothing written to the WAL; got logs %v", logs)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The imported entries are read from the index and data files once reopened with the WAL.
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d entries; got %d", n, len(items))
+	}
+	seen := make(map[string]bool)
+	for _, item := range items {
+		seen[string(item)] = true
+	}
+	for i := 0; i < n; i++ {
+		if msg := fmt.Sprintf("msg.%4d", i); !seen[msg] {
+			t.Fatalf("expected entry %s", msg)
+		}
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit58.corrupt")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	seq := message.ID(ids[1]).Sequence()
+	e, err := db.internal.reader.readEntry(seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPath := dataFile.Name()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of the value of the record.
+	f, err := os.OpenFile(dataPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := e.msgOffset + int64(idSize) + int64(e.topicSize)
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.GetByID(ids[1], topic); err != ErrCorruptRecord {
+		t.Fatalf("expected error %v; got %v", ErrCorruptRecord, err)
+	}
+	for _, i := range []int{0, 2} {
+		val, err := db.GetByID(ids[i], topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("msg.%2d", i); string(val) != want {
+			t.Fatalf("expected value %s; got %s", want, val)
+		}
+	}
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.CorruptRecords, []uint64{seq}) || report.Consistent() {
+		t.Fatalf("expected corrupt record %d; got %+v", seq, report)
+	}
+}
+
+func TestFileVersion(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoPath := db.internal.info.Name()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	setVersion := func(v uint32) {
+		f, err := os.OpenFile(infoPath, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, v)
+		if _, err := f.WriteAt(b, 7); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A DB of the file format version 1 is read and written without the checksum of the records.
+	setVersion(1)
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit59.version")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	e0, err := db.internal.reader.readEntry(message.ID(ids[0]).Sequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e1, err := db.internal.reader.readEntry(message.ID(ids[1]).Sequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e1.msgOffset != e0.msgOffset+int64(e0.mSize(1)) {
+		t.Fatalf("expected records without checksum; got offsets %d and %d", e0.msgOffset, e1.msgOffset)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := db.fileVersion(); v != 1 {
+		t.Fatalf("expected file format version 1; got %d", v)
+	}
+	for i, id := range ids {
+		val, err := db.GetByID(id, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("msg.%2d", i); string(val) != want {
+			t.Fatalf("expected value %s; got %s", want, val)
+		}
+	}
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() {
+		t.Fatalf("expected consistent DB; got %+v", report)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A DB of a later file format version is not opened.
+	setVersion(version + 1)
+	if _, err := Open(dbPath); err != ErrInvalidDatabase {
+		t.Fatalf("expected ErrInvalidDatabase for a later file format version; got %v", err)
+	}
+}
+
+func TestConcurrentBatches(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := []byte("unit59.shared")
+	own := func(i int) []byte { return []byte(fmt.Sprintf("unit59.own.%d", i)) }
+	const nBatches, n = 8, 50
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < nBatches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+				for j := 0; j < n; j++ {
+					if err := b.Put(shared, []byte(fmt.Sprintf("msg.%d.%d", i, j))); err != nil {
+						return err
+					}
+					if err := b.Put(own(i), []byte(fmt.Sprintf("msg.%d.%d", i, j))); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	verify := func() {
+		items, err := db.Get(NewQuery(shared).WithLimit(2 * nBatches * n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for _, item := range items {
+			seen[string(item)] = true
+		}
+		if len(items) != nBatches*n || len(seen) != nBatches*n {
+			t.Fatalf("expected %d entries of the shared topic; got %d, %d distinct", nBatches*n, len(items), len(seen))
+		}
+		for i := 0; i < nBatches; i++ {
+			items, err := db.Get(NewQuery(own(i)).WithLimit(2 * n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != n {
+				t.Fatalf("expected %d entries of topic %s; got %d", n, own(i), len(items))
+			}
+			for _, item := range items {
+				if !seen[string(item)] {
+					t.Fatalf("expected entry %s of topic %s in the shared topic", item, own(i))
+				}
+			}
+		}
+	}
+	// The entries of the committed batches are visible before they are synced.
+	verify()
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+}
+
+func TestCountQuery(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit60.count")
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if i == 3 {
+			// The older entries are synced so entries are counted from the data file and from memdb.
+			time.Sleep(1100 * time.Millisecond)
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("contract msg.%2d", i))).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := db.GetItems(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	older, newer := items[len(items)-1].InsertedAt, items[0].InsertedAt
+
+	tests := []struct {
+		name string
+		q    func() *Query
+	}{
+		{"all", func() *Query { return NewQuery(topic) }},
+		{"contract", func() *Query { return NewQuery(topic).WithContract(contract) }},
+		{"last", func() *Query { return NewQuery(topic).WithLastDuration(time.Hour) }},
+		{"from", func() *Query { return NewQuery(topic).WithFrom(newer) }},
+		{"to", func() *Query { return NewQuery(topic).WithTo(older) }},
+		{"ascending", func() *Query { return NewQuery(topic).WithAscending().WithFrom(newer) }},
+	}
+	for _, tt := range tests {
+		count, err := db.CountQuery(tt.q())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		v, err := db.Get(tt.q().WithLimit(100))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if count != uint64(len(v)) || count == 0 {
+			t.Fatalf("%s: expected count %d; got %d", tt.name, len(v), count)
+		}
+	}
+	if _, err := db.CountQuery(NewQuery(nil)); err != errTopicEmpty {
+		t.Fatalf("expected error %v; got %v", errTopicEmpty, err)
+	}
+
+	// The entries read from the data file are not cached by the count.
+	db.Close()
+	db, err = Open(dbPath, WithReadCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count, err := db.CountQuery(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Fatalf("expected count 6; got %d", count)
+	}
+	if n := len(db.internal.cache.entries); n != 0 {
+		t.Fatalf("expected no entries cached; got %d", n)
+	}
+}
+
+func TestSharedMemdb(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	if err := os.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	mem, err := memdb.Open(memdb.WithLogFilePath(dbPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	open := func(name string, id uint16) *DB {
+		db, err := Open(filepath.Join(dbPath, name), WithSharedMemdb(mem, id), WithMaxSyncDuration(time.Minute, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	a, b := open("a", 1), open("b", 2)
+	if _, err := Open(filepath.Join(dbPath, "c"), WithSharedMemdb(mem, 1)); err != errMemdbIDInUse {
+		t.Fatalf("expected error %v; got %v", errMemdbIDInUse, err)
+	}
+
+	// The seqs of the DBs are the same so the entries collide unless the keys are namespaced.
+	topic := []byte("unit61.shared")
+	n := 10
+	for i := 0; i < n; i++ {
+		if err := a.Put(topic, []byte(fmt.Sprintf("a.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(topic, []byte(fmt.Sprintf("b.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify := func(db *DB, prefix string) {
+		items, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != n {
+			t.Fatalf("expected %d entries of DB %s; got %d", n, prefix, len(items))
+		}
+		for _, item := range items {
+			if !bytes.HasPrefix(item, []byte(prefix+".")) {
+				t.Fatalf("expected entry of DB %s; got %s", prefix, item)
+			}
+		}
+	}
+	verify(a, "a")
+	verify(b, "b")
+
+	// Syncing a DB frees its own entries and leaves the entries of the other DB cached.
+	time.Sleep(1100 * time.Millisecond)
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := a.internal.mem.Keys(); len(keys) != 0 {
+		t.Fatalf("expected no cached entries of DB a; got %d", len(keys))
+	}
+	if keys := b.internal.mem.Keys(); len(keys) != n {
+		t.Fatalf("expected %d cached entries of DB b; got %d", n, len(keys))
+	}
+	verify(a, "a")
+	verify(b, "b")
+
+	// The backup of a DB sharing the memdb holds the entries not yet synced.
+	var buf bytes.Buffer
+	if err := b.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restorePath := dbPath + "-restore"
+	os.RemoveAll(restorePath)
+	defer os.RemoveAll(restorePath)
+	if err := RestoreBackup(&buf, restorePath); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(restorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(restored, "b")
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The IDs are released on close and the memdb is left open.
+	a, b = open("a", 1), open("b", 2)
+	defer a.Close()
+	defer b.Close()
+	verify(a, "a")
+	verify(b, "b")
+}
+
+func TestDeleteTopicEntry(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit33.test")
+	n := 10
+	var ids [][]byte
+	for i := 0; i < n; i++ {
+		id, err := db.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// The first entry of the topic packs the raw topic.
+	if err := db.Delete(ids[0], topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n-1 {
+		t.Fatalf("expected %d entries after reopen; got %d, %v", n-1, len(v), err)
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	cleanup()
+	defer cleanup()
+	var calls int64
+	fn := func(key uint64) uint64 {
+		atomic.AddInt64(&calls, 1)
+		key ^= key >> 33
+		key *= 0xff51afd7ed558ccd
+		return key ^ key>>33
+	}
+	db, err := Open(dbPath, WithKeyHash(fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit38.test")
+	n := 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d entries; got %d, %v", n, len(v), err)
+	}
+	if atomic.LoadInt64(&calls) == 0 {
+		t.Fatal("expected the keys hashed by the key hash function")
+	}
+}
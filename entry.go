@@ -18,6 +18,8 @@ package unitdb
 
 import (
 	"encoding/binary"
+	"fmt"
+	"math"
 	"strconv"
 	"time"
 	"unsafe"
@@ -36,7 +38,10 @@ type (
 
 		parsed    bool
 		topicHash uint64 // topicHash for recovery from log and not persisted to the DB.
+		prefix    uint64 // prefix of the topic the topic mutex of the entry is locked with.
 		cache     []byte // entry from memdb if it exist.
+		putID     []byte // putID is the ID of the last put, an entry put again without a new ID gets a new ID.
+		ttlErr    error  // ttlErr is the error parsing the TTL set by WithTTL, returned when the entry is put.
 	}
 	// Entry entry is a message entry structure.
 	Entry struct {
@@ -47,6 +52,7 @@ type (
 		ExpiresAt  uint32 // The time expiry of the message.
 		Contract   uint32 // The contract is used to as salt to hash topic parts and also used as prefix in the message ID.
 		Encryption bool
+		MaxCount   uint32 // The maximum number of entries kept for the topic, older entries are deleted on sync.
 	}
 )
 
@@ -61,9 +67,15 @@ func NewEntry(topic, payload []byte) *Entry {
 // WithID sets entry ID.
 func (e *Entry) WithID(id []byte) *Entry {
 	e.ID = id
+	e.entry.putID = nil
 	return e
 }
 
+// Seq returns the seq assigned to the entry by the last put, or zero if the entry is not put.
+func (e *Entry) Seq() uint64 {
+	return e.entry.seq
+}
+
 // WithPayload sets payload to put entry into DB.
 func (e *Entry) WithPayload(payload []byte) *Entry {
 	e.Payload = payload
@@ -76,15 +88,73 @@ func (e *Entry) WithContract(contract uint32) *Entry {
 	return e
 }
 
-// WithTTL sets TTL for message expiry for the entry.
+// WithTTL sets TTL for message expiry for the entry. The TTL is parsed as by SetTTL, an invalid
+// TTL is returned as an error when the entry is put.
 func (e *Entry) WithTTL(ttl string) *Entry {
-	val, err := strconv.ParseInt(ttl, 10, 64)
-	if err == nil {
-		e.ExpiresAt = uint32(time.Now().Add(time.Duration(int(val)) * time.Second).Unix())
+	e.entry.ttlErr = e.SetTTL(ttl)
+	return e
+}
+
+// SetTTL sets TTL for message expiry for the entry. The TTL is a bare integer number of seconds,
+// a number of days or weeks with a "d" or "w" suffix, such as "30d", or a duration accepted by
+// time.ParseDuration, such as "1h". It returns an error if the TTL is invalid or is not positive.
+func (e *Entry) SetTTL(ttl string) error {
+	duration, err := parseTTL(ttl)
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(duration).Unix()
+	if expiresAt > math.MaxUint32 {
+		return errTtlTooLarge
+	}
+	e.ExpiresAt = uint32(expiresAt)
+	return nil
+}
+
+// parseTTL parses the TTL into a duration.
+func parseTTL(ttl string) (time.Duration, error) {
+	if val, err := strconv.ParseInt(ttl, 10, 64); err == nil {
+		return checkTTL(ttl, val, time.Second)
+	}
+	if n := len(ttl); n > 1 {
+		var unit time.Duration
+		switch ttl[n-1] {
+		case 'd':
+			unit = 24 * time.Hour
+		case 'w':
+			unit = 7 * 24 * time.Hour
+		}
+		if unit != 0 {
+			val, err := strconv.ParseInt(ttl[:n-1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %q", errTtlInvalid, ttl)
+			}
+			return checkTTL(ttl, val, unit)
+		}
+	}
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", errTtlInvalid, ttl)
 	}
-	var duration time.Duration
-	duration, _ = time.ParseDuration(ttl)
-	e.ExpiresAt = uint32(time.Now().Add(duration).Unix())
+	return checkTTL(ttl, int64(duration), 1)
+}
+
+// checkTTL returns the TTL of val units, the TTL must be positive and fit in a duration.
+func checkTTL(ttl string, val int64, unit time.Duration) (time.Duration, error) {
+	if val <= 0 {
+		return 0, fmt.Errorf("%w: %q", errTtlInvalid, ttl)
+	}
+	if val > int64(math.MaxInt64/unit) {
+		return 0, errTtlTooLarge
+	}
+	return time.Duration(val) * unit, nil
+}
+
+// WithMaxCount sets the maximum number of entries kept for the topic of the entry. Once entries
+// beyond the limit are synced, the oldest entries of the topic are deleted. The limit is kept in
+// memory and applies to the topic until it is set again.
+func (e *Entry) WithMaxCount(n uint32) *Entry {
+	e.MaxCount = n
 	return e
 }
 
@@ -94,11 +164,11 @@ func (e *Entry) WithEncryption() *Entry {
 	return e
 }
 
+// reset resets the entry to put it again, the ID and the seq of the last put are kept for the caller.
 func (e *Entry) reset() {
-	e.entry.seq = 0
 	e.entry.topicSize = 0
 	e.entry.cache = nil
-	e.ID = nil
+	e.entry.putID = e.ID
 	e.Payload = nil
 }
 
@@ -20,13 +20,35 @@ import (
 	"errors"
 )
 
+// ErrEntryTooLarge is returned when putting an entry with the topic or the payload larger than the DB limits.
+var ErrEntryTooLarge = errors.New("entry is too large")
+
+// ErrInvalidDatabase is returned when opening a DB with a truncated header or a header not written by unitdb.
+var ErrInvalidDatabase = errors.New("database header is invalid")
+
+// ErrReadOnly is returned when writing to a DB opened with WithReadOnly.
+var ErrReadOnly = errors.New("database is read-only")
+
+// ErrMemdbFull is returned when putting an entry once the memdb reaches the memdb size and
+// the memdb full policy does not free space for the entry.
+var ErrMemdbFull = errors.New("memdb is full")
+
+// ErrCorruptRecord is returned when a record read from the data file does not match its checksum.
+var ErrCorruptRecord = errors.New("data record is corrupted")
+
+// ErrCASFailed is returned by PutIf when the latest entry of the topic does not have the expected ID.
+var ErrCASFailed = errors.New("latest entry does not match the expected entry")
+
 var (
 	errTopicEmpty          = errors.New("Topic is empty")
 	errMsgIDEmpty          = errors.New("Message ID is empty")
 	errMsgIDDeleted        = errors.New("Message ID is deleted")
+	errMsgIDInvalid        = errors.New("Message ID is invalid")
+	errMsgIDSeqNotAfter    = errors.New("Message ID sequence is not after the database sequence")
 	errMsgIDDoesNotExist   = errors.New("Message ID does not exist in database")
 	errMsgIDPrefixMismatch = errors.New("Message ID does not match topic or Contract")
 	errTtlTooLarge         = errors.New("TTL is too large")
+	errTtlInvalid          = errors.New("TTL is invalid")
 	errTopicTooLarge       = errors.New("Topic is too large")
 	errMsgExpired          = errors.New("Message has expired")
 	errValueEmpty          = errors.New("Payload is empty")
@@ -36,10 +58,21 @@ var (
 	errImmutable           = errors.New("database is immutable")
 	errFull                = errors.New("database is full")
 	errCorrupted           = errors.New("database is corrupted")
+	errWindowVersion       = errors.New("window file version is not supported")
 	errLocked              = errors.New("database is locked")
 	errClosed              = errors.New("database is closed")
 	errBatchSeqComplete    = errors.New("batch seq is complete")
 	errWriteConflict       = errors.New("batch write conflict")
+	errCursorInvalid       = errors.New("query cursor is invalid")
+	errQueryConflict       = errors.New("query options are contradictory")
+	errFilterRateInvalid   = errors.New("filter false positive rate is invalid")
+	errPoolSizeInvalid     = errors.New("WAL buffer pool size is invalid")
+	errThresholdInvalid    = errors.New("compaction threshold is invalid")
+	errExpiryInvalid       = errors.New("expiry interval or batch size is invalid")
+	errTopTopicsInvalid    = errors.New("topic rate window or top topics is invalid")
+	errCompactTimeout      = errors.New("compaction timed out")
+	errTopicIndexDisabled  = errors.New("sorted topics are not enabled")
+	errMemdbIDInUse        = errors.New("memdb ID is in use by another DB")
 	errBadRequest          = errors.New("The request was invalid or cannot be otherwise served")
 	errForbidden           = errors.New("The request is understood, but it has been refused or access is not allowed")
 )
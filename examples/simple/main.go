@@ -57,7 +57,10 @@ func main() {
 	db.Put(topic, msg)
 
 	// Delete message
-	messageId := db.NewID()
+	messageId, err := db.NewID()
+	if err != nil {
+		log.Fatal(err)
+	}
 	entry := unitdb.NewEntry([]byte("teams.alpha.ch1.r1"), []byte("msg for team alpha channel1 recipient1")).WithID(messageId)
 	db.PutEntry(entry)
 
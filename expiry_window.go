@@ -82,6 +82,7 @@ func newExpiryWindowBucket(bgKeyExp bool, expDurType time.Duration, maxExpDur in
 	return ex
 }
 
+// getExpiredEntries returns up to maxResults expired entries and removes them from the expiry windows.
 func (wb *_ExpiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEntry {
 	if !wb.backgroundKeyExpiry {
 		return nil
@@ -93,33 +94,38 @@ func (wb *_ExpiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEnt
 		return expiredEntries
 	}
 
-	for i := 0; i < wb.maxExpDurations; i++ {
+	for _, ws := range wb.expiryWindows.expiry {
+		if len(expiredEntries) >= maxResults {
+			break
+		}
 		// get windows shard.
-		ws := wb.expiryWindows.expiry[i]
 		ws.mu.Lock()
-		defer ws.mu.Unlock()
 		windowTimes := make([]int64, 0, len(ws.windows))
 		for windowTime := range ws.windows {
 			windowTimes = append(windowTimes, windowTime)
 		}
 		sort.Slice(windowTimes[:], func(i, j int) bool { return windowTimes[i] < windowTimes[j] })
 		for i := 0; i < len(windowTimes); i++ {
-			if windowTimes[i] > int64(startTime) || len(expiredEntries) > maxResults {
+			if windowTimes[i] > int64(startTime) || len(expiredEntries) >= maxResults {
 				break
 			}
 			windowEntries := ws.windows[windowTimes[i]]
-			expiredEntriesCount := 0
+			var pending _ExpiryWindowEntries
 			for i := range windowEntries {
 				entry := windowEntries[i]
-				if entry.expiryTime() < startTime {
+				if entry.expiryTime() < startTime && len(expiredEntries) < maxResults {
 					expiredEntries = append(expiredEntries, entry)
-					expiredEntriesCount++
+					continue
 				}
+				pending = append(pending, entry)
 			}
-			if expiredEntriesCount == len(windowEntries) {
+			if len(pending) == 0 {
 				delete(ws.windows, windowTimes[i])
+			} else {
+				ws.windows[windowTimes[i]] = pending
 			}
 		}
+		ws.mu.Unlock()
 	}
 	atomic.StoreInt64(&wb.earliestExpiryHash, 0)
 	return expiredEntries
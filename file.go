@@ -23,6 +23,8 @@ import (
 	"os"
 	"path"
 	"sync"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 // _FileType represent a file type.
@@ -36,8 +38,9 @@ const (
 	typeData
 	typeLease
 	typeFilter
+	typeTopic
 
-	typeAll = typeInfo | typeTimeWindow | typeIndex | typeData | typeLease | typeFilter
+	typeAll = typeInfo | typeTimeWindow | typeIndex | typeData | typeLease | typeFilter | typeTopic
 
 	prefix   = "unitdb"
 	indexDir = "index"
@@ -49,18 +52,17 @@ const (
 type _FileDesc struct {
 	fileType _FileType
 	num      int16
-	fd       uintptr
 }
 
-func filePath(dirName string, fd _FileDesc) string {
+func filePath(fsys fs.FileSystem, dirName string, fd _FileDesc) string {
 	name := fmt.Sprintf("%#x-%d", fd.fileType, fd.num)
-	if err := ensureDir(path.Join(dirName, indexDir)); err != nil {
+	if err := ensureDir(fsys, path.Join(dirName, indexDir)); err != nil {
 		return name
 	}
-	if err := ensureDir(path.Join(dirName, dataDir)); err != nil {
+	if err := ensureDir(fsys, path.Join(dirName, dataDir)); err != nil {
 		return name
 	}
-	if err := ensureDir(path.Join(dirName, winDir)); err != nil {
+	if err := ensureDir(fsys, path.Join(dirName, winDir)); err != nil {
 		return name
 	}
 	switch fd.fileType {
@@ -82,19 +84,17 @@ func filePath(dirName string, fd _FileDesc) string {
 	case typeFilter:
 		suffix := fmt.Sprintf("%s.filter", prefix)
 		return path.Join(dirName, suffix)
+	case typeTopic:
+		suffix := fmt.Sprintf("%s.topics", prefix)
+		return path.Join(dirName, suffix)
 	default:
 		return fmt.Sprintf("%#x-%d", fd.fileType, fd.num)
 	}
 }
 
-// _LockFile represents a lock file.
-type _LockFile interface {
-	unlock() error
-}
-
 type (
 	_File struct {
-		*os.File
+		fs.File
 		fd   _FileDesc
 		size int64
 	}
@@ -107,34 +107,25 @@ type (
 	}
 )
 
-// createLockFile to create lock file.
-func createLockFile(dirName string) (_LockFile, error) {
-	if err := ensureDir(dirName); err != nil {
-		return nil, err
-	}
-	suffix := fmt.Sprintf("%s.lock", prefix)
-
-	return newLockFile(path.Join(dirName, suffix))
-}
-
-func newFile(path string, nFiles int16, fd _FileDesc) (_FileSet, error) {
+func newFile(fsys fs.FileSystem, path string, nFiles int16, fd _FileDesc, readOnly bool) (_FileSet, error) {
 	if nFiles == 0 {
 		return _FileSet{}, errors.New("no new file")
 	}
 	fileFlag := os.O_CREATE | os.O_RDWR
+	if readOnly {
+		fileFlag = os.O_RDONLY
+	}
 	fileMode := os.FileMode(0666)
 	f := _File{}
 	fs := _FileSet{mu: new(sync.RWMutex), fileMap: make(map[int16]_File, nFiles)}
 	for i := int16(0); i < nFiles; i++ {
 		fd.num = i
-		path := filePath(path, fd)
-		fi, err := os.OpenFile(path, fileFlag, fileMode)
+		path := filePath(fsys, path, fd)
+		fi, err := fsys.OpenFile(path, fileFlag, fileMode)
 		if err != nil {
 			return fs, err
 		}
 		f.File = fi
-
-		fd.fd = fi.Fd()
 		f.fd = fd
 		stat, err := fi.Stat()
 		if err != nil {
@@ -242,12 +233,50 @@ func (fs *_FileSet) size() (int64, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 	size := int64(0)
-	for _, f := range fs.fileMap {
-		size += f.currSize()
+	for _, files := range fs.list {
+		for _, f := range files.fileMap {
+			stat, err := f.Stat()
+			if err != nil {
+				return 0, err
+			}
+			size += stat.Size()
+		}
 	}
 	return size, nil
 }
 
+// replace renames the file at the path over the file of the given type and reopens it.
+func (fs *_FileSet) replace(fsys fs.FileSystem, fd _FileDesc, path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, fileset := range fs.list {
+		if fileset.fd.fileType != fd.fileType || fileset.fd.num != fd.num {
+			continue
+		}
+		f := fileset._File
+		name := f.Name()
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := fsys.Rename(path, name); err != nil {
+			return err
+		}
+		fi, err := fsys.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(0666))
+		if err != nil {
+			return err
+		}
+		stat, err := fi.Stat()
+		if err != nil {
+			return err
+		}
+		f.File = fi
+		f.size = stat.Size()
+		fileset.fileMap[fd.num] = *f
+		return nil
+	}
+	return errors.New("file not found")
+}
+
 func (fs *_FileSet) close() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -261,11 +290,6 @@ func (fs *_FileSet) close() error {
 	return nil
 }
 
-func ensureDir(dirName string) error {
-	err := os.Mkdir(dirName, 0777)
-	if err == nil || os.IsExist(err) {
-		return nil
-	} else {
-		return err
-	}
+func ensureDir(fsys fs.FileSystem, dirName string) error {
+	return fsys.MkdirAll(dirName, 0777)
 }
@@ -17,71 +17,122 @@
 package unitdb
 
 import (
+	"encoding/binary"
+	"sync/atomic"
+
 	"github.com/unit-io/unitdb/filter"
-	"github.com/unit-io/unitdb/memdb"
+)
+
+const (
+	// filterHeaderSize is size of filter parameters and the hash version stored before the filter block.
+	filterHeaderSize = 24
+	// filterVersion is the version of the hash the filter block is generated with. A filter block
+	// of another version is rebuilt from the index blocks.
+	filterVersion = 1
 )
 
 // Filter filter is bloom filter generator.
 type Filter struct {
 	file        _FileSet
 	filterBlock *filter.Generator
-	blockCache  *memdb.DB
-	cacheID     uint64
+	bits        uint64
+	hashes      uint64
+	dirty       int32
+}
+
+// newFilter loads the filter from the filter file. A new filter is sized by the filter options
+// and its parameters are persisted with the filter block, so the options are ignored on reopen.
+// It reports whether the filter is to be rebuilt, as a filter block written by earlier versions
+// hashes the entries with an earlier hash and is replaced by a new filter block.
+func newFilter(file _FileSet, opts *_Options) (Filter, bool, error) {
+	f := Filter{file: file}
+	size := file.currSize()
+	if size >= filterHeaderSize {
+		raw := make([]byte, size)
+		if _, err := file.ReadAt(raw, 0); err != nil {
+			return f, false, err
+		}
+		f.bits = binary.LittleEndian.Uint64(raw[:8])
+		f.hashes = binary.LittleEndian.Uint64(raw[8:16])
+		version := binary.LittleEndian.Uint64(raw[16:24])
+		if version == filterVersion && size == filterHeaderSize+filter.Size(f.bits, f.hashes) {
+			f.filterBlock = filter.NewGeneratorFromBytes(raw[filterHeaderSize:], f.bits, f.hashes)
+			return f, false, nil
+		}
+	}
+	f.bits, f.hashes = filter.DefaultParams()
+	if opts.filterFalsePositiveRate > 0 {
+		f.bits, f.hashes = filter.Params(opts.filterEntries, opts.filterFalsePositiveRate)
+	}
+	f.filterBlock = filter.NewGenerator(f.bits, f.hashes)
+	if opts.flags.readOnly {
+		return f, size != 0, nil
+	}
+	if size != 0 {
+		if err := file.truncate(0); err != nil {
+			return f, false, err
+		}
+	}
+	return f, size != 0, f.writeFilterBlock()
+}
+
+// rebuildFilter appends the entries from the index blocks to the filter.
+func (db *DB) rebuildFilter() error {
+	r := _BlockReader{indexFile: db.internal.reader.indexFile}
+	size := r.indexFile.currSize()
+	for off := int64(0); off+int64(blockSize) <= size; off += int64(blockSize) {
+		r.offset = off
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(b.entryIdx); i++ {
+			if e := b.entries[i]; e.seq != 0 && !e.isDeleted() {
+				db.internal.filter.Append(e.seq)
+			}
+		}
+	}
+	// A read-only DB keeps the rebuilt filter in memory.
+	if db.opts.flags.readOnly {
+		return nil
+	}
+	return db.internal.filter.sync()
 }
 
 // Append appends an entry to bloom filter.
 func (f *Filter) Append(h uint64) {
 	f.filterBlock.Append(h)
+	atomic.StoreInt32(&f.dirty, 1)
 }
 
 // Test tests entry in bloom filter. It returns false if entry definitely does not exist or true may be entry exist in DB.
 func (f *Filter) Test(h uint64) bool {
-	/// Test filter block for presence.
-	fltr, _ := f.getFilterBlock(true)
-	if fltr != nil && !fltr.Test(h) {
-		return false
-	}
-	return true
+	return f.filterBlock.Test(h)
 }
 
-// Close finalizes writing filter to file.
-func (f *Filter) close() error {
-	f.writeFilterBlock()
-	if err := f.file.Close(); err != nil {
+// sync writes the filter block if entries are appended since the last write.
+func (f *Filter) sync() error {
+	if !atomic.CompareAndSwapInt32(&f.dirty, 1, 0) {
+		return nil
+	}
+	if err := f.writeFilterBlock(); err != nil {
+		atomic.StoreInt32(&f.dirty, 1)
 		return err
 	}
 	return nil
 }
 
-// writeFilterBlock writes the filter block.
+// writeFilterBlock writes the filter parameters, the hash version and the filter block.
 func (f *Filter) writeFilterBlock() error {
 	d := f.filterBlock.Finish()
-	if _, err := f.file.WriteAt(d, 0); err != nil {
+	buf := make([]byte, filterHeaderSize+len(d))
+	binary.LittleEndian.PutUint64(buf[:8], f.bits)
+	binary.LittleEndian.PutUint64(buf[8:16], f.hashes)
+	binary.LittleEndian.PutUint64(buf[16:24], filterVersion)
+	copy(buf[filterHeaderSize:], d)
+	if _, err := f.file.WriteAt(buf, 0); err != nil {
 		return err
 	}
 
 	return nil
 }
-
-func (f *Filter) getFilterBlock(fillCache bool) (*filter.Block, error) {
-	if f.file.currSize() <= 0 {
-		return nil, nil
-	}
-	var cacheKey uint64
-	if f.blockCache != nil {
-		cacheKey = f.cacheID ^ uint64(f.file.currSize())
-		if data, err := f.blockCache.Get(cacheKey); data != nil {
-			return filter.NewFilterBlock(data), err
-		}
-	}
-
-	raw := make([]byte, f.file.currSize())
-	if _, err := f.file.ReadAt(raw, 0); err != nil {
-		return nil, err
-	}
-
-	if f.blockCache != nil && fillCache {
-		f.blockCache.Put(cacheKey, raw)
-	}
-	return filter.NewFilterBlock(raw), nil
-}
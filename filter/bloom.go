@@ -72,11 +72,21 @@ func (b *Filter) hash(h uint64) []uint64 {
 	n := len(b.keys)
 	hashes := make([]uint64, n)
 	for i := 0; i < n; i++ {
-		hashes[i] = h ^ b.keys[i]
+		hashes[i] = mix(h ^ b.keys[i])
 	}
 	return hashes
 }
 
+// mix is the murmur3 64 bit finalizer. It spreads sequential keys across the filter bits.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
 // Add adds `key` to the filter.
 func (b *Filter) Add(h uint64) {
 	b.lock.Lock()
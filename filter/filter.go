@@ -1,5 +1,7 @@
 package filter
 
+import "math"
+
 const (
 	bloomHashes uint64 = 7
 	bloomBits   uint64 = 160000
@@ -10,16 +12,56 @@ type Generator struct {
 	filter *Filter
 }
 
+// DefaultParams returns the number of bits and hashes used by NewFilterGenerator.
+func DefaultParams() (m, k uint64) {
+	return bloomBits, bloomHashes
+}
+
+// Params returns the number of bits and hashes to size a filter
+// for n entries with false positive rate p.
+func Params(n uint64, p float64) (m, k uint64) {
+	m = uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k = uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if m < MMin {
+		m = MMin
+	}
+	if k < KMin {
+		k = KMin
+	}
+	return m, k
+}
+
+// Size returns the size of the filter block contents for m bits and k hashes.
+func Size(m, k uint64) int64 {
+	return int64(Uint64Bytes * (k + (m+63)/64))
+}
+
 // NewFilterGenerator returns a new filter generator.
 func NewFilterGenerator() *Generator {
 	return &Generator{filter: newFilter(bloomBits, bloomHashes)}
 }
 
+// NewGenerator returns a new filter generator with m bits and k hashes.
+func NewGenerator(m, k uint64) *Generator {
+	return &Generator{filter: newFilter(m, k)}
+}
+
+// NewGeneratorFromBytes returns a filter generator from filter block contents
+// so more keys are added to an existing filter.
+func NewGeneratorFromBytes(b []byte, m, k uint64) *Generator {
+	return &Generator{filter: newFilterFromBytes(b, m, k)}
+}
+
 // Append adds a key to the filter block.
 func (b *Generator) Append(h uint64) {
 	b.filter.Add(h)
 }
 
+// Test is used to test for key presence in the filter.
+func (b *Generator) Test(h uint64) bool {
+	return b.filter.Test(h)
+}
+
 // Finish finishes building the filter block and returns a slice to its contents.
 func (b *Generator) Finish() []byte {
 	return b.filter.Bytes()
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fs provides the file system the DB files are stored in. The DB runs on
+// the OS file system by default, an in-memory or a remote file system is injected
+// into the DB by implementing FileSystem.
+package fs
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+type (
+	// File is a file opened on a FileSystem.
+	File interface {
+		io.Reader
+		io.ReaderAt
+		io.Writer
+		io.WriterAt
+		io.Seeker
+		io.Closer
+		Name() string
+		Stat() (os.FileInfo, error)
+		Sync() error
+		Truncate(size int64) error
+	}
+
+	// LockFile is a lock held on a FileSystem.
+	LockFile interface {
+		Unlock() error
+	}
+
+	// FileSystem stores the DB files. The errors follow the os package so os.IsNotExist
+	// and os.IsExist can be used on the errors returned.
+	FileSystem interface {
+		// OpenFile opens the named file with the flag and the mode the same as os.OpenFile.
+		OpenFile(name string, flag int, perm os.FileMode) (File, error)
+		// Stat returns the FileInfo of the named file.
+		Stat(name string) (os.FileInfo, error)
+		// ReadDir returns the FileInfo of the files in the directory sorted by name.
+		ReadDir(dirName string) ([]os.FileInfo, error)
+		// MkdirAll creates the directory along with the parents if they do not exist.
+		MkdirAll(path string, perm os.FileMode) error
+		// Remove removes the named file.
+		Remove(name string) error
+		// Rename renames the file, replacing the new file if it exists.
+		Rename(oldName, newName string) error
+		// Chtimes changes the access and modification times of the named file.
+		Chtimes(name string, atime time.Time, mtime time.Time) error
+		// SyncDir flushes the directory so the files created or renamed in it are found after a crash.
+		SyncDir(dirName string) error
+		// CreateLockFile locks the named file. A shared lock is held along with the other
+		// shared locks, it returns os.ErrExist if the file is locked otherwise. It reports
+		// whether the lock file is freshly created rather than left in place by an earlier
+		// holder, e.g. a process that crashed or the shared readers.
+		CreateLockFile(name string, shared bool) (LockFile, bool, error)
+	}
+)
+
+// OS is the FileSystem of the operating system.
+var OS FileSystem = _OSFS{}
+
+type _OSFS struct{}
+
+func (_OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Return a nil interface rather than a nil *os.File.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (_OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (_OSFS) ReadDir(dirName string) ([]os.FileInfo, error) {
+	d, err := os.Open(dirName)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	files, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sortByName(files)
+	return files, nil
+}
+
+func (_OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (_OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (_OSFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (_OSFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (_OSFS) SyncDir(dirName string) error {
+	d, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (_OSFS) CreateLockFile(name string, shared bool) (LockFile, bool, error) {
+	return newLockFile(name, shared)
+}
@@ -0,0 +1,90 @@
+// +build !windows
+
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+type _UnixFileLock struct {
+	f      *os.File
+	name   string
+	shared bool
+}
+
+// Unlock removes the lock from file. A shared lock file is left in place for the other readers,
+// and the lock file is left in place if it is taken over, i.e. it is no longer the file locked.
+func (fl *_UnixFileLock) Unlock() error {
+	if !fl.shared && sameFile(fl.f, fl.name) {
+		if err := os.Remove(fl.name); err != nil {
+			return err
+		}
+	}
+	return fl.f.Close()
+}
+
+// sameFile reports whether the named file is the open file.
+func sameFile(f *os.File, name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	lfi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, lfi)
+}
+
+func lockFile(f *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			err = os.ErrExist
+		}
+		return err
+	}
+	return nil
+}
+
+func newLockFile(name string, shared bool) (LockFile, bool, error) {
+	_, err := os.Stat(name)
+	fresh := os.IsNotExist(err)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if os.IsPermission(err) && shared {
+		// The lock file of a read-only dir is locked read-only, or the dir is locked if there is
+		// no lock file as a writer cannot create the lock file either.
+		if f, err = os.Open(name); os.IsNotExist(err) {
+			f, err = os.Open(filepath.Dir(name))
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := lockFile(f, shared); err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	return &_UnixFileLock{f, name, shared}, fresh, nil
+}
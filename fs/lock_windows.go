@@ -16,7 +16,7 @@
  * limitations under the License.
  */
 
-package unitdb
+package fs
 
 import (
 	"os"
@@ -32,19 +32,39 @@ var (
 const (
 	errorLockViolation    = 0x21
 	lockfileExclusiveLock = 3
+	lockfileSharedLock    = 1
 )
 
 type _WindowsFileLock struct {
-	fd   syscall.Handle
-	name string
+	fd     syscall.Handle
+	name   string
+	shared bool
 }
 
-// unlock removes the lock from file.
-func (fl *_WindowsFileLock) unlock() error {
-	if err := os.Remove(fl.name); err != nil {
-		return err
+// Unlock removes the lock from file. A shared lock file is left in place for the other readers,
+// and the lock file is left in place if it is taken over, i.e. it is no longer the file locked.
+func (fl *_WindowsFileLock) Unlock() error {
+	f := os.NewFile(uintptr(fl.fd), fl.name)
+	if !fl.shared && sameFile(f, fl.name) {
+		if err := os.Remove(fl.name); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// sameFile reports whether the named file is the open file.
+func sameFile(f *os.File, name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	lfi, err := f.Stat()
+	if err != nil {
+		return false
 	}
-	return syscall.Close(fl.fd)
+	return os.SameFile(fi, lfi)
 }
 
 func lockFile(h syscall.Handle, flags, reserved, locklow, lockhigh uint32, ol *syscall.Overlapped) error {
@@ -55,20 +75,23 @@ func lockFile(h syscall.Handle, flags, reserved, locklow, lockhigh uint32, ol *s
 	return nil
 }
 
-func newLockFile(name string) (_LockFile, error) {
+func newLockFile(name string, shared bool) (LockFile, bool, error) {
 	path, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	_, err = os.Stat(name)
+	fresh := os.IsNotExist(err)
+	// The lock file is opened rather than truncated so the heartbeat of the holder is kept.
 	fd, err := syscall.CreateFile(path,
 		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
 		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
 		nil,
-		syscall.CREATE_ALWAYS,
+		syscall.OPEN_ALWAYS,
 		syscall.FILE_ATTRIBUTE_NORMAL,
 		0)
 	if err != nil {
-		return nil, os.ErrExist
+		return nil, false, os.ErrExist
 	}
 	defer func() {
 		if err != nil {
@@ -76,9 +99,13 @@ func newLockFile(name string) (_LockFile, error) {
 		}
 	}()
 	var ol syscall.Overlapped
-	err = lockFile(fd, lockfileExclusiveLock, 0, 1, 0, &ol)
+	flags := uint32(lockfileExclusiveLock)
+	if shared {
+		flags = lockfileSharedLock
+	}
+	err = lockFile(fd, flags, 0, 1, 0, &ol)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	return &_WindowsFileLock{fd, name}, nil
+	return &_WindowsFileLock{fd, name, shared}, fresh, nil
 }
@@ -0,0 +1,410 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errDirNotEmpty = errors.New("directory not empty")
+
+type (
+	_MemFS struct {
+		mu    sync.Mutex
+		nodes map[string]*_MemNode
+	}
+
+	_MemNode struct {
+		mu      sync.RWMutex
+		name    string
+		data    []byte
+		mode    os.FileMode
+		modTime time.Time
+		// locks is the number of shared locks held on the file, -1 if the lock is exclusive.
+		// The lock is held on the file rather than the name, so a removed lock file is unlocked.
+		locks int
+	}
+
+	_MemFile struct {
+		fs     *_MemFS
+		node   *_MemNode
+		name   string
+		flag   int
+		offset int64
+		closed bool
+	}
+
+	_MemFileInfo struct {
+		name    string
+		size    int64
+		mode    os.FileMode
+		modTime time.Time
+	}
+
+	_MemLock struct {
+		fs     *_MemFS
+		node   *_MemNode
+		name   string
+		shared bool
+	}
+)
+
+// NewMemFS returns a FileSystem holding the files in memory. The files are lost once the
+// FileSystem is released, so it is used to run a DB without a disk, e.g. in the tests.
+func NewMemFS() FileSystem {
+	return &_MemFS{nodes: make(map[string]*_MemNode)}
+}
+
+func (fs *_MemFS) mkdirAll(key string, perm os.FileMode) error {
+	for dir := key; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if n, ok := fs.nodes[dir]; ok {
+			if !n.mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+			}
+			break
+		}
+		fs.nodes[dir] = &_MemNode{name: path.Base(dir), mode: os.ModeDir | perm, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (fs *_MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := path.Clean(name)
+	n, ok := fs.nodes[key]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if err := fs.mkdirAll(path.Dir(key), 0777); err != nil {
+			return nil, err
+		}
+		n = &_MemNode{name: path.Base(key), mode: perm, modTime: time.Now()}
+		fs.nodes[key] = n
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case n.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	if flag&os.O_TRUNC != 0 {
+		n.mu.Lock()
+		n.data = n.data[:0]
+		n.modTime = time.Now()
+		n.mu.Unlock()
+	}
+	return &_MemFile{fs: fs, node: n, name: name, flag: flag}, nil
+}
+
+func (fs *_MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[path.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return n.stat(), nil
+}
+
+func (fs *_MemFS) ReadDir(dirName string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := path.Clean(dirName)
+	if n, ok := fs.nodes[key]; !ok || !n.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dirName, Err: os.ErrNotExist}
+	}
+	var files []os.FileInfo
+	for k, n := range fs.nodes {
+		if k != key && path.Dir(k) == key {
+			files = append(files, n.stat())
+		}
+	}
+	sortByName(files)
+	return files, nil
+}
+
+func (fs *_MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mkdirAll(strings.TrimSuffix(path, "/"), perm)
+}
+
+func (fs *_MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := path.Clean(name)
+	n, ok := fs.nodes[key]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		for k := range fs.nodes {
+			if k != key && path.Dir(k) == key {
+				return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+			}
+		}
+	}
+	delete(fs.nodes, key)
+	return nil
+}
+
+func (fs *_MemFS) Rename(oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldKey, newKey := path.Clean(oldName), path.Clean(newName)
+	n, ok := fs.nodes[oldKey]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if err := fs.mkdirAll(path.Dir(newKey), 0777); err != nil {
+		return err
+	}
+	delete(fs.nodes, oldKey)
+	n.name = path.Base(newKey)
+	fs.nodes[newKey] = n
+	if n.mode.IsDir() {
+		// Move the files in the directory along with it.
+		for k, child := range fs.nodes {
+			if strings.HasPrefix(k, oldKey+"/") {
+				delete(fs.nodes, k)
+				fs.nodes[newKey+k[len(oldKey):]] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *_MemFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[path.Clean(name)]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	n.mu.Lock()
+	n.modTime = mtime
+	n.mu.Unlock()
+	return nil
+}
+
+// SyncDir is a no-op as the files in memory are not lost on a crash of the DB.
+func (fs *_MemFS) SyncDir(dirName string) error {
+	if _, err := fs.Stat(dirName); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fs *_MemFS) CreateLockFile(name string, shared bool) (LockFile, bool, error) {
+	_, err := fs.Stat(name)
+	fresh := os.IsNotExist(err)
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, false, err
+	}
+	n := f.(*_MemFile).node
+	f.Close()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.locks < 0 || (n.locks > 0 && !shared) {
+		return nil, false, os.ErrExist
+	}
+	if shared {
+		n.locks++
+	} else {
+		n.locks = -1
+	}
+	return &_MemLock{fs: fs, node: n, name: path.Clean(name), shared: shared}, fresh, nil
+}
+
+// Unlock removes the lock from file. A shared lock file is left in place for the other readers.
+func (l *_MemLock) Unlock() error {
+	l.node.mu.Lock()
+	if l.shared {
+		l.node.locks--
+	} else {
+		l.node.locks = 0
+	}
+	l.node.mu.Unlock()
+	if l.shared {
+		return nil
+	}
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	// The lock file is left in place if it is taken over.
+	if l.fs.nodes[l.name] == l.node {
+		delete(l.fs.nodes, l.name)
+	}
+	return nil
+}
+
+func (n *_MemNode) stat() os.FileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return &_MemFileInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+func (f *_MemFile) check(write bool) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *_MemFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *_MemFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *_MemFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.resize(end)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *_MemFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.node.mu.RLock()
+		f.offset = int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *_MemFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.node.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("invalid argument")}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *_MemFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *_MemFile) Name() string {
+	return f.name
+}
+
+func (f *_MemFile) Stat() (os.FileInfo, error) {
+	if err := f.check(false); err != nil {
+		return nil, err
+	}
+	return f.node.stat(), nil
+}
+
+func (f *_MemFile) Sync() error {
+	return f.check(false)
+}
+
+func (f *_MemFile) Truncate(size int64) error {
+	if err := f.check(true); err != nil {
+		return err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	f.node.resize(size)
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (n *_MemNode) resize(size int64) {
+	if size <= int64(cap(n.data)) {
+		old := len(n.data)
+		n.data = n.data[:size]
+		// Zero the bytes kept in the capacity from a previous truncate.
+		for i := old; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, n.data)
+	n.data = data
+}
+
+func (fi *_MemFileInfo) Name() string       { return fi.name }
+func (fi *_MemFileInfo) Size() int64        { return fi.size }
+func (fi *_MemFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *_MemFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *_MemFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *_MemFileInfo) Sys() interface{}   { return nil }
+
+func sortByName(files []os.FileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+}
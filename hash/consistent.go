@@ -21,8 +21,15 @@ type Consistent struct {
 	R []uint16
 	// N is the current length of W
 	N uint16
+
+	// hash is the hash function of keys, keys are used as is if hash is nil.
+	hash KeyHash
 }
 
+// KeyHash is a signature of a hash function of the keys assigned to the blocks.
+// The hash function must be deterministic.
+type KeyHash func(key uint64) uint64
+
 // InitConsistent a new anchor with a given capacity and initial size.
 //
 // 	INITANCHOR(a, w)
@@ -50,6 +57,27 @@ func InitConsistent(blocks, used int) *Consistent {
 	return c
 }
 
+// InitConsistentWithHash a new anchor with a given capacity and initial size, the keys are
+// hashed by fn before they are assigned to the blocks. It panics if fn is not deterministic.
+func InitConsistentWithHash(blocks, used int, fn KeyHash) *Consistent {
+	for _, key := range []uint64{0, 1, 1 << 32, 1<<64 - 1} {
+		if fn(key) != fn(key) {
+			panic("hash: key hash function is not deterministic")
+		}
+	}
+	c := InitConsistent(blocks, used)
+	c.hash = fn
+	return c
+}
+
+// keyHash returns the hash of the key.
+func (c *Consistent) keyHash(key uint64) uint64 {
+	if c.hash == nil {
+		return key
+	}
+	return c.hash(key)
+}
+
 // FindBlock find the blocks which a hash-key is assigned to.
 //
 // If the path for a given key contains any non-working blocks, the path (and in turn,
@@ -68,7 +96,7 @@ func InitConsistent(blocks, used int) *Consistent {
 // 	return b
 func (c *Consistent) FindBlock(key uint64) uint16 {
 	A, K := c.A, c.K
-	ha, hb, hc, hd := fleaInit(key)
+	ha, hb, hc, hd := fleaInit(c.keyHash(key))
 	b := uint16(FastMod(uint64(hd), uint64(len(A))))
 	for A[b] > 0 {
 		ha, hb, hc, hd = fleaRound(ha, hb, hc, hd)
@@ -88,7 +116,7 @@ func (c *Consistent) FindPreviousBlock(key uint64) uint16 {
 	A[cb] = N
 	K[cb] = W[N]
 
-	ha, hb, hc, hd := fleaInit(key)
+	ha, hb, hc, hd := fleaInit(c.keyHash(key))
 	b := uint16(FastMod(uint64(hd), uint64(len(A))))
 	for A[b] > 0 {
 		ha, hb, hc, hd = fleaRound(ha, hb, hc, hd)
@@ -129,7 +157,7 @@ func (c *Consistent) FindPreviousBlock(key uint64) uint16 {
 // 	return P
 func (c *Consistent) GetPath(key uint64, pathBuffer []uint16) []uint16 {
 	A, K := c.A, c.K
-	ha, hb, hc, hd := fleaInit(key)
+	ha, hb, hc, hd := fleaInit(c.keyHash(key))
 	b := uint16(FastMod(uint64(hd), uint64(len(A))))
 	pathBuffer = append(pathBuffer, b)
 	for A[b] > 0 {
@@ -293,3 +293,46 @@ func TestDistributionExtended(t *testing.T) {
 	}
 	t.Logf("%#+v\n", counts)
 }
+
+func TestConsistentWithHash(t *testing.T) {
+	const blocks = 8
+	fn := func(key uint64) uint64 {
+		key ^= key >> 33
+		key *= 0xff51afd7ed558ccd
+		key ^= key >> 33
+		return key
+	}
+	a, b := InitConsistentWithHash(blocks, blocks, fn), InitConsistentWithHash(blocks, blocks, fn)
+	counts := make([]int, blocks)
+	for i := uint64(0); i < 1e5; i++ {
+		block := a.FindBlock(i)
+		if block != b.FindBlock(i) {
+			t.Fatalf("expected key %d assigned to the same block", i)
+		}
+		counts[block]++
+	}
+	for block, n := range counts {
+		if n == 0 {
+			t.Fatalf("expected keys assigned to block %d; counts = %v", block, counts)
+		}
+	}
+
+	// All keys are assigned to one block if the hash of all keys is the same.
+	c := InitConsistentWithHash(blocks, blocks, func(key uint64) uint64 { return 1 })
+	for i := uint64(0); i < 100; i++ {
+		if c.FindBlock(i) != c.FindBlock(0) {
+			t.Fatal("expected the key hash to assign the keys to the blocks")
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for a key hash that is not deterministic")
+		}
+	}()
+	var n uint64
+	InitConsistentWithHash(blocks, blocks, func(key uint64) uint64 {
+		n++
+		return key + n
+	})
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+type (
+	// Health is the health of the DB write path.
+	Health struct {
+		Healthy bool `json:"healthy"`
+		// Syncing is set while a sync of the write ahead log to the DB files is in progress.
+		Syncing   bool   `json:"syncing"`
+		SyncError string `json:"sync_error,omitempty"`
+		// WALFull is set once the buffer pool is full and writes to the write ahead log back off.
+		WALFull        bool    `json:"wal_full"`
+		WALCapacity    float64 `json:"wal_capacity"`
+		WALPendingLogs int     `json:"wal_pending_logs"`
+		Writable       bool    `json:"writable"`
+	}
+
+	_SyncError struct {
+		err error
+	}
+)
+
+// Health checks the DB write path. The DB is unhealthy if it is closed, the last sync failed,
+// the write ahead log is full or the DB directory is not writable.
+func (db *DB) Health() Health {
+	if err := db.ok(); err != nil {
+		return Health{SyncError: err.Error()}
+	}
+	h := Health{
+		Syncing:        db.internal.syncHandle.status(),
+		WALCapacity:    db.internal.mem.Capacity(),
+		WALPendingLogs: len(db.internal.mem.LogFiles()),
+	}
+	if v, ok := db.internal.syncErr.Load().(_SyncError); ok && v.err != nil {
+		h.SyncError = v.err.Error()
+	}
+	h.WALFull = h.WALCapacity >= 1
+	h.Writable = db.opts.flags.readOnly || db.writable()
+	h.Healthy = h.SyncError == "" && !h.WALFull && h.Writable
+	return h
+}
+
+// writable checks the DB directory is writable by creating a probe file.
+func (db *DB) writable() bool {
+	name := path.Join(db.internal.path, ".healthz"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	f, err := db.internal.fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return db.internal.fsys.Remove(name) == nil
+}
+
+// HealthzHandler returns a http.Handler for load balancer health checks. It responds with
+// the DB health and the status 503 if the DB is unhealthy.
+func (db *DB) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := db.Health()
+		b, err := json.MarshalIndent(h, "", "  ")
+		if err != nil {
+			logger.Error().Msg("healthz: Error marshaling response to /healthz request: " + err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(b)
+	})
+}
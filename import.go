@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// Import imports the entries of the other DB into the DB. Entries keep their topic,
+// contract and expiry, and are written with a new seq in the DB so the message ID of
+// an imported entry differs from its ID in the other DB. Entries with a message ID that
+// exists in the DB under the same topic are skipped, as are the expired and deleted
+// entries of the other DB. Entries are imported again if Import is called again.
+// It returns the number of entries imported.
+func (db *DB) Import(other *DB) (int, error) {
+	if err := db.okWrite(); err != nil {
+		return 0, err
+	}
+	if err := other.Sync(); err != nil {
+		return 0, err
+	}
+
+	other.internal.compactLock.RLock()
+	defer other.internal.compactLock.RUnlock()
+
+	// Collect window entries of the other DB by topic, both synced and from the memdb.
+	seen := make(map[uint64]struct{})
+	winEntries := make(map[uint64]_WindowEntries)
+	addEntry := func(topicHash uint64, we _WinEntry) {
+		if _, ok := seen[we.seq()]; ok {
+			return
+		}
+		seen[we.seq()] = struct{}{}
+		winEntries[topicHash] = append(winEntries[topicHash], we)
+	}
+	r := newWindowReader(other.fs)
+	if err := r.entryIterator(func(topicHash uint64, we _WinEntry) error {
+		addEntry(topicHash, we)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	for _, seq := range other.internal.mem.Keys() {
+		data, err := other.internal.mem.Get(seq)
+		if err != nil || data == nil {
+			continue
+		}
+		var m _Entry
+		if err := m.UnmarshalBinary(data[:entrySize]); err != nil {
+			return 0, err
+		}
+		addEntry(m.topicHash, newWinEntry(m.seq, m.expiresAt))
+	}
+
+	// Imported entries take seqs past the seqs of the other DB so an imported entry is
+	// not taken for a duplicate of a later entry of the other DB with the same seq.
+	db.advanceSeq(other.seq())
+	var n int
+	for topicHash, wEntries := range winEntries {
+		t, ok := other.internal.trie.getTopic(topicHash)
+		if !ok {
+			continue
+		}
+		sort.Slice(wEntries, func(i, j int) bool {
+			return wEntries[i].seq() < wEntries[j].seq()
+		})
+		for _, we := range wEntries {
+			if we.isExpired() {
+				continue
+			}
+			e, err := other.readEntry(_Query{topicHash: topicHash, seq: we.seq()})
+			if err != nil {
+				if err == errMsgIDDeleted || err == errEntryInvalid {
+					continue
+				}
+				return n, err
+			}
+			prefix, val, err := other.readValue(e)
+			if err != nil {
+				return n, err
+			}
+			// topic hash is resolved in the DB, it may be chained to another hash in the other DB.
+			contract := binary.LittleEndian.Uint32(prefix[4:8])
+			hash, ok := db.internal.trie.reserveHash(t.GetHash(contract), t.Parts)
+			if ok {
+				dup, err := db.hasEntry(hash, prefix, we.seq())
+				if dup || err != nil {
+					db.internal.trie.release(hash, 1, false)
+				}
+				if err != nil {
+					return n, err
+				}
+				if dup {
+					continue
+				}
+			}
+			name, _ := other.internal.topics.name(topicHash)
+			if err := db.importEntry(t, name, hash, !ok, prefix, we, val); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// hasEntry checks if the topic has an entry with the message ID of the given prefix and seq.
+// The seq alone is not enough as the seq may be used by an unrelated entry in the DB.
+func (db *DB) hasEntry(topicHash uint64, prefix []byte, seq uint64) (bool, error) {
+	stored, err := db.lookupID(topicHash, seq)
+	if stored == nil || err != nil {
+		return false, err
+	}
+	// the stored prefix holds the epoch and the contract of the message ID.
+	return bytes.Equal(stored[:8], prefix[:8]), nil
+}
+
+// importEntry writes the entry read from another DB with a new seq and the message ID prefix of the entry.
+// The entry marked as being written by reserveHash is released once it is written or fails.
+func (db *DB) importEntry(t *message.Topic, name string, topicHash uint64, newTopic bool, prefix []byte, we _WinEntry, val []byte) error {
+	id := make(message.ID, message.ID(prefix).Size())
+	copy(id, prefix[:8])
+	binary.LittleEndian.PutUint64(id[8:], db.nextSeq())
+	e := &Entry{
+		ID:        id,
+		Payload:   val,
+		Contract:  binary.LittleEndian.Uint32(prefix[4:8]),
+		ExpiresAt: we.expiryTime(),
+	}
+	e.entry.topicHash = topicHash
+	e.entry.parsed = true
+	var rawTopic []byte
+	// topic is packed if it is new topic entry
+	if newTopic {
+		rawTopic = t.Marshal()
+		e.entry.topicSize = uint16(len(rawTopic))
+		if err := db.putTopic(topicHash, rawTopic, name); err != nil {
+			db.internal.trie.release(topicHash, 1, false)
+			return err
+		}
+	}
+	if err := db.packEntry(e, rawTopic); err != nil {
+		db.internal.trie.release(topicHash, 1, false)
+		return err
+	}
+	return db.writeEntry(e)
+}
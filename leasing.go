@@ -21,6 +21,7 @@ import (
 	"io"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/unit-io/unitdb/hash"
 )
@@ -167,7 +168,7 @@ func (l *_Lease) freeBlock(off int64, size uint32) {
 	}
 	fbs.fb = append(fbs.fb, _FreeBlock{offset: off, size: size})
 	fbs.cache[off] = true
-	l.size += int64(size)
+	atomic.AddInt64(&l.size, int64(size))
 }
 
 func (l *_Lease) free(seq uint64, off int64, size uint32) {
@@ -177,11 +178,19 @@ func (l *_Lease) free(seq uint64, off int64, size uint32) {
 	l.freeBlock(off, size)
 }
 
+// isFree reports whether the block at the given offset has been freed.
+func (l *_Lease) isFree(off int64) bool {
+	fbs := l.freeBlocks(uint64(off))
+	fbs.RLock()
+	defer fbs.RUnlock()
+	return fbs.cache[off]
+}
+
 func (l *_Lease) allocate(size uint32) int64 {
 	if size == 0 {
 		panic("unable to allocate zero bytes")
 	}
-	if l.size < l.minimumFreeBlocksSize {
+	if l.freeSize() < l.minimumFreeBlocksSize {
 		return -1
 	}
 	fbs := l.freeBlocks(uint64(size))
@@ -201,10 +210,27 @@ func (l *_Lease) allocate(size uint32) int64 {
 		fbs.fb[i].offset += int64(size)
 	}
 	delete(fbs.cache, off)
-	l.size -= int64(size)
+	atomic.AddInt64(&l.size, -int64(size))
 	return off
 }
 
+// freeSize returns the total size of free blocks.
+func (l *_Lease) freeSize() int64 {
+	return atomic.LoadInt64(&l.size)
+}
+
+// count returns the number of free blocks.
+func (l *_Lease) count() int {
+	n := 0
+	for i := 0; i < nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.RLock()
+		n += fbs.len()
+		fbs.RUnlock()
+	}
+	return n
+}
+
 func (l *_Lease) read() error {
 	off := int64(0)
 	blocks := &_FreeBlocks{cache: make(map[int64]bool)}
@@ -254,3 +280,45 @@ func (l *_Lease) write() error {
 
 	return nil
 }
+
+// ranges returns free blocks sorted by offset with overlapping blocks merged.
+func (l *_Lease) ranges() _FreeRanges {
+	var fb []_FreeBlock
+	for i := 0; i < nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.RLock()
+		fb = append(fb, fbs.fb...)
+		fbs.RUnlock()
+	}
+	if len(fb) == 0 {
+		return nil
+	}
+	sort.Slice(fb, func(i, j int) bool {
+		return fb[i].offset < fb[j].offset
+	})
+	ranges := _FreeRanges{fb[0]}
+	for _, b := range fb[1:] {
+		last := &ranges[len(ranges)-1]
+		end := last.offset + int64(last.size)
+		if b.offset > end {
+			ranges = append(ranges, b)
+			continue
+		}
+		if bEnd := b.offset + int64(b.size); bEnd > end {
+			last.size = uint32(bEnd - last.offset)
+		}
+	}
+	return ranges
+}
+
+// reset removes all free blocks.
+func (l *_Lease) reset() {
+	for i := 0; i < nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.Lock()
+		fbs.fb = nil
+		fbs.cache = make(map[int64]bool)
+		fbs.Unlock()
+	}
+	atomic.StoreInt64(&l.size, 0)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+const (
+	// lockHeartbeat is the interval the exclusive holder refreshes the heartbeat in the lock file.
+	lockHeartbeat = time.Second
+	// lockRecordSize is the size of the pid and the heartbeat written to the lock file.
+	lockRecordSize = 16
+)
+
+// _LockFile is the lock held on the DB directory. The exclusive holder writes its pid and
+// a heartbeat to the lock file, so a lock left by a process that stopped is detected.
+type _LockFile struct {
+	fs.LockFile
+	fsys fs.FileSystem
+	name string
+
+	// The lock file the heartbeat is written to, nil for a shared lock.
+	f     fs.File
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// createLockFile to create lock file. A shared lock is held by the read-only handles of the DB.
+// A lock left by a holder that stopped is acquired as the lock is released with the holder. A lock
+// still held whose heartbeat is older than the stale timeout is taken over only if the process of
+// the holder is not running, e.g. the lock is held on a file system shared by the hosts. A zero
+// timeout never takes over a lock.
+func createLockFile(fsys fs.FileSystem, dirName string, shared bool, staleTimeout time.Duration) (*_LockFile, error) {
+	if err := ensureDir(fsys, dirName); err != nil {
+		return nil, err
+	}
+	name := path.Join(dirName, fmt.Sprintf("%s.lock", prefix))
+	lock, fresh, err := fsys.CreateLockFile(name, shared)
+	if err == os.ErrExist && staleTimeout > 0 && lockStale(fsys, name, staleTimeout) {
+		// The lock file is removed so the lock is held on a new file, the stale holder
+		// keeps the lock on the removed file and leaves the new file in place on unlock.
+		logger.Info().Str("context", "db.createLockFile").Msg("taking over stale lock " + name)
+		if err := fsys.Remove(name); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		lock, fresh, err = fsys.CreateLockFile(name, shared)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &_LockFile{LockFile: lock, fsys: fsys, name: name}
+	if shared {
+		if !fresh {
+			// The heartbeat is left by an exclusive holder that crashed, it is cleared
+			// so the readers holding the lock are not taken for a stale holder.
+			if f, err := fsys.OpenFile(name, os.O_RDWR, 0666); err == nil {
+				f.Truncate(0)
+				f.Close()
+			}
+		}
+		return l, nil
+	}
+	if l.f, err = fsys.OpenFile(name, os.O_RDWR, 0666); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	if err := l.beat(); err != nil {
+		l.f.Close()
+		lock.Unlock()
+		return nil, err
+	}
+	l.stopC = make(chan struct{})
+	l.wg.Add(1)
+	go l.heartbeat()
+	return l, nil
+}
+
+// lockStale reports whether the lock file holds a heartbeat older than the timeout of a holder
+// whose process is not running. A lock file without a heartbeat is held by the readers and never
+// stale.
+func lockStale(fsys fs.FileSystem, name string, timeout time.Duration) bool {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, lockRecordSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return false
+	}
+	beat := time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:16])))
+	if time.Since(beat) <= timeout {
+		return false
+	}
+	return !processAlive(int(binary.LittleEndian.Uint64(buf[:8])))
+}
+
+// processAlive reports whether the process of the pid is running. On Windows a process is found
+// only while it runs, on the other systems the process is signaled to check it runs.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer p.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// beat writes the pid and the current time to the lock file.
+func (l *_LockFile) beat() error {
+	buf := make([]byte, lockRecordSize)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(os.Getpid()))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+	if _, err := l.f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *_LockFile) heartbeat() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopC:
+			return
+		case <-ticker.C:
+			if err := l.beat(); err != nil {
+				logger.Error().Err(err).Str("context", "db.lockHeartbeat")
+			}
+		}
+	}
+}
+
+// unlock stops the heartbeat and removes the lock.
+func (l *_LockFile) unlock() error {
+	if l.f != nil {
+		close(l.stopC)
+		l.wg.Wait()
+		l.f.Close()
+	}
+	return l.LockFile.Unlock()
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync"
+
+	"github.com/unit-io/unitdb/memdb"
+)
+
+const (
+	// memSeqBits is the number of low bits of a memdb key holding the seq, the
+	// high bits hold the ID of the DB sharing the memdb.
+	memSeqBits = 48
+	memSeqMask = 1<<memSeqBits - 1
+)
+
+// sharedMems are the DB IDs in use per shared memdb.
+var sharedMems = struct {
+	sync.Mutex
+	ids map[*memdb.DB]map[uint16]bool
+}{ids: make(map[*memdb.DB]map[uint16]bool)}
+
+// _MemDB is the memdb of the DB. The DBs sharing a memdb keep their entries under the namespace
+// of the DB ID, so a DB only reads, syncs and frees its own entries. The keys of a memdb
+// not shared are the seqs of the entries.
+type _MemDB struct {
+	*memdb.DB
+	shared bool
+	id     uint16
+	ns     uint64
+}
+
+// newSharedMemDB registers the DB ID with the shared memdb. It returns an error
+// if the ID is in use by another DB sharing the memdb.
+func newSharedMemDB(mem *memdb.DB, id uint16) (*_MemDB, error) {
+	sharedMems.Lock()
+	defer sharedMems.Unlock()
+	ids, ok := sharedMems.ids[mem]
+	if !ok {
+		ids = make(map[uint16]bool)
+		sharedMems.ids[mem] = ids
+	}
+	if ids[id] {
+		return nil, errMemdbIDInUse
+	}
+	ids[id] = true
+
+	return &_MemDB{DB: mem, shared: true, id: id, ns: uint64(id) << memSeqBits}, nil
+}
+
+// key returns the memdb key of the seq.
+func (m *_MemDB) key(seq uint64) uint64 {
+	return m.ns | seq
+}
+
+// seqs returns the seqs of the memdb keys of the DB, skipping the keys of other DBs sharing the memdb.
+func (m *_MemDB) seqs(keys []uint64) []uint64 {
+	if !m.shared {
+		return keys
+	}
+	seqs := keys[:0]
+	for _, key := range keys {
+		if key&^memSeqMask == m.ns {
+			seqs = append(seqs, key&memSeqMask)
+		}
+	}
+	return seqs
+}
+
+// Get gets data of the entry for the seq.
+func (m *_MemDB) Get(seq uint64) ([]byte, error) {
+	return m.DB.Get(m.key(seq))
+}
+
+// Lookup gets data of the entry for the seq and time ID.
+func (m *_MemDB) Lookup(timeID int64, seq uint64) ([]byte, error) {
+	return m.DB.Lookup(timeID, m.key(seq))
+}
+
+// Put puts data of the entry for the seq.
+func (m *_MemDB) Put(seq uint64, data []byte) (int64, error) {
+	return m.DB.Put(m.key(seq), data)
+}
+
+// Delete deletes the entry for the seq.
+func (m *_MemDB) Delete(seq uint64) error {
+	return m.DB.Delete(m.key(seq))
+}
+
+// Keys gets the seqs of all entries of the DB.
+func (m *_MemDB) Keys() []uint64 {
+	return m.seqs(m.DB.Keys())
+}
+
+// BlockIterator iterates the time blocks committed to the WAL holding entries of the DB.
+func (m *_MemDB) BlockIterator(f func(timeID int64, seqs []uint64) (bool, error)) error {
+	return m.DB.BlockIterator(m.iterator(f))
+}
+
+// All iterates all time blocks holding entries of the DB.
+func (m *_MemDB) All(f func(timeID int64, seqs []uint64) (bool, error)) error {
+	return m.DB.All(m.iterator(f))
+}
+
+func (m *_MemDB) iterator(f func(timeID int64, seqs []uint64) (bool, error)) func(timeID int64, keys []uint64) (bool, error) {
+	return func(timeID int64, keys []uint64) (bool, error) {
+		seqs := m.seqs(keys)
+		if len(seqs) == 0 {
+			return false, nil
+		}
+		return f(timeID, seqs)
+	}
+}
+
+// free frees the entries of the seqs synced from the time block. A memdb not shared frees
+// the time block, the time block of a shared memdb is freed once all DBs free their entries.
+func (m *_MemDB) free(timeID int64, seqs []uint64) error {
+	if !m.shared {
+		return m.DB.Free(timeID)
+	}
+	keys := make([]uint64, len(seqs))
+	for i, seq := range seqs {
+		keys[i] = m.key(seq)
+	}
+	return m.DB.FreeKeys(timeID, keys)
+}
+
+// Close closes the memdb. A shared memdb is left open for the other DBs and the DB ID is released.
+func (m *_MemDB) Close() error {
+	if !m.shared {
+		return m.DB.Close()
+	}
+	sharedMems.Lock()
+	defer sharedMems.Unlock()
+	ids := sharedMems.ids[m.DB]
+	delete(ids, m.id)
+	if len(ids) == 0 {
+		delete(sharedMems.ids, m.DB)
+	}
+	return nil
+}
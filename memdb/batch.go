@@ -18,7 +18,6 @@ package memdb
 
 import (
 	"fmt"
-	"time"
 )
 
 // Batch is a write batch.
@@ -37,8 +36,10 @@ type Batch struct {
 }
 
 func (b *Batch) newTinyLog() {
-	timeID := _TimeID(time.Now().UTC().UnixNano())
-	b.db.addTimeBlock(timeID)
+	timeID := b.db.batchTimeID()
+	for !b.db.addTimeBlock(timeID) {
+		timeID = b.db.batchTimeID()
+	}
 	b.tinyLog = &_TinyLog{id: timeID, _TimeID: timeID, managed: true, doneChan: make(chan struct{})}
 }
 
@@ -60,6 +61,9 @@ func (b *Batch) Put(key uint64, data []byte) error {
 	if err := b.db.ok(); err != nil {
 		return err
 	}
+	if err := b.db.checkCapacity(); err != nil {
+		return err
+	}
 
 	block, ok := b.db.timeBlock(b.tinyLog.timeID())
 	if !ok {
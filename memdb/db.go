@@ -19,7 +19,6 @@ package memdb
 import (
 	"encoding/binary"
 	"errors"
-	"os"
 	"sort"
 	"sync"
 	"time"
@@ -55,8 +54,10 @@ func Open(opts ...Options) (*DB, error) {
 	}
 
 	// Make sure we have a directory.
-	if err := os.MkdirAll(options.logFilePath, 0777); err != nil {
-		return nil, errors.New("DB.Open, Unable to create db dir")
+	if !options.readOnly {
+		if err := options.fsys.MkdirAll(options.logFilePath, 0777); err != nil {
+			return nil, errors.New("DB.Open, Unable to create db dir")
+		}
 	}
 
 	bufPool := bpool.NewBufferPool(options.memdbSize, &bpool.Options{MaxElapsedTime: 1 * time.Second})
@@ -68,21 +69,28 @@ func Open(opts ...Options) (*DB, error) {
 
 		// buffer pool
 		buffer: bufPool,
+		freeC:  make(chan struct{}),
 	}
-	logOpts := wal.Options{Path: options.logFilePath + "/" + logDir, BufferSize: options.bufferSize, Reset: options.logResetFlag}
-	wal, err := wal.New(logOpts)
-	if err != nil {
-		wal.Close()
-		return nil, err
-	}
+	if !options.readOnly {
+		logOpts := wal.Options{Path: options.logFilePath + "/" + logDir, FileSystem: options.fsys, BufferSize: options.bufferSize, Reset: options.logResetFlag, PoolSize: options.walPoolSize, PoolBufferSize: options.walPoolBufferSize}
+		wal, err := wal.New(logOpts)
+		if err != nil {
+			wal.Close()
+			return nil, err
+		}
 
-	internal.closer = wal
-	internal.wal = wal
+		internal.closer = wal
+		internal.wal = wal
+	}
 
+	consistent := hash.InitConsistent(nBlocks, nBlocks)
+	if options.keyHash != nil {
+		consistent = hash.InitConsistentWithHash(nBlocks, nBlocks, options.keyHash)
+	}
 	db := &DB{
 		opts:        options,
 		internal:    internal,
-		consistent:  hash.InitConsistent(nBlocks, nBlocks),
+		consistent:  consistent,
 		timeBlocks:  make(map[_TimeID]*_Block),
 		timeFilters: make(map[_BlockKey]*_TimeFilter),
 	}
@@ -91,7 +99,7 @@ func Open(opts ...Options) (*DB, error) {
 		db.timeFilters[_BlockKey(i)] = &_TimeFilter{timeRecords: make(map[_TimeID]*filter.Block), filter: filter.NewFilterGenerator()}
 	}
 
-	if !options.logResetFlag {
+	if !options.logResetFlag && !options.readOnly {
 		if err := db.startRecovery(); err != nil {
 			return nil, err
 		}
@@ -186,15 +194,25 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 	blockKey := db.blockKey(key)
 	db.mu.RUnlock()
 
+	qm := db.internal.queryManager
+
 	// first execute query plan
-	if len(db.internal.queryManager.timeFilters[blockKey].timeRecords) == 0 {
+	qm.mu.RLock()
+	r := qm.timeFilters[blockKey]
+	qm.mu.RUnlock()
+	r.RLock()
+	nRecords := len(r.timeRecords)
+	r.RUnlock()
+	if nRecords == 0 {
 		if err := db.seek(key, 0); err != nil {
 			return nil, err
 		}
 	}
 
 	// Lookup key first for the current timeRecord.
-	block, ok := db.internal.queryManager.timeBlocks[db.internal.queryManager.timeRcord]
+	qm.mu.RLock()
+	block, ok := qm.timeBlocks[qm.timeRcord]
+	qm.mu.RUnlock()
 	if ok {
 		block.RLock()
 		off, ok := block.records[iKey(false, key)]
@@ -209,10 +227,10 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 		}
 	}
 
-	db.mu.RLock()
+	qm.mu.RLock()
 	// Get time block
-	r, ok := db.internal.queryManager.timeFilters[blockKey]
-	db.mu.RUnlock()
+	r, ok = qm.timeFilters[blockKey]
+	qm.mu.RUnlock()
 	if !ok {
 		return nil, errEntryDoesNotExist
 	}
@@ -227,7 +245,9 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 		return timeIDs[i] > timeIDs[j]
 	})
 	for _, timeID := range timeIDs {
-		block, ok := db.internal.queryManager.timeBlocks[timeID]
+		qm.mu.RLock()
+		block, ok := qm.timeBlocks[timeID]
+		qm.mu.RUnlock()
 		if ok {
 			block.RLock()
 			off, ok := block.records[iKey(false, key)]
@@ -236,7 +256,9 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 				block.RLock()
 				defer block.RUnlock()
 				db.internal.meter.Gets.Inc(1)
-				db.internal.queryManager.timeRcord = timeID
+				qm.mu.Lock()
+				qm.timeRcord = timeID
+				qm.mu.Unlock()
 
 				return block.get(off)
 			}
@@ -250,7 +272,9 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 	}
 
 	// reset timeBlock and start over
-	db.internal.queryManager.timeFilters[blockKey] = &_TimeFilter{timeRecords: make(map[_TimeID]*filter.Block), filter: filter.NewFilterGenerator()}
+	qm.mu.Lock()
+	qm.timeFilters[blockKey] = &_TimeFilter{timeRecords: make(map[_TimeID]*filter.Block), filter: filter.NewFilterGenerator()}
+	qm.mu.Unlock()
 
 	return db.Get(key)
 }
@@ -368,6 +392,9 @@ func (db *DB) Put(key uint64, data []byte) (int64, error) {
 	if err := db.ok(); err != nil {
 		return 0, err
 	}
+	if err := db.checkCapacity(); err != nil {
+		return 0, err
+	}
 
 	timeID := db.timeID()
 	db.mu.RLock()
@@ -417,11 +444,90 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 	return b.Commit()
 }
 
+// Flush writes the entries not yet written to the WAL and fsyncs the WAL, so the entries are
+// recovered if the DB is not closed cleanly.
+func (db *DB) Flush() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.internal.logManager.flush()
+	if db.internal.wal == nil {
+		return nil
+	}
+
+	return db.internal.wal.Sync()
+}
+
+// Seal waits for the current time block to pass and commits it, so the entries put before Seal
+// are in time blocks ready to be iterated by BlockIterator. It blocks for up to the time block
+// duration.
+func (db *DB) Seal() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	next := time.Unix(0, int64(db.timeID())).Add(db.internal.logManager.opts.blockDuration)
+	if wait := time.Until(next); wait > 0 {
+		time.Sleep(wait)
+	}
+	db.internal.logManager.flush()
+
+	return nil
+}
+
 // Free frees time block from DB for a provided time ID and releases block from WAL.
 func (db *DB) Free(timeID int64) error {
 	return db.releaseLog(_TimeID(timeID))
 }
 
+// FreeKeys frees the keys from the time block for a provided time ID, so each of the owners sharing
+// the DB frees its own keys. The time block is released from WAL once all its keys are freed.
+func (db *DB) FreeKeys(timeID int64, keys []uint64) error {
+	db.mu.RLock()
+	block, ok := db.timeBlocks[_TimeID(timeID)]
+	db.mu.RUnlock()
+	if !ok {
+		return errEntryDoesNotExist
+	}
+
+	block.Lock()
+	for _, key := range keys {
+		if _, ok := block.records[iKey(false, key)]; ok {
+			delete(block.records, iKey(false, key))
+			block.count--
+		}
+		delete(block.records, iKey(true, key))
+	}
+	n := len(block.records)
+	block.Unlock()
+	if n != 0 {
+		return nil
+	}
+
+	return db.releaseLog(_TimeID(timeID))
+}
+
+// LogFileSize returns the total size of the write ahead logs on disk.
+func (db *DB) LogFileSize() int64 {
+	if db.internal.wal == nil {
+		return 0
+	}
+	return db.internal.wal.FileSize()
+}
+
+// LogFiles returns the paths of the write ahead logs on disk.
+func (db *DB) LogFiles() []string {
+	if db.internal.wal == nil {
+		return nil
+	}
+	return db.internal.wal.LogFiles()
+}
+
+// Capacity returns the used capacity of the buffer pool, the log writes back off once it
+// reaches 1.
+func (db *DB) Capacity() float64 {
+	return db.cap()
+}
+
 // Size returns the total number of entries in DB.
 func (db *DB) Size() int64 {
 	size := int64(0)
@@ -66,9 +66,13 @@ type _DB struct {
 	// tiny Log
 	timeRef    _TimeID
 	logManager *_TinyLogManager
+	// batchTimeRef is the last time ID given to a batch.
+	batchTimeRef int64
 
 	// buffer pool
 	buffer *bpool.BufferPool
+	// freeC is closed and replaced once time blocks are freed.
+	freeC chan struct{}
 
 	// Write ahead log
 	wal *wal.WAL
@@ -88,6 +92,11 @@ func (db *DB) close() error {
 
 	db.internal.logManager.closeWait()
 
+	// Wake up the writes waiting for the time blocks to be freed.
+	db.mu.Lock()
+	db.signalFree()
+	db.mu.Unlock()
+
 	var err error
 	if db.internal.closer != nil {
 		if err1 := db.internal.closer.Close(); err1 != nil {
@@ -120,6 +129,20 @@ func (db *DB) timeID() _TimeID {
 	return db.internal.logManager.timeID()
 }
 
+// batchTimeID returns a time ID for a batch, increasing so concurrent batches never share a time block.
+func (db *DB) batchTimeID() _TimeID {
+	for {
+		last := atomic.LoadInt64(&db.internal.batchTimeRef)
+		timeID := time.Now().UTC().UnixNano()
+		if timeID <= last {
+			timeID = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&db.internal.batchTimeRef, last, timeID) {
+			return _TimeID(timeID)
+		}
+	}
+}
+
 // blockKey gets blockKey for the Key using consistent hashing.
 func (db *DB) blockKey(key uint64) _BlockKey {
 	return _BlockKey(db.consistent.FindBlock(key))
@@ -214,22 +237,25 @@ func (db *DB) seek(key uint64, cutoff int64) error {
 			_, ok := block.records[iKey(false, key)]
 			block.RUnlock()
 			if ok {
-				b, ok := db.internal.queryManager.timeFilters[blockKey]
-				if ok {
-					b.timeRecords[timeID] = filter.NewFilterBlock(r.filter.Bytes())
+				r.RLock()
+				fltr := filter.NewFilterBlock(r.filter.Bytes())
+				r.RUnlock()
+				qm := db.internal.queryManager
+				qm.mu.Lock()
+				if b, ok := qm.timeFilters[blockKey]; ok {
+					b.Lock()
+					b.timeRecords[timeID] = fltr
+					b.Unlock()
 				}
-				db.internal.queryManager.timeBlocks[timeID] = block
+				qm.timeBlocks[timeID] = block
 				if cutoff != 0 {
-					db.internal.queryManager.cutoff = _TimeID(cutoff)
+					qm.cutoff = _TimeID(cutoff)
 				}
+				qm.mu.Unlock()
 				return nil
 			}
-			r.RLock()
-			fltr := r.timeRecords[timeID]
-			r.RUnlock()
-			if !fltr.Test(key) {
-				return errEntryDoesNotExist
-			}
+			// The filter snapshot of a newer time block cannot rule out an older one,
+			// as concurrent batches keep writing to their time blocks out of order.
 		}
 	}
 
@@ -276,6 +302,13 @@ func (db *DB) tinyWrite(tinyLog *_TinyLog) error {
 		// nothing to write
 		return nil
 	}
+	if db.opts.noWAL {
+		// The log is committed without writing it to the WAL, so there is no log to release.
+		block.Lock()
+		defer block.Unlock()
+		block.lastOffset = blockSize
+		return nil
+	}
 	logWriter, err := db.internal.wal.NewWriter()
 	if err != nil {
 		return err
@@ -319,8 +352,8 @@ func (db *DB) releaseLog(timeID _TimeID) error {
 		return errEntryDoesNotExist
 	}
 
-	block.RLock()
-	defer block.RUnlock()
+	block.Lock()
+	defer block.Unlock()
 	for _, timeRef := range block.timeRefs {
 		if err := db.internal.wal.SignalLogApplied(int64(timeRef)); err != nil {
 			return err
@@ -332,11 +365,45 @@ func (db *DB) releaseLog(timeID _TimeID) error {
 	delete(db.timeBlocks, _TimeID(timeID))
 	db.internal.timeMark.timeUnref(timeID)
 
+	// The block is write locked so the buffer is not reset under a concurrent Get.
 	db.internal.buffer.Put(block.data)
+	db.signalFree()
 
 	return nil
 }
 
+// signalFree wakes up the writes waiting for the time blocks to be freed. The caller must hold db.mu.
+func (db *DB) signalFree() {
+	close(db.internal.freeC)
+	db.internal.freeC = make(chan struct{})
+}
+
+// checkCapacity applies the full policy to a write once the DB reaches the maximum size.
+func (db *DB) checkCapacity() error {
+	if db.opts.fullPolicy == FullAllow {
+		return nil
+	}
+	for db.cap() >= 1 {
+		if db.opts.fullPolicy == FullReject {
+			return ErrMemFull
+		}
+		db.mu.RLock()
+		freeC := db.internal.freeC
+		db.mu.RUnlock()
+		// The log writes back off on a full DB, so the time blocks are committed to the WAL to be freed,
+		// the current time block is committed again once the time block duration passes.
+		db.internal.logManager.flush()
+		select {
+		case <-freeC:
+		case <-time.After(db.opts.timeBlockDuration):
+		}
+		if err := db.ok(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // setClosed flag; return true if DB is not already closed.
 func (db *DB) setClosed() bool {
 	return atomic.CompareAndSwapUint32(&db.internal.closed, 0, 1)
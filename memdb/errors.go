@@ -12,3 +12,6 @@ var (
 	errBadRequest        = errors.New("The request was invalid or cannot be otherwise served")
 	errForbidden         = errors.New("The request is understood, but it has been refused or access is not allowed")
 )
+
+// ErrMemFull is returned when the memdb reaches its maximum size and the full policy rejects the writes.
+var ErrMemFull = errors.New("memdb is full")
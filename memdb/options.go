@@ -18,25 +18,61 @@ package memdb
 
 import (
 	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/hash"
 )
 
 type _Options struct {
 	logFilePath string
 
+	// fsys sets the file system the logs are stored in.
+	fsys fs.FileSystem
+
 	// memdbSize sets maximum size of DB.
 	memdbSize int64
 
 	// bufferSize sets size of buffer to use for buffer pooling.
 	bufferSize int64
 
+	// walPoolSize sets maximum number of buffers kept in the WAL buffer pool.
+	walPoolSize int
+
+	// walPoolBufferSize sets size of a buffer allocated by the WAL log writer.
+	walPoolBufferSize int64
+
 	// logResetFlag flag to skips log recovery on DB open and reset WAL.
 	logResetFlag bool
 
 	logInterval time.Duration
 
 	timeBlockDuration time.Duration
+
+	// fullPolicy sets the policy applied to the writes once the DB reaches the maximum size.
+	fullPolicy FullPolicy
+
+	// noWAL skips writing the time blocks to the WAL.
+	noWAL bool
+
+	// readOnly skips opening and recovering the WAL.
+	readOnly bool
+
+	// keyHash sets the hash function the keys are hashed with before they are assigned to the blocks.
+	keyHash hash.KeyHash
 }
 
+// FullPolicy is the policy applied to the writes once the DB reaches the maximum size.
+type FullPolicy uint8
+
+const (
+	// FullAllow accepts the writes, the log writes back off until the time blocks are freed.
+	FullAllow FullPolicy = iota
+	// FullReject rejects the writes with ErrMemFull.
+	FullReject
+	// FullBlock commits the time blocks to the WAL and blocks the writes until the time blocks are freed.
+	FullBlock
+)
+
 // Options it contains configurable options and flags for DB.
 type Options interface {
 	set(*_Options)
@@ -64,6 +100,9 @@ func WithDefaultOptions() Options {
 		if o.logFilePath == "" {
 			o.logFilePath = "/tmp/unitdb"
 		}
+		if o.fsys == nil {
+			o.fsys = fs.OS
+		}
 		if o.memdbSize == 0 {
 			o.memdbSize = defaultMemdbSize
 		}
@@ -86,6 +125,13 @@ func WithLogFilePath(path string) Options {
 	})
 }
 
+// WithFileSystem sets the file system for storing logs.
+func WithFileSystem(fsys fs.FileSystem) Options {
+	return newFuncOption(func(o *_Options) {
+		o.fsys = fsys
+	})
+}
+
 // WithMemdbSize sets max size of DB.
 func WithMemdbSize(size int64) Options {
 	return newFuncOption(func(o *_Options) {
@@ -100,6 +146,22 @@ func WithBufferSize(size int64) Options {
 	})
 }
 
+// WithWALBufferPool sets maximum number of buffers kept in the WAL buffer pool
+// and size of a buffer allocated by the WAL log writer.
+func WithWALBufferPool(poolSize int, bufferSize int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.walPoolSize = poolSize
+		o.walPoolBufferSize = bufferSize
+	})
+}
+
+// WithFullPolicy sets the policy applied to the writes once the DB reaches the maximum size.
+func WithFullPolicy(policy FullPolicy) Options {
+	return newFuncOption(func(o *_Options) {
+		o.fullPolicy = policy
+	})
+}
+
 // WithLogReset flag to skip recovery on DB open and reset WAL.
 func WithLogReset() Options {
 	return newFuncOption(func(o *_Options) {
@@ -107,6 +169,23 @@ func WithLogReset() Options {
 	})
 }
 
+// WithNoWAL skips writing the time blocks to the WAL. The entries are kept only in memory until
+// they are freed, so the entries not yet freed are lost if the process crashes.
+func WithNoWAL() Options {
+	return newFuncOption(func(o *_Options) {
+		o.noWAL = true
+	})
+}
+
+// WithReadOnly opens the DB without opening the WAL, so the logs are neither recovered nor
+// changed and the log dir is not created. The time blocks are not written to the WAL.
+func WithReadOnly() Options {
+	return newFuncOption(func(o *_Options) {
+		o.readOnly = true
+		o.noWAL = true
+	})
+}
+
 // WithLogInterval sets interval for a time block. Block is pushed to the queue to write it to the log file.
 func WithLogInterval(dur time.Duration) Options {
 	return newFuncOption(func(o *_Options) {
@@ -120,3 +199,11 @@ func WithTimeBlockInterval(dur time.Duration) Options {
 		o.timeBlockDuration = dur
 	})
 }
+
+// WithKeyHash sets the hash function the keys are hashed with before they are assigned to the
+// blocks of the DB. The hash function must be deterministic, Open panics otherwise.
+func WithKeyHash(fn hash.KeyHash) Options {
+	return newFuncOption(func(o *_Options) {
+		o.keyHash = fn
+	})
+}
@@ -16,7 +16,11 @@
 
 package memdb
 
+import "sync"
+
 type _QueryManager struct {
+	mu sync.RWMutex // Read Write mutex, guards access to the cached time records and time blocks.
+
 	timeRcord   _TimeID
 	timeFilters map[_BlockKey]*_TimeFilter
 	timeBlocks  _TimeBlocks
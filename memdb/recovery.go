@@ -18,10 +18,12 @@ package memdb
 
 import (
 	"encoding/binary"
+	"os"
 	"sort"
 	"time"
 
 	"github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/wal"
 )
 
 // delete deletes entry from the DB.
@@ -213,3 +215,112 @@ func (db *DB) All(f func(timeID int64, keys []uint64) (bool, error)) (err error)
 
 	return nil
 }
+
+// LogReport reports the logs recovery would apply from the WAL.
+type LogReport struct {
+	// Logs is the number of logs that would be applied.
+	Logs int
+	// Entries is the number of entries that would be recovered.
+	Entries int64
+	// Deletes is the number of deletes that would be applied.
+	Deletes int64
+	// MinKey and MaxKey is the range of keys of the entries that would be recovered.
+	MinKey, MaxKey uint64
+	// Corrupted lists the time IDs of the logs that are unreadable.
+	Corrupted []int64
+}
+
+// VerifyLog replays the WAL read-only and reports what recovery would apply
+// on DB open. It does not modify the WAL.
+func VerifyLog(opts ...Options) (LogReport, error) {
+	options := &_Options{}
+	WithDefaultOptions().set(options)
+	for _, opt := range opts {
+		if opt != nil {
+			opt.set(options)
+		}
+	}
+
+	report := LogReport{}
+	logPath := options.logFilePath + "/" + logDir
+	if _, err := options.fsys.Stat(logPath); os.IsNotExist(err) {
+		return report, nil
+	}
+	logOpts := wal.Options{Path: logPath, FileSystem: options.fsys, BufferSize: options.bufferSize, ReadOnly: true}
+	wal, err := wal.New(logOpts)
+	if err != nil {
+		return report, err
+	}
+	defer wal.Close()
+
+	r, err := wal.NewReader()
+	if err != nil {
+		return report, err
+	}
+	err = r.Verify(func(timeID int64, err error) (bool, error) {
+		if err != nil {
+			report.Corrupted = append(report.Corrupted, timeID)
+			return false, nil
+		}
+		logReport, ok := verifyLogRecords(r)
+		if !ok {
+			report.Corrupted = append(report.Corrupted, timeID)
+			return false, nil
+		}
+		report.Logs++
+		report.Entries += logReport.Entries
+		report.Deletes += logReport.Deletes
+		if logReport.Entries > 0 {
+			if report.MinKey == 0 || logReport.MinKey < report.MinKey {
+				report.MinKey = logReport.MinKey
+			}
+			if logReport.MaxKey > report.MaxKey {
+				report.MaxKey = logReport.MaxKey
+			}
+		}
+		return false, nil
+	})
+
+	return report, err
+}
+
+// verifyLogRecords decodes the records of the current log of the reader.
+// It returns false if a record is malformed.
+func verifyLogRecords(r *wal.Reader) (report LogReport, ok bool) {
+	for {
+		logData, ok, err := r.Next()
+		if err != nil {
+			return report, false
+		}
+		if !ok {
+			return report, true
+		}
+		var off int
+		for off < len(logData) {
+			if off+4 > len(logData) {
+				return report, false
+			}
+			dataLen := int(binary.LittleEndian.Uint32(logData[off : off+4]))
+			if dataLen < 4+9 || off+dataLen > len(logData) {
+				return report, false
+			}
+			data := logData[off+4 : off+dataLen]
+			key := binary.LittleEndian.Uint64(data[1:9])
+			off += dataLen
+			if data[0] == 1 {
+				if len(data[9:]) < 8 {
+					return report, false
+				}
+				report.Deletes++
+				continue
+			}
+			report.Entries++
+			if report.MinKey == 0 || key < report.MinKey {
+				report.MinKey = key
+			}
+			if key > report.MaxKey {
+				report.MaxKey = key
+			}
+		}
+	}
+}
@@ -189,6 +189,15 @@ func (p *_TinyLogManager) write() {
 	}
 }
 
+// flush enqueues the current log to write and waits for it to be committed to the WAL.
+func (p *_TinyLogManager) flush() {
+	p.mu.Lock()
+	tinyLog := p.tinyLog
+	p.newTinyLog()
+	p.mu.Unlock()
+	p.writeWait(tinyLog)
+}
+
 // writeWait enqueues the log and waits for it to be executed.
 func (p *_TinyLogManager) writeWait(tinyLog *_TinyLog) {
 	if tinyLog == nil {
@@ -35,8 +35,9 @@ const (
 	TopicWildcard
 	TopicWildcardSymbol = '*'
 	TopicGenericSymbol  = "..."
-	TopicSeparator      = '.' // The separator character.
-	TopicMaxDepth       = 100 // Maximum depth for topic using a separator
+	TopicSeparator      = '.'  // The separator character.
+	TopicEscape         = '\\' // The escape character of a separator or a wildcard symbol in a topic segment.
+	TopicMaxDepth       = 100  // Maximum depth for topic using a separator
 
 	// Wildcard wildcard is hash for wildcard topic such as '*' or '...'
 	Wildcard = uint32(857445537)
@@ -89,8 +90,83 @@ func (t *Topic) GetHash(contract uint32) uint64 {
 // _SplitFunc various split function to split topic using delimeter.
 type _SplitFunc struct{}
 
-func (_SplitFunc) splitTopic(c rune) bool {
-	return c == TopicSeparator
+// splitParts splits the topic into segments on the separators that are not escaped, so `a\.b.c`
+// has the segments `a\.b` and "c". Empty segments are skipped.
+func splitParts(topic []byte) [][]byte {
+	var parts [][]byte
+	start := 0
+	for i := 0; i < len(topic); i++ {
+		switch topic[i] {
+		case TopicEscape:
+			i++
+		case TopicSeparator:
+			if i > start {
+				parts = append(parts, topic[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(topic) {
+		parts = append(parts, topic[start:])
+	}
+	return parts
+}
+
+// unescapePart removes the escape characters from a topic segment, the segment is hashed unescaped.
+// Only the escape characters of a separator, a wildcard symbol or an escape character are removed,
+// so a segment with a backslash before any other character hashes as it did before the escapes
+// were supported. The entries of a topic stored before with `\.` or `\\` in a segment are found
+// by the topic with the backslash escaped, e.g. the entries of `a\.b` are found by `a\\.b`.
+func unescapePart(part []byte) []byte {
+	if bytes.IndexByte(part, TopicEscape) < 0 {
+		return part
+	}
+	b := make([]byte, 0, len(part))
+	for i := 0; i < len(part); i++ {
+		if part[i] == TopicEscape && i+1 < len(part) && escapable(part[i+1]) {
+			i++
+		}
+		b = append(b, part[i])
+	}
+	return b
+}
+
+// escapable reports whether the character is escaped by a preceding escape character.
+func escapable(c byte) bool {
+	return c == TopicSeparator || c == TopicWildcardSymbol || c == TopicEscape
+}
+
+// escaped reports whether the character at i is escaped by an odd number of escape characters.
+func escaped(topic []byte, i int) bool {
+	n := 0
+	for j := i - 1; j >= 0 && topic[j] == TopicEscape; j-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// wildcardPart reports whether the topic segment ends with a wildcard symbol that is not escaped.
+func wildcardPart(part []byte) bool {
+	if len(part) == 0 || part[len(part)-1] != TopicWildcardSymbol {
+		return false
+	}
+	return !escaped(part, len(part)-1)
+}
+
+// genericSuffix returns the number of separators at the end of the topic that are not escaped,
+// or zero if the topic does not end with the generic wildcard symbol.
+func genericSuffix(topic []byte) int {
+	i := len(topic)
+	for i > 0 && topic[i-1] == TopicSeparator {
+		i--
+	}
+	if i < len(topic) && escaped(topic, i) {
+		i++
+	}
+	if n := len(topic) - i; n >= len(TopicGenericSymbol) {
+		return n
+	}
+	return 0
 }
 
 func (_SplitFunc) options(c rune) bool {
@@ -217,7 +293,6 @@ func parseStaticTopic(contract uint32, topic *Topic) (ok bool) {
 	// defer logger.Debug().Str("context", "topic.parseStaticTopic").Dur("duration", time.Since(start)).Msg("")
 
 	var part Part
-	var fn _SplitFunc
 	topic.Parts = make([]Part, 0, 6)
 	ok = topic.parseOptions(topic.TopicOptions)
 
@@ -226,10 +301,10 @@ func parseStaticTopic(contract uint32, topic *Topic) (ok bool) {
 		return false
 	}
 
-	parts := bytes.FieldsFunc(topic.Topic, fn.splitTopic)
+	parts := splitParts(topic.Topic)
 	part = Part{}
 	for _, p := range parts {
-		part.Hash = hash.WithSalt(p, contract)
+		part.Hash = hash.WithSalt(unescapePart(p), contract)
 		topic.Parts = append(topic.Parts, part)
 	}
 
@@ -244,7 +319,6 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 	// defer logger.Debug().Str("context", "topic.parseWildcardTopic").Dur("duration", time.Since(start)).Msg("")
 
 	var part Part
-	var fn _SplitFunc
 	topic.Parts = make([]Part, 0, 6)
 	ok = topic.parseOptions(topic.TopicOptions)
 
@@ -254,32 +328,30 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 	}
 
 	depth := uint8(0)
-	q := []byte(TopicGenericSymbol)
-	if bytes.HasSuffix(topic.Topic, q) {
+	if n := genericSuffix(topic.Topic); n > 0 {
 		depth++
-		topic.Topic = bytes.TrimRight(topic.Topic, string(TopicGenericSymbol))
+		topic.Topic = topic.Topic[:len(topic.Topic)-n]
 		topic.TopicType = TopicWildcard
 		topic.Depth = TopicMaxDepth
 	}
 
-	parts := bytes.FieldsFunc(topic.Topic, fn.splitTopic)
-	q = []byte{TopicWildcardSymbol}
+	parts := splitParts(topic.Topic)
 	part = Part{}
 	wildchars := uint8(0)
 	wildcharcount := 0
 	for idx, p := range parts {
 		depth++
-		if bytes.HasSuffix(p, q) {
+		if wildcardPart(p) {
 			topic.TopicType = TopicWildcard
 			if idx == 0 {
-				part.Hash = hash.WithSalt(p, contract)
+				part.Hash = hash.WithSalt(unescapePart(p), contract)
 				topic.Parts = append(topic.Parts, part)
 			}
 			wildchars++
 			wildcharcount++
 			continue
 		}
-		part.Hash = hash.WithSalt(p, contract)
+		part.Hash = hash.WithSalt(unescapePart(p), contract)
 		topic.Parts = append(topic.Parts, part)
 		if wildchars > 0 {
 			if idx-wildcharcount-1 >= 0 {
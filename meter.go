@@ -19,9 +19,15 @@ package unitdb
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/unit-io/unitdb/message"
 	"github.com/unit-io/unitdb/metrics"
 )
 
@@ -36,6 +42,11 @@ type Meter struct {
 	Recovers   metrics.Counter
 	Aborts     metrics.Counter
 	Dels       metrics.Counter
+	Expires    metrics.Counter
+	Compacts   metrics.Counter
+	TopicReads metrics.Counter
+	Hits       metrics.Counter
+	Misses     metrics.Counter
 	InMsgs     metrics.Counter
 	OutMsgs    metrics.Counter
 	InBytes    metrics.Counter
@@ -55,6 +66,11 @@ func NewMeter() *Meter {
 		Recovers:   metrics.NewCounter(),
 		Aborts:     metrics.NewCounter(),
 		Dels:       metrics.NewCounter(),
+		Expires:    metrics.NewCounter(),
+		Compacts:   metrics.NewCounter(),
+		TopicReads: metrics.NewCounter(),
+		Hits:       metrics.NewCounter(),
+		Misses:     metrics.NewCounter(),
 		InMsgs:     metrics.NewCounter(),
 		OutMsgs:    metrics.NewCounter(),
 		InBytes:    metrics.NewCounter(),
@@ -69,6 +85,11 @@ func NewMeter() *Meter {
 	Metrics.GetOrRegister("Recovers", c.Recovers)
 	Metrics.GetOrRegister("Aborts", c.Aborts)
 	Metrics.GetOrRegister("Dels", c.Dels)
+	Metrics.GetOrRegister("Expires", c.Expires)
+	Metrics.GetOrRegister("Compacts", c.Compacts)
+	Metrics.GetOrRegister("TopicReads", c.TopicReads)
+	Metrics.GetOrRegister("Hits", c.Hits)
+	Metrics.GetOrRegister("Misses", c.Misses)
 	Metrics.GetOrRegister("InMsgs", c.InMsgs)
 	Metrics.GetOrRegister("OutMsgs", c.OutMsgs)
 	Metrics.GetOrRegister("InBytes", c.InBytes)
@@ -81,6 +102,150 @@ func (m *Meter) UnregisterAll() {
 	m.Metrics.UnregisterAll()
 }
 
+// maxTopicRates is the maximum number of topics the write rates are tracked for. Once
+// exceeded, the topics with the lowest rates are dropped.
+const maxTopicRates = 1 << 14
+
+// _TopicMeter tracks write rates per topic as an exponentially
+// weighted moving average over the rate window. It also holds the
+// names of the topics, which are kept until the topic is removed.
+type _TopicMeter struct {
+	mu     sync.Mutex
+	window time.Duration
+	max    int
+	topics map[uint64]*_TopicRate
+	names  map[uint64]_TopicName
+}
+
+type _TopicRate struct {
+	count float64 // decayed write count.
+	last  time.Time
+}
+
+type _TopicName struct {
+	contract uint32
+	topic    string
+}
+
+func newTopicMeter(window time.Duration) *_TopicMeter {
+	return &_TopicMeter{
+		window: window,
+		max:    maxTopicRates,
+		topics: make(map[uint64]*_TopicRate),
+		names:  make(map[uint64]_TopicName),
+	}
+}
+
+func (m *_TopicMeter) get(topicHash uint64, now time.Time) *_TopicRate {
+	r, ok := m.topics[topicHash]
+	if !ok {
+		if len(m.topics) >= m.max {
+			m.evict(now)
+		}
+		r = &_TopicRate{last: now}
+		m.topics[topicHash] = r
+	}
+	return r
+}
+
+// evict drops the half of the topics with the lowest write rates.
+func (m *_TopicMeter) evict(now time.Time) {
+	rates := make([]uint64, 0, len(m.topics))
+	for topicHash, r := range m.topics {
+		m.decay(r, now)
+		rates = append(rates, topicHash)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return m.topics[rates[i]].count < m.topics[rates[j]].count
+	})
+	for _, topicHash := range rates[:len(rates)-m.max/2] {
+		delete(m.topics, topicHash)
+	}
+}
+
+// decay decays the write count of the topic since its last update.
+func (m *_TopicMeter) decay(r *_TopicRate, now time.Time) {
+	if dt := now.Sub(r.last); dt > 0 {
+		r.count *= math.Exp(-float64(dt) / float64(m.window))
+		r.last = now
+	}
+}
+
+// setName sets the topic name reported for the topic hash.
+func (m *_TopicMeter) setName(topicHash uint64, contract uint32, topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names[topicHash] = _TopicName{contract: contract, topic: topic}
+}
+
+// name returns the topic name set for the topic hash.
+func (m *_TopicMeter) name(topicHash uint64) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := m.names[topicHash]; ok {
+		return n.topic, true
+	}
+	return "", false
+}
+
+// remove drops the write rate and the name of a topic removed from the DB.
+func (m *_TopicMeter) remove(topicHash uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.topics, topicHash)
+	delete(m.names, topicHash)
+}
+
+// mark records n writes to the topic.
+func (m *_TopicMeter) mark(topicHash uint64, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	r := m.get(topicHash, now)
+	m.decay(r, now)
+	r.count += float64(n)
+}
+
+// key returns the key the topic is reported by. The topics of the master contract are
+// reported by name, the topics of other contracts by contract and name, so the same
+// topic of two contracts is reported apart. Topics without a name are reported by hash.
+func (m *_TopicMeter) key(topicHash uint64) string {
+	n, ok := m.names[topicHash]
+	switch {
+	case !ok:
+		return strconv.FormatUint(topicHash, 10)
+	case n.contract == message.MasterContract:
+		return n.topic
+	default:
+		return strconv.FormatUint(uint64(n.contract), 10) + "/" + n.topic
+	}
+}
+
+// top returns write rates per second of the n busiest topics.
+func (m *_TopicMeter) top(n int) map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	rates := make([]uint64, 0, len(m.topics))
+	for topicHash, r := range m.topics {
+		m.decay(r, now)
+		if r.count > 0 {
+			rates = append(rates, topicHash)
+		}
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return m.topics[rates[i]].count > m.topics[rates[j]].count
+	})
+	if len(rates) > n {
+		rates = rates[:n]
+	}
+	top := make(map[string]float64, len(rates))
+	for _, topicHash := range rates {
+		top[m.key(topicHash)] = m.topics[topicHash].count / m.window.Seconds()
+	}
+	return top
+}
+
 // Varz outputs unitdb stats on the monitoring port at /varz.
 type Varz struct {
 	Start    time.Time `json:"start"`
@@ -95,6 +260,10 @@ type Varz struct {
 	Recovers int64     `json:"recovers"`
 	Aborts   int64     `json:"aborts"`
 	Dels     int64     `json:"Dels"`
+	Expires  int64     `json:"expires"`
+	Compacts int64     `json:"compacts"`
+	Hits     int64     `json:"cache_hits"`
+	Misses   int64     `json:"cache_misses"`
 	InMsgs   int64     `json:"in_msgs"`
 	OutMsgs  int64     `json:"out_msgs"`
 	InBytes  int64     `json:"in_bytes"`
@@ -110,6 +279,9 @@ type Varz struct {
 	Max      float64   `json:"max"`      // Highest event duration.
 	Min      float64   `json:"min"`      // Lowest event duration.
 	StdDev   float64   `json:"stddev"`   // Standard deviation.
+	// TopTopics is write rate per second of the busiest topics. The topics of contracts other
+	// than the master contract are keyed by "contract/topic".
+	TopTopics map[string]float64 `json:"top_topics"`
 	// Range     		 time.Duration `json:"range"`    // Event duration range (Max-Min).
 	// // Per-second rate based on event duration avg. via Metrics.Cumulative / Metrics.Samples.
 	// Rate 			float64 `json:"rate"`
@@ -152,6 +324,10 @@ func (db *DB) Varz() (*Varz, error) {
 	v.Recovers = db.internal.meter.Recovers.Count()
 	v.Aborts = db.internal.meter.Aborts.Count()
 	v.Dels = db.internal.meter.Dels.Count()
+	v.Expires = db.internal.meter.Expires.Count()
+	v.Compacts = db.internal.meter.Compacts.Count()
+	v.Hits = db.internal.meter.Hits.Count()
+	v.Misses = db.internal.meter.Misses.Count()
 	v.InMsgs = db.internal.meter.InMsgs.Count()
 	v.OutMsgs = db.internal.meter.OutMsgs.Count()
 	v.InBytes = db.internal.meter.InBytes.Count()
@@ -168,6 +344,7 @@ func (db *DB) Varz() (*Varz, error) {
 	v.Max = float64(ts.Max())
 	v.Min = float64(ts.Min())
 	v.StdDev = float64(ts.StdDev())
+	v.TopTopics = db.internal.topics.top(db.opts.maxTopTopics)
 
 	return v, nil
 }
@@ -185,6 +362,40 @@ func (db *DB) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// MetricsHandler returns a http.Handler that exposes unitdb stats in the Prometheus text format.
+func (db *DB) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		db.writeMetrics(w)
+	})
+}
+
+func (db *DB) writeMetrics(w io.Writer) {
+	m := db.internal.meter
+	metric := func(name, typ, help string, value int64) {
+		fmt.Fprintf(w, "# HELP unitdb_%s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE unitdb_%s %s\n", name, typ)
+		fmt.Fprintf(w, "unitdb_%s %d\n", name, value)
+	}
+	metric("gets_total", "counter", "Number of get requests.", m.Gets.Count())
+	metric("puts_total", "counter", "Number of put requests.", m.Puts.Count())
+	metric("dels_total", "counter", "Number of deleted entries.", m.Dels.Count())
+	metric("syncs_total", "counter", "Number of entries synced to disk.", m.Syncs.Count())
+	metric("recovers_total", "counter", "Number of entries recovered from the write ahead log.", m.Recovers.Count())
+	metric("aborts_total", "counter", "Number of aborted syncs.", m.Aborts.Count())
+	metric("expires_total", "counter", "Number of expired entries removed.", m.Expires.Count())
+	metric("compacts_total", "counter", "Number of compactions of the data file.", m.Compacts.Count())
+	metric("cache_hits_total", "counter", "Number of reads served from the read cache.", m.Hits.Count())
+	metric("cache_misses_total", "counter", "Number of reads from the data file by the read cache.", m.Misses.Count())
+	metric("in_msgs_total", "counter", "Number of messages written.", m.InMsgs.Count())
+	metric("out_msgs_total", "counter", "Number of messages read.", m.OutMsgs.Count())
+	metric("in_bytes_total", "counter", "Number of bytes written.", m.InBytes.Count())
+	metric("out_bytes_total", "counter", "Number of bytes read.", m.OutBytes.Count())
+	metric("entries", "gauge", "Number of entries in the DB.", int64(db.Count()))
+	metric("memdb_entries", "gauge", "Number of entries in memdb not yet synced to disk.", db.internal.mem.Size())
+	metric("wal_pending_logs", "gauge", "Number of write ahead logs not yet applied.", int64(len(db.internal.mem.LogFiles())))
+}
+
 // ResponseHandler handles responses for monitoring routes.
 func ResponseHandler(w http.ResponseWriter, r *http.Request, data []byte) {
 	// Get callback from request.
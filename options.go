@@ -19,6 +19,8 @@ package unitdb
 import (
 	"time"
 
+	"github.com/unit-io/unitdb/hash"
+	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
 )
 
@@ -27,11 +29,29 @@ type _Flags struct {
 	// immutable set immutable flag on database.
 	immutable bool
 
+	// readOnly opens the database files read-only.
+	readOnly bool
+
 	// encryption flag to encrypt keys.
 	encryption bool
 
 	// backgroundKeyExpiry sets flag to run key expirer.
 	backgroundKeyExpiry bool
+
+	// readCache sets flag to cache entries read from the data file.
+	readCache bool
+
+	// topicDictionary sets flag to keep the topics in a topic file.
+	topicDictionary bool
+
+	// compactOnClose sets flag to compact the DB on close.
+	compactOnClose bool
+
+	// sortedTopics sets flag to keep the topic names sorted for prefix queries.
+	sortedTopics bool
+
+	// noWAL sets flag to skip writing the entries to the write ahead log.
+	noWAL bool
 }
 
 // _BatchOptions is used to set options when using batch operation.
@@ -39,6 +59,7 @@ type _BatchOptions struct {
 	contract      uint32
 	encryption    bool
 	writeInterval time.Duration
+	writeSize     int64
 }
 
 // _QueryOptions is used to set options for DB query.
@@ -71,11 +92,80 @@ type _Options struct {
 	// bufferSize sets Size of buffer to use for pooling.
 	bufferSize int64
 
+	// walPoolSize sets maximum number of buffers kept in the WAL buffer pool.
+	walPoolSize int
+
+	// walPoolBufferSize sets size of a buffer allocated by the WAL log writer.
+	walPoolBufferSize int64
+
 	// memdbSize sets Size of blockcache.
 	memdbSize int64
 
+	// memdbFullPolicy sets the policy applied to the puts once the memdb reaches the memdb size.
+	memdbFullPolicy MemdbFullPolicy
+
 	// freeBlockSize minimum freeblocks size before free blocks are allocated and reused.
 	freeBlockSize int64
+
+	// topicRateWindow sets the window of the moving average used to compute per topic write rates.
+	topicRateWindow time.Duration
+
+	// maxTopTopics sets the number of busiest topics reported by Varz.
+	maxTopTopics int
+
+	// valueCodec sets the codec used to compress payloads.
+	valueCodec Codec
+
+	// compressionThreshold sets payload size above which payloads are compressed.
+	compressionThreshold int
+
+	// idGenerator generates IDs returned by DB NewID.
+	idGenerator func() []byte
+
+	// filterFalsePositiveRate sets target false positive rate of the bloom filter.
+	filterFalsePositiveRate float64
+
+	// filterEntries sets number of entries used to size the bloom filter.
+	filterEntries uint64
+
+	// expiryInterval sets the interval between background expiry runs.
+	expiryInterval time.Duration
+
+	// expiryBatchSize sets maximum number of expired entries deleted per expiry run.
+	expiryBatchSize int
+
+	// expiryCallback is called for each entry deleted by the expirer.
+	expiryCallback func(topic, id []byte)
+
+	// compactionThreshold sets the fraction of the data file held by free blocks above which the DB is compacted.
+	compactionThreshold float64
+
+	// compactOnCloseTimeout sets maximum duration of the compaction on close.
+	compactOnCloseTimeout time.Duration
+
+	// maxPayloadSize sets maximum size of an entry payload in bytes.
+	maxPayloadSize int
+
+	// maxTopicLength sets maximum length of an entry topic in bytes.
+	maxTopicLength int
+
+	// watchBufferSize sets the number of write events buffered per watcher.
+	watchBufferSize int
+
+	// watchPolicy sets the policy applied to the write events once the buffer of a watcher is full.
+	watchPolicy WatchPolicy
+
+	// staleLockTimeout sets the age of the lock heartbeat above which the lock is taken over on open.
+	staleLockTimeout time.Duration
+
+	// sharedMemdb sets the memdb shared by the DBs opened with it.
+	sharedMemdb *memdb.DB
+
+	// memdbID sets the ID of the DB namespacing its entries in the shared memdb.
+	memdbID uint16
+
+	// keyHash sets the hash function the keys of the memdb and the topics of the time window are hashed with.
+	keyHash hash.KeyHash
 }
 
 // Options it contains configurable options and flags for DB.
@@ -118,6 +208,16 @@ func WithMutable() Options {
 	})
 }
 
+// WithReadOnly opens DB read-only. The DB files are opened under a shared lock so
+// multiple read-only handles can open the same DB, and the background syncer and
+// key expirer are not started. Put, Delete, Batch and Compact return ErrReadOnly.
+// The write ahead log is recovered on the next open for writes.
+func WithReadOnly() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.readOnly = true
+	})
+}
+
 // WithEncryption sets encryption on DB.
 func WithEncryption() Options {
 	return newFuncOption(func(o *_Options) {
@@ -132,6 +232,24 @@ func WithBackgroundKeyExpiry() Options {
 	})
 }
 
+// WithReadCache sets read-through cache for DB. Entries read from the data file
+// are cached in memory up to memdb size, in addition to the memory held by the memdb.
+func WithReadCache() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.readCache = true
+	})
+}
+
+// WithTopicDictionary keeps the raw topics and the topic names in a topic file, so the topics
+// are loaded on open without reading the data file and the expiry callback reports the topic
+// of entries put before the DB was reopened. The topic file is rebuilt from the data file if
+// it is missing topics.
+func WithTopicDictionary() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.topicDictionary = true
+	})
+}
+
 // WithDefaultBatchOptions will set some default values for Batch operation.
 //   contract: MasterContract
 //   encryption: False
@@ -163,6 +281,17 @@ func WithBatchWriteInterval(dur time.Duration) Options {
 	})
 }
 
+// WithBatchWriteSize sets the size in bytes of the entries accumulated by a batch before
+// they are written to the DB, so a large batch is written in parts and does not hold all its
+// entries in memory. Entries written in parts are visible to queries before the batch commits,
+// as entries written with Batch Write, and are synced to the DB files once the batch commits.
+// Zero disables partial writes.
+func WithBatchWriteSize(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.batchOptions.writeSize = size
+	})
+}
+
 // WithDefaultQueryOptions will set some default values for Query operation.
 //   defaultQueryLimit: 1000
 //   maxQueryLimit: 100000
@@ -194,6 +323,33 @@ func WithDefaultOptions() Options {
 		if o.encryptionKey == nil {
 			o.encryptionKey = []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
 		}
+		if o.topicRateWindow == 0 {
+			o.topicRateWindow = time.Minute
+		}
+		if o.maxTopTopics == 0 {
+			o.maxTopTopics = 10
+		}
+		if o.valueCodec == nil {
+			o.valueCodec = SnappyCompression
+		}
+		if o.filterEntries == 0 {
+			o.filterEntries = 1 << 20
+		}
+		if o.expiryInterval == 0 {
+			o.expiryInterval = time.Minute * maxExpDur
+		}
+		if o.expiryBatchSize == 0 {
+			o.expiryBatchSize = 1000
+		}
+		if o.maxPayloadSize == 0 {
+			o.maxPayloadSize = 1 << 19 // 512KB
+		}
+		if o.maxTopicLength == 0 {
+			o.maxTopicLength = maxTopicLength
+		}
+		if o.watchBufferSize == 0 {
+			o.watchBufferSize = defaultWatchBufferSize
+		}
 	})
 }
 
@@ -229,6 +385,16 @@ func WithBufferSize(size int64) Options {
 	})
 }
 
+// WithWALBufferPool sets maximum number of buffers kept in the WAL buffer pool
+// and size of a buffer allocated by the WAL log writer. Pre-sizing the pool
+// avoids allocating log buffers under high write concurrency.
+func WithWALBufferPool(poolSize int, bufferSize int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.walPoolSize = poolSize
+		o.walPoolBufferSize = bufferSize
+	})
+}
+
 // WithMemdbSize sets Size of blockcache.
 func WithMemdbSize(size int64) Options {
 	return newFuncOption(func(o *_Options) {
@@ -236,6 +402,28 @@ func WithMemdbSize(size int64) Options {
 	})
 }
 
+// MemdbFullPolicy is the policy applied to the puts once the memdb reaches the memdb size.
+type MemdbFullPolicy uint8
+
+const (
+	// MemdbFullAllow accepts the puts, the log writes back off until the memdb is synced.
+	MemdbFullAllow MemdbFullPolicy = iota
+	// MemdbFullReject rejects the puts with ErrMemdbFull.
+	MemdbFullReject
+	// MemdbFullShrink flushes and syncs the memdb to the DB files right away to free space for
+	// the put, and rejects the put with ErrMemdbFull if the memdb is still full.
+	MemdbFullShrink
+	// MemdbFullBlock blocks the puts until the background sync frees space.
+	MemdbFullBlock
+)
+
+// WithMemdbFullPolicy sets the policy applied to the puts once the memdb reaches the memdb size.
+func WithMemdbFullPolicy(policy MemdbFullPolicy) Options {
+	return newFuncOption(func(o *_Options) {
+		o.memdbFullPolicy = policy
+	})
+}
+
 // WithFreeBlockSize sets minimum freeblocks size
 // before free blocks are allocated and reused.
 func WithFreeBlockSize(size int64) Options {
@@ -250,3 +438,215 @@ func WithEncryptionKey(key []byte) Options {
 		o.encryptionKey = key
 	})
 }
+
+// WithTopicRateWindow sets the window of the moving average
+// used to compute per topic write rates. The window must be positive.
+func WithTopicRateWindow(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.topicRateWindow = dur
+	})
+}
+
+// WithMaxTopTopics sets the number of busiest topics reported by Varz. The number must be positive.
+func WithMaxTopTopics(n int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.maxTopTopics = n
+	})
+}
+
+// WithValueCompression sets the codec used to compress payloads
+// written to the data file, for example SnappyCompression or NoCompression.
+func WithValueCompression(codec Codec) Options {
+	return newFuncOption(func(o *_Options) {
+		o.valueCodec = codec
+	})
+}
+
+// WithCompressionThreshold sets payload size in bytes above which payloads are compressed.
+// Smaller payloads are stored uncompressed.
+func WithCompressionThreshold(size int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.compressionThreshold = size
+	})
+}
+
+// WithIDGenerator sets the generator used by DB NewID to mint message IDs.
+//
+// A generated ID must be 16 bytes long. First 4 bytes hold the little endian
+// creation time as returned by uid.NewApoch and it is used by query cutoff,
+// next 4 bytes are reserved for the contract which is set when the entry is put,
+// and last 8 bytes hold a unique non zero little endian sequence.
+// Entries are ordered by the sequence so the generator must keep it increasing,
+// NewID returns an error if the generated sequence is not after the DB sequence.
+// The DB sequence is advanced to the generated sequence.
+func WithIDGenerator(fn func() []byte) Options {
+	return newFuncOption(func(o *_Options) {
+		o.idGenerator = fn
+	})
+}
+
+// WithFilterFalsePositiveRate sizes the bloom filter of a new DB for the false positive rate.
+// The filter is sized for the number of entries set using WithFilterExpectedEntries.
+// Filter parameters are persisted so the option has no effect on an existing DB.
+func WithFilterFalsePositiveRate(p float64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.filterFalsePositiveRate = p
+	})
+}
+
+// WithFilterExpectedEntries sets number of entries used to size the bloom filter
+// of a new DB with the false positive rate set using WithFilterFalsePositiveRate.
+func WithFilterExpectedEntries(n uint64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.filterEntries = n
+	})
+}
+
+// WithExpiryInterval sets the interval between background expiry runs, the interval must be positive.
+// The expirer runs more often while there is a backlog of expired entries.
+func WithExpiryInterval(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.expiryInterval = dur
+	})
+}
+
+// WithExpiryBatchSize sets maximum number of expired entries deleted per expiry run, the size must be positive.
+func WithExpiryBatchSize(size int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.expiryBatchSize = size
+	})
+}
+
+// WithExpiryCallback sets a callback called for each entry deleted by the expirer.
+// The callback is called with the topic and the message ID of the expired entry.
+// Topic is nil if the topic has not been written since the DB was opened, as topic
+// names are not stored in DB.
+func WithExpiryCallback(fn func(topic, id []byte)) Options {
+	return newFuncOption(func(o *_Options) {
+		o.expiryCallback = fn
+	})
+}
+
+// WithMaxPayloadSize sets maximum size of an entry payload in bytes, 512KB by default.
+// Putting a larger payload returns ErrEntryTooLarge.
+func WithMaxPayloadSize(size int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.maxPayloadSize = size
+	})
+}
+
+// WithMaxTopicLength sets maximum length of an entry topic in bytes.
+// Putting an entry with a longer topic returns ErrEntryTooLarge.
+func WithMaxTopicLength(length int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.maxTopicLength = length
+	})
+}
+
+// WithCompactionThreshold compacts the DB during the background sync once the free blocks
+// released by deleted and expired entries exceed the fraction of the data file, for example
+// 0.5 compacts the DB when half of the data file is free. Zero disables automatic compaction.
+func WithCompactionThreshold(fraction float64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.compactionThreshold = fraction
+	})
+}
+
+// WithCompactOnClose compacts the DB on Close after the final sync once the free blocks exceed
+// the compaction threshold, or a quarter of the data file if no threshold is set. The compaction
+// is skipped if it does not complete within timeout, so a fast shutdown is not held up.
+// Zero timeout does not limit the compaction.
+func WithCompactOnClose(timeout time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.compactOnClose = true
+		o.compactOnCloseTimeout = timeout
+	})
+}
+
+// WithSortedTopics keeps a sorted index of the topic names, so TopicsWithPrefix returns
+// the topics under a prefix in lexical order without matching the whole topic trie.
+func WithSortedTopics() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.sortedTopics = true
+	})
+}
+
+// WatchPolicy is the policy applied to the write events once the buffer of a watcher is full.
+type WatchPolicy uint8
+
+const (
+	// WatchDrop drops the write events the watcher has no buffer for.
+	WatchDrop WatchPolicy = iota
+	// WatchBlock blocks the sync until the watcher receives the write events.
+	WatchBlock
+)
+
+// defaultWatchBufferSize is the number of write events buffered per watcher if no size is set.
+const defaultWatchBufferSize = 1024
+
+// WithWatchBufferSize sets the number of write events buffered per watcher. A size that is not
+// positive falls back to the default of 1024.
+func WithWatchBufferSize(size int) Options {
+	return newFuncOption(func(o *_Options) {
+		if size <= 0 {
+			size = defaultWatchBufferSize
+		}
+		o.watchBufferSize = size
+	})
+}
+
+// WithWatchPolicy sets the policy applied to the write events once the buffer of a watcher is full.
+func WithWatchPolicy(policy WatchPolicy) Options {
+	return newFuncOption(func(o *_Options) {
+		o.watchPolicy = policy
+	})
+}
+
+// WithNoWAL skips writing the entries to the write ahead log, for a one-shot bulk import where the
+// WAL overhead dominates and a failed import is run again. The entries are written to the index
+// and data files only when they are synced, so call Sync once the import is done. Sync waits for
+// the current time block to pass so the latest entries are synced too, it blocks for up to a second.
+//
+// WARNING: without the WAL nothing put since the last sync survives a crash, a crash in the middle
+// of an import loses every entry put since the last sync. Do not use it for live writes.
+func WithNoWAL() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.noWAL = true
+	})
+}
+
+// WithStaleLockTimeout takes over the lock of the DB on open if the holder has not refreshed
+// the heartbeat in the lock file within the timeout and the process of the holder is not
+// running, e.g. the holder crashed on a file system that does not release the lock of the
+// process. The holder refreshes the heartbeat every second, so the timeout must be well above it.
+func WithStaleLockTimeout(timeout time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.staleLockTimeout = timeout
+	})
+}
+
+// WithSharedMemdb opens the DB on a memdb shared by the DBs of the process, so dozens of small DBs
+// share one cache and one log writer. The entries of the DB are kept under the namespace of the
+// id in the memdb, each DB sharing the memdb needs a distinct id. The memdb is opened and closed
+// by the caller, it is not closed when the DB is closed. The memdb options of the DB, such as the
+// memdb size and WithNoWAL, are ignored in favour of the options the memdb is opened with.
+//
+// The write ahead log of a shared memdb is not part of the backup of the DB, so sync the DB before
+// the backup to include the entries in the backup.
+func WithSharedMemdb(mem *memdb.DB, id uint16) Options {
+	return newFuncOption(func(o *_Options) {
+		o.sharedMemdb = mem
+		o.memdbID = id
+	})
+}
+
+// WithKeyHash sets the hash function the keys of the memdb and the topic hashes of the time window
+// are hashed with before they are assigned to the blocks, e.g. to spread the entries of contracts
+// clustering poorly under the default. The hash function must be deterministic, Open panics
+// otherwise. The blocks are not persisted, so the hash function may change between opens. It is
+// ignored for the memdb opened with WithSharedMemdb, the memdb is opened with memdb.WithKeyHash.
+func WithKeyHash(fn hash.KeyHash) Options {
+	return newFuncOption(func(o *_Options) {
+		o.keyHash = fn
+	})
+}
@@ -17,16 +17,21 @@
 package unitdb
 
 import (
+	"encoding/binary"
+	"sort"
 	"time"
 
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 // Query represents a topic to query and optional contract information.
 type (
 	_Query struct {
-		topicHash uint64
-		seq       uint64
+		topicHash  uint64
+		seq        uint64
+		expiresAt  uint32
+		insertedAt uint32
 	}
 	_InternalQuery struct {
 		parts      []message.Part // The parts represents a topic which contains a contract and a list of hashes for various parts of the topic.
@@ -34,18 +39,95 @@ type (
 		topicType  uint8
 		prefix     uint64 // The prefix is generated from contract and first of the topic.
 		cutoff     int64  // The cutoff is time limit check on message IDs.
+		to         int64  // The to is the upper time limit check on message IDs.
+		cursor     uint64 // The cursor is the seq the query resumes from.
+		since      uint64 // The since is the seq the query returns entries after.
+		next       uint64 // The next is the last seq reached by the query.
 		winEntries []_Query
 
 		opts *_QueryOptions
 	}
+	// Item is an entry returned by a query.
+	Item struct {
+		ID         []byte    // The message ID.
+		Value      []byte    // The message payload.
+		InsertedAt time.Time // The time the message was put with a resolution of a second.
+
+		expiresAt uint32
+	}
 	Query struct {
 		internal _InternalQuery
 		Topic    []byte // The topic of the message.
 		Contract uint32 // The contract is used as prefix in the message ID.
 		Limit    int    // The maximum number of elements to return.
+		Cursor   []byte // The continuation token returned by a previous query.
+		// Ascending returns the entries in insertion order, oldest entries first.
+		Ascending bool
+		// SinceSeq returns only the entries with a seq greater than SinceSeq if non zero.
+		SinceSeq uint64
+		// Expired returns the expired entries not yet reclaimed along with the live entries.
+		Expired bool
+		// Last returns only the entries inserted within the duration before the query runs if non zero.
+		Last time.Duration
+		// From and To return only the entries inserted within the time range if non zero, the bounds
+		// are inclusive. The range cannot be combined with Last.
+		From time.Time
+		To   time.Time
+	}
+	// TopicKey identifies the results of a query by the contract and the topic of the query.
+	TopicKey struct {
+		Contract uint32
+		Topic    string
 	}
 )
 
+// newItem creates an item from the stored ID prefix and the entry seq. The time the message ID was
+// generated is used as the insertion time if the window entry has no insertion time, i.e. the entry
+// is written to a window block of version 1 or recovered from the WAL.
+func newItem(prefix []byte, q _Query, val []byte) Item {
+	id := messageID(prefix, q.seq)
+	insertedAt := time.Unix(int64(q.insertedAt), 0)
+	if q.insertedAt == 0 {
+		insertedAt = time.Unix(uid.Time(id[:4]), 0)
+	}
+	return Item{
+		ID:         id,
+		Value:      val,
+		InsertedAt: insertedAt,
+		expiresAt:  q.expiresAt,
+	}
+}
+
+// ExpiresAt returns the expiry time of the item in seconds since the epoch, or 0 if the item does not expire.
+func (it Item) ExpiresAt() uint32 {
+	return it.expiresAt
+}
+
+// IsExpired returns true if the item has expired. Expired items are returned only by a query with WithExpired set.
+func (it Item) IsExpired() bool {
+	return it.expiresAt != 0 && it.expiresAt <= uint32(time.Now().Unix())
+}
+
+// messageID creates the message ID from the stored ID prefix and the entry seq.
+func messageID(prefix []byte, seq uint64) message.ID {
+	id := make(message.ID, message.ID(prefix).Size())
+	copy(id, prefix[:8])
+	binary.LittleEndian.PutUint64(id[8:], seq)
+	return id
+}
+
+// values returns payloads of the items.
+func values(items []Item) [][]byte {
+	if items == nil {
+		return nil
+	}
+	vals := make([][]byte, len(items))
+	for i, item := range items {
+		vals[i] = item.Value
+	}
+	return vals
+}
+
 // NewQuery creates a new query structure from the topic.
 func NewQuery(topic []byte) *Query {
 	opts := &_Options{}
@@ -68,29 +150,133 @@ func (q *Query) WithLimit(limit int) *Query {
 	return q
 }
 
-// WithLast sets query duration to fetch stored messages.
+// WithCursor sets the continuation token returned by Next on a previous query.
+// The query resumes from entries older than the last entry returned by that query.
+func (q *Query) WithCursor(token []byte) *Query {
+	q.Cursor = token
+	return q
+}
+
+// WithAscending sets query to return entries in insertion order, oldest entries first.
+// The query cursor then resumes from entries newer than the last entry returned.
+func (q *Query) WithAscending() *Query {
+	q.Ascending = true
+	return q
+}
+
+// WithExpired sets query to return the expired entries not yet reclaimed along with the live entries.
+// The expired items are told apart by Item.IsExpired.
+func (q *Query) WithExpired() *Query {
+	q.Expired = true
+	return q
+}
+
+// WithSinceSeq sets query to return only the entries put after the seq returned by DB.Seq,
+// so a consumer checkpoints the seq and resumes from the entries newer than the checkpoint.
+func (q *Query) WithSinceSeq(seq uint64) *Query {
+	q.SinceSeq = seq
+	return q
+}
+
+// Next returns a continuation token to fetch the next page of results once the
+// query has run. It returns nil if no more entries follow. The token encodes
+// the seq of the last entry reached so it remains valid across concurrent writes.
+func (q *Query) Next() []byte {
+	if q.internal.next == 0 {
+		return nil
+	}
+	token := make([]byte, 8)
+	binary.LittleEndian.PutUint64(token, q.internal.next)
+	return token
+}
+
+// WithLast sets query duration to fetch stored messages. The duration is parsed by
+// time.ParseDuration, the query is not changed if the duration is invalid.
+//
+// Deprecated: Use WithLastDuration.
 func (q *Query) WithLast(dur string) *Query {
-	base := time.Now()
-	duration, err := time.ParseDuration(dur)
+	d, err := time.ParseDuration(dur)
 	if err != nil {
 		return q
 	}
-	// In case of last, include it to the query.
-	q.internal.cutoff = base.Add(-duration).Unix()
+	return q.WithLastDuration(d)
+}
+
+// WithLastDuration sets query to return only the entries inserted within the duration before the query runs.
+func (q *Query) WithLastDuration(d time.Duration) *Query {
+	q.Last = d
+	return q
+}
+
+// WithFrom sets query to return only the entries inserted at or after the time.
+func (q *Query) WithFrom(from time.Time) *Query {
+	q.From = from
+	return q
+}
+
+// WithTo sets query to return only the entries inserted at or before the time.
+func (q *Query) WithTo(to time.Time) *Query {
+	q.To = to
+	return q
+}
+
+// validate checks the query options are valid and not contradictory.
+func (q *Query) validate() error {
 	switch {
-	case (q.Limit == 0):
-		q.Limit = q.internal.opts.defaultQueryLimit
-	case q.Limit > q.internal.opts.maxQueryLimit:
-		q.Limit = q.internal.opts.maxQueryLimit
+	case q.Limit < 0 || q.Last < 0:
+		return errBadRequest
+	case q.Last != 0 && (!q.From.IsZero() || !q.To.IsZero()):
+		return errQueryConflict
+	case !q.From.IsZero() && !q.To.IsZero() && q.From.After(q.To):
+		return errQueryConflict
 	}
+	return nil
+}
 
-	return q
+// after returns the seq the ascending query starts after, it is the later of the cursor and the since seq.
+func (q *_InternalQuery) after() uint64 {
+	if q.since > q.cursor {
+		return q.since
+	}
+	return q.cursor
+}
+
+// sortEntries sorts the window entries of the query by seq in the order of the query.
+func (q *Query) sortEntries() {
+	sort.Slice(q.internal.winEntries[:], func(i, j int) bool {
+		if q.Ascending {
+			return q.internal.winEntries[i].seq < q.internal.winEntries[j].seq
+		}
+		return q.internal.winEntries[i].seq > q.internal.winEntries[j].seq
+	})
+}
+
+// limitEntries sorts the window entries of the query and keeps the entries up to the query limit.
+// The entries of all topics of the query are kept by their order, so the cursor set from the
+// entries read does not skip the entries of a topic not yet read.
+func (q *Query) limitEntries() {
+	q.sortEntries()
+	if len(q.internal.winEntries) > q.Limit {
+		q.internal.winEntries = q.internal.winEntries[:q.Limit]
+	}
 }
 
 func (q *Query) parse() error {
+	if err := q.validate(); err != nil {
+		return err
+	}
 	if q.Contract == 0 {
 		q.Contract = message.MasterContract
 	}
+	q.internal.cursor = 0
+	q.internal.next = 0
+	if len(q.Cursor) != 0 {
+		if len(q.Cursor) != 8 {
+			return errCursorInvalid
+		}
+		q.internal.cursor = binary.LittleEndian.Uint64(q.Cursor)
+	}
+	q.internal.since = q.SinceSeq
 	topic := new(message.Topic)
 	//Parse the Key.
 	topic.ParseKey(q.Topic)
@@ -104,9 +290,29 @@ func (q *Query) parse() error {
 	q.internal.depth = topic.Depth
 	q.internal.topicType = topic.TopicType
 	q.internal.prefix = message.Prefix(q.internal.parts)
+	q.internal.cutoff = 0
+	q.internal.to = 0
+	switch {
+	case q.Last != 0:
+		q.internal.cutoff = time.Now().Add(-q.Last).Unix()
+		if q.Limit > q.internal.opts.maxQueryLimit {
+			q.Limit = q.internal.opts.maxQueryLimit
+		}
+	case !q.From.IsZero():
+		q.internal.cutoff = q.From.Unix()
+	}
+	if !q.To.IsZero() {
+		q.internal.to = q.To.Unix()
+	}
 	// In case of last, include it to the query.
 	if from, limit, ok := topic.Last(); ok {
-		q.internal.cutoff = from.Unix()
+		// The last duration of the topic cannot be combined with the time options of the query.
+		if from.Unix() > 0 {
+			if q.Last != 0 || !q.From.IsZero() || !q.To.IsZero() {
+				return errQueryConflict
+			}
+			q.internal.cutoff = from.Unix()
+		}
 		switch {
 		case (q.Limit == 0 && limit == 0):
 			q.Limit = q.internal.opts.defaultQueryLimit
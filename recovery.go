@@ -20,7 +20,9 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"sync/atomic"
 
+	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
 	// _ "net/http/pprof"
 )
@@ -35,7 +37,7 @@ func (db *_SyncHandle) recoverWindowBlocks(windowEntries map[uint64]_WindowEntri
 		if err != nil {
 			return err
 		}
-		if ok := db.internal.trie.setOffset(_Topic{hash: h, offset: wOff}); !ok {
+		if ok := db.internal.trie.setOffset(h, wOff); !ok {
 			return errors.New("recovery.recoverWindowBlocks: timeWindow sync error, unable to set topic offset in trie")
 		}
 	}
@@ -50,6 +52,13 @@ func (db *_SyncHandle) startRecovery() error {
 		db.internal.closeW.Done()
 	}()
 	fmt.Println("db.recoverLog: start recovery")
+	// The sequence is persisted on sync, so if the DB was not closed cleanly the entries
+	// recovered from the log are ahead of it. Advance the sequence past those entries.
+	for _, seq := range db.internal.mem.Keys() {
+		if seq > db.seq() {
+			atomic.StoreUint64(&db.internal.dbInfo.sequence, seq)
+		}
+	}
 	if ok := db.startSync(); !ok {
 		return nil
 	}
@@ -102,7 +111,19 @@ func (db *_SyncHandle) startRecovery() error {
 				if err := t.Unmarshal(rawtopic); err != nil {
 					return false, err
 				}
+				if err := db.putTopic(m.topicHash, rawtopic, ""); err != nil {
+					return false, err
+				}
 				db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth)
+				// The topics recovered from the log are named by the topic dictionary.
+				if db.internal.topicDict != nil {
+					if r, ok := db.internal.topicDict.get(m.topicHash); ok {
+						db.setTopicName(m.topicHash, r)
+					}
+				}
+				if name, ok := db.internal.topics.name(m.topicHash); ok && db.internal.topicIndex != nil && staticTopic(t) {
+					db.internal.topicIndex.add(t.Parts[0].Hash, name, m.topicHash)
+				}
 			}
 			if _, ok := winEntries[m.topicHash]; ok {
 				winEntries[m.topicHash] = append(winEntries[m.topicHash], newWinEntry(e.seq, m.expiresAt))
@@ -140,7 +161,7 @@ func (db *_SyncHandle) startRecovery() error {
 			// if err := timeRelease(timeID); err != nil {
 			// 	return false, err
 			// }
-			if err := db.internal.mem.Free(timeID); err != nil {
+			if err := db.internal.mem.free(timeID, seqs); err != nil {
 				return true, err
 			}
 		}
@@ -176,3 +197,36 @@ func (db *DB) recoverLog() error {
 
 	return nil
 }
+
+// LogReport reports the write ahead log entries recovery would apply to the DB.
+type LogReport struct {
+	// Logs is the number of logs that would be applied.
+	Logs int
+	// Entries is the number of entries that would be recovered.
+	Entries int64
+	// Deletes is the number of deletes that would be applied.
+	Deletes int64
+	// FirstSeq and LastSeq is the sequence range of the entries that would be recovered.
+	FirstSeq, LastSeq uint64
+	// Corrupted lists the time IDs of the logs that are unreadable.
+	Corrupted []int64
+}
+
+// VerifyLog replays the write ahead log of the DB at path read-only and reports
+// what recovery would apply on the next Open. It does not write to the index or
+// data files nor modify the log, so it is safe to run on a suspect DB before
+// opening it.
+func VerifyLog(path string) (LogReport, error) {
+	r, err := memdb.VerifyLog(memdb.WithLogFilePath(path))
+	if err != nil {
+		return LogReport{}, err
+	}
+	return LogReport{
+		Logs:      r.Logs,
+		Entries:   r.Entries,
+		Deletes:   r.Deletes,
+		FirstSeq:  r.MinKey,
+		LastSeq:   r.MaxKey,
+		Corrupted: r.Corrupted,
+	}, nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package unitdb
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// _Retention holds the maximum number of entries kept per topic.
+type _Retention struct {
+	mu       sync.RWMutex
+	maxCount map[uint64]uint32
+}
+
+func newRetention() *_Retention {
+	return &_Retention{maxCount: make(map[uint64]uint32)}
+}
+
+// set sets the maximum number of entries kept for the topic hash.
+func (r *_Retention) set(topicHash uint64, maxCount uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxCount[topicHash] = maxCount
+}
+
+// get returns the maximum number of entries kept for the topic hash.
+func (r *_Retention) get(topicHash uint64) (uint32, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	maxCount, ok := r.maxCount[topicHash]
+	return maxCount, ok
+}
+
+// trimTopics deletes the oldest entries of the topics beyond the maximum number of live entries
+// kept for the topic. The deleted and expired entries are not counted. The n entries appended to
+// the window chain of a topic on sync push at most the n oldest live entries out of the limit, so
+// the window entries are walked until n entries are trimmed, the walk is extended past the limit
+// and the appended entries as the deleted entries are skipped. Like expiry, the entries are trimmed
+// if the DB is immutable. The caller must hold the sync lock.
+func (db *DB) trimTopics(appended map[uint64]int) error {
+	if len(appended) == 0 {
+		return nil
+	}
+	w, err := newBlockWriter(db.fs, db.fileVersion(), db.internal.freeList, nil)
+	if err != nil {
+		return err
+	}
+	var trimmed uint64
+	for topicHash, n := range appended {
+		maxCount, ok := db.internal.retention.get(topicHash)
+		if !ok {
+			continue
+		}
+		off, ok := db.internal.trie.getOffset(topicHash)
+		if !ok {
+			continue
+		}
+		r := _BlockReader{indexFile: w.indexFile}
+		live, trim := 0, 0
+		for limit, done := int(maxCount)+n, 0; trim < n; limit *= 2 {
+			wEntries, err := db.internal.timeWindow.flookup(context.Background(), db.fs, topicHash, 0, 0, off, 0, limit, true, nil)
+			if err != nil {
+				return err
+			}
+			for _, we := range wEntries[done:] {
+				// The expired entries are freed on expiry.
+				if we.isExpired() {
+					continue
+				}
+				if _, err := r.readEntry(we.seq()); err != nil {
+					if err == errMsgIDDeleted || err == errEntryInvalid || err == io.EOF {
+						continue
+					}
+					return err
+				}
+				if live++; live <= int(maxCount) {
+					continue
+				}
+				e, err := w.del(we.seq())
+				if err != nil {
+					return err
+				}
+				trim++
+				if e.seq == 0 || e.isDeleted() {
+					continue
+				}
+				db.internal.mem.Delete(e.seq)
+				if db.internal.cache != nil {
+					db.internal.cache.delete(e.seq)
+				}
+				// The record of an entry packing the raw topic is kept.
+				if e.topicSize == 0 {
+					db.internal.freeList.freeBlock(e.msgOffset, e.mSize(db.fileVersion()))
+				}
+				trimmed++
+			}
+			if len(wEntries) < limit {
+				break
+			}
+			done = len(wEntries)
+		}
+	}
+	if trimmed == 0 {
+		return nil
+	}
+	if err := w.writeIndex(); err != nil {
+		return err
+	}
+	db.decount(trimmed)
+	db.internal.meter.Dels.Inc(int64(trimmed))
+	return db.sync()
+}
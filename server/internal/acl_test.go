@@ -0,0 +1,169 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/unit-io/unitdb/server/internal/message/security"
+	"github.com/unit-io/unitdb/server/internal/pkg/crypto"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/types"
+)
+
+func TestTopicACL(t *testing.T) {
+	acl, err := security.NewACL(security.ACLConfig{
+		Default: security.ACLDeny,
+		Rules: []security.ACLRule{
+			{ClientID: "client1", Topic: "unit1.private...", Access: "readwrite", Policy: security.ACLDeny},
+			{ClientID: "client1", Topic: "unit1...", Access: "readwrite"},
+			{ClientID: "*", Topic: "unit1.*.status", Access: "read"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &_Service{acl: acl}
+
+	tests := []struct {
+		clientID  string
+		topic     string
+		access    uint32
+		forwarded bool
+		err       *types.Error
+	}{
+		// Allowed publish
+		{"client1", "unit1.test", security.AllowWrite, false, nil},
+		{"client1", "unit1.test.a.b", security.AllowWrite, false, nil},
+		// Denied publish
+		{"client1", "unit1.private.test", security.AllowWrite, false, types.ErrTopicForbidden},
+		{"client2", "unit1.test", security.AllowWrite, false, types.ErrTopicForbidden},
+		{"client2", "unit2.test", security.AllowWrite, false, types.ErrTopicForbidden},
+		// Wildcard scoped grants
+		{"client2", "unit1.a.status", security.AllowRead, false, nil},
+		{"client2", "unit1.a.b.status", security.AllowRead, false, types.ErrTopicForbidden},
+		{"client2", "unit1.a.status", security.AllowWrite, false, types.ErrTopicForbidden},
+		// Forwarded requests are authorized at the origin node.
+		{"client2", "unit2.test", security.AllowWrite, true, nil},
+	}
+	for _, tc := range tests {
+		c := &_Conn{service: s, aclClientID: tc.clientID}
+		topic := security.ParseKey([]byte(tc.topic))
+		if err := c.authorize(topic, tc.access, tc.forwarded); err != tc.err {
+			t.Fatalf("client %s access %d to topic %s: expected %v, got %v", tc.clientID, tc.access, tc.topic, tc.err, err)
+		}
+	}
+
+	// Reloading the policy replaces the rules.
+	if err := s.ReloadACL([]byte(`{"default": "allow", "rules": [{"client_id": "client1", "topic": "unit1.test", "access": "write", "policy": "deny"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	c := &_Conn{service: s, aclClientID: "client1"}
+	if err := c.authorize(security.ParseKey([]byte("unit1.test")), security.AllowWrite, false); err != types.ErrTopicForbidden {
+		t.Fatalf("expected %v, got %v", types.ErrTopicForbidden, err)
+	}
+	if err := c.authorize(security.ParseKey([]byte("unit2.test")), security.AllowWrite, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadACL([]byte(`{"default": "none"}`)); err != security.ErrInvalidACLPolicy {
+		t.Fatalf("expected %v, got %v", security.ErrInvalidACLPolicy, err)
+	}
+}
+
+func TestTopicACLIdentity(t *testing.T) {
+	mac := crypto.NewKeyring()
+	if err := mac.Add("a", []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := mac.Add("b", []byte("mex8oBSd59m6I4BWm1vZletvrCDGWsF6"), 2); err != nil {
+		t.Fatal(err)
+	}
+	s := &_Service{acl: &security.ACL{}, mac: mac}
+	denied, err := uid.NewClientID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := uid.NewClientID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := denied.Encode(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untagged := tagged[:len(tagged)-2]
+	if err := s.ReloadACL([]byte(fmt.Sprintf(`{"rules": [{"client_id": "%s", "topic": "unit1...", "access": "write", "policy": "deny"}]}`, untagged))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The variants of the denied client ID are the same client and are denied.
+	topic := security.ParseKey([]byte("unit1.test"))
+	for _, clientID := range []string{untagged, tagged, untagged + ".x"} {
+		c := &_Conn{service: s, aclClientID: s.aclIdentity(clientID)}
+		if err := c.authorize(topic, security.AllowWrite, false); err != types.ErrTopicForbidden {
+			t.Fatalf("client %s: expected %v, got %v", clientID, types.ErrTopicForbidden, err)
+		}
+	}
+	encoded, err := other.Encode(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &_Conn{service: s, aclClientID: s.aclIdentity(encoded)}
+	if err := c.authorize(topic, security.AllowWrite, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopicEscapes(t *testing.T) {
+	tests := []struct {
+		topic    string
+		wildcard bool
+	}{
+		{`unit1.a.*`, true},
+		{`unit1.a...`, true},
+		{`unit1.a.\*`, false},
+		{`unit1.a\...`, false},
+		{`key/unit1.a\.*`, true},
+		{`key/unit1.a\.b?last=1`, false},
+	}
+	for _, tc := range tests {
+		if wildcard := security.ParseKey([]byte(tc.topic)).IsWildcard(); wildcard != tc.wildcard {
+			t.Fatalf("topic %s: expected wildcard %v, got %v", tc.topic, tc.wildcard, wildcard)
+		}
+	}
+	if topic := security.ParseKey([]byte(`key/unit1.a\.b?last=1`)); string(topic.Topic[:topic.Size]) != `unit1.a\.b` {
+		t.Fatalf("expected topic of key parsed; got %s", topic.Topic[:topic.Size])
+	}
+
+	matches := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{`unit1.*`, `unit1.a\.b`, true},
+		{`unit1.*`, `unit1.a.b`, false},
+		{`unit1.a\.b...`, `unit1.a\.b.c`, true},
+		{`unit1.a...`, `unit1.a\.b`, false},
+		{`unit1.a\...`, `unit1.a\...`, true},
+	}
+	for _, tc := range matches {
+		if match := security.MatchTopic([]byte(tc.pattern), []byte(tc.topic)); match != tc.match {
+			t.Fatalf("pattern %s topic %s: expected match %v, got %v", tc.pattern, tc.topic, tc.match, match)
+		}
+	}
+}
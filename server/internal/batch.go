@@ -192,7 +192,7 @@ func (m *batchManager) publish(c *_Conn, publishWaitTimeout time.Duration) {
 			pub.MessageID = uint16(c.MessageIds.NextID(utp.PUBLISH))
 
 			// persist outbound
-			store.Log.PersistOutbound(uint32(c.connID), pub)
+			store.Log.PersistOutbound(uint32(c.sessID), pub)
 
 			select {
 			case c.pub <- pub:
@@ -205,7 +205,7 @@ func (m *batchManager) publish(c *_Conn, publishWaitTimeout time.Duration) {
 				pub.MessageID = uint16(c.MessageIds.NextID(utp.PUBLISH))
 
 				// persist outbound
-				store.Log.PersistOutbound(uint32(c.connID), pub)
+				store.Log.PersistOutbound(uint32(c.sessID), pub)
 				select {
 				case c.pub <- pub:
 				case <-time.After(publishWaitTimeout):
@@ -21,10 +21,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/unitdb/server/internal/message"
@@ -34,19 +37,63 @@ import (
 	rh "github.com/unit-io/unitdb/server/internal/pkg/hash"
 	"github.com/unit-io/unitdb/server/internal/pkg/log"
 	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/store"
 	"github.com/unit-io/unitdb/server/utp"
 )
 
 const (
-	// Default timeout before attempting to reconnect to a node
+	// Default timeout before attempting to reconnect to a node, doubled on each failed attempt
 	defaultClusterReconnect = 200 * time.Millisecond
+	// Default maximum timeout before attempting to reconnect to a node
+	defaultClusterReconnectMax = 30 * time.Second
+	// Default fraction of the reconnect timeout randomized to spread the reconnects of the nodes
+	defaultClusterReconnectJitter = 0.2
+	// Default time to wait for the next request from a connecting node
+	defaultClusterReadTimeout = 120 * time.Second
+	// Default time to wait for a write to a node to complete
+	defaultClusterWriteTimeout = 120 * time.Second
 	// Number of replicas in ringhash
 	clusterHashReplicas = 20
+	// Default time between heartbeats sent to a node
+	defaultClusterHeartbeat = 1000 * time.Millisecond
+	// Default number of missed heartbeats before a node is considered disconnected
+	defaultClusterHeartbeatMissAfter = 3
+	// Default size of the outbound queue of a proxied session
+	defaultClusterQueueSize = 1
+	// Number of requests rejected in a row by a node before the ring hash is resynced from the node
+	defaultClusterResyncAfter = 2
+	// Initial time between ring hash resyncs, doubled on each resync
+	defaultClusterResyncBackoff = 1000 * time.Millisecond
+	// Maximum time between ring hash resyncs
+	maxClusterResyncBackoff = 60 * time.Second
+	// Default time to wait for the outbound messages to be delivered to the nodes on shutdown
+	defaultClusterDrainTimeout = 5 * time.Second
+	// Time between checks of the outbound messages pending delivery while draining
+	clusterDrainInterval = 10 * time.Millisecond
+)
+
+// Policies applied when the outbound queue of a proxied session is full.
+const (
+	// Wait until there is room in the queue
+	clusterQueueBlock = "block"
+	// Drop the oldest queued message to make room
+	clusterQueueDropOldest = "drop_oldest"
+	// Drop the new message and return an error
+	clusterQueueError = "error"
+)
+
+var (
+	errClusterQueueFull = errors.New("cluster: outbound queue is full")
+	errClusterDraining  = errors.New("cluster: node is shutting down")
+	errTopicAlias       = errors.New("cluster: publish topic alias is not registered")
 )
 
 type clusterNodeConfig struct {
 	Name string `json:"name"`
 	Addr string `json:"addr"`
+	// Relative capacity of the node. The number of ring hash replicas of the node
+	// is scaled by the weight. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
 }
 
 type clusterConfig struct {
@@ -56,6 +103,83 @@ type clusterConfig struct {
 	ThisName string `json:"self"`
 	// Failover configuration
 	Failover *clusterFailoverConfig
+	// Time in milliseconds between heartbeats sent to each node
+	Heartbeat int `json:"heartbeat"`
+	// Number of missed heartbeats before a node is marked disconnected
+	HeartbeatMissAfter int `json:"heartbeat_miss_after"`
+	// Number of nodes each contract is replicated to, including its master. Defaults to 1.
+	ReplicationFactor int `json:"replication_factor"`
+	// Outbound queue configuration of the sessions proxied to this node
+	Queue *clusterQueueConfig `json:"outbound_queue"`
+	// Batching of the publishes forwarded to the other nodes
+	Batch *clusterBatchConfig `json:"batch"`
+	// Time in milliseconds to wait for the first request from a connecting node
+	ReadTimeout int `json:"read_timeout"`
+	// Time in milliseconds to wait for a write to a node to complete before the connection is dropped
+	WriteTimeout int `json:"write_timeout"`
+	// Hash function of the ring hash: "fnv" or "mix". Defaults to "fnv". All nodes must use the same hash.
+	RingHash string `json:"ring_hash,omitempty"`
+	// Backoff between the attempts to reconnect to a node
+	Reconnect *clusterReconnectConfig `json:"reconnect"`
+	// Size in bytes of the socket read and write buffers of the connections between the nodes.
+	// The OS default is used if it is not set.
+	ReadBufferSize  int `json:"read_buffer_size"`
+	WriteBufferSize int `json:"write_buffer_size"`
+}
+
+type clusterReconnectConfig struct {
+	// Time in milliseconds before the first reconnect attempt, doubled on each failed attempt
+	Base int `json:"base"`
+	// Maximum time in milliseconds between reconnect attempts
+	Max int `json:"max"`
+	// Fraction of the time between reconnect attempts randomized, from 0 to 1. The jitter is 0.2
+	// if the reconnect backoff is not configured.
+	Jitter float64 `json:"jitter"`
+	// Number of failed reconnect attempts in a row before the node is marked dead and removed
+	// from the ring hash. The node is never marked dead if it is not set. A dead node is revived
+	// once it sends a heartbeat to this node.
+	MaxFailures int `json:"max_failures"`
+}
+
+// clusterBackoff is the exponential backoff between the attempts to reconnect to a node.
+type clusterBackoff struct {
+	base   time.Duration
+	max    time.Duration
+	jitter float64
+}
+
+// interval returns the time to wait after the given number of failed attempts in a row. The
+// jitter shortens the interval by a random fraction, so the interval never exceeds the maximum.
+func (b clusterBackoff) interval(failures int) time.Duration {
+	base, max := b.base, b.max
+	if base <= 0 {
+		base = defaultClusterReconnect
+	}
+	if max < base {
+		max = base
+	}
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d <<= 1
+	}
+	if d > max {
+		d = max
+	}
+	if b.jitter > 0 {
+		d -= time.Duration(b.jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+type clusterQueueConfig struct {
+	// Maximum number of messages queued for a proxied session
+	Size int `json:"size"`
+	// Policy applied when the queue is full: "block", "drop_oldest" or "error"
+	Policy string `json:"policy"`
+	// Replay the unacknowledged messages once the node reconnects instead of closing the
+	// session: the message in flight is retried, then the messages queued meanwhile are
+	// delivered in order
+	Replay bool `json:"replay"`
 }
 
 // ClusterNode is a client's connection to another node.
@@ -72,9 +196,33 @@ type ClusterNode struct {
 	address string
 	// Name of the node
 	name string
+	// Weight of the node in the ring hash
+	weight int
+	// Time to wait for a write to the node to complete
+	writeTimeout time.Duration
+	// Backoff between the attempts to reconnect to the node
+	backoff clusterBackoff
+	// Number of failed reconnect attempts in a row before the node is marked dead, zero never marks the node dead
+	maxFailures int
+	// Socket buffer sizes of the connection to the node
+	buffers listener.BufferSizes
 
 	// A number of times this node has failed in a row
 	failCount int
+	// True once the node is marked dead after too many failed reconnect attempts. A dead node
+	// is not reconnected and is left out of the ring hash until it sends a heartbeat.
+	dead bool
+	// A number of heartbeats missed in a row
+	missedHeartbeats int
+	// A number of requests rejected in a row by the node as out of sync
+	rejections int
+	// A number of outbound messages queued for the proxied sessions of the node and not yet delivered.
+	// Accessed atomically.
+	pending int64
+	// Load of the node as reported by its last heartbeat
+	load ClusterLoad
+	// Batches the publishes forwarded to the node. Could be nil if batching is not enabled
+	batch *clusterBatcher
 
 	// Channel for shutting down the runner; buffered, 1
 	done chan bool
@@ -110,11 +258,65 @@ type ClusterReq struct {
 	Topic    *security.Topic
 	Type     uint8
 	Message  *message.Message
+	// Sequence of the publish among the publishes of the contract forwarded by the node sending this
+	// request, zero if the request is not ordered
+	Seq uint64
+	// Start time of the node sending this request, the sequence restarts once the node restarts
+	Epoch int64
 
 	// Originating session
 	Conn *ClusterSess
 	// True if the original session has disconnected
 	ConnGone bool
+	// True if the request is sent to a replica of the contract rather than its master.
+	// The replica applies the request locally and never forwards it any further.
+	Replica bool
+}
+
+// ClusterHeartbeat is a health check sent by a node to each of its peers.
+type ClusterHeartbeat struct {
+	// Name of the node sending the heartbeat
+	Node string
+	// Load of the node sending the heartbeat
+	Load ClusterLoad
+}
+
+// ClusterLoad is the lightweight load stats of a node used to place the contracts of a failed node.
+type ClusterLoad struct {
+	// Number of client connections to the node
+	Connections int64
+	// Number of inbound messages per second
+	InMsgRate float64
+	// Number of messages in the memdb store of the node
+	MemdbSize int64
+}
+
+// ClusterRing is the list of nodes used by a node for its ring hash.
+type ClusterRing struct {
+	// Names of the nodes in the ring hash
+	Nodes []string
+	// Ring hash signature of the node
+	Signature string
+	// Names of the failed nodes mapped to the nodes taking over their contracts
+	Takeover map[string]string
+}
+
+// ClusterOwnershipReq is a request for the ownership view of a node.
+type ClusterOwnershipReq struct {
+	// Sample of contracts to find the owners of
+	Contracts []string
+}
+
+// ClusterOwnership is the view of a node on the ownership of the contracts.
+type ClusterOwnership struct {
+	// Name of the node
+	Node string `json:"node"`
+	// Names of the nodes in the ring hash of the node
+	Nodes []string `json:"nodes"`
+	// Ring hash signature of the node
+	Signature string `json:"signature"`
+	// Names of the nodes the requested contracts are mapped to
+	Owners map[string]string `json:"owners"`
 }
 
 // ClusterResp is a Master to Proxy response message.
@@ -131,10 +333,12 @@ type ClusterResp struct {
 }
 
 // Handle outbound node communication: read messages from the channel, forward to remote nodes.
-// FIXME(gene): this will drain the outbound queue in case of a failure: all unprocessed messages will be dropped.
-// Maybe it's a good thing, maybe not.
+// The proxied sessions of the node are closed on failure unless the outbound queue is configured
+// to replay unacknowledged messages on reconnect.
+// The time between reconnect attempts grows on each failed attempt and starts over once
+// the node is connected.
 func (n *ClusterNode) reconnect() {
-	var reconnTicker *time.Ticker
+	var reconnTimer *time.Timer
 
 	// Avoid parallel reconnection threads
 	n.lock.Lock()
@@ -149,33 +353,50 @@ func (n *ClusterNode) reconnect() {
 	var err error
 	for {
 		// Attempt to reconnect right away
-		if n.endpoint, err = rpc.Dial("tcp", n.address); err == nil {
-			if reconnTicker != nil {
-				reconnTicker.Stop()
+		var endpoint *rpc.Client
+		if endpoint, err = n.dial(); err == nil {
+			if reconnTimer != nil {
+				reconnTimer.Stop()
 			}
 			n.lock.Lock()
+			n.endpoint = endpoint
 			n.connected = true
 			n.reconnecting = false
 			n.lock.Unlock()
 			log.Info("cluster.reconnect", "connection established "+n.name)
 			return
-		} else if count == 0 {
-			reconnTicker = time.NewTicker(defaultClusterReconnect)
 		}
 
 		count++
+		if n.maxFailures > 0 && count >= n.maxFailures {
+			n.lock.Lock()
+			n.dead = true
+			n.reconnecting = false
+			n.lock.Unlock()
+			if reconnTimer != nil {
+				reconnTimer.Stop()
+			}
+			log.Error("cluster.reconnect", fmt.Sprintf("node '%s' marked dead after %d failed reconnect attempts", n.name, count))
+			Globals.Cluster.nodeChanged(n, true)
+			return
+		}
+		if reconnTimer == nil {
+			reconnTimer = time.NewTimer(n.backoff.interval(count))
+		} else {
+			reconnTimer.Reset(n.backoff.interval(count))
+		}
 
 		select {
-		case <-reconnTicker.C:
-			// Wait for timer to try to reconnect again. Do nothing if the timer is inactive.
+		case <-reconnTimer.C:
+			// Wait for timer to try to reconnect again.
 		case <-n.done:
 			// Shutting down
 			log.Info("cluster.reconnect", "node shutdown started "+n.name)
-			reconnTicker.Stop()
+			reconnTimer.Stop()
+			n.lock.Lock()
 			if n.endpoint != nil {
 				n.endpoint.Close()
 			}
-			n.lock.Lock()
 			n.connected = false
 			n.reconnecting = false
 			n.lock.Unlock()
@@ -185,16 +406,38 @@ func (n *ClusterNode) reconnect() {
 	}
 }
 
+// dial connects to the node. The write deadline of the connection is reset on each write
+// so a call to a stuck node fails instead of blocking the caller.
+func (n *ClusterNode) dial() (*rpc.Client, error) {
+	conn, err := net.Dial("tcp", n.address)
+	if err != nil {
+		return nil, err
+	}
+	if !n.buffers.IsZero() {
+		b, err := n.buffers.Apply(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		log.Info("cluster.dial", "socket buffer sizes of "+n.name+" "+b.String())
+	}
+	return rpc.NewClient(&listener.TimeoutConn{Conn: conn, WriteTimeout: n.writeTimeout}), nil
+}
+
 func (n *ClusterNode) call(proc string, msg, resp interface{}) error {
-	if !n.connected {
+	n.lock.Lock()
+	connected, endpoint := n.connected, n.endpoint
+	n.lock.Unlock()
+	if !connected {
 		return errors.New("cluster.call: node '" + n.name + "' not connected")
 	}
 
-	if err := n.endpoint.Call(proc, msg, resp); err != nil {
-		log.Fatal("cluster.call", "call failed to "+n.name, err)
+	if err := endpoint.Call(proc, msg, resp); err != nil {
+		log.ErrLogger.Error().Err(err).Str("context", "cluster.call").Msg("call failed to " + n.name)
 
 		n.lock.Lock()
-		if n.connected {
+		// The node could have been reconnected meanwhile.
+		if n.connected && n.endpoint == endpoint {
 			n.endpoint.Close()
 			n.connected = false
 			go n.reconnect()
@@ -211,7 +454,10 @@ func (n *ClusterNode) callAsync(proc string, msg, resp interface{}, done chan *r
 		log.Fatal("cluster.callAsync", "RPC done channel is unbuffered", nil)
 	}
 
-	if !n.connected {
+	n.lock.Lock()
+	connected, endpoint := n.connected, n.endpoint
+	n.lock.Unlock()
+	if !connected {
 		call := &rpc.Call{
 			ServiceMethod: proc,
 			Args:          msg,
@@ -230,7 +476,7 @@ func (n *ClusterNode) callAsync(proc string, msg, resp interface{}, done chan *r
 		call := <-myDone
 		if call.Error != nil {
 			n.lock.Lock()
-			if n.connected {
+			if n.connected && n.endpoint == endpoint {
 				n.endpoint.Close()
 				n.connected = false
 				go n.reconnect()
@@ -243,21 +489,110 @@ func (n *ClusterNode) callAsync(proc string, msg, resp interface{}, done chan *r
 		}
 	}()
 
-	call := n.endpoint.Go(proc, msg, resp, myDone)
+	call := endpoint.Go(proc, msg, resp, myDone)
 	call.Done = done
 
 	return call
 }
 
+// heartbeat periodically checks the node is responsive. A connection which is
+// silently half-open never fails a call, so once the node misses enough heartbeats
+// in a row it is marked disconnected and a reconnect is initiated.
+func (n *ClusterNode) heartbeat(interval time.Duration, missAfter int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.lock.Lock()
+			connected := n.connected
+			endpoint := n.endpoint
+			dead := n.dead
+			n.lock.Unlock()
+			if !connected || endpoint == nil || dead {
+				// Reconnect is in progress or the node waits to be revived.
+				continue
+			}
+
+			unused := false
+			call := endpoint.Go("Cluster.Heartbeat", &ClusterHeartbeat{Node: Globals.Cluster.thisNodeName, Load: Globals.Cluster.localLoad()}, &unused, make(chan *rpc.Call, 1))
+			timeout := time.NewTimer(interval)
+			var err error
+			select {
+			case <-call.Done:
+				err = call.Error
+			case <-timeout.C:
+				err = errors.New("cluster.heartbeat: node '" + n.name + "' timed out")
+			case <-n.done:
+				timeout.Stop()
+				return
+			}
+			timeout.Stop()
+
+			n.lock.Lock()
+			if err == nil {
+				n.missedHeartbeats = 0
+				n.lock.Unlock()
+				continue
+			}
+			n.missedHeartbeats++
+			if n.missedHeartbeats >= missAfter && n.connected && n.endpoint == endpoint {
+				log.Error("cluster.heartbeat", err.Error())
+				n.missedHeartbeats = 0
+				n.failCount++
+				n.endpoint.Close()
+				n.connected = false
+				go n.reconnect()
+			}
+			n.lock.Unlock()
+		case <-n.done:
+			return
+		}
+	}
+}
+
 // Proxy forwards message to master
 func (n *ClusterNode) forward(msg *ClusterReq) error {
+	errC := make(chan error, 1)
+	n.forwardAsync(msg, func(err error) { errC <- err })
+	return <-errC
+}
+
+// forwardAsync forwards message to master like forward without waiting for the publishes batched
+// to the master. done is called with the error of the forward once the batch is sent, the other
+// requests are forwarded and done is called before forwardAsync returns.
+func (n *ClusterNode) forwardAsync(msg *ClusterReq, done func(error)) {
 	log.Info("cluster.forward", "forwarding request to node "+n.name)
 	msg.Node = Globals.Cluster.thisNodeName
+	if n.batch != nil && msg.Type == message.PUBLISH && !msg.ConnGone {
+		n.batch.add(msg, func(rejected bool, err error) {
+			done(n.forwarded(msg, rejected, err))
+		})
+		return
+	}
 	rejected := false
 	err := n.call("Cluster.Master", msg, &rejected)
+	done(n.forwarded(msg, rejected, err))
+}
+
+// forwarded completes the forward of the message. A request rejected by the master as out of sync is
+// retried once the ring hash is resynced from the master.
+func (n *ClusterNode) forwarded(msg *ClusterReq, rejected bool, err error) error {
+	if err == nil && rejected && Globals.Cluster.resync(n) {
+		// Retry the request with the ring hash resynced from the master node.
+		msg.Signature = Globals.Cluster.ringSignature()
+		rejected = false
+		err = n.call("Cluster.Master", msg, &rejected)
+	}
 	if err == nil && rejected {
 		err = errors.New("cluster.forward: master node out of sync")
 	}
+	if err == nil {
+		n.lock.Lock()
+		n.rejections = 0
+		n.lock.Unlock()
+	}
 	return err
 }
 
@@ -267,9 +602,13 @@ type Cluster struct {
 	nodes map[string]*ClusterNode
 	// Name of the local node
 	thisNodeName string
+	// Weight of the local node in the ring hash
+	thisNodeWeight int
 
 	// Resolved address to listed on
 	listenOn string
+	// Socket buffer sizes of the inbound connections
+	buffers listener.BufferSizes
 
 	// Socket for inbound connections
 	inbound *net.TCPListener
@@ -278,6 +617,57 @@ type Cluster struct {
 
 	// Failover parameters. Could be nil if failover is not enabled
 	fo *clusterFailover
+
+	// Time between heartbeats sent to each node
+	heartbeat time.Duration
+	// Number of missed heartbeats before a node is marked disconnected
+	heartbeatMissAfter int
+
+	// Number of nodes each contract is replicated to
+	replicas int
+
+	// Time to wait for the first request from a connecting node
+	readTimeout time.Duration
+
+	// Guards the ring hash, the list of nodes of the ring hash and the takeover map
+	ringLock sync.RWMutex
+	// List of nodes used for ring hash
+	ringKeys []string
+	// Failed nodes mapped to the live nodes taking over their part of the ring hash
+	takeover map[string]string
+	// Hash function of the ring hash. Could be nil to use the default hash
+	ringHash rh.Hash
+	// Guards the ring hash resync from a peer node
+	resyncLock sync.Mutex
+	// Time before the next ring hash resync is allowed
+	resyncAt time.Time
+	// Time between ring hash resyncs
+	resyncBackoff time.Duration
+
+	// Outbound queue parameters of the proxied sessions
+	queue clusterQueueConfig
+
+	// Set to 1 once the cluster is draining and no new requests are forwarded. Accessed atomically.
+	draining int32
+
+	// Order of the publishes of the contracts
+	order clusterOrder
+	// Start time of this node sent with the forwarded publishes
+	epoch int64
+
+	// Guards the load stats of the local node
+	loadLock sync.Mutex
+	// Load stats of the local node as of loadAt
+	load ClusterLoad
+	// Time the load stats were last calculated
+	loadAt time.Time
+	// Number of inbound messages as of loadAt
+	loadInMsgs int64
+
+	// Nodes marked dead or revived, the run loop rehashes the ring hash
+	nodeState chan clusterNodeState
+	// Channel for stopping the run loop
+	done chan bool
 }
 
 // Master at topic's master node receives C2S messages from topic's proxy nodes.
@@ -295,7 +685,7 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 		if conn != nil {
 			conn.stop <- nil
 		}
-	} else if msg.Signature == c.ring.Signature() {
+	} else if msg.Signature == c.ringSignature() {
 		// This cluster member received a request for a topic it owns.
 
 		if conn == nil {
@@ -314,13 +704,28 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 		conn.connID = msg.Conn.ConnID
 		conn.clientID = msg.Conn.ClientID
 
+		if msg.Replica {
+			// Do not forward the replicated request to other nodes.
+			if msg.MsgSub != nil {
+				msg.MsgSub.IsForwarded = true
+			}
+			if msg.MsgUnsub != nil {
+				msg.MsgUnsub.IsForwarded = true
+			}
+			if msg.MsgPub != nil {
+				msg.MsgPub.IsForwarded = true
+			}
+		}
+
 		switch msg.Type {
 		case message.SUBSCRIBE:
 			conn.handler(msg.MsgSub)
 		case message.UNSUBSCRIBE:
 			conn.handler(msg.MsgUnsub)
 		case message.PUBLISH:
-			conn.handler(msg.MsgPub)
+			if !c.order.apply(msg.Node, msg.Epoch, msg.Conn.ClientID.Contract(), msg.Seq, func() { conn.handler(msg.MsgPub) }) {
+				log.Info("cluster.Master", "duplicate publish dropped from node "+msg.Node)
+			}
 		}
 	} else {
 		// Reject the request: wrong signature, cluster is out of sync.
@@ -330,8 +735,171 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 	return nil
 }
 
+// MasterBatch at topic's master node receives a batch of publishes from topic's proxy node and
+// applies them in the order of the batch. The result of each publish is reported, a failed publish
+// does not fail the publishes applied before or after it. Called by a remote node.
+func (c *Cluster) MasterBatch(batch *ClusterBatch, resp *ClusterBatchResp) error {
+	resp.Rejected = make([]bool, len(batch.Reqs))
+	resp.Errors = make([]string, len(batch.Reqs))
+	for i, msg := range batch.Reqs {
+		if err := c.Master(msg, &resp.Rejected[i]); err != nil {
+			resp.Errors[i] = err.Error()
+		}
+	}
+	return nil
+}
+
+// Ring is called by a peer node out of sync to fetch the list of nodes of the ring hash. The nodes
+// and the takeover map are copied under the ring lock, so the reply is not read while rehashed.
+func (c *Cluster) Ring(unused *bool, ring *ClusterRing) error {
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+	ring.Nodes = append([]string(nil), c.ringKeys...)
+	ring.Signature = c.ring.Signature()
+	ring.Takeover = make(map[string]string, len(c.takeover))
+	for name, owner := range c.takeover {
+		ring.Takeover[name] = owner
+	}
+	return nil
+}
+
+// Ownership is called by an operator or a peer node to inspect the ring hash of this node and
+// which node each of the requested contracts is mapped to.
+func (c *Cluster) Ownership(req *ClusterOwnershipReq, resp *ClusterOwnership) error {
+	resp.Node = c.thisNodeName
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+	resp.Nodes = c.ringKeys
+	resp.Signature = c.ring.Signature()
+	resp.Owners = make(map[string]string, len(req.Contracts))
+	for _, contract := range req.Contracts {
+		resp.Owners[contract] = c.ring.Get(contract)
+	}
+	return nil
+}
+
+// HandleOwnership will process HTTP requests for the ownership view of the node. The contracts
+// to find the owners of are passed as "contract" query parameters.
+func (c *Cluster) HandleOwnership(w http.ResponseWriter, r *http.Request) {
+	if c == nil {
+		http.Error(w, "cluster not initialized", http.StatusNotFound)
+		return
+	}
+	var resp ClusterOwnership
+	c.Ownership(&ClusterOwnershipReq{Contracts: r.URL.Query()["contract"]}, &resp)
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		log.Error("cluster.HandleOwnership", "Error marshaling response to ownership request: "+err.Error())
+	}
+
+	ResponseHandler(w, r, b)
+}
+
+// resync is called when a node rejects a request as out of sync. On repeated rejections it fetches
+// the list of nodes from the node and rehashes the ring hash. Resyncs are backed off so nodes with
+// divergent lists do not flap. Returns true if the ring hash matches the node after the resync.
+func (c *Cluster) resync(n *ClusterNode) bool {
+	n.lock.Lock()
+	n.rejections++
+	rejections := n.rejections
+	n.lock.Unlock()
+	if rejections < defaultClusterResyncAfter {
+		return false
+	}
+
+	c.resyncLock.Lock()
+	defer c.resyncLock.Unlock()
+	now := time.Now()
+	if now.Before(c.resyncAt) {
+		return false
+	}
+	if c.resyncBackoff == 0 || now.After(c.resyncAt.Add(maxClusterResyncBackoff)) {
+		// No resync happened recently, start over.
+		c.resyncBackoff = defaultClusterResyncBackoff
+	}
+	c.resyncAt = now.Add(c.resyncBackoff)
+	if c.resyncBackoff *= 2; c.resyncBackoff > maxClusterResyncBackoff {
+		c.resyncBackoff = maxClusterResyncBackoff
+	}
+
+	unused := false
+	var ring ClusterRing
+	if err := n.call("Cluster.Ring", &unused, &ring); err != nil {
+		log.Error("cluster.resync", err.Error())
+		return false
+	}
+	for _, name := range ring.Nodes {
+		if name != c.thisNodeName && c.nodes[name] == nil {
+			log.Error("cluster.resync", "ring hash of node "+n.name+" has an unknown node "+name)
+			return false
+		}
+	}
+	if c.rehashIfChanged(ring.Signature, ring.Nodes, ring.Takeover) {
+		log.Info("cluster.resync", "ring hash resynced from node "+n.name+" using nodes "+fmt.Sprint(ring.Nodes))
+	}
+
+	n.lock.Lock()
+	n.rejections = 0
+	n.lock.Unlock()
+	return ring.Signature == c.ringSignature()
+}
+
+// Heartbeat is called by a peer node to check this node is responsive.
+func (c *Cluster) Heartbeat(hb *ClusterHeartbeat, unused *bool) error {
+	if n := c.nodes[hb.Node]; n != nil {
+		n.lock.Lock()
+		n.load = hb.Load
+		revived := n.dead
+		n.dead = false
+		n.lock.Unlock()
+		if revived {
+			log.Info("cluster.Heartbeat", "node '"+n.name+"' revived")
+			go n.reconnect()
+			c.nodeChanged(n, false)
+		}
+	}
+	return nil
+}
+
+// localLoad returns the load stats of the local node. The inbound message rate is averaged
+// over at least one heartbeat interval.
+func (c *Cluster) localLoad() ClusterLoad {
+	c.loadLock.Lock()
+	defer c.loadLock.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(c.loadAt); elapsed >= c.heartbeat {
+		var connections, inMsgs int64
+		if s := Globals.Service; s != nil && s.meter != nil {
+			connections = s.meter.Connections.Count()
+			inMsgs = s.meter.InMsgs.Count()
+		}
+		c.load.Connections = connections
+		if !c.loadAt.IsZero() {
+			c.load.InMsgRate = float64(inMsgs-c.loadInMsgs) / elapsed.Seconds()
+		}
+		c.load.MemdbSize = store.Log.Size()
+		c.loadAt, c.loadInMsgs = now, inMsgs
+	}
+	return c.load
+}
+
+// nodeLoad returns the last known load stats of the named node.
+func (c *Cluster) nodeLoad(name string) ClusterLoad {
+	if name == c.thisNodeName {
+		return c.localLoad()
+	}
+	n := c.nodes[name]
+	if n == nil {
+		return ClusterLoad{}
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.load
+}
+
 // Dispatch receives messages from the master node addressed to a specific local connection.
-func (Cluster) Proxy(resp *ClusterResp, unused *bool) error {
+func (*Cluster) Proxy(resp *ClusterResp, unused *bool) error {
 	log.Info("cluster.Proxy", "response from Master for connection "+fmt.Sprint(resp.FromConnID))
 
 	// This cluster member received a response from topic owner to be forwarded to a connection
@@ -348,9 +916,36 @@ func (Cluster) Proxy(resp *ClusterResp, unused *bool) error {
 	return nil
 }
 
+// Given contract name, find the cluster nodes the contract is replicated to, master first.
+// The local node is included in the list if it is one of the replicas.
+func (c *Cluster) replicasForContract(contract string) []string {
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+	return c.ring.GetN(contract, c.replicas)
+}
+
+// Given contract name, find the name of the node serving the contract: the master if it is
+// connected, otherwise the first connected replica.
+func (c *Cluster) ownerForContract(contract string) string {
+	replicas := c.replicasForContract(contract)
+	for _, key := range replicas {
+		if key == c.thisNodeName {
+			return key
+		}
+		if node := c.nodes[key]; node != nil && node.isConnected() {
+			return key
+		}
+	}
+	if len(replicas) == 0 {
+		return ""
+	}
+	// No replica is reachable, stick to the master.
+	return replicas[0]
+}
+
 // Given contract name, find appropriate cluster node to route message to
 func (c *Cluster) nodeForContract(contract string) *ClusterNode {
-	key := c.ring.Get(contract)
+	key := c.ownerForContract(contract)
 	if key == c.thisNodeName {
 		log.Error("cluster", "request to route to self")
 		// Do not route to self
@@ -369,22 +964,56 @@ func (c *Cluster) isRemoteContract(contract string) bool {
 		// Cluster not initialized, all contracts are local
 		return false
 	}
-	return c.ring.Get(contract) != c.thisNodeName
+	return c.ownerForContract(contract) != c.thisNodeName
 }
 
-// Forward client message to the Master (cluster node which owns the topic)
-func (c *Cluster) routeToContract(msg lp.MessagePack, topic *security.Topic, msgType uint8, m *message.Message, conn *_Conn) error {
-	// Find the cluster node which owns the topic, then forward to it.
-	n := c.nodeForContract(fmt.Sprint(conn.clientID.Contract()))
-	if n == nil {
-		return errors.New("cluster.routeToContract: attempt to route to non-existent node")
+// hasRemoteReplicas returns true if a write to the contract must be forwarded to other nodes.
+func (c *Cluster) hasRemoteReplicas(contract string) bool {
+	if c == nil {
+		// Cluster not initialized, all contracts are local
+		return false
+	}
+	for _, key := range c.replicasForContract(contract) {
+		if key != c.thisNodeName {
+			return true
+		}
 	}
+	return false
+}
 
-	// Save node name: it's need in order to inform relevant nodes when the session is disconnected
-	if conn.nodes == nil {
-		conn.nodes = make(map[string]bool)
+// Forward client message to the Master (cluster node which owns the topic).
+// Publish messages are forwarded to all replicas of the contract with the sequence of the publish.
+func (c *Cluster) routeToContract(msg lp.MessagePack, topic *security.Topic, msgType uint8, m *message.Message, conn *_Conn, seq uint64) error {
+	errC := make(chan error, 1)
+	if err := c.routeToContractAsync(msg, topic, msgType, m, conn, seq, func(err error) { errC <- err }); err != nil {
+		return err
+	}
+	return <-errC
+}
+
+// routeToContractAsync forwards client message like routeToContract without waiting for the
+// publishes batched to the replicas. It returns the error if the message is not forwarded, done
+// is called otherwise once the message is forwarded to the replicas, with nil if the message
+// reached at least one replica.
+func (c *Cluster) routeToContractAsync(msg lp.MessagePack, topic *security.Topic, msgType uint8, m *message.Message, conn *_Conn, seq uint64, done func(error)) error {
+	if c.isDraining() {
+		return errClusterDraining
+	}
+	contract := fmt.Sprint(conn.clientID.Contract())
+
+	var nodes []*ClusterNode
+	if msgType == message.PUBLISH {
+		for _, key := range c.replicasForContract(contract) {
+			if n := c.nodes[key]; n != nil {
+				nodes = append(nodes, n)
+			}
+		}
+	} else if n := c.nodeForContract(contract); n != nil {
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return errors.New("cluster.routeToContract: attempt to route to non-existent node")
 	}
-	conn.nodes[n.name] = true
 
 	// var msgSub,msgPub,msgUnsub lp.Packet
 	var msgSub *utp.Subscribe
@@ -399,23 +1028,68 @@ func (c *Cluster) routeToContract(msg lp.MessagePack, topic *security.Topic, msg
 		msgUnsub.IsForwarded = true
 	case message.PUBLISH:
 		msgPub = msg.(*utp.Publish)
+		// The aliases are known only to the connection, the publish is forwarded with full topics.
+		if !conn.aliases.resolvePublish(msgPub) {
+			return errTopicAlias
+		}
 		msgPub.IsForwarded = true
 	}
-	return n.forward(
-		&ClusterReq{
-			Node:      c.thisNodeName,
-			Signature: c.ring.Signature(),
-			MsgSub:    msgSub,
-			MsgUnsub:  msgUnsub,
-			MsgPub:    msgPub,
-			Topic:     topic,
-			Type:      msgType,
-			Message:   m,
-			Conn: &ClusterSess{
-				//RemoteAddr: conn.(),
-				ConnID:   conn.connID,
-				SessID:   conn.sessID,
-				ClientID: conn.clientID}})
+
+	owner := c.ownerForContract(contract)
+	var lock sync.Mutex
+	var err error
+	delivered := false
+	pending := len(nodes)
+	forwarded := func(n *ClusterNode, e error) {
+		lock.Lock()
+		if e != nil {
+			// The replicas which missed the write are reported, the write is not retried.
+			log.ErrLogger.Error().Err(e).Str("context", "cluster.routeToContract").Str("contract", contract).Msg("request not forwarded to node " + n.name)
+			err = e
+		} else {
+			delivered = true
+		}
+		pending--
+		last := pending == 0
+		lock.Unlock()
+		if !last {
+			return
+		}
+		if delivered {
+			// The message reached at least one replica.
+			done(nil)
+			return
+		}
+		done(err)
+	}
+	for _, n := range nodes {
+		// Save node name: it's need in order to inform relevant nodes when the session is disconnected
+		if conn.nodes == nil {
+			conn.nodes = make(map[string]bool)
+		}
+		conn.nodes[n.name] = true
+
+		n := n
+		n.forwardAsync(
+			&ClusterReq{
+				Node:      c.thisNodeName,
+				Signature: c.ringSignature(),
+				MsgSub:    msgSub,
+				MsgUnsub:  msgUnsub,
+				MsgPub:    msgPub,
+				Topic:     topic,
+				Type:      msgType,
+				Message:   m,
+				Seq:       seq,
+				Epoch:     c.epoch,
+				Replica:   n.name != owner,
+				Conn: &ClusterSess{
+					//RemoteAddr: conn.(),
+					ConnID:   conn.connID,
+					SessID:   conn.sessID,
+					ClientID: conn.clientID}}, func(e error) { forwarded(n, e) })
+	}
+	return nil
 }
 
 // Session terminated at origin. Inform remote Master nodes that the session is gone.
@@ -475,27 +1149,117 @@ func ClusterInit(configString json.RawMessage, self *string) int {
 	gob.Register(utp.Unsubscribe{})
 
 	Globals.Cluster = &Cluster{
-		thisNodeName: thisName,
-		nodes:        make(map[string]*ClusterNode)}
+		thisNodeName:       thisName,
+		nodes:              make(map[string]*ClusterNode),
+		heartbeat:          defaultClusterHeartbeat,
+		heartbeatMissAfter: defaultClusterHeartbeatMissAfter,
+		replicas:           1,
+		readTimeout:        defaultClusterReadTimeout,
+		epoch:              time.Now().UnixNano(),
+		queue:              clusterQueueConfig{Size: defaultClusterQueueSize, Policy: clusterQueueBlock},
+		done:               make(chan bool)}
+
+	if config.Heartbeat > 0 {
+		Globals.Cluster.heartbeat = time.Duration(config.Heartbeat) * time.Millisecond
+	}
+	if config.HeartbeatMissAfter > 0 {
+		Globals.Cluster.heartbeatMissAfter = config.HeartbeatMissAfter
+	}
+	writeTimeout := defaultClusterWriteTimeout
+	if config.ReadTimeout > 0 {
+		Globals.Cluster.readTimeout = time.Duration(config.ReadTimeout) * time.Millisecond
+	}
+	if config.WriteTimeout > 0 {
+		writeTimeout = time.Duration(config.WriteTimeout) * time.Millisecond
+	}
+	if config.ReplicationFactor > 1 {
+		Globals.Cluster.replicas = config.ReplicationFactor
+	}
+	backoff := clusterBackoff{base: defaultClusterReconnect, max: defaultClusterReconnectMax, jitter: defaultClusterReconnectJitter}
+	maxFailures := 0
+	if config.Reconnect != nil {
+		if config.Reconnect.MaxFailures > 0 {
+			maxFailures = config.Reconnect.MaxFailures
+		}
+		if config.Reconnect.Base > 0 {
+			backoff.base = time.Duration(config.Reconnect.Base) * time.Millisecond
+		}
+		if config.Reconnect.Max > 0 {
+			backoff.max = time.Duration(config.Reconnect.Max) * time.Millisecond
+		}
+		if config.Reconnect.Jitter < 0 || config.Reconnect.Jitter > 1 {
+			log.Fatal("cluster.ClusterInit", "reconnect jitter must be from 0 to 1", nil)
+		}
+		backoff.jitter = config.Reconnect.Jitter
+	}
+	Globals.Cluster.buffers = listener.BufferSizes{Read: config.ReadBufferSize, Write: config.WriteBufferSize}
+	warnings, err := Globals.Cluster.buffers.Validate()
+	if err != nil {
+		log.Fatal("cluster.ClusterInit", "invalid socket buffer size", err)
+	}
+	for _, w := range warnings {
+		log.Info("cluster.ClusterInit", w)
+	}
+	switch config.RingHash {
+	case "", "fnv":
+	case "mix":
+		Globals.Cluster.ringHash = rh.MixHash
+	default:
+		log.Fatal("cluster.ClusterInit", "unknown ring hash "+config.RingHash, nil)
+	}
+	if config.Queue != nil {
+		if config.Queue.Size > 0 {
+			Globals.Cluster.queue.Size = config.Queue.Size
+		}
+		switch config.Queue.Policy {
+		case clusterQueueBlock, clusterQueueDropOldest, clusterQueueError:
+			Globals.Cluster.queue.Policy = config.Queue.Policy
+		case "":
+		default:
+			log.Fatal("cluster.ClusterInit", "unknown outbound queue policy "+config.Queue.Policy, nil)
+		}
+		Globals.Cluster.queue.Replay = config.Queue.Replay
+	}
+	var batchSize int
+	var batchDelay time.Duration
+	if config.Batch != nil {
+		batchSize = config.Batch.MaxSize
+		batchDelay = time.Duration(config.Batch.MaxDelay) * time.Millisecond
+	}
 
 	var nodeNames []string
 	for _, host := range config.Nodes {
 		nodeNames = append(nodeNames, host.Name)
 
+		if host.Weight < 1 {
+			host.Weight = 1
+		}
+
 		if host.Name == thisName {
 			Globals.Cluster.listenOn = host.Addr
+			Globals.Cluster.thisNodeWeight = host.Weight
 			// Don't create a cluster member for this local instance
 			continue
 		}
 
 		n := ClusterNode{
-			address: host.Addr,
-			name:    host.Name,
-			done:    make(chan bool, 1)}
+			address:      host.Addr,
+			name:         host.Name,
+			weight:       host.Weight,
+			writeTimeout: writeTimeout,
+			backoff:      backoff,
+			maxFailures:  maxFailures,
+			buffers:      Globals.Cluster.buffers,
+			done:         make(chan bool, 1)}
+		if batchSize > 1 {
+			n.batch = newClusterBatcher(&n, batchSize, batchDelay)
+		}
 
 		Globals.Cluster.nodes[host.Name] = &n
 	}
 
+	Globals.Cluster.nodeState = make(chan clusterNodeState, len(Globals.Cluster.nodes))
+
 	if len(Globals.Cluster.nodes) == 0 {
 		// Cluster needs at least two nodes.
 		log.Info("cluster.ClusterInit", "Invalid cluster size: 1")
@@ -515,6 +1279,9 @@ func ClusterInit(configString json.RawMessage, self *string) int {
 func (c *_Conn) rpcWriteLoop() {
 	// There is no readLoop for RPC, delete the session here
 	defer func() {
+		// The messages left in the queue are never delivered.
+		atomic.StoreInt32(&c.rpcDone, 1)
+		c.dropQueued()
 		c.closeRPC()
 		Globals.connCache.delete(c.connID)
 		c.unsubAll()
@@ -525,19 +1292,19 @@ func (c *_Conn) rpcWriteLoop() {
 	for {
 		select {
 		case msg, ok := <-c.send:
-			if !ok || c.clnode.endpoint == nil {
+			if !ok {
 				// channel closed
 				return
 			}
-			m, err := lp.Encode(msg)
-			if err != nil {
-				log.Error("conn.writeRpc", err.Error())
+			if !c.clnode.hasEndpoint() {
+				atomic.AddInt64(&c.clnode.pending, -1)
+				c.service.meter.DroppedMsgs.Inc(1)
 				return
 			}
-			// The error is returned if the remote node is down. Which means the remote
-			// session is also disconnected.
-			if err := c.clnode.call("Cluster.Proxy", &ClusterResp{Msg: m.Bytes(), FromConnID: c.connID}, &unused); err != nil {
-				log.Error("conn.writeRPC", err.Error())
+			delivered := c.writeRPC(msg)
+			atomic.AddInt64(&c.clnode.pending, -1)
+			if !delivered {
+				c.service.meter.DroppedMsgs.Inc(1)
 				return
 			}
 		case msg := <-c.stop:
@@ -550,6 +1317,122 @@ func (c *_Conn) rpcWriteLoop() {
 	}
 }
 
+// writeRPC delivers an outbound message to the node of the proxied session. It returns false
+// if the message could not be delivered and the session must be closed.
+func (c *_Conn) writeRPC(msg lp.MessagePack) bool {
+	var unused bool
+	m, err := lp.Encode(msg)
+	if err != nil {
+		log.Error("conn.writeRpc", err.Error())
+		return false
+	}
+	for {
+		// The error is returned if the remote node is down. Which means the remote
+		// session is also disconnected, unless the message is replayed on reconnect.
+		err := c.clnode.call("Cluster.Proxy", &ClusterResp{Msg: m.Bytes(), FromConnID: c.connID}, &unused)
+		if err == nil {
+			return true
+		}
+		log.Error("conn.writeRPC", err.Error())
+		if !c.queue().Replay || !c.waitReconnect() {
+			return false
+		}
+	}
+}
+
+// waitReconnect waits for the node of a proxied session to reconnect. It returns false
+// if the node or the session is shutting down.
+func (c *_Conn) waitReconnect() bool {
+	ticker := time.NewTicker(defaultClusterReconnect)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.clnode.lock.Lock()
+			connected := c.clnode.connected
+			c.clnode.lock.Unlock()
+			if connected {
+				return true
+			}
+		case <-c.clnode.done:
+			return false
+		case <-c.stop:
+			return false
+		}
+	}
+}
+
+// queue returns the outbound queue parameters.
+func (c *_Conn) queue() clusterQueueConfig {
+	if Globals.Cluster == nil {
+		return clusterQueueConfig{Size: defaultClusterQueueSize, Policy: clusterQueueBlock}
+	}
+	return Globals.Cluster.queue
+}
+
+// enqueue queues an outbound message. The outbound queue policy is applied to proxied
+// sessions, the messages to other connections are queued as is.
+func (c *_Conn) enqueue(msg lp.MessagePack) error {
+	if c.clnode == nil {
+		c.send <- msg
+		return nil
+	}
+
+	atomic.AddInt64(&c.clnode.pending, 1)
+	defer func() {
+		// The message queued once the write loop has exited is never delivered.
+		if atomic.LoadInt32(&c.rpcDone) == 1 {
+			c.dropQueued()
+		}
+	}()
+	switch c.queue().Policy {
+	case clusterQueueDropOldest:
+		for {
+			select {
+			case c.send <- msg:
+				return nil
+			default:
+			}
+			// Queue is full, drop the oldest message to make room
+			select {
+			case <-c.send:
+				atomic.AddInt64(&c.clnode.pending, -1)
+				c.service.meter.DroppedMsgs.Inc(1)
+			default:
+			}
+		}
+	case clusterQueueError:
+		select {
+		case c.send <- msg:
+			return nil
+		default:
+			atomic.AddInt64(&c.clnode.pending, -1)
+			c.service.meter.DroppedMsgs.Inc(1)
+			return errClusterQueueFull
+		}
+	default:
+		c.send <- msg
+		return nil
+	}
+}
+
+// dropQueued drops the outbound messages queued for the proxied session.
+func (c *_Conn) dropQueued() {
+	for {
+		select {
+		case _, ok := <-c.send:
+			if !ok {
+				return
+			}
+			atomic.AddInt64(&c.clnode.pending, -1)
+			c.service.meter.DroppedMsgs.Inc(1)
+		default:
+			return
+		}
+	}
+}
+
 // Proxied session is being closed at the Master node
 func (c *_Conn) closeRPC() {
 	log.Info("cluster.closeRPC", "session closed at master")
@@ -562,15 +1445,15 @@ func (c *Cluster) Start() {
 		panic(err)
 	}
 
-	l.SetReadTimeout(120 * time.Second)
+	l.SetReadTimeout(c.readTimeout)
+	l.SetBufferSizes(c.buffers)
 
 	for _, n := range c.nodes {
 		go n.reconnect()
+		go n.heartbeat(c.heartbeat, c.heartbeatMissAfter)
 	}
 
-	if c.fo != nil {
-		go c.run()
-	}
+	go c.run()
 
 	err = rpc.Register(c)
 	if err != nil {
@@ -591,35 +1474,198 @@ func (c *Cluster) shutdown() {
 	Globals.Cluster = nil
 	c.inbound.Close()
 
-	if c.fo != nil {
-		c.fo.done <- true
-	}
+	close(c.done)
 
 	for _, n := range c.nodes {
-		n.done <- true
+		// Closing the channel stops both the reconnect and the heartbeat runners.
+		close(n.done)
+
+		n.lock.Lock()
+		if n.connected {
+			// Mark the node disconnected first so a failed call does not start a reconnect.
+			n.connected = false
+			n.endpoint.Close()
+		}
+		n.lock.Unlock()
 	}
 
 	log.Info("cluster.shutdown", "Cluster shut down")
 }
 
+// DrainAndClose gracefully shuts down the local cluster node. It stops forwarding new requests to
+// other nodes, waits up to the timeout for the outbound messages queued for the proxied sessions to
+// be delivered, then shuts the node down. Returns an error if messages were left undelivered.
+func (c *Cluster) DrainAndClose(timeout time.Duration) error {
+	if c == nil {
+		return nil
+	}
+	atomic.StoreInt32(&c.draining, 1)
+
+	var err error
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := c.pending()
+		if pending == 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			err = fmt.Errorf("cluster.DrainAndClose: %d outbound messages not delivered", pending)
+			log.Error("cluster.DrainAndClose", err.Error())
+			break
+		}
+		time.Sleep(clusterDrainInterval)
+	}
+
+	c.shutdown()
+	return err
+}
+
+// isDraining returns true once the cluster has started to drain.
+func (c *Cluster) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// pending returns the number of outbound messages not yet delivered to the nodes.
+func (c *Cluster) pending() int64 {
+	var pending int64
+	for _, n := range c.nodes {
+		pending += atomic.LoadInt64(&n.pending)
+	}
+	return pending
+}
+
+// ringSignature returns the signature of the current ring hash.
+func (c *Cluster) ringSignature() string {
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+	return c.ring.Signature()
+}
+
+// rehashIfChanged replaces the takeover map and recalculates the ring hash using the provided list
+// of nodes unless the ring hash already has the given signature. Reports whether it rehashed.
+func (c *Cluster) rehashIfChanged(signature string, nodes []string, takeover map[string]string) bool {
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+	if signature == c.ring.Signature() {
+		return false
+	}
+	c.takeover = takeover
+	c.rehashLocked(nodes)
+	return true
+}
+
 // Recalculate the ring hash using provided list of nodes or only nodes in a non-failed state.
-// Returns the list of nodes used for ring hash.
+// Returns the sorted list of nodes used for ring hash.
 func (c *Cluster) rehash(nodes []string) []string {
-	ring := rh.NewRing(clusterHashReplicas, nil)
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+	return c.rehashLocked(nodes)
+}
+
+// rehashLocked is rehash with the ring lock held.
+func (c *Cluster) rehashLocked(nodes []string) []string {
+	ring := rh.NewRing(clusterHashReplicas, c.ringHash)
 
 	var ringKeys []string
 
 	if nodes == nil {
 		for _, node := range c.nodes {
+			if node.isDead() {
+				continue
+			}
 			ringKeys = append(ringKeys, node.name)
 		}
 		ringKeys = append(ringKeys, c.thisNodeName)
 	} else {
 		ringKeys = append(ringKeys, nodes...)
 	}
-	ring.Add(ringKeys...)
+	// Sort the nodes so the ring hash is the same on all nodes with the same members.
+	sort.Strings(ringKeys)
+	for _, key := range ringKeys {
+		ring.AddWeighted(key, c.nodeWeight(key))
+	}
+	// The part of the ring hash of a failed node is taken over by a single live node, so the
+	// contracts of the live nodes are not moved.
+	inRing := make(map[string]bool, len(ringKeys))
+	for _, key := range ringKeys {
+		inRing[key] = true
+	}
+	var failed []string
+	for name, owner := range c.takeover {
+		if !inRing[name] && inRing[owner] {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	for _, name := range failed {
+		ring.AddWeightedAs(name, c.takeover[name], c.nodeWeight(name))
+	}
 
 	c.ring = ring
+	c.ringKeys = ringKeys
 
 	return ringKeys
 }
+
+// clusterNodeState is a node marked dead or revived.
+type clusterNodeState struct {
+	node *ClusterNode
+	dead bool
+}
+
+// nodeChanged hands the node marked dead or revived to the run loop to rehash.
+func (c *Cluster) nodeChanged(n *ClusterNode, dead bool) {
+	select {
+	case c.nodeState <- clusterNodeState{node: n, dead: dead}:
+	case <-c.done:
+	}
+}
+
+// nodeStateChanged updates the dead nodes metric and removes the node marked dead from the ring hash
+// or adds back the revived node. The leader rehashes the ring hash of the cluster if failover is enabled.
+// Called by the run loop.
+func (c *Cluster) nodeStateChanged(state clusterNodeState) {
+	if s := Globals.Service; s != nil && s.meter != nil {
+		if state.dead {
+			s.meter.DeadNodes.Inc(1)
+		} else {
+			s.meter.DeadNodes.Dec(1)
+		}
+	}
+	if c.fo != nil {
+		return
+	}
+	c.rehash(nil)
+}
+
+// isConnected returns true if the node is believed to be connected.
+func (n *ClusterNode) isConnected() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.connected
+}
+
+// hasEndpoint returns true once the node has been connected.
+func (n *ClusterNode) hasEndpoint() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.endpoint != nil
+}
+
+// isDead returns true if the node is marked dead.
+func (n *ClusterNode) isDead() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.dead
+}
+
+// nodeWeight returns the ring hash weight of the named node.
+func (c *Cluster) nodeWeight(name string) int {
+	if name == c.thisNodeName {
+		return c.thisNodeWeight
+	}
+	if n := c.nodes[name]; n != nil {
+		return n.weight
+	}
+	return 1
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Default time a forwarded publish waits for more publishes to the same master before the batch is sent
+const defaultClusterBatchDelay = 2 * time.Millisecond
+
+type clusterBatchConfig struct {
+	// Maximum number of publishes forwarded to a master in one request. Batching is disabled unless it is above 1.
+	MaxSize int `json:"max_size"`
+	// Time in milliseconds a publish waits for more publishes to the same master before the batch is sent
+	MaxDelay int `json:"max_delay"`
+}
+
+// ClusterBatch is a batch of publishes forwarded to the master in one request.
+type ClusterBatch struct {
+	// Requests in the order they are forwarded
+	Reqs []*ClusterReq
+}
+
+// ClusterBatchResp is the response of the master to a batch of publishes.
+type ClusterBatchResp struct {
+	// True for the requests rejected by the master as out of sync, by the index of the request in the batch
+	Rejected []bool
+	// Error of the requests failed by the master, by the index of the request in the batch. Empty
+	// for the requests applied, the requests following a failed request are still applied.
+	Errors []string
+}
+
+// clusterBatcher coalesces the publishes forwarded to a node into batches. One batch is in flight at a
+// time, so the node receives the publishes in the order they are forwarded. The publishes forwarded while
+// a batch is in flight are sent in the next batch once it completes. The publishes are added without
+// waiting for the batch, so the publishes of a session are coalesced along with the other sessions.
+type clusterBatcher struct {
+	node *ClusterNode
+	// Maximum number of publishes in a batch
+	size int
+	// Time the first publish of a batch waits for more publishes
+	delay time.Duration
+
+	lock sync.Mutex
+	// Publishes waiting for a batch
+	pending []clusterBatchItem
+	// True while the batches are being sent
+	running bool
+	// Signaled once the pending publishes fill a batch; buffered, 1
+	fullC chan struct{}
+}
+
+type clusterBatchItem struct {
+	req *ClusterReq
+	// Called once the batch of the request is sent with the result of the request
+	done func(rejected bool, err error)
+}
+
+func newClusterBatcher(n *ClusterNode, size int, delay time.Duration) *clusterBatcher {
+	if delay <= 0 {
+		delay = defaultClusterBatchDelay
+	}
+	return &clusterBatcher{node: n, size: size, delay: delay, fullC: make(chan struct{}, 1)}
+}
+
+// add adds the request to a batch without waiting for the batch to be sent. Once the batch is
+// sent done is called with whether the master rejected the request and the error of the request,
+// if any. done is called from the goroutine sending the batches, in the order the requests are added.
+func (b *clusterBatcher) add(req *ClusterReq, done func(rejected bool, err error)) {
+	b.lock.Lock()
+	b.pending = append(b.pending, clusterBatchItem{req: req, done: done})
+	if len(b.pending) >= b.size {
+		select {
+		case b.fullC <- struct{}{}:
+		default:
+		}
+	}
+	if !b.running {
+		b.running = true
+		go b.run()
+	}
+	b.lock.Unlock()
+}
+
+// run sends the pending publishes in batches until none are left.
+func (b *clusterBatcher) run() {
+	timer := time.NewTimer(b.delay)
+	select {
+	case <-timer.C:
+	case <-b.fullC:
+		timer.Stop()
+	}
+	for {
+		b.lock.Lock()
+		n := len(b.pending)
+		if n == 0 {
+			b.running = false
+			b.lock.Unlock()
+			return
+		}
+		if n > b.size {
+			n = b.size
+		}
+		items := make([]clusterBatchItem, n)
+		copy(items, b.pending)
+		b.pending = b.pending[n:]
+		b.lock.Unlock()
+		b.send(items)
+	}
+}
+
+func (b *clusterBatcher) send(items []clusterBatchItem) {
+	batch := &ClusterBatch{Reqs: make([]*ClusterReq, len(items))}
+	for i, item := range items {
+		batch.Reqs[i] = item.req
+	}
+	var resp ClusterBatchResp
+	err := b.node.call("Cluster.MasterBatch", batch, &resp)
+	for i, item := range items {
+		if err != nil {
+			item.done(false, err)
+			continue
+		}
+		if i < len(resp.Errors) && resp.Errors[i] != "" {
+			item.done(false, errors.New(resp.Errors[i]))
+			continue
+		}
+		item.done(i < len(resp.Rejected) && resp.Rejected[i], nil)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"log"
 	"math/rand"
 	"net/rpc"
+	"sort"
 	"time"
 )
 
@@ -28,6 +29,8 @@ import (
 // times, the leader node annouces it dead and initiates rehashing: it regenerates ring hash with
 // only live nodes and communicates the new list of nodes to followers. They in turn do their
 // rehashing using the new list. When the dead node is revived, rehashing happens again.
+// The contracts of a dead node are taken over by the least loaded live node, as reported by
+// the node heartbeats, rather than redistributed by ring position.
 
 // Failover config
 type clusterFailover struct {
@@ -49,8 +52,6 @@ type clusterFailover struct {
 	leaderPing chan *ClusterPing
 	// Channel for processing election votes
 	electionVote chan *ClusterVote
-	// Channel for stopping the failover runner
-	done chan bool
 }
 
 type clusterFailoverConfig struct {
@@ -74,6 +75,8 @@ type ClusterPing struct {
 	Signature string
 	// Names of nodes currently active in the cluster
 	Nodes []string
+	// Names of the dead nodes mapped to the nodes taking over their contracts
+	Takeover map[string]string
 }
 
 // ClusterVoteRequest is a request from a leader candidate to a node to vote for the candidate.
@@ -127,8 +130,7 @@ func (c *Cluster) failoverInit(config *clusterFailoverConfig) bool {
 		voteTimeout:        config.VoteAfter,
 		nodeFailCountLimit: config.NodeFailAfter,
 		leaderPing:         make(chan *ClusterPing, config.VoteAfter),
-		electionVote:       make(chan *ClusterVote, len(c.nodes)),
-		done:               make(chan bool, 1)}
+		electionVote:       make(chan *ClusterVote, len(c.nodes))}
 
 	log.Println("cluster: failover mode enabled")
 
@@ -161,46 +163,153 @@ func (c *Cluster) Vote(vreq *ClusterVoteRequest, response *ClusterVoteResponse)
 func (c *Cluster) sendPings() {
 	rehash := false
 
+	// The takeover map is replaced on rehash and never modified in place.
+	c.ringLock.RLock()
+	signature, takeover := c.ring.Signature(), c.takeover
+	c.ringLock.RUnlock()
+
 	for _, node := range c.nodes {
 		unused := false
 		err := node.call("Cluster.Ping", &ClusterPing{
 			Leader:    c.thisNodeName,
 			Term:      c.fo.term,
-			Signature: c.ring.Signature(),
-			Nodes:     c.fo.activeNodes}, &unused)
+			Signature: signature,
+			Nodes:     c.fo.activeNodes,
+			Takeover:  takeover}, &unused)
 
+		// The fail count is also incremented by missed heartbeats, so compare the
+		// node state against the active nodes rather than the exact fail count.
+		node.lock.Lock()
 		if err != nil {
 			node.failCount++
-			if node.failCount == c.fo.nodeFailCountLimit {
-				// Node failed too many times
-				rehash = true
-			}
 		} else {
-			if node.failCount >= c.fo.nodeFailCountLimit {
-				// Node has recovered
-				rehash = true
-			}
 			node.failCount = 0
 		}
+		failed := node.failCount >= c.fo.nodeFailCountLimit || node.dead
+		node.lock.Unlock()
+
+		if failed == c.fo.isActive(node.name) {
+			// Node failed too many times or has recovered
+			rehash = true
+		}
 	}
 
 	if rehash {
 		var activeNodes []string
 		for _, node := range c.nodes {
-			if node.failCount < c.fo.nodeFailCountLimit {
+			node.lock.Lock()
+			failCount := node.failCount
+			dead := node.dead
+			node.lock.Unlock()
+			if failCount < c.fo.nodeFailCountLimit && !dead {
 				activeNodes = append(activeNodes, node.name)
 			}
 		}
 		activeNodes = append(activeNodes, c.thisNodeName)
 
 		c.fo.activeNodes = activeNodes
-		c.rehash(activeNodes)
+		takeover := c.failoverRehash(activeNodes)
 
-		log.Println("cluster: initiating failover rehash for nodes", activeNodes)
+		log.Println("cluster: initiating failover rehash for nodes", activeNodes, "takeover", takeover)
 		//globals.hub.rehash <- true
 	}
 }
 
+// failoverRehash regenerates the ring hash with the active nodes. The contracts of each dead node
+// are placed on the least loaded active node, which is charged the load of the dead node so
+// several dead nodes are not all placed on the same node. Returns the new takeover map.
+func (c *Cluster) failoverRehash(activeNodes []string) map[string]string {
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+
+	active := make(map[string]bool, len(activeNodes))
+	loads := make(map[string]ClusterLoad, len(activeNodes))
+	for _, name := range activeNodes {
+		active[name] = true
+		loads[name] = c.nodeLoad(name)
+	}
+
+	// Keep the placement of the nodes which are still dead, unless the node taking over has died too.
+	takeover := make(map[string]string)
+	for name, owner := range c.takeover {
+		if !active[name] && active[owner] {
+			takeover[name] = owner
+			loads[owner] = loads[owner].add(c.nodeLoad(name))
+		}
+	}
+	var dead []string
+	for name := range c.nodes {
+		if _, ok := takeover[name]; !ok && !active[name] {
+			dead = append(dead, name)
+		}
+	}
+	sort.Strings(dead)
+	for _, name := range dead {
+		owner := lightestNode(loads)
+		if owner == "" {
+			break
+		}
+		takeover[name] = owner
+		loads[owner] = loads[owner].add(c.nodeLoad(name))
+	}
+
+	c.takeover = takeover
+	c.rehashLocked(activeNodes)
+	return takeover
+}
+
+// add returns the sum of the two loads.
+func (l ClusterLoad) add(o ClusterLoad) ClusterLoad {
+	return ClusterLoad{
+		Connections: l.Connections + o.Connections,
+		InMsgRate:   l.InMsgRate + o.InMsgRate,
+		MemdbSize:   l.MemdbSize + o.MemdbSize}
+}
+
+// lightestNode returns the name of the least loaded node. Each load stat is scaled by its maximum
+// across the nodes so the stats weigh the same. Ties are broken by the node name.
+func lightestNode(loads map[string]ClusterLoad) string {
+	var max ClusterLoad
+	for _, l := range loads {
+		if l.Connections > max.Connections {
+			max.Connections = l.Connections
+		}
+		if l.InMsgRate > max.InMsgRate {
+			max.InMsgRate = l.InMsgRate
+		}
+		if l.MemdbSize > max.MemdbSize {
+			max.MemdbSize = l.MemdbSize
+		}
+	}
+	scale := func(v, max float64) float64 {
+		if max <= 0 {
+			return 0
+		}
+		return v / max
+	}
+
+	lightest, min := "", 0.0
+	for name, l := range loads {
+		score := scale(float64(l.Connections), float64(max.Connections)) +
+			scale(l.InMsgRate, max.InMsgRate) +
+			scale(float64(l.MemdbSize), float64(max.MemdbSize))
+		if lightest == "" || score < min || (score == min && name < lightest) {
+			lightest, min = name, score
+		}
+	}
+	return lightest
+}
+
+// isActive returns true if the node is in the list of nodes the leader considers active.
+func (fo *clusterFailover) isActive(name string) bool {
+	for _, n := range fo.activeNodes {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Cluster) electLeader() {
 	// Increment the term (voting for myself in this term) and clear the leader
 	c.fo.term++
@@ -256,10 +365,17 @@ func (c *Cluster) electLeader() {
 	}
 }
 
-// Go routine that processes calls related to leader election and maintenance.
+// Go routine that processes the nodes marked dead or revived and, if failover is enabled, the calls
+// related to leader election and maintenance.
 func (c *Cluster) run() {
-
-	ticker := time.NewTicker(c.fo.heartBeat)
+	var tick <-chan time.Time
+	var leaderPing chan *ClusterPing
+	var electionVote chan *ClusterVote
+	if c.fo != nil {
+		ticker := time.NewTicker(c.fo.heartBeat)
+		defer ticker.Stop()
+		tick, leaderPing, electionVote = ticker.C, c.fo.leaderPing, c.fo.electionVote
+	}
 
 	missed := 0
 	// Don't rehash immediately on the first ping. If this node just came onlyne, leader will
@@ -268,7 +384,7 @@ func (c *Cluster) run() {
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-tick:
 			if c.fo.leader == c.thisNodeName {
 				// I'm the leader, send pings
 				c.sendPings()
@@ -280,7 +396,7 @@ func (c *Cluster) run() {
 					c.electLeader()
 				}
 			}
-		case ping := <-c.fo.leaderPing:
+		case ping := <-leaderPing:
 			// Ping from a leader.
 
 			if ping.Term < c.fo.term {
@@ -305,11 +421,11 @@ func (c *Cluster) run() {
 			}
 
 			missed = 0
-			if ping.Signature != c.ring.Signature() {
+			if ping.Signature != c.ringSignature() {
 				if rehashSkipped {
 					log.Println("cluster: rehashing at a request of",
-						ping.Leader, ping.Nodes, ping.Signature, c.ring.Signature())
-					c.rehash(ping.Nodes)
+						ping.Leader, ping.Nodes, ping.Signature)
+					c.rehashIfChanged(ping.Signature, ping.Nodes, ping.Takeover)
 					rehashSkipped = false
 
 					//globals.hub.rehash <- true
@@ -318,7 +434,7 @@ func (c *Cluster) run() {
 				}
 			}
 
-		case vreq := <-c.fo.electionVote:
+		case vreq := <-electionVote:
 			if c.fo.term < vreq.req.Term {
 				// This is a new election. This node has not voted yet. Vote for the requestor and
 				// clear the current leader.
@@ -331,7 +447,9 @@ func (c *Cluster) run() {
 				log.Printf("Voting NO for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
 				vreq.resp <- ClusterVoteResponse{Result: false, Term: c.fo.term}
 			}
-		case <-c.fo.done:
+		case state := <-c.nodeState:
+			c.nodeStateChanged(state)
+		case <-c.done:
 			return
 		}
 	}
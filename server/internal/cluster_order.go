@@ -0,0 +1,257 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time to hold a forwarded publish waiting for the publishes forwarded before it
+	defaultClusterOrderWait = 200 * time.Millisecond
+	// Default time a forwarded publish is remembered so its duplicates are dropped
+	defaultClusterDedupWindow = time.Minute
+)
+
+// clusterOrder orders the publishes of each contract. The publishes of a contract forwarded to the
+// replicas of the contract are stored one at a time and carry the sequence of the contract on the node. The master applies the publishes forwarded by each node in
+// the order of the sequence, so the publishes of a contract are read in the order the master accepted them.
+// A publish forwarded again with a sequence seen within the dedup window is dropped, so a publish is not
+// applied twice if it is forwarded twice during a rehash.
+type clusterOrder struct {
+	lock      sync.Mutex
+	contracts map[uint32]*contractOrder
+	// Time to hold a forwarded publish waiting for the publishes forwarded before it
+	wait time.Duration
+	// Time a forwarded publish is remembered so its duplicates are dropped
+	dedup time.Duration
+}
+
+type contractOrder struct {
+	// Guards the publishes of the contract stored by the node and forwarded to the replicas. The
+	// store put of the publish is held under the lock so the sequence follows the order the publishes
+	// are stored in, a node stores the forwarded publishes of a contract one at a time.
+	putLock sync.Mutex
+	// Sequence of the last publish of the contract forwarded by the node
+	seq uint64
+
+	// Guards the forwarded publishes of the contract applied by the node
+	applyLock sync.Mutex
+	// Forwarded publishes by the origin node
+	origins map[string]*originOrder
+}
+
+type originOrder struct {
+	// Start time of the origin node, the sequence restarts once the node restarts
+	epoch int64
+	// Sequence of the last publish applied
+	applied uint64
+	// Publishes held until the publishes before them are applied, by sequence
+	held map[uint64]func()
+	// Time the oldest held publish arrived
+	heldSince time.Time
+	// Time the publishes were accepted, by sequence
+	seen map[uint64]time.Time
+	// Time the publishes seen before the dedup window were last removed
+	purgedAt time.Time
+}
+
+func (o *clusterOrder) get(contract uint32) *contractOrder {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.contracts == nil {
+		o.contracts = make(map[uint32]*contractOrder)
+	}
+	co, ok := o.contracts[contract]
+	if !ok {
+		co = &contractOrder{origins: make(map[string]*originOrder)}
+		o.contracts[contract] = co
+	}
+	return co
+}
+
+func (o *clusterOrder) holdTime() time.Duration {
+	if o.wait == 0 {
+		return defaultClusterOrderWait
+	}
+	return o.wait
+}
+
+func (o *clusterOrder) dedupTime() time.Duration {
+	if o.dedup == 0 {
+		return defaultClusterDedupWindow
+	}
+	return o.dedup
+}
+
+// put stores a publish of the contract accepted by the node. It returns the sequence to forward
+// the publish with, or zero if the publish is not forwarded.
+func (o *clusterOrder) put(contract uint32, forward bool, put func() error) (uint64, error) {
+	if !forward {
+		// The publish is not sequenced, it is stored concurrently with the other publishes.
+		return 0, put()
+	}
+	co := o.get(contract)
+	co.putLock.Lock()
+	defer co.putLock.Unlock()
+	if err := put(); err != nil {
+		return 0, err
+	}
+	co.seq++
+	return co.seq, nil
+}
+
+// apply applies a publish of the contract forwarded by the node in the order of its sequence.
+// A publish forwarded ahead of the publishes before it is held until they are applied. Once the
+// wait elapses the publishes missing before it, e.g. lost on a failed forward, are skipped.
+// It returns false if the publish is a duplicate of a publish seen within the dedup window and
+// is dropped.
+func (o *clusterOrder) apply(node string, epoch int64, contract uint32, seq uint64, fn func()) bool {
+	if seq == 0 {
+		// The publish is not ordered.
+		fn()
+		return true
+	}
+	co := o.get(contract)
+	co.applyLock.Lock()
+	defer co.applyLock.Unlock()
+	origin, ok := co.origins[node]
+	if !ok {
+		origin = newOriginOrder(epoch)
+		co.origins[node] = origin
+	}
+	switch {
+	case epoch > origin.epoch:
+		// The origin node restarted and its sequence restarts.
+		origin.restart(epoch)
+	case epoch < origin.epoch:
+		// The publish was forwarded before the origin node restarted, it is applied unordered
+		// without resetting the order of the publishes forwarded since the restart.
+		fn()
+		return true
+	}
+	if !origin.accept(seq, o.dedupTime()) {
+		return false
+	}
+	switch {
+	case seq <= origin.applied:
+		// The publish arrived after it was skipped, apply it rather than dropping it.
+		fn()
+		return true
+	case seq > origin.applied+1:
+		if len(origin.held) == 0 {
+			origin.heldSince = time.Now()
+			time.AfterFunc(o.holdTime(), func() { o.skip(node, contract) })
+		}
+		origin.held[seq] = fn
+		return true
+	}
+	fn()
+	origin.applied = seq
+	origin.drain()
+	return true
+}
+
+func newOriginOrder(epoch int64) *originOrder {
+	return &originOrder{epoch: epoch, held: make(map[uint64]func()), seen: make(map[uint64]time.Time)}
+}
+
+// restart resets the order of the publishes once the origin node restarts. The publishes held from
+// before the restart are applied first in the order of their sequence, as the publishes missing
+// before them are lost with the restart.
+func (origin *originOrder) restart(epoch int64) {
+	seqs := make([]uint64, 0, len(origin.held))
+	for seq := range origin.held {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		origin.held[seq]()
+	}
+	*origin = *newOriginOrder(epoch)
+}
+
+// accept records the sequence of a publish. It returns false if the publish was seen within the window.
+func (origin *originOrder) accept(seq uint64, window time.Duration) bool {
+	now := time.Now()
+	if at, ok := origin.seen[seq]; ok && now.Sub(at) < window {
+		return false
+	}
+	if now.Sub(origin.purgedAt) >= window {
+		for s, at := range origin.seen {
+			if now.Sub(at) >= window {
+				delete(origin.seen, s)
+			}
+		}
+		origin.purgedAt = now
+	}
+	origin.seen[seq] = now
+	return true
+}
+
+// skip skips the publishes missing before the held publishes of the node once the wait elapses.
+func (o *clusterOrder) skip(node string, contract uint32) {
+	co := o.get(contract)
+	co.applyLock.Lock()
+	defer co.applyLock.Unlock()
+	origin := co.origins[node]
+	if len(origin.held) == 0 {
+		return
+	}
+	if wait := o.holdTime() - time.Since(origin.heldSince); wait > 0 {
+		// The publishes held first were applied, wait for the remaining publishes.
+		time.AfterFunc(wait, func() { o.skip(node, contract) })
+		return
+	}
+	var first uint64
+	for seq := range origin.held {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	origin.applied = first - 1
+	origin.drain()
+}
+
+// drain applies the held publishes following the last applied publish.
+func (origin *originOrder) drain() {
+	for {
+		next := origin.applied + 1
+		fn, ok := origin.held[next]
+		if !ok {
+			break
+		}
+		delete(origin.held, next)
+		fn()
+		origin.applied = next
+	}
+	if len(origin.held) > 0 {
+		origin.heldSince = time.Now()
+	}
+}
+
+// orderPublish stores the publish of the contract in the order it is accepted by the node and
+// returns the sequence to forward the publish to the replicas of the contract with.
+func (c *Cluster) orderPublish(contract uint32, forward bool, put func() error) (uint64, error) {
+	if c == nil {
+		// Cluster not initialized, the publishes are not forwarded
+		return 0, put()
+	}
+	return c.order.put(contract, forward, put)
+}
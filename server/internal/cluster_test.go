@@ -0,0 +1,1254 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unit-io/unitdb/server/internal/message"
+	lp "github.com/unit-io/unitdb/server/internal/net"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/store"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+func TestClusterResync(t *testing.T) {
+	// Node "b" is in sync with the cluster of three nodes, node "a" has lost node "c" from its ring hash.
+	b := &Cluster{thisNodeName: "b", thisNodeWeight: 1, nodes: map[string]*ClusterNode{
+		"a": {name: "a", weight: 1},
+		"c": {name: "c", weight: 1},
+	}}
+	b.rehash(nil)
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1, done: make(chan bool, 1)},
+		"c": {name: "c", weight: 1},
+	}}
+	a.rehash([]string{"a", "b"})
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Cluster", b); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(l)
+
+	n := a.nodes["b"]
+	if n.endpoint, err = rpc.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	n.connected = true
+	defer n.endpoint.Close()
+
+	cluster, connCache := Globals.Cluster, Globals.connCache
+	Globals.Cluster, Globals.connCache = a, NewConnCache()
+	defer func() {
+		Globals.Cluster, Globals.connCache = cluster, connCache
+	}()
+
+	forward := func() error {
+		return n.forward(&ClusterReq{Signature: a.ring.Signature(), Conn: &ClusterSess{}})
+	}
+	// The first rejection is surfaced, the ring hash is resynced on the repeated rejection.
+	if err := forward(); err == nil {
+		t.Fatal("expected request rejected by out of sync node")
+	}
+	if err := forward(); err != nil {
+		t.Fatalf("expected request routed after resync; got %v", err)
+	}
+	if a.ring.Signature() != b.ring.Signature() {
+		t.Fatal("expected ring hash resynced from node")
+	}
+	if err := forward(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resyncs are backed off.
+	a.rehash([]string{"a", "b"})
+	for i := 0; i < defaultClusterResyncAfter; i++ {
+		if err := forward(); err == nil {
+			t.Fatal("expected resync to be backed off")
+		}
+	}
+	if a.ring.Signature() == b.ring.Signature() {
+		t.Fatal("expected ring hash not resynced during backoff")
+	}
+}
+
+func TestClusterRehash(t *testing.T) {
+	nodes := func(names ...string) map[string]*ClusterNode {
+		m := make(map[string]*ClusterNode)
+		for _, name := range names {
+			m[name] = &ClusterNode{name: name, weight: 1}
+		}
+		return m
+	}
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, nodes: nodes("b", "c", "d")}
+	d := &Cluster{thisNodeName: "d", thisNodeWeight: 1, nodes: nodes("c", "b", "a")}
+	keysA, keysD := a.rehash(nil), d.rehash(nil)
+	if !reflect.DeepEqual(keysA, keysD) {
+		t.Fatalf("expected same ring keys, got %v and %v", keysA, keysD)
+	}
+	if a.ring.Signature() != d.ring.Signature() {
+		t.Fatal("expected same ring hash signature for the same members")
+	}
+
+	// Rehashing from a list of nodes in a different order gives the same ring hash.
+	sig := a.ring.Signature()
+	a.rehash([]string{"d", "a", "c", "b"})
+	if a.ring.Signature() != sig || !reflect.DeepEqual(a.ringKeys, keysA) {
+		t.Fatal("expected rehash to be idempotent")
+	}
+}
+
+func TestClusterFailoverLoad(t *testing.T) {
+	// Node "a" leads the cluster, "d" fails while "b" is heavily and "c" lightly loaded.
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, heartbeat: time.Hour, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1, load: ClusterLoad{Connections: 900, InMsgRate: 5000, MemdbSize: 40000}},
+		"c": {name: "c", weight: 1, load: ClusterLoad{Connections: 100, InMsgRate: 200, MemdbSize: 1000}},
+		"d": {name: "d", weight: 1, load: ClusterLoad{Connections: 300, InMsgRate: 900, MemdbSize: 8000}},
+	}}
+	a.load, a.loadAt = ClusterLoad{Connections: 500, InMsgRate: 2000, MemdbSize: 20000}, time.Now()
+	a.rehash(nil)
+
+	owners := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		contract := fmt.Sprint(i)
+		owners[contract] = a.ring.Get(contract)
+	}
+
+	activeNodes := []string{"a", "b", "c"}
+	a.failoverRehash(activeNodes)
+	if a.takeover["d"] != "c" {
+		t.Fatalf("expected contracts of node d taken over by the least loaded node c; got %v", a.takeover)
+	}
+	moved := 0
+	for contract, owner := range owners {
+		got := a.ring.Get(contract)
+		if owner == "d" {
+			moved++
+			if got != "c" {
+				t.Fatalf("expected contract %s of failed node placed on node c; got %s", contract, got)
+			}
+		} else if got != owner {
+			t.Fatalf("expected contract %s to stay on node %s; got %s", contract, owner, got)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("expected failed node to own some contracts")
+	}
+
+	// A follower rehashing with the nodes and takeover of the leader ping gets the same ring hash.
+	b := &Cluster{thisNodeName: "b", thisNodeWeight: 1, nodes: map[string]*ClusterNode{
+		"a": {name: "a", weight: 1},
+		"c": {name: "c", weight: 1},
+		"d": {name: "d", weight: 1},
+	}}
+	b.takeover = a.takeover
+	b.rehash(activeNodes)
+	if b.ring.Signature() != a.ring.Signature() {
+		t.Fatal("expected follower ring hash to match the leader")
+	}
+
+	// Once the node recovers the takeover is dropped.
+	a.failoverRehash([]string{"a", "b", "c", "d"})
+	if len(a.takeover) != 0 || a.ring.Get("1") != owners["1"] {
+		t.Fatalf("expected takeover dropped after recovery; got %v", a.takeover)
+	}
+}
+
+func TestClusterRingConcurrent(t *testing.T) {
+	// The ring hash is rebuilt by the failover and the resync while it is read by the RPC handlers.
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, replicas: 2, heartbeat: time.Hour, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1},
+		"c": {name: "c", weight: 1},
+	}}
+	a.rehash(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if i%2 == 0 {
+				a.failoverRehash([]string{"a", "b"})
+			} else {
+				a.rehash(nil)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			var unused bool
+			var ring ClusterRing
+			a.Ring(&unused, &ring)
+			// The reply is read once the handler returns, as the RPC server encodes it.
+			for name, owner := range ring.Takeover {
+				if name == "" || owner == "" {
+					t.Error("expected named nodes in the takeover map")
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			var resp ClusterOwnership
+			a.Ownership(&ClusterOwnershipReq{Contracts: []string{fmt.Sprint(i)}}, &resp)
+			if len(a.replicasForContract(fmt.Sprint(i))) == 0 {
+				t.Error("expected replicas for the contract")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// The reply does not share the takeover map of the cluster.
+	var unused bool
+	var ring ClusterRing
+	a.Ring(&unused, &ring)
+	ring.Takeover["x"] = "a"
+	if _, ok := a.takeover["x"]; ok {
+		t.Fatal("expected takeover map of the cluster unchanged by the reply")
+	}
+}
+
+func TestClusterOwnership(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"a", "b"} {
+		c := &Cluster{thisNodeName: name, thisNodeWeight: 1, nodes: map[string]*ClusterNode{}}
+		for _, peer := range []string{"a", "b", "c"} {
+			if peer != name {
+				c.nodes[peer] = &ClusterNode{name: peer, weight: 1}
+			}
+		}
+		c.rehash(nil)
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("Cluster", c); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go srv.Accept(l)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	req := &ClusterOwnershipReq{Contracts: []string{"3376684800", "1", "42", "612249907"}}
+	var views []ClusterOwnership
+	for _, addr := range addrs {
+		client, err := rpc.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		var view ClusterOwnership
+		if err := client.Call("Cluster.Ownership", req, &view); err != nil {
+			t.Fatal(err)
+		}
+		views = append(views, view)
+	}
+
+	if views[0].Node != "a" || views[1].Node != "b" {
+		t.Fatalf("unexpected node names %s and %s", views[0].Node, views[1].Node)
+	}
+	if views[0].Signature != views[1].Signature {
+		t.Fatal("expected same ring hash signature")
+	}
+	if !reflect.DeepEqual(views[0].Nodes, views[1].Nodes) {
+		t.Fatalf("expected same nodes, got %v and %v", views[0].Nodes, views[1].Nodes)
+	}
+	if len(views[0].Owners) != len(req.Contracts) || !reflect.DeepEqual(views[0].Owners, views[1].Owners) {
+		t.Fatalf("expected same owners, got %v and %v", views[0].Owners, views[1].Owners)
+	}
+}
+
+func TestClusterWriteTimeout(t *testing.T) {
+	// The listener accepts the connection but never reads from it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	n := &ClusterNode{name: "b", address: l.Addr().String(), writeTimeout: 100 * time.Millisecond}
+	if n.endpoint, err = n.dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.endpoint.Close()
+	conn := <-accepted
+	defer conn.Close()
+
+	// The message is larger than the socket buffers so the write blocks.
+	resp := &ClusterResp{Msg: make([]byte, 64<<20)}
+	unused := false
+	start := time.Now()
+	if err := n.endpoint.Call("Cluster.Proxy", resp, &unused); err == nil {
+		t.Fatal("expected write to a blackholed node to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected write to time out after the write timeout, took %v", elapsed)
+	}
+}
+
+func TestClusterHeartbeatStalled(t *testing.T) {
+	// The peer accepts the connection but never answers, so the connection looks healthy.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	cluster := Globals.Cluster
+	Globals.Cluster = &Cluster{thisNodeName: "a", heartbeat: time.Hour}
+	defer func() {
+		Globals.Cluster = cluster
+	}()
+
+	// The node is reconnected to an unreachable address once marked down so it stays disconnected.
+	n := &ClusterNode{name: "b", address: unreachable, backoff: clusterBackoff{base: time.Hour}, done: make(chan bool, 1)}
+	if n.endpoint, err = rpc.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	n.connected = true
+	conn := <-accepted
+	defer conn.Close()
+
+	const interval, missAfter = 20 * time.Millisecond, 3
+	start := time.Now()
+	go n.heartbeat(interval, missAfter)
+	defer close(n.done)
+
+	// Each heartbeat waits up to the interval for the response, so the node is marked down
+	// within twice the interval for each missed heartbeat.
+	window := 2 * missAfter * interval
+	for {
+		n.lock.Lock()
+		connected, failCount := n.connected, n.failCount
+		n.lock.Unlock()
+		if !connected {
+			if failCount != 1 {
+				t.Fatalf("expected fail count 1 once the node is marked down; got %d", failCount)
+			}
+			break
+		}
+		if time.Since(start) > window+time.Second {
+			t.Fatalf("expected stalled node marked down within %v", window)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < missAfter*interval {
+		t.Fatalf("expected node marked down only after %d missed heartbeats, took %v", missAfter, elapsed)
+	}
+}
+
+func TestClusterReconnectBackoff(t *testing.T) {
+	b := clusterBackoff{base: 100 * time.Millisecond, max: time.Second}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, d := range expected {
+		if interval := b.interval(i + 1); interval != d*time.Millisecond {
+			t.Fatalf("expected interval %v after %d failures; got %v", d*time.Millisecond, i+1, interval)
+		}
+	}
+
+	// The jitter shortens the interval but the interval still grows up to the cap.
+	b.jitter = 0.5
+	for i, d := range expected {
+		interval := b.interval(i + 1)
+		if max := d * time.Millisecond; interval > max || interval < max/2 {
+			t.Fatalf("expected interval from %v to %v after %d failures; got %v", max/2, max, i+1, interval)
+		}
+	}
+
+	// The node reconnects after a few failed attempts once the listener is back.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	n := &ClusterNode{name: "b", address: addr, backoff: clusterBackoff{base: 10 * time.Millisecond, max: 40 * time.Millisecond}, done: make(chan bool, 1)}
+	go n.reconnect()
+	time.Sleep(100 * time.Millisecond)
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Skip("unable to listen on the node address again: ", err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			defer conn.Close()
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n.lock.Lock()
+		connected := n.connected
+		n.lock.Unlock()
+		if connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected node to reconnect within the backoff cap")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.endpoint.Close()
+}
+
+func TestClusterNodeDead(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, replicas: 1, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1, address: addr, backoff: clusterBackoff{base: 5 * time.Millisecond, max: 10 * time.Millisecond},
+			maxFailures: 3, done: make(chan bool, 1)},
+		"c": {name: "c", weight: 1, connected: true},
+	}, nodeState: make(chan clusterNodeState, 2), done: make(chan bool)}
+	a.rehash(nil)
+	cluster := Globals.Cluster
+	Globals.Cluster = a
+	go a.run()
+	defer func() {
+		close(a.done)
+		Globals.Cluster = cluster
+	}()
+
+	contracts := make([]string, 100)
+	routed := false
+	for i := range contracts {
+		contracts[i] = fmt.Sprint(i)
+		if a.ownerForContract(contracts[i]) == "b" {
+			routed = true
+		}
+	}
+	if !routed {
+		t.Fatal("expected contracts routed to node b")
+	}
+
+	// The unreachable node is marked dead once it exceeds the reconnect failures.
+	n := a.nodes["b"]
+	exited := make(chan struct{})
+	go func() {
+		n.reconnect()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected reconnect to exit once the node is marked dead")
+	}
+	if !n.isDead() {
+		t.Fatal("expected node marked dead")
+	}
+	inRing := func() bool {
+		a.ringLock.RLock()
+		defer a.ringLock.RUnlock()
+		for _, key := range a.ringKeys {
+			if key == "b" {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor := func(want bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for inRing() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected node b in the ring hash %v", want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(false)
+	for _, contract := range contracts {
+		if owner := a.ownerForContract(contract); owner == "b" {
+			t.Fatalf("expected contract %s not routed to the dead node", contract)
+		}
+	}
+
+	// The dead node is revived and reconnected once it sends a heartbeat.
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	unused := false
+	if err := a.Heartbeat(&ClusterHeartbeat{Node: "b"}, &unused); err != nil {
+		t.Fatal(err)
+	}
+	if n.isDead() {
+		t.Fatal("expected node revived")
+	}
+	waitFor(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for !n.isConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected revived node reconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	n.lock.Lock()
+	n.endpoint.Close()
+	n.lock.Unlock()
+}
+
+// clusterReplicaRecorder records the requests received by a replica of a contract.
+type clusterReplicaRecorder struct {
+	sync.Mutex
+	reqs []ClusterReq
+}
+
+func (r *clusterReplicaRecorder) Master(msg *ClusterReq, rejected *bool) error {
+	r.Lock()
+	r.reqs = append(r.reqs, *msg)
+	r.Unlock()
+	return nil
+}
+
+func (r *clusterReplicaRecorder) received() []ClusterReq {
+	r.Lock()
+	defer r.Unlock()
+	reqs := r.reqs
+	r.reqs = nil
+	return reqs
+}
+
+func TestClusterReplicaFailover(t *testing.T) {
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, replicas: 2, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1, backoff: clusterBackoff{base: time.Hour}, done: make(chan bool, 1)},
+		"c": {name: "c", weight: 1, backoff: clusterBackoff{base: time.Hour}, done: make(chan bool, 1)},
+	}}
+	// The local node is left out of the ring hash so both replicas of the contract are remote.
+	a.rehash([]string{"b", "c"})
+	clientID := uid.ID("clientid0001")
+	contract := fmt.Sprint(clientID.Contract())
+	replicas := a.replicasForContract(contract)
+	if len(replicas) != 2 {
+		t.Fatalf("expected contract replicated to 2 nodes; got %v", replicas)
+	}
+	primary, secondary := a.nodes[replicas[0]], a.nodes[replicas[1]]
+
+	recorders := make(map[string]*clusterReplicaRecorder)
+	listeners := make(map[string]net.Listener)
+	for _, n := range []*ClusterNode{primary, secondary} {
+		rec := &clusterReplicaRecorder{}
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("Cluster", rec); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go srv.Accept(l)
+		n.address = l.Addr().String()
+		if n.endpoint, err = rpc.Dial("tcp", n.address); err != nil {
+			t.Fatal(err)
+		}
+		n.connected = true
+		defer close(n.done)
+		recorders[n.name], listeners[n.name] = rec, l
+	}
+
+	cluster, connCache := Globals.Cluster, Globals.connCache
+	Globals.Cluster, Globals.connCache = a, NewConnCache()
+	defer func() {
+		Globals.Cluster, Globals.connCache = cluster, connCache
+	}()
+
+	conn := &_Conn{clientID: clientID, subs: message.NewStats()}
+	publish := func() error {
+		pub := &utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg")}}}
+		return a.routeToContract(pub, nil, message.PUBLISH, nil, conn, 0)
+	}
+	subscribe := func() error {
+		sub := &utp.Subscribe{Subscriptions: []*utp.Subscription{{Topic: "unit1.test"}}}
+		return a.routeToContract(sub, nil, message.SUBSCRIBE, nil, conn, 0)
+	}
+
+	// The writes are forwarded to both replicas, the reads to the primary only.
+	if err := publish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := recorders[primary.name].received(); len(reqs) != 2 || reqs[0].Replica || reqs[1].Type != message.SUBSCRIBE {
+		t.Fatalf("expected publish and subscribe at the primary; got %+v", reqs)
+	}
+	if reqs := recorders[secondary.name].received(); len(reqs) != 1 || !reqs[0].Replica || reqs[0].Type != message.PUBLISH {
+		t.Fatalf("expected replicated publish at the secondary; got %+v", reqs)
+	}
+
+	// The primary stops, the contract keeps being served by the secondary.
+	listeners[primary.name].Close()
+	primary.lock.Lock()
+	primary.endpoint.Close()
+	primary.lock.Unlock()
+	if err := publish(); err != nil {
+		t.Fatalf("expected publish served by the replica once the primary stopped; got %v", err)
+	}
+	if primary.isConnected() {
+		t.Fatal("expected primary marked disconnected")
+	}
+	if err := subscribe(); err != nil {
+		t.Fatalf("expected subscribe served by the replica once the primary stopped; got %v", err)
+	}
+	reqs := recorders[secondary.name].received()
+	if len(reqs) != 2 || reqs[0].Type != message.PUBLISH || reqs[1].Type != message.SUBSCRIBE || reqs[1].Replica {
+		t.Fatalf("expected publish and subscribe at the secondary; got %+v", reqs)
+	}
+}
+
+// clusterRecorder records the messages proxied to a node.
+type clusterRecorder struct {
+	sync.Mutex
+	msgs [][]byte
+}
+
+func (r *clusterRecorder) Proxy(resp *ClusterResp, unused *bool) error {
+	// Slow down the delivery so messages are still queued when the drain starts.
+	time.Sleep(10 * time.Millisecond)
+	r.Lock()
+	r.msgs = append(r.msgs, resp.Msg)
+	r.Unlock()
+	return nil
+}
+
+func TestClusterDrainAndClose(t *testing.T) {
+	rec := &clusterRecorder{}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Cluster", rec); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(l)
+
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1, done: make(chan bool, 1)},
+	}, done: make(chan bool)}
+	a.rehash(nil)
+	n := a.nodes["b"]
+	if n.endpoint, err = rpc.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	n.connected = true
+
+	cluster, connCache := Globals.Cluster, Globals.connCache
+	Globals.Cluster, Globals.connCache = a, NewConnCache()
+	defer func() {
+		Globals.Cluster, Globals.connCache = cluster, connCache
+	}()
+
+	const count = 5
+	conn := &_Conn{clnode: n, clientID: uid.ID("clientid0001"), subs: message.NewStats(),
+		send: make(chan lp.MessagePack, count), stop: make(chan interface{}, 1)}
+	for i := 0; i < count; i++ {
+		pub := &utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte(fmt.Sprintf("msg.%d", i))}}}
+		if err := conn.enqueue(pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go conn.rpcWriteLoop()
+
+	if err := a.DrainAndClose(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	rec.Lock()
+	delivered := len(rec.msgs)
+	rec.Unlock()
+	if delivered != count {
+		t.Fatalf("expected %d messages delivered before shutdown, got %d", count, delivered)
+	}
+	if Globals.Cluster != nil {
+		t.Fatal("expected cluster shut down")
+	}
+	if n.connected {
+		t.Fatal("expected node disconnected")
+	}
+
+	// New requests are not forwarded once the cluster is draining.
+	pub := &utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg")}}}
+	if err := a.routeToContract(pub, nil, message.PUBLISH, nil, conn, 0); err != errClusterDraining {
+		t.Fatalf("expected %v, got %v", errClusterDraining, err)
+	}
+}
+
+func TestClusterPendingDropped(t *testing.T) {
+	// Node "b" is disconnected, so the write loop of its proxied session exits on the first message.
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1, done: make(chan bool, 1)},
+	}, done: make(chan bool)}
+	a.rehash(nil)
+	n := a.nodes["b"]
+
+	cluster, connCache := Globals.Cluster, Globals.connCache
+	Globals.Cluster, Globals.connCache = a, NewConnCache()
+	defer func() {
+		Globals.Cluster, Globals.connCache = cluster, connCache
+	}()
+
+	s := &_Service{meter: NewMeter()}
+	defer s.meter.UnregisterAll()
+	conn := &_Conn{service: s, clnode: n, clientID: uid.ID("clientid0001"), subs: message.NewStats(),
+		send: make(chan lp.MessagePack, 4), stop: make(chan interface{}, 1)}
+	pub := &utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg")}}}
+	for i := 0; i < 3; i++ {
+		if err := conn.enqueue(pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.rpcWriteLoop()
+	// The messages queued after the write loop has exited are dropped as well.
+	if err := conn.enqueue(pub); err != nil {
+		t.Fatal(err)
+	}
+	if pending := a.pending(); pending != 0 {
+		t.Fatalf("expected no messages pending once the session is closed; got %d", pending)
+	}
+	if dropped := s.meter.DroppedMsgs.Count(); dropped != 4 {
+		t.Fatalf("expected 4 messages dropped; got %d", dropped)
+	}
+	if err := a.DrainAndClose(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterQueueFlood(t *testing.T) {
+	const size, count = 4, 10
+	payload := func(msg lp.MessagePack) string {
+		return string(msg.(*utp.Publish).Messages[0].Payload)
+	}
+	cluster := Globals.Cluster
+	defer func() {
+		Globals.Cluster = cluster
+	}()
+	var meters []*Meter
+	defer func() {
+		for _, m := range meters {
+			m.UnregisterAll()
+		}
+	}()
+	// flood queues the messages for a session proxied to a disconnected node.
+	flood := func(policy string, replay bool) (*_Conn, []error) {
+		Globals.Cluster = &Cluster{queue: clusterQueueConfig{Size: size, Policy: policy, Replay: replay}}
+		s := &_Service{meter: NewMeter()}
+		meters = append(meters, s.meter)
+		n := &ClusterNode{name: "b", done: make(chan bool, 1)}
+		conn := &_Conn{service: s, clnode: n, send: make(chan lp.MessagePack, size), stop: make(chan interface{}, 1)}
+		var errs []error
+		for i := 0; i < count; i++ {
+			pub := &utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte(fmt.Sprintf("msg.%d", i))}}}
+			if policy == clusterQueueBlock && i >= size {
+				break
+			}
+			errs = append(errs, conn.enqueue(pub))
+		}
+		return conn, errs
+	}
+	queued := func(conn *_Conn) []string {
+		var payloads []string
+		for len(conn.send) > 0 {
+			payloads = append(payloads, payload(<-conn.send))
+		}
+		return payloads
+	}
+
+	// The new messages are rejected once the queue is full.
+	conn, errs := flood(clusterQueueError, false)
+	for i, err := range errs {
+		if (i < size && err != nil) || (i >= size && err != errClusterQueueFull) {
+			t.Fatalf("unexpected error queuing message %d: %v", i, err)
+		}
+	}
+	if dropped := conn.service.meter.DroppedMsgs.Count(); dropped != count-size {
+		t.Fatalf("expected %d messages dropped, got %d", count-size, dropped)
+	}
+	if got, want := queued(conn), []string{"msg.0", "msg.1", "msg.2", "msg.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected queued messages %v, got %v", want, got)
+	}
+
+	// The oldest messages make room for the new ones.
+	conn, errs = flood(clusterQueueDropOldest, false)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error queuing message %d: %v", i, err)
+		}
+	}
+	if dropped := conn.service.meter.DroppedMsgs.Count(); dropped != count-size {
+		t.Fatalf("expected %d messages dropped, got %d", count-size, dropped)
+	}
+	if got, want := queued(conn), []string{"msg.6", "msg.7", "msg.8", "msg.9"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected queued messages %v, got %v", want, got)
+	}
+	if pending := atomic.LoadInt64(&conn.clnode.pending); pending != size {
+		t.Fatalf("expected %d messages pending, got %d", size, pending)
+	}
+
+	// The sender waits for room in the queue.
+	conn, _ = flood(clusterQueueBlock, false)
+	queuedC := make(chan error, 1)
+	go func() {
+		queuedC <- conn.enqueue(&utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg.4")}}})
+	}()
+	select {
+	case <-queuedC:
+		t.Fatal("expected the sender blocked while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-conn.send
+	if err := <-queuedC; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queued(conn), []string{"msg.1", "msg.2", "msg.3", "msg.4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected queued messages %v, got %v", want, got)
+	}
+
+	// The message in flight and the messages queued while the node is down are replayed
+	// in order once the node reconnects.
+	conn, _ = flood(clusterQueueBlock, true)
+	n := conn.clnode
+	// The node was connected before, the write of the first message fails.
+	n.endpoint = &rpc.Client{}
+	go conn.rpcWriteLoop()
+	defer close(n.done)
+	for len(conn.send) == size {
+		time.Sleep(time.Millisecond)
+	}
+	if err := conn.enqueue(&utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg.4")}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &clusterRecorder{}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Cluster", rec); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(l)
+	endpoint, err := rpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endpoint.Close()
+	n.lock.Lock()
+	n.endpoint, n.connected = endpoint, true
+	n.lock.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&n.pending) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected queued messages replayed, %d pending", atomic.LoadInt64(&n.pending))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	if len(rec.msgs) != size+1 {
+		t.Fatalf("expected %d messages replayed, got %d", size+1, len(rec.msgs))
+	}
+	for i, m := range rec.msgs {
+		msg, err := lp.Read(bytes.NewReader(m), 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := payload(msg), fmt.Sprintf("msg.%d", i); got != want {
+			t.Fatalf("expected message %s replayed in order, got %s", want, got)
+		}
+	}
+	if dropped := conn.service.meter.DroppedMsgs.Count(); dropped != 0 {
+		t.Fatalf("expected no messages dropped, got %d", dropped)
+	}
+}
+
+func TestClusterOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	o := &clusterOrder{wait: 50 * time.Millisecond}
+	put := func(topic, payload string) func() error {
+		return func() error {
+			return store.Message.Put(message.Contract, []byte(topic), []byte(payload), "")
+		}
+	}
+	local := func(topic, payload string) {
+		if _, err := o.put(message.Contract, false, put(topic, payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	epoch := int64(1)
+	forwarded := func(seq uint64, topic, payload string) {
+		o.apply("b", epoch, message.Contract, seq, func() {
+			if err := put(topic, payload)(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	read := func(topic string) []string {
+		msgs, err := store.Message.Get(message.Contract, []byte(topic), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payloads []string
+		// Messages are read newest first.
+		for i := len(msgs) - 1; i >= 0; i-- {
+			payloads = append(payloads, string(msgs[i].Payload))
+		}
+		return payloads
+	}
+
+	// The publishes forwarded out of order are applied in the order of their sequence,
+	// interleaved with the local publishes in the order the master accepted them.
+	forwarded(2, "unit4.order", "forwarded.2")
+	local("unit4.order", "local.1")
+	forwarded(1, "unit4.order", "forwarded.1")
+	local("unit4.order", "local.2")
+	forwarded(3, "unit4.order", "forwarded.3")
+	want := []string{"local.1", "forwarded.1", "forwarded.2", "local.2", "forwarded.3"}
+	if got := read("unit4.order"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected read order %v, got %v", want, got)
+	}
+
+	// A publish missing before the held publishes is skipped once the wait elapses.
+	forwarded(5, "unit4.skip", "forwarded.5")
+	local("unit4.skip", "local.3")
+	time.Sleep(100 * time.Millisecond)
+	forwarded(4, "unit4.skip", "forwarded.4")
+	want = []string{"local.3", "forwarded.5", "forwarded.4"}
+	if got := read("unit4.skip"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected read order %v, got %v", want, got)
+	}
+
+	// The publishes held once the origin node restarts are applied before the restarted sequence.
+	forwarded(7, "unit4.restart", "forwarded.7")
+	epoch = 2
+	forwarded(2, "unit4.restart", "restarted.2")
+	forwarded(1, "unit4.restart", "restarted.1")
+	want = []string{"forwarded.7", "restarted.1", "restarted.2"}
+	if got := read("unit4.restart"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected read order %v, got %v", want, got)
+	}
+
+	// A publish forwarded before the restart is applied without resetting the restarted sequence.
+	epoch = 1
+	forwarded(8, "unit4.restart", "forwarded.8")
+	epoch = 2
+	forwarded(3, "unit4.restart", "restarted.3")
+	want = []string{"forwarded.7", "restarted.1", "restarted.2", "forwarded.8", "restarted.3"}
+	if got := read("unit4.restart"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected read order %v, got %v", want, got)
+	}
+
+	// The local publishes forwarded to the replicas are sequenced.
+	for i := uint64(1); i <= 2; i++ {
+		seq, err := o.put(message.Contract, true, put("unit4.seq", "local"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != i {
+			t.Fatalf("expected sequence %d, got %d", i, seq)
+		}
+	}
+}
+
+func TestClusterDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	o := &clusterOrder{wait: 50 * time.Millisecond, dedup: 100 * time.Millisecond}
+	forwarded := func(epoch int64, seq uint64, payload string) bool {
+		return o.apply("b", epoch, message.Contract, seq, func() {
+			if err := store.Message.Put(message.Contract, []byte("unit8.dedup"), []byte(payload), ""); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	count := func() int {
+		msgs, err := store.Message.Get(message.Contract, []byte("unit8.dedup"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(msgs)
+	}
+
+	// The same publish forwarded twice is applied once.
+	if !forwarded(1, 1, "forwarded.1") {
+		t.Fatal("expected the publish to be applied")
+	}
+	if forwarded(1, 1, "forwarded.1") {
+		t.Fatal("expected the duplicate publish to be dropped")
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("expected 1 message, got %d", n)
+	}
+
+	// A publish held for the publishes before it is not applied twice either.
+	forwarded(1, 3, "forwarded.3")
+	if forwarded(1, 3, "forwarded.3") {
+		t.Fatal("expected the duplicate held publish to be dropped")
+	}
+	forwarded(1, 2, "forwarded.2")
+	if n := count(); n != 3 {
+		t.Fatalf("expected 3 messages, got %d", n)
+	}
+
+	// The sequence restarts once the node restarts.
+	if !forwarded(2, 1, "restarted.1") {
+		t.Fatal("expected the publish of the restarted node to be applied")
+	}
+	if n := count(); n != 4 {
+		t.Fatalf("expected 4 messages, got %d", n)
+	}
+
+	// A publish seen before the window is no longer remembered.
+	time.Sleep(150 * time.Millisecond)
+	if !forwarded(2, 1, "restarted.1") {
+		t.Fatal("expected the publish to be applied once the window elapsed")
+	}
+}
+
+// clusterBatchRecorder records the requests forwarded to a master.
+type clusterBatchRecorder struct {
+	sync.Mutex
+	batches [][]uint64
+	calls   int
+	// Seq of the publish failed by the master
+	fail uint64
+}
+
+func (r *clusterBatchRecorder) Master(msg *ClusterReq, rejected *bool) error {
+	r.Lock()
+	r.calls++
+	r.Unlock()
+	return nil
+}
+
+func (r *clusterBatchRecorder) MasterBatch(batch *ClusterBatch, resp *ClusterBatchResp) error {
+	// Slow down the batches so the publishes forwarded meanwhile are coalesced.
+	time.Sleep(5 * time.Millisecond)
+	var seqs []uint64
+	for _, msg := range batch.Reqs {
+		seqs = append(seqs, msg.Seq)
+	}
+	r.Lock()
+	r.batches = append(r.batches, seqs)
+	fail := r.fail
+	r.Unlock()
+	resp.Rejected = make([]bool, len(batch.Reqs))
+	resp.Errors = make([]string, len(batch.Reqs))
+	for i, seq := range seqs {
+		if seq == fail {
+			resp.Errors[i] = "publish failed"
+		}
+	}
+	return nil
+}
+
+func TestClusterBatch(t *testing.T) {
+	rec := &clusterBatchRecorder{}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Cluster", rec); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(l)
+
+	a := &Cluster{thisNodeName: "a", thisNodeWeight: 1, nodes: map[string]*ClusterNode{
+		"b": {name: "b", weight: 1, done: make(chan bool, 1)},
+	}}
+	a.rehash(nil)
+	n := a.nodes["b"]
+	const maxSize = 8
+	n.batch = newClusterBatcher(n, maxSize, 10*time.Millisecond)
+	if n.endpoint, err = rpc.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	n.connected = true
+	defer n.endpoint.Close()
+
+	cluster := Globals.Cluster
+	Globals.Cluster = a
+	defer func() {
+		Globals.Cluster = cluster
+	}()
+
+	// A burst of publishes from the sessions, each session publishes in order.
+	const sessions, count = 10, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, sessions*count)
+	for s := 0; s < sessions; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				errs <- n.forward(&ClusterReq{Type: message.PUBLISH, Seq: uint64(s*count + i + 1), Conn: &ClusterSess{}})
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Requests other than the publishes are not batched.
+	if err := n.forward(&ClusterReq{Type: message.SUBSCRIBE, Conn: &ClusterSess{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.Lock()
+	if rec.calls != 1 {
+		t.Fatalf("expected 1 request not batched, got %d", rec.calls)
+	}
+	if len(rec.batches) >= sessions*count {
+		t.Fatalf("expected publishes batched, got %d batches for %d publishes", len(rec.batches), sessions*count)
+	}
+	last := make(map[int]uint64)
+	total := 0
+	for _, seqs := range rec.batches {
+		if len(seqs) > maxSize {
+			t.Fatalf("expected at most %d publishes in a batch, got %d", maxSize, len(seqs))
+		}
+		for _, seq := range seqs {
+			s := int(seq-1) / count
+			if seq <= last[s] {
+				t.Fatalf("expected publishes of session %d in order, got %d after %d", s, seq, last[s])
+			}
+			last[s] = seq
+			total++
+		}
+	}
+	if total != sessions*count {
+		t.Fatalf("expected %d publishes, got %d", sessions*count, total)
+	}
+	// The burst of publishes of a session is coalesced, the failed publish of a batch does not
+	// fail the other publishes of the batch.
+	rec.batches = nil
+	rec.fail = 3
+	rec.Unlock()
+	const burst = 20
+	results := make(chan error, burst)
+	failed := make(map[uint64]error)
+	var lock sync.Mutex
+	for i := 0; i < burst; i++ {
+		seq := uint64(i + 1)
+		n.forwardAsync(&ClusterReq{Type: message.PUBLISH, Seq: seq, Conn: &ClusterSess{}}, func(err error) {
+			lock.Lock()
+			failed[seq] = err
+			lock.Unlock()
+			results <- err
+		})
+	}
+	for i := 0; i < burst; i++ {
+		<-results
+	}
+	for seq, err := range failed {
+		if (seq == rec.fail) != (err != nil) {
+			t.Fatalf("expected only publish %d failed, got %v for publish %d", rec.fail, err, seq)
+		}
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	if len(rec.batches) >= burst {
+		t.Fatalf("expected the publishes of a session batched, got %d batches for %d publishes", len(rec.batches), burst)
+	}
+	var seqs []uint64
+	for _, batch := range rec.batches {
+		seqs = append(seqs, batch...)
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("expected the publishes of a session in order, got %v", seqs)
+		}
+	}
+}
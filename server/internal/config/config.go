@@ -38,10 +38,28 @@ type Config struct {
 	// Default HTTP(S) address:port to listen on for grpc. Either a
 	// numeric or a canonical name, e.g. ":80" or ":https". Could include a host name, e.g.
 	// "localhost:80".
-	// Could be blank: if TLS is not configured, will use ":80", otherwise ":443".
-	// Can be overridden from the command line, see option --listen.
+	// Could be blank: the gRPC clients are then served on the Listen address along with
+	// the TCP and websocket clients.
+	// Can be overridden from the command line, see option --grpc_listen.
 	GrpcListen string `json:"grpc_listen"`
 
+	// Time in milliseconds to wait for the next message from a client before the connection is closed.
+	// Defaults to 120 seconds.
+	ReadTimeout int `json:"read_timeout"`
+
+	// Time in milliseconds to wait for a write to a client to complete before the connection is closed.
+	// Defaults to 120 seconds.
+	WriteTimeout int `json:"write_timeout"`
+
+	// Size in bytes of the socket read and write buffers of the client connections.
+	// The OS default is used if it is not set.
+	ReadBufferSize  int `json:"read_buffer_size"`
+	WriteBufferSize int `json:"write_buffer_size"`
+
+	// Minimum size in bytes of a websocket message to compress using permessage-deflate.
+	// Compression is disabled if it is not set.
+	WSCompressionThreshold int `json:"ws_compression_threshold"`
+
 	// Default logging level is "InfoLevel" so to enable the debug log set the "LogLevel" to "DebugLevel".
 	LoggingLevel string `json:"logging_level"`
 
@@ -51,6 +69,9 @@ type Config struct {
 
 	EncryptionConfig json.RawMessage `json:"encryption_config"`
 
+	// Topic ACL policy. All access is allowed if it is not set.
+	ACLConfig json.RawMessage `json:"acl_config"`
+
 	// Configs for subsystems
 	Cluster json.RawMessage `json:"cluster_config"`
 
@@ -60,24 +81,59 @@ type Config struct {
 
 	// Config to expose runtime stats
 	VarzPath string `json:"varz_path"`
+
+	// Time in seconds the subscriptions of a disconnected client are kept for the client to reconnect.
+	// Subscriptions are not kept if it is not set.
+	SessionExpiry int `json:"session_expiry"`
+
+	// Publish rate limits per contract
+	RateLimit *RateLimitConfig `json:"rate_limit"`
 }
 
-// EncryptionConfig represents the configuration for the encryption.
+// RateLimitConfig represents the configuration of the publish rate limit of each contract.
+// Limits are enforced per node on the messages published by clients connected to the node,
+// so a contract served by several nodes may publish up to the limit on each of them.
+type RateLimitConfig struct {
+	// Number of messages a contract may publish per second. Publishes are not limited if it is not set.
+	Rate float64 `json:"rate"`
+
+	// Number of messages a contract may publish in a burst. Defaults to the rate.
+	Burst int `json:"burst"`
+}
+
+// EncryptionConfig represents the configuration for the encryption. It holds a single key or a list
+// of keys, the older keys are kept to decrypt the client Ids encoded with them.
 type EncryptionConfig struct {
+	EncryptionKey
+
+	// Keys lists the keys in use in addition to the key of the configuration.
+	Keys []EncryptionKey `json:"keys,omitempty"`
+}
 
+// EncryptionKey represents an encryption key.
+type EncryptionKey struct {
 	// chacha20poly1305 encryption key for client Ids and topic keys. 32 random bytes base64-encoded.
 	Key string `json:"key,omitempty"`
 
 	// Key identifier. it is useful when you use multiple keys.
 	Identifier string `json:"identifier"`
 
-	// slealed flag tells if key in the configuration is sealed.
-	Sealed bool `json:"slealed"`
+	// sealed flag tells if key in the configuration is sealed. Sealed keys are rejected.
+	Sealed bool `json:"sealed"`
 
 	// timestamp is helpful to determine the latest key in case of keyroll over.
 	Timestamp uint32 `json:"timestamp,omitempty"`
 }
 
+// AllKeys returns the key of the configuration followed by the listed keys. The key of the
+// configuration is left out if it is not set and keys are listed.
+func (c EncryptionConfig) AllKeys() []EncryptionKey {
+	if c.Key == "" && len(c.Keys) > 0 {
+		return c.Keys
+	}
+	return append([]EncryptionKey{c.EncryptionKey}, c.Keys...)
+}
+
 func (c *Config) Encryption(encrConfig json.RawMessage) EncryptionConfig {
 	var encr EncryptionConfig
 	if err := json.Unmarshal(encrConfig, &encr); err != nil {
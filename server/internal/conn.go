@@ -43,18 +43,28 @@ type _Conn struct {
 	recv               chan lp.MessagePack
 	pub                chan *utp.Publish
 	stop               chan interface{}
-	insecure           bool           // The insecure flag provided by client will not perform key validation and permissions check on the topic.
-	username           string         // The username provided by the client during connect.
-	message.MessageIds                // local identifier of messages
-	clientID           uid.ID         // The clientid provided by client during connect or new Id assigned.
-	connID             uid.LID        // The locally unique id of the connection.
-	sessID             uid.LID        // The locally unique session id of the connection.
-	service            *_Service      // The service for this connection.
-	subs               *message.Stats // The subscriptions for this connection.
+	insecure           bool            // The insecure flag provided by client will not perform key validation and permissions check on the topic.
+	username           string          // The username provided by the client during connect.
+	message.MessageIds                 // local identifier of messages
+	clientID           uid.ID          // The clientid provided by client during connect or new Id assigned.
+	aclClientID        string          // The identity of the client ID provided by client during connect, matched by the topic ACL.
+	connID             uid.LID         // The locally unique id of the connection.
+	sessID             uid.LID         // The locally unique session id of the connection.
+	service            *_Service       // The service for this connection.
+	subs               *message.Stats  // The subscriptions for this connection.
+	inflight           *_InflightStore // The inbound messages in flight for the session.
+	// The window of publishes awaiting the durable acknowledgement, set only for publish streams.
+	window chan struct{}
+	// The subscription requests of the connection, restored when the client reconnects.
+	subscriptions map[string]*utp.Subscription
+	// The topic aliases registered by the client for the connection.
+	aliases _TopicAliases
 	// Reference to the cluster node where the connection has originated. Set only for cluster RPC sessions
 	clnode *ClusterNode
 	// Cluster nodes to inform when disconnected
 	nodes map[string]bool
+	// Set to 1 once the write loop of the proxied session has exited. Accessed atomically.
+	rpcDone int32
 
 	// Batch
 	batchManager *batchManager
@@ -77,9 +87,19 @@ func (s *_Service) newConn(t net.Conn) *_Conn {
 		sessID:     sessID,
 		service:    s,
 		subs:       message.NewStats(),
+		inflight:   Globals.connCache.getInflight(sessID),
+
+		subscriptions: make(map[string]*utp.Subscription),
 		// Close
 		closeC: make(chan struct{}),
 	}
+	if wc, ok := t.(lp.WindowedConn); ok {
+		window := wc.PublishWindow()
+		if window < 1 {
+			window = 1
+		}
+		c.window = make(chan struct{}, window)
+	}
 
 	// Increment the connection counter
 	s.meter.Connections.Inc(1)
@@ -95,7 +115,7 @@ func (s *_Service) newRpcConn(conn interface{}, connID, sessID uid.LID, clientID
 		clientID:   clientID,
 		sessID:     sessID,
 		MessageIds: message.NewMessageIds(),
-		send:       make(chan lp.MessagePack, 1), // buffered
+		send:       make(chan lp.MessagePack, Globals.Cluster.queue.Size), // buffered
 		recv:       make(chan lp.MessagePack),
 		pub:        make(chan *utp.Publish),
 		stop:       make(chan interface{}, 1), // Buffered by 1 just to make it non-blocking
@@ -141,7 +161,7 @@ func (c *_Conn) SendMessage(msg *message.Message) bool {
 	}
 
 	// persist outbound
-	store.Log.PersistOutbound(uint32(c.connID), pub)
+	store.Log.PersistOutbound(uint32(c.sessID), pub)
 
 	// Acknowledge the publication
 	select {
@@ -167,7 +187,10 @@ func (c *_Conn) SendRawBytes(buf []byte) bool {
 	case <-time.After(time.Microsecond * 50):
 		return false
 	default:
-		c.socket.Write(buf)
+		if err := c.write(buf); err != nil {
+			log.Error("conn.SendRawBytes", err.Error())
+			return false
+		}
 	}
 
 	return true
@@ -178,17 +201,14 @@ func (c *_Conn) subscribe(msg utp.Subscribe, topic *security.Topic, sub *utp.Sub
 	c.Lock()
 	defer c.Unlock()
 
-	key := string(topic.Key)
-	if key == "" {
-		key, err = security.GenerateKey(c.clientID.Contract(), []byte(topic.Topic), security.AllowNone)
-		if err != nil {
-			log.ErrLogger.Err(err).Str("context", "conn.subscribe")
-			return err
-		}
+	key, err := c.subscriptionKey(topic)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.subscribe")
+		return err
 	}
 	if exists := c.subs.Exist(key); exists && !msg.IsForwarded && Globals.Cluster.isRemoteContract(fmt.Sprint(c.clientID.Contract())) {
 		// The contract is handled by a remote node. Forward message to it.
-		if err := Globals.Cluster.routeToContract(&msg, topic, message.SUBSCRIBE, &message.Message{}, c); err != nil {
+		if err := Globals.Cluster.routeToContract(&msg, topic, message.SUBSCRIBE, &message.Message{}, c, 0); err != nil {
 			log.ErrLogger.Err(err).Str("context", "conn.subscribe").Int64("connid", int64(c.connID)).Msg("unable to subscribe to remote topic")
 			return err
 		}
@@ -215,12 +235,29 @@ func (c *_Conn) subscribe(msg utp.Subscribe, topic *security.Topic, sub *utp.Sub
 	return nil
 }
 
-// unsubscribe unsubscribes this client from a particular topic.
-func (c *_Conn) unsubscribe(msg utp.Unsubscribe, topic *security.Topic) (err error) {
+// subscriptionKey returns the key the subscription to the topic is counted by. A key is
+// generated for a topic subscribed without a key.
+func (c *_Conn) subscriptionKey(topic *security.Topic) (string, error) {
+	if len(topic.Key) != 0 {
+		return string(topic.Key), nil
+	}
+	return security.GenerateKey(c.clientID.Contract(), []byte(topic.Topic), security.AllowNone)
+}
+
+// unsubscribe unsubscribes this client from a particular topic. The subscription is removed from
+// the subscriptions of the connection and of the session, the stored subscription is deleted
+// once the last subscription to the topic is removed, and the unsubscribe is forwarded to the
+// contract master if the contract is remote.
+func (c *_Conn) unsubscribe(msg utp.Unsubscribe, topic *security.Topic, sub *utp.Subscription) (err error) {
 	c.Lock()
 	defer c.Unlock()
 
-	key := string(topic.Key)
+	delete(c.subscriptions, sub.Topic)
+	key, err := c.subscriptionKey(topic)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.unsubscribe")
+		return err
+	}
 	// Remove the subscription from stats and if there's no more subscriptions, notify everyone.
 	if last, messageID := c.subs.Decrement(topic.Topic[:topic.Size], key); last {
 		// Unsubscribe the subscriber
@@ -233,7 +270,7 @@ func (c *_Conn) unsubscribe(msg utp.Unsubscribe, topic *security.Topic) (err err
 	}
 	if !msg.IsForwarded && Globals.Cluster.isRemoteContract(fmt.Sprint(c.clientID.Contract())) {
 		// The topic is handled by a remote node. Forward message to it.
-		if err := Globals.Cluster.routeToContract(&msg, topic, message.UNSUBSCRIBE, &message.Message{}, c); err != nil {
+		if err := Globals.Cluster.routeToContract(&msg, topic, message.UNSUBSCRIBE, &message.Message{}, c, 0); err != nil {
 			log.ErrLogger.Err(err).Str("context", "conn.unsubscribe").Int64("connid", int64(c.connID)).Msg("unable to unsubscribe to remote topic")
 			return err
 		}
@@ -242,7 +279,8 @@ func (c *_Conn) unsubscribe(msg utp.Unsubscribe, topic *security.Topic) (err err
 }
 
 // publish publishes a message to everyone and returns the number of outgoing bytes written.
-func (c *_Conn) publish(pkt utp.Publish, topic *security.Topic, m *utp.PublishMessage) (err error) {
+// The message is forwarded to the replicas of the contract with the sequence seq.
+func (c *_Conn) publish(pkt utp.Publish, topic *security.Topic, m *utp.PublishMessage, seq uint64) (err error) {
 	c.service.meter.InMsgs.Inc(1)
 	c.service.meter.InBytes.Inc(int64(len(m.Payload)))
 	// subscription count
@@ -280,7 +318,9 @@ func (c *_Conn) publish(pkt utp.Publish, topic *security.Topic, m *utp.PublishMe
 					}
 					// persist outbound
 					store.Log.PersistOutbound(uint32(sub.sessID), &pkt)
-					sub.send <- notify
+					if err := sub.enqueue(notify); err != nil {
+						log.ErrLogger.Err(err).Str("context", "conn.publish").Int64("connid", int64(sub.connID)).Msg("unable to notify subscriber")
+					}
 				// Subscriber's DeliveryMode EXPRESS
 				case 0:
 					if !sub.SendMessage(pubMsg) {
@@ -300,15 +340,50 @@ func (c *_Conn) publish(pkt utp.Publish, topic *security.Topic, m *utp.PublishMe
 	c.service.meter.OutMsgs.Inc(int64(msgCount))
 	c.service.meter.OutBytes.Inc(pubMsg.Size() * int64(msgCount))
 
-	if !pkt.IsForwarded && Globals.Cluster.isRemoteContract(fmt.Sprint(c.clientID.Contract())) {
-		if err = Globals.Cluster.routeToContract(&pkt, topic, message.PUBLISH, pubMsg, c); err != nil {
-			log.ErrLogger.Err(err).Str("context", "conn.publish").Int64("connid", int64(c.connID)).Msg("unable to publish to remote topic")
+	if !pkt.IsForwarded && Globals.Cluster.hasRemoteReplicas(fmt.Sprint(c.clientID.Contract())) {
+		// The publish is batched to the replicas without waiting, the error is reported once it is sent.
+		failed := func(err error) {
+			if err != nil {
+				log.ErrLogger.Err(err).Str("context", "conn.publish").Int64("connid", int64(c.connID)).Msg("unable to publish to remote topic")
+			}
+		}
+		if err = Globals.Cluster.routeToContractAsync(&pkt, topic, message.PUBLISH, pubMsg, c, seq, failed); err != nil {
+			failed(err)
 			return err
 		}
 	}
 	return nil
 }
 
+// resumeSession takes over the session stored for the session key and resends its queued
+// messages unless a clean session is requested. The session is stored with the session ID
+// the connection persists its messages with, so they are resumed when the client reconnects.
+func (c *_Conn) resumeSession(sessKey int32, clean bool) {
+	if rawSess, err := store.Session.Get(uint64(sessKey)); err == nil {
+		sessID := binary.LittleEndian.Uint32(rawSess[:4])
+		if !clean {
+			c.resume(sessID)
+		} else {
+			store.Log.Reset(sessID)
+			Globals.connCache.deleteInflight(uid.LID(sessID))
+		}
+		// Resume the in-flight messages of the session.
+		Globals.connCache.releaseInflight(c.sessID)
+		c.sessID = uid.LID(sessID)
+		c.inflight = Globals.connCache.getInflight(c.sessID)
+	}
+	if clean {
+		// A clean session does not resume the messages in flight.
+		c.inflight.reset()
+	}
+	rawSess := make([]byte, 4)
+	binary.LittleEndian.PutUint32(rawSess[0:4], uint32(c.sessID))
+	store.Session.Put(uint64(sessKey), rawSess)
+	if sessKey != int32(c.clientID.Epoch()) {
+		store.Session.Put(uint64(c.clientID.Epoch()), rawSess)
+	}
+}
+
 // Load all stored messages and resend them to ensure DeliveryMode > 1,2 even after an application crash.
 func (c *_Conn) resume(prefix uint32) {
 	// contract is used as blockId and key prefix
@@ -330,7 +405,7 @@ func (c *_Conn) resume(prefix uint32) {
 					FlowControl: utp.NOTIFY,
 					MessageID:   m.MessageID,
 				}
-				c.send <- notify
+				c.enqueue(notify)
 			default:
 				store.Log.Delete(k)
 			}
@@ -359,6 +434,81 @@ func (c *_Conn) notifyError(err *types.Error, messageID uint16) {
 	}
 }
 
+// notifyMatches sends the concrete topics matching the wildcard topic of a subscription,
+// so the client can backfill the topics it subscribed to.
+func (c *_Conn) notifyMatches(topic *security.Topic) {
+	matches, err := store.Message.Topics(c.clientID.Contract(), topic.Topic[:topic.Size])
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.notifyMatches").Str("topic", string(topic.Topic[:topic.Size])).Msg("unable to match topics")
+		c.notifyError(types.ErrServerError, 0)
+		return
+	}
+	resp := &types.MatchesResponse{
+		Status:  200,
+		Topic:   string(topic.Topic[:topic.Size]),
+		Matches: matches,
+	}
+	if b, err := json.Marshal(resp); err == nil {
+		c.SendMessage(&message.Message{
+			Topic:   "unitdb/matches",
+			Payload: b,
+		})
+	}
+}
+
+// trackSubscription records the subscription request to restore it when the client reconnects.
+func (c *_Conn) trackSubscription(sub *utp.Subscription) {
+	c.Lock()
+	defer c.Unlock()
+	if c.subscriptions != nil {
+		c.subscriptions[sub.Topic] = sub
+	}
+}
+
+// untrackSubscription removes the subscription request recorded for the topic.
+func (c *_Conn) untrackSubscription(sub *utp.Subscription) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.subscriptions, sub.Topic)
+}
+
+// sessionExpiry returns the time the subscriptions of the client are kept after it disconnects.
+func (c *_Conn) sessionExpiry() time.Duration {
+	if c.service == nil || c.service.config == nil {
+		return 0
+	}
+	return time.Duration(c.service.config.SessionExpiry) * time.Second
+}
+
+// saveSession keeps the subscriptions of the client so they are restored if the client
+// reconnects with the same client ID before the session expires. Proxied sessions are
+// not kept as the node where the session originated restores and forwards them again.
+func (c *_Conn) saveSession() {
+	expiry := c.sessionExpiry()
+	if expiry <= 0 || c.clientID == nil || c.clnode != nil {
+		return
+	}
+	c.Lock()
+	subs := make([]*utp.Subscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subs = append(subs, sub)
+	}
+	c.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+	Globals.connCache.saveSession(c.clientID, subs, expiry)
+}
+
+// restoreSession subscribes the connection to the subscriptions kept for the client.
+func (c *_Conn) restoreSession() {
+	for _, sub := range Globals.connCache.restoreSession(c.clientID) {
+		if err := c.onSubscribe(utp.Subscribe{}, sub); err != nil {
+			log.ErrLogger.Error().Str("context", "conn.restoreSession").Str("topic", sub.Topic).Int64("connid", int64(c.connID)).Msg("unable to restore subscription")
+		}
+	}
+}
+
 func (c *_Conn) unsubAll() {
 	for _, stat := range c.subs.All() {
 		store.Subscription.Delete(c.clientID.Contract(), stat.ID, stat.Topic)
@@ -398,11 +548,13 @@ func (c *_Conn) close() error {
 	// already locked. Locking the 'Close()' would result in a deadlock.
 	// Don't close clustered connection, their servers are not being shut down.
 	if c.clnode == nil {
+		c.saveSession()
 		for _, stat := range c.subs.All() {
 			store.Subscription.Delete(c.clientID.Contract(), stat.ID, stat.Topic)
 			// Decrement the subscription counter
 			c.service.meter.Subscriptions.Dec(1)
 		}
+		Globals.connCache.releaseInflight(c.sessID)
 	}
 
 	Globals.connCache.delete(c.connID)
@@ -18,18 +18,32 @@ package internal
 
 import (
 	"sync"
+	"time"
 
 	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/utp"
 )
 
 type _ConnCache struct {
 	sync.RWMutex
 	m map[uid.LID]*_Conn
+	// in-flight messages by session ID, kept across reconnects.
+	inflight map[uid.LID]*_InflightStore
+	// subscriptions of disconnected clients by client ID, kept until the session expires.
+	sessions map[string]*_Session
+}
+
+// _Session is the subscription set of a disconnected client.
+type _Session struct {
+	subs  []*utp.Subscription
+	timer *time.Timer
 }
 
 func NewConnCache() *_ConnCache {
 	cache := &_ConnCache{
-		m: make(map[uid.LID]*_Conn),
+		m:        make(map[uid.LID]*_Conn),
+		inflight: make(map[uid.LID]*_InflightStore),
+		sessions: make(map[string]*_Session),
 	}
 
 	return cache
@@ -57,3 +71,64 @@ func (cc *_ConnCache) delete(connID uid.LID) {
 	defer cc.Unlock()
 	delete(cc.m, connID)
 }
+
+// getInflight fetches the in-flight store of a session, a new store is created if the session has none.
+func (cc *_ConnCache) getInflight(sessID uid.LID) *_InflightStore {
+	cc.Lock()
+	defer cc.Unlock()
+	if s, ok := cc.inflight[sessID]; ok {
+		return s
+	}
+	s := newInflightStore()
+	cc.inflight[sessID] = s
+	return s
+}
+
+// releaseInflight removes the in-flight store of a session if it has no messages in flight.
+func (cc *_ConnCache) releaseInflight(sessID uid.LID) {
+	cc.Lock()
+	defer cc.Unlock()
+	if s, ok := cc.inflight[sessID]; ok && s.len() == 0 {
+		delete(cc.inflight, sessID)
+	}
+}
+
+// deleteInflight removes the in-flight store of a session.
+func (cc *_ConnCache) deleteInflight(sessID uid.LID) {
+	cc.Lock()
+	defer cc.Unlock()
+	delete(cc.inflight, sessID)
+}
+
+// saveSession keeps the subscriptions of a disconnected client until the session expires.
+func (cc *_ConnCache) saveSession(clientID uid.ID, subs []*utp.Subscription, expiry time.Duration) {
+	key := string(clientID)
+	cc.Lock()
+	defer cc.Unlock()
+	if s, ok := cc.sessions[key]; ok {
+		s.timer.Stop()
+	}
+	s := &_Session{subs: subs}
+	s.timer = time.AfterFunc(expiry, func() {
+		cc.Lock()
+		defer cc.Unlock()
+		if cc.sessions[key] == s {
+			delete(cc.sessions, key)
+		}
+	})
+	cc.sessions[key] = s
+}
+
+// restoreSession removes the session of a reconnected client and returns its subscriptions.
+func (cc *_ConnCache) restoreSession(clientID uid.ID) []*utp.Subscription {
+	key := string(clientID)
+	cc.Lock()
+	defer cc.Unlock()
+	s, ok := cc.sessions[key]
+	if !ok {
+		return nil
+	}
+	s.timer.Stop()
+	delete(cc.sessions, key)
+	return s.subs
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/unit-io/unitdb/server/internal/config"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+func TestPersistentSession(t *testing.T) {
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	s := &_Service{config: &config.Config{SessionExpiry: 60}}
+	clientID := uid.ID("client1")
+	c := &_Conn{service: s, clientID: clientID, subscriptions: make(map[string]*utp.Subscription)}
+	sub := &utp.Subscription{Topic: "unit1.test", DeliveryMode: 1, Delay: 10}
+	c.trackSubscription(sub)
+	c.trackSubscription(&utp.Subscription{Topic: "unit2.test"})
+	c.untrackSubscription(&utp.Subscription{Topic: "unit2.test"})
+
+	// The client disconnects and reconnects with the same client ID.
+	c.saveSession()
+	if subs := Globals.connCache.restoreSession(uid.ID("client2")); subs != nil {
+		t.Fatalf("expected no subscriptions for other client; got %v", subs)
+	}
+	subs := Globals.connCache.restoreSession(clientID)
+	if !reflect.DeepEqual(subs, []*utp.Subscription{sub}) {
+		t.Fatalf("expected subscriptions restored; got %v", subs)
+	}
+	if subs := Globals.connCache.restoreSession(clientID); subs != nil {
+		t.Fatalf("expected session removed once restored; got %v", subs)
+	}
+
+	// The session is removed when it expires.
+	Globals.connCache.saveSession(clientID, []*utp.Subscription{sub}, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if subs := Globals.connCache.restoreSession(clientID); subs != nil {
+		t.Fatalf("expected session expired; got %v", subs)
+	}
+
+	// Subscriptions are not kept if session expiry is not set.
+	s.config.SessionExpiry = 0
+	c.saveSession()
+	if subs := Globals.connCache.restoreSession(clientID); subs != nil {
+		t.Fatalf("expected subscriptions not kept; got %v", subs)
+	}
+}
@@ -0,0 +1,477 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unit-io/unitdb/server/internal/config"
+	"github.com/unit-io/unitdb/server/internal/message"
+	"github.com/unit-io/unitdb/server/internal/message/security"
+	lp "github.com/unit-io/unitdb/server/internal/net"
+	"github.com/unit-io/unitdb/server/internal/pkg/stats"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/store"
+	"github.com/unit-io/unitdb/server/internal/types"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+func TestConnWriteTimeout(t *testing.T) {
+	// Nothing is read from the other end of the pipe, so the write blocks until the deadline.
+	client, server := net.Pipe()
+	defer client.Close()
+
+	c := &_Conn{socket: server, service: &_Service{config: &config.Config{WriteTimeout: 100}}}
+	start := time.Now()
+	err := c.write([]byte("msg"))
+	if err == nil {
+		t.Fatal("expected write to a blackholed connection to fail")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("expected write to time out after the write timeout, took %v", elapsed)
+	}
+}
+
+func TestNotifyMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, topic := range []string{"unit2.b.c", "unit2.b.d.e", "unit2.x.c"} {
+		if err := store.Message.Put(message.Contract, []byte(topic), []byte("matches message"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The topics put before the store is reopened are matched.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, false); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &_Service{meter: NewMeter()}
+	defer s.meter.UnregisterAll()
+	clientID := make(uid.ID, 16)
+	clientID.SetContract(message.Contract)
+	c := &_Conn{service: s, connID: uid.LID(1), clientID: clientID, subs: message.NewStats(),
+		MessageIds: message.NewMessageIds(), pub: make(chan *utp.Publish, 1)}
+	topic := security.ParseKey([]byte("unit2.b..."))
+	if !topic.IsWildcard() {
+		t.Fatal("expected wildcard topic")
+	}
+	// The wildcard subscription is stored as a topic but it is not a concrete topic.
+	if err := c.subscribe(utp.Subscribe{}, topic, &utp.Subscription{Topic: "unit2.b..."}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.notifyMatches(topic)
+	pub := <-c.pub
+	if len(pub.Messages) != 1 || pub.Messages[0].Topic != "unitdb/matches" {
+		t.Fatalf("unexpected matches message %+v", pub)
+	}
+	var resp types.MatchesResponse
+	if err := json.Unmarshal(pub.Messages[0].Payload, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Topic != "unit2.b..." || !reflect.DeepEqual(resp.Matches, []string{"unit2.b.c", "unit2.b.d.e"}) {
+		t.Fatalf("unexpected matches %+v", resp)
+	}
+
+	if security.ParseKey([]byte("unit2.b.c")).IsWildcard() {
+		t.Fatal("expected static topic")
+	}
+	if !security.ParseKey([]byte("unit2.*.c")).IsWildcard() {
+		t.Fatal("expected wildcard topic")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unsubscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	s := &_Service{meter: NewMeter()}
+	defer s.meter.UnregisterAll()
+	clientID := make(uid.ID, 16)
+	clientID.SetContract(message.Contract)
+	c := &_Conn{service: s, connID: uid.LID(1), clientID: clientID, subs: message.NewStats(),
+		MessageIds: message.NewMessageIds(), pub: make(chan *utp.Publish, 1), subscriptions: make(map[string]*utp.Subscription)}
+	Globals.connCache.add(c)
+
+	topic := security.ParseKey([]byte("unit6.unsub"))
+	sub := &utp.Subscription{Topic: "unit6.unsub"}
+	if err := c.subscribe(utp.Subscribe{}, topic, sub); err != nil {
+		t.Fatal(err)
+	}
+	c.trackSubscription(sub)
+
+	publish := func() {
+		m := &utp.PublishMessage{Topic: "unit6.unsub", Payload: []byte("unsubscribe message")}
+		pub := utp.Publish{Messages: []*utp.PublishMessage{m}}
+		if err := c.publish(pub, topic, m, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish()
+	select {
+	case <-c.pub:
+	default:
+		t.Fatal("expected message delivered to subscriber")
+	}
+
+	if err := c.unsubscribe(utp.Unsubscribe{}, topic, sub); err != nil {
+		t.Fatal(err)
+	}
+	publish()
+	select {
+	case pub := <-c.pub:
+		t.Fatalf("expected no message delivered after unsubscribe; got %+v", pub)
+	default:
+	}
+	if n := len(c.subs.All()); n != 0 {
+		t.Fatalf("expected no subscriptions of the connection; got %d", n)
+	}
+	if _, ok := c.subscriptions[sub.Topic]; ok {
+		t.Fatal("expected subscription removed from the session")
+	}
+	if n := s.meter.Subscriptions.Count(); n != 0 {
+		t.Fatalf("expected subscription counter 0; got %d", n)
+	}
+	topics, err := store.Subscription.Topics(message.Contract, []byte("unit6..."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 0 {
+		t.Fatalf("expected subscription topic pruned; got %v", topics)
+	}
+}
+
+func TestPublishWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "window")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	s := &_Service{meter: NewMeter()}
+	defer s.meter.UnregisterAll()
+	clientID := make(uid.ID, 16)
+	clientID.SetContract(message.Contract)
+	const window = 16
+	c := &_Conn{service: s, connID: uid.LID(1), clientID: clientID, insecure: true, subs: message.NewStats(),
+		MessageIds: message.NewMessageIds(), send: make(chan lp.MessagePack, window), window: make(chan struct{}, window),
+		closeC: make(chan struct{})}
+
+	// The publishes take three windows, each window is acknowledged once it is synced.
+	const n = 3 * window
+	var stored int64
+	go func() {
+		for i := 0; i < n; i++ {
+			m := &utp.PublishMessage{Topic: "unit7.window", Payload: []byte("window message")}
+			if err := c.onPublish(utp.Publish{MessageID: uint16(i + 1), Messages: []*utp.PublishMessage{m}}); err != nil {
+				t.Error(err)
+				return
+			}
+			atomic.AddInt64(&stored, 1)
+		}
+	}()
+
+	start := time.Now()
+	acked := make(map[uint16]bool)
+	for len(acked) < n {
+		select {
+		case pkt := <-c.send:
+			ack, ok := pkt.(*utp.ControlMessage)
+			if !ok || ack.FlowControl != utp.ACKNOWLEDGE {
+				t.Fatalf("unexpected message %+v", pkt)
+			}
+			if acked[ack.MessageID] {
+				t.Fatalf("publish %d acknowledged twice", ack.MessageID)
+			}
+			// The publisher is held back until the acknowledged publishes free the window.
+			if pending := atomic.LoadInt64(&stored) - int64(len(acked)); pending > 2*window {
+				t.Fatalf("expected at most %d publishes pending; got %d", 2*window, pending)
+			}
+			acked[ack.MessageID] = true
+		case <-time.After(30 * time.Second):
+			t.Fatalf("expected %d publishes acknowledged; got %d", n, len(acked))
+		}
+	}
+	// Each window waits for a sync of the store, the syncs are a second apart.
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Fatalf("expected acknowledgements to pace with sync; all acknowledged in %v", elapsed)
+	}
+	c.closeW.Wait()
+}
+
+func TestPublishWindowMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "window")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	s := &_Service{meter: NewMeter()}
+	defer s.meter.UnregisterAll()
+	clientID := make(uid.ID, 16)
+	clientID.SetContract(message.Contract)
+	const window = 2
+	c := &_Conn{service: s, connID: uid.LID(1), clientID: clientID, insecure: true, subs: message.NewStats(),
+		MessageIds: message.NewMessageIds(), send: make(chan lp.MessagePack, window), window: make(chan struct{}, window),
+		closeC: make(chan struct{})}
+
+	// Each publish has more messages than the window.
+	const n = 2 * window
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			var msgs []*utp.PublishMessage
+			for j := 0; j < 3*window; j++ {
+				msgs = append(msgs, &utp.PublishMessage{Topic: "unit7.window", Payload: []byte("window message")})
+			}
+			if err := c.onPublish(utp.Publish{MessageID: uint16(i + 1), Messages: msgs}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	acked := 0
+	for acked < n {
+		select {
+		case pkt := <-c.send:
+			ack, ok := pkt.(*utp.ControlMessage)
+			if !ok || ack.FlowControl != utp.ACKNOWLEDGE {
+				t.Fatalf("unexpected message %+v", pkt)
+			}
+			acked++
+		case <-time.After(30 * time.Second):
+			t.Fatalf("expected %d publishes acknowledged; got %d", n, acked)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.closeW.Wait()
+}
+
+func TestResumeSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	clientID := make(uid.ID, 16)
+	clientID.SetContract(message.Contract)
+	clientID.SetEpoch(7)
+	connect := func(connID uid.LID) *_Conn {
+		c := &_Conn{connID: connID, sessID: connID, clientID: clientID, MessageIds: message.NewMessageIds(),
+			send: make(chan lp.MessagePack, 4), pub: make(chan *utp.Publish, 1), inflight: Globals.connCache.getInflight(connID)}
+		c.resumeSession(7, false)
+		return c
+	}
+	resumed := func(c *_Conn) map[uint16]bool {
+		ids := make(map[uint16]bool)
+		for len(c.send) > 0 {
+			if notify, ok := (<-c.send).(*utp.ControlMessage); ok && notify.FlowControl == utp.NOTIFY {
+				ids[notify.MessageID] = true
+			}
+		}
+		return ids
+	}
+
+	// Each connection queues a reliable message which is not acknowledged before the client reconnects.
+	a := connect(uid.LID(33))
+	a.SendMessage(&message.Message{MessageID: 1, Topic: "unit8.resume", Payload: []byte("resume message"), DeliveryMode: 1})
+	b := connect(uid.LID(65))
+	if b.sessID != a.sessID {
+		t.Fatalf("expected session %d resumed; got %d", a.sessID, b.sessID)
+	}
+	if ids := resumed(b); !reflect.DeepEqual(ids, map[uint16]bool{1: true}) {
+		t.Fatalf("expected queued message resumed; got %v", ids)
+	}
+	b.SendMessage(&message.Message{MessageID: 2, Topic: "unit8.resume", Payload: []byte("resume message"), DeliveryMode: 1})
+	c := connect(uid.LID(97))
+	if c.sessID != a.sessID {
+		t.Fatalf("expected session %d resumed; got %d", a.sessID, c.sessID)
+	}
+	if ids := resumed(c); !reflect.DeepEqual(ids, map[uint16]bool{1: true, 2: true}) {
+		t.Fatalf("expected queued messages of both connections resumed; got %v", ids)
+	}
+}
+
+func TestTopicAlias(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	s := &_Service{meter: NewMeter(), stats: stats.New(&stats.Config{Addr: "localhost:8094"})}
+	defer s.meter.UnregisterAll()
+	defer s.stats.Unregister()
+	clientID := make(uid.ID, 16)
+	clientID.SetContract(message.Contract)
+	c := &_Conn{service: s, connID: uid.LID(1), clientID: clientID, insecure: true, subs: message.NewStats(),
+		MessageIds: message.NewMessageIds(), send: make(chan lp.MessagePack, 4), pub: make(chan *utp.Publish, 4),
+		inflight: Globals.connCache.getInflight(uid.LID(1)), subscriptions: make(map[string]*utp.Subscription)}
+	Globals.connCache.add(c)
+
+	// The subscription registers the alias for its topic.
+	const topic = "unit9.alias.topic"
+	if err := c.handler(&utp.Subscribe{MessageID: 1, Subscriptions: []*utp.Subscription{{Topic: topic}},
+		Properties: utp.Properties{TopicAlias: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	<-c.send
+
+	// The publish by alias is routed to the topic of the alias.
+	m := &utp.PublishMessage{Payload: []byte("alias message"), Properties: utp.Properties{TopicAlias: 3}}
+	if err := c.handler(&utp.Publish{MessageID: 2, Messages: []*utp.PublishMessage{m}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pub := <-c.pub:
+		if len(pub.Messages) != 1 || pub.Messages[0].Topic != topic || string(pub.Messages[0].Payload) != "alias message" {
+			t.Fatalf("unexpected message %+v", pub.Messages[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected message delivered to subscriber")
+	}
+	// The message is forwarded to the cluster with the full topic.
+	if m.Topic != topic || m.Properties.TopicAlias != 0 {
+		t.Fatalf("expected message resolved to topic %s; got %+v", topic, m)
+	}
+
+	// A publish with a topic and an alias registers the alias.
+	other := &utp.Subscription{Topic: "unit9.alias.other"}
+	if err := c.subscribe(utp.Subscribe{}, security.ParseKey([]byte(other.Topic)), other); err != nil {
+		t.Fatal(err)
+	}
+	m = &utp.PublishMessage{Topic: other.Topic, Payload: []byte("alias message"), Properties: utp.Properties{TopicAlias: 4}}
+	if err := c.onPublish(utp.Publish{Messages: []*utp.PublishMessage{m}}); err != nil {
+		t.Fatal(err)
+	}
+	m = &utp.PublishMessage{Payload: []byte("alias message"), Properties: utp.Properties{TopicAlias: 4}}
+	if err := c.onPublish(utp.Publish{Messages: []*utp.PublishMessage{m}}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Topic != other.Topic {
+		t.Fatalf("expected message resolved to topic %s; got %s", other.Topic, m.Topic)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case pub := <-c.pub:
+			if pub.Messages[0].Topic != other.Topic {
+				t.Fatalf("expected message delivered to topic %s; got %s", other.Topic, pub.Messages[0].Topic)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected message delivered to subscriber")
+		}
+	}
+
+	m = &utp.PublishMessage{Payload: []byte("alias message"), Properties: utp.Properties{TopicAlias: 5}}
+	if err := c.onPublish(utp.Publish{Messages: []*utp.PublishMessage{m}}); err != types.ErrBadRequest {
+		t.Fatalf("expected error %v for unregistered alias; got %v", types.ErrBadRequest, err)
+	}
+
+	// A new alias is not registered once the connection has registered the maximum number of aliases,
+	// a registered alias can still be replaced.
+	for alias := uint16(100); len(c.aliases.topics) < maxTopicAliases; alias++ {
+		if !c.aliases.register(alias, other.Topic) {
+			t.Fatalf("expected alias %d registered", alias)
+		}
+	}
+	m = &utp.PublishMessage{Topic: other.Topic, Payload: []byte("alias message"), Properties: utp.Properties{TopicAlias: 5}}
+	if err := c.onPublish(utp.Publish{Messages: []*utp.PublishMessage{m}}); err != types.ErrBadRequest {
+		t.Fatalf("expected error %v for alias over the maximum; got %v", types.ErrBadRequest, err)
+	}
+	if !c.aliases.register(3, other.Topic) {
+		t.Fatal("expected registered alias replaced")
+	}
+}
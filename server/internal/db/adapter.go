@@ -18,6 +18,7 @@ package adapter
 
 import (
 	"errors"
+	"net/http"
 )
 
 var (
@@ -46,6 +47,11 @@ type Adapter interface {
 	// it returns an error if some error was encountered during storage.
 	Put(contract uint32, topic, payload []byte, ttl string) error
 
+	// PutWithAck is used to store a message like Put, the message is stored asynchronously and
+	// the returned channel receives nil once the message is durable, or the error encountered
+	// during storage.
+	PutWithAck(contract uint32, topic, payload []byte, ttl string) <-chan error
+
 	// PutWithID is used to store a message using a pre generated ID, the SSID provided must be a full SSID
 	// SSID, where first element should be a contract ID. The time resolution
 	// for TTL will be in seconds. The function is executed synchronously and
@@ -56,6 +62,9 @@ type Adapter interface {
 	// last is specified by last duration argument.
 	Get(contract uint32, topic []byte, last string) ([][]byte, error)
 
+	// Topics returns the concrete topics matching the topic, the topic may have wildcards.
+	Topics(contract uint32, topic []byte) ([]string, error)
+
 	// NewID generate messageId that can later used to store and delete message from message store
 	NewID() ([]byte, error)
 
@@ -77,4 +86,10 @@ type Adapter interface {
 
 	// Keys performs a query and attempts to fetch all keys.
 	Keys() []uint64
+
+	// Size returns the number of messages in the memdb store.
+	Size() int64
+
+	// HealthzHandler returns a http.Handler for health checks of the message store.
+	HealthzHandler() http.Handler
 }
@@ -20,10 +20,13 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/unit-io/unitdb"
 	"github.com/unit-io/unitdb/memdb"
+	"github.com/unit-io/unitdb/server/internal/config"
 	"github.com/unit-io/unitdb/server/internal/pkg/log"
 	"github.com/unit-io/unitdb/server/internal/store"
 )
@@ -68,9 +71,9 @@ func (a *adapter) Open(path, jsonconfig string, reset bool) error {
 	}
 
 	var err error
-	var config configType
+	var conf configType
 
-	if err = json.Unmarshal([]byte(jsonconfig), &config); err != nil {
+	if err = json.Unmarshal([]byte(jsonconfig), &conf); err != nil {
 		return errors.New("unitdb adapter failed to parse config: " + err.Error())
 	}
 
@@ -79,8 +82,10 @@ func (a *adapter) Open(path, jsonconfig string, reset bool) error {
 		log.Error("adapter.Open", "Unable to create db dir")
 	}
 
-	// Attempt to open the database
-	a.db, err = unitdb.Open(path+"/"+defaultDatabase, nil, unitdb.WithMutable())
+	// Attempt to open the database. A message read from a peer is at most config.MaxMessageSize,
+	// so larger payloads are rejected as well. The topic dictionary keeps the topic names across
+	// restarts, Topics does not return the topics put before the restart without it.
+	a.db, err = unitdb.Open(path+"/"+defaultDatabase, nil, unitdb.WithMutable(), unitdb.WithMaxPayloadSize(config.MaxMessageSize), unitdb.WithTopicDictionary())
 	if err != nil {
 		log.Error("adapter.Open", "Unable to open db")
 		return err
@@ -90,12 +95,12 @@ func (a *adapter) Open(path, jsonconfig string, reset bool) error {
 	if reset {
 		opts = memdb.WithLogReset()
 	}
-	a.mem, err = memdb.Open(opts, memdb.WithLogFilePath(path), memdb.WithBufferSize(config.Size))
+	a.mem, err = memdb.Open(opts, memdb.WithLogFilePath(path), memdb.WithBufferSize(conf.Size))
 	if err != nil {
 		return err
 	}
 
-	a.config = &config
+	a.config = &conf
 
 	return nil
 }
@@ -135,6 +140,16 @@ func (a *adapter) Put(contract uint32, topic, payload []byte, ttl string) error
 	return a.db.PutEntry(entry)
 }
 
+// PutWithAck appends the messages to the store and returns a channel that receives nil
+// once the messages are synced to the store.
+func (a *adapter) PutWithAck(contract uint32, topic, payload []byte, ttl string) <-chan error {
+	entry := unitdb.NewEntry(topic, payload).WithContract(contract)
+	if ttl != "" {
+		entry.WithTTL(ttl)
+	}
+	return a.db.PutEntryWithAck(entry)
+}
+
 // PutWithID appends the messages to the store using a pre generated messageId.
 func (a *adapter) PutWithID(contract uint32, messageId, topic, payload []byte, ttl string) error {
 	entry := unitdb.NewEntry(topic, payload).WithContract(contract).WithID(messageId)
@@ -149,20 +164,22 @@ func (a *adapter) PutWithID(contract uint32, messageId, topic, payload []byte, t
 func (a *adapter) Get(contract uint32, topic []byte, last string) (matches [][]byte, err error) {
 	// Iterating over key/value pairs.
 	query := unitdb.NewQuery(topic).WithContract(contract)
-	if last != "" {
-		query.WithLast(last)
+	if d, err := time.ParseDuration(last); err == nil {
+		query.WithLastDuration(d)
 	}
 
 	return a.db.Get(query)
 }
 
+// Topics returns the concrete topics matching the topic. The topics put before the DB is reopened
+// are named by the topic dictionary.
+func (a *adapter) Topics(contract uint32, topic []byte) ([]string, error) {
+	return a.db.Topics(unitdb.NewQuery(topic).WithContract(contract))
+}
+
 // NewID generates a new messageId.
 func (a *adapter) NewID() ([]byte, error) {
-	id := a.db.NewID()
-	if id == nil {
-		return nil, errors.New("Key is empty.")
-	}
-	return id, nil
+	return a.db.NewID()
 }
 
 // Put appends the messages to the store.
@@ -194,6 +211,11 @@ func (a *adapter) Keys() []uint64 {
 	return a.mem.Keys()
 }
 
+// Size returns the number of messages in the memdb store.
+func (a *adapter) Size() int64 {
+	return a.mem.Size()
+}
+
 // DeleteMessage deletes message from memdb store.
 func (a *adapter) DeleteMessage(key uint64) error {
 	if err := a.mem.Delete(key); err != nil {
@@ -202,6 +224,11 @@ func (a *adapter) DeleteMessage(key uint64) error {
 	return nil
 }
 
+// HealthzHandler returns a http.Handler for health checks of the message store.
+func (a *adapter) HealthzHandler() http.Handler {
+	return a.db.HealthzHandler()
+}
+
 func init() {
 	adp := &adapter{}
 	store.RegisterAdapter(adapterName, adp)
@@ -19,12 +19,12 @@ package internal
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
+	"github.com/unit-io/unitdb/server/internal/config"
 	"github.com/unit-io/unitdb/server/internal/message"
 	"github.com/unit-io/unitdb/server/internal/message/security"
 	lp "github.com/unit-io/unitdb/server/internal/net"
@@ -57,11 +57,11 @@ func (c *_Conn) readLoop(ctx context.Context) (err error) {
 		case <-c.closeC:
 			return nil
 		default:
-			// Set read/write deadlines so we can close dangling connections
-			c.socket.SetDeadline(time.Now().Add(time.Second * 120))
+			// Set read deadline so we can close dangling connections
+			c.socket.SetReadDeadline(time.Now().Add(c.service.readTimeout()))
 
 			// Decode an incoming Message
-			pkt, err := lp.Read(reader)
+			pkt, err := lp.Read(reader, config.MaxMessageSize)
 			if err != nil {
 				return err
 			}
@@ -109,15 +109,23 @@ func (c *_Conn) handler(inMsg lp.MessagePack) error {
 			FlowControl: utp.ACKNOWLEDGE,
 			Message:     rawAck.Bytes(),
 		}
-		c.send <- ack
+		if err := c.enqueue(ack); err != nil {
+			return err
+		}
 
 		if err == types.ErrInvalidClientID {
-			c.sendClientID(clientID.Encode(c.service.mac))
+			cid, err1 := clientID.Encode(c.service.mac)
+			if err1 != nil {
+				return types.ErrServerError
+			}
+			c.sendClientID(cid)
 			return err
 		}
 
 		c.clientID = clientID
+		c.aclClientID = c.service.aclIdentity(m.ClientID)
 		c.MessageIds.Reset()
+		c.aliases.reset()
 
 		// batch manager
 		c.newBatchManager(&batchOptions{
@@ -134,21 +142,12 @@ func (c *_Conn) handler(inMsg lp.MessagePack) error {
 		}
 
 		// Take care of any messages in the store
-		sessID := c.sessID
-		if rawSess, err := store.Session.Get(uint64(sessKey)); err == nil {
-			sessID := binary.LittleEndian.Uint32(rawSess[:4])
-			if !m.CleanSessFlag {
-				c.resume(sessID)
-			} else {
-				store.Log.Reset(sessID)
-			}
-			c.sessID = uid.LID(sessID)
-		}
-		rawSess := make([]byte, 4)
-		binary.LittleEndian.PutUint32(rawSess[0:4], uint32(sessID))
-		store.Session.Put(uint64(sessKey), rawSess)
-		if sessKey != int32(c.clientID.Epoch()) {
-			store.Session.Put(uint64(c.clientID.Epoch()), rawSess)
+		c.resumeSession(sessKey, m.CleanSessFlag)
+		// Restore the subscriptions kept since the client disconnected.
+		if m.CleanSessFlag {
+			Globals.connCache.restoreSession(c.clientID)
+		} else {
+			c.restoreSession()
 		}
 	case utp.DISCONNECT:
 		c.clientDisconnect(errors.New("client initiated disconnect")) // no harm in calling this if the connection is already down (better than stopping!)
@@ -172,7 +171,9 @@ func (c *_Conn) handler(inMsg lp.MessagePack) error {
 		if m.IsForwarded {
 			return nil
 		}
-		c.send <- ack
+		if err := c.enqueue(ack); err != nil {
+			return err
+		}
 	// An attempt to subscribe to a topic.
 	case utp.SUBSCRIBE:
 		m := *inMsg.(*utp.Subscribe)
@@ -181,20 +182,44 @@ func (c *_Conn) handler(inMsg lp.MessagePack) error {
 			FlowControl: utp.ACKNOWLEDGE,
 			MessageID:   m.MessageID,
 		}
+		// A topic alias registers the alias for the topic of the single subscription, forwarded
+		// subscriptions do not register aliases as the aliases are known only to the client connection.
+		var alias uint16
+		if !m.IsForwarded {
+			alias = m.Properties.TopicAlias
+		}
+		if alias != 0 && len(m.Subscriptions) != 1 {
+			status = types.ErrBadRequest.Status
+			c.notifyError(types.ErrBadRequest, m.MessageID)
+			alias = 0
+		}
 		// Subscribe for each subscription
+		var wildcards []*security.Topic
 		for _, subsc := range m.Subscriptions {
 			if err := c.onSubscribe(m, subsc); err != nil {
 				status = err.Status
 				c.notifyError(err, m.MessageID)
 				continue
 			}
-
+			if alias != 0 && !c.aliases.register(alias, subsc.Topic) {
+				status = types.ErrBadRequest.Status
+				c.notifyError(types.ErrBadRequest, m.MessageID)
+			}
+			if topic := security.ParseKey([]byte(subsc.Topic)); topic.IsWildcard() {
+				wildcards = append(wildcards, topic)
+			}
 		}
 
 		if m.IsForwarded {
 			return nil
 		}
-		c.send <- ack
+		if err := c.enqueue(ack); err != nil {
+			return err
+		}
+		// Follow the acknowledgement with the topics matching the wildcard subscriptions.
+		for _, topic := range wildcards {
+			c.notifyMatches(topic)
+		}
 
 	// An attempt to unsubscribe from a topic.
 	case utp.UNSUBSCRIBE:
@@ -212,7 +237,9 @@ func (c *_Conn) handler(inMsg lp.MessagePack) error {
 			}
 		}
 
-		c.send <- ack
+		if err := c.enqueue(ack); err != nil {
+			return err
+		}
 
 	// Ping response, respond appropriately.
 	case utp.PINGREQ:
@@ -220,14 +247,45 @@ func (c *_Conn) handler(inMsg lp.MessagePack) error {
 			MessageType: utp.PINGREQ,
 			FlowControl: utp.ACKNOWLEDGE,
 		}
-		c.send <- ack
+		if err := c.enqueue(ack); err != nil {
+			return err
+		}
 
 	case utp.PUBLISH:
 		m := *inMsg.(*utp.Publish)
+		// The throttled publish is not taken in flight, so the client may retry it.
+		if err := c.rateLimit(m); err != nil {
+			status = err.Status
+			c.notifyError(err, m.MessageID)
+			return nil
+		}
+		// Forwarded messages are already deduplicated by the node where the connection has originated.
+		if !m.IsForwarded {
+			ok, err := c.inflight.receive(m)
+			if err != nil {
+				status = err.Status
+				c.notifyError(err, m.MessageID)
+				return nil
+			}
+			if !ok {
+				// A duplicate publish replayed by the client, acknowledge it again without delivering.
+				// The message is released once acknowledged, as its original may never be.
+				if err := c.acknowledge(m); err != nil {
+					status = err.Status
+					return nil
+				}
+				c.inflight.release(m)
+				return nil
+			}
+		}
 		if err := c.onPublish(m); err != nil {
 			status = err.Status
 			c.notifyError(err, m.MessageID)
 		}
+		// The publish windowed for durable acks is released once it is acknowledged.
+		if !m.IsForwarded && c.window == nil {
+			c.inflight.release(m)
+		}
 	case utp.FLOWCONTROL:
 		// Persist incoming
 		c.storeInbound(inMsg)
@@ -243,16 +301,20 @@ func (c *_Conn) handler(inMsg lp.MessagePack) error {
 			}
 			switch msg.(type) {
 			case *utp.Publish:
-				c.send <- msg
+				return c.enqueue(msg)
 			}
 		case utp.RECEIPT:
+			c.inflight.receipt(m.MessageID)
 			comp := &utp.ControlMessage{
 				MessageType: utp.PUBLISH,
 				FlowControl: utp.COMPLETE,
 				MessageID:   m.MessageID,
 			}
 			c.storeOutbound(comp)
-			c.send <- comp
+			if err := c.enqueue(comp); err != nil {
+				return err
+			}
+			c.inflight.complete(m.MessageID)
 		}
 	}
 
@@ -279,7 +341,10 @@ func (c *_Conn) writeLoop(ctx context.Context) {
 				log.Error("conn.writeLoop", err.Error())
 				return
 			}
-			c.socket.Write(m.Bytes())
+			if err := c.write(m.Bytes()); err != nil {
+				log.Error("conn.writeLoop", err.Error())
+				return
+			}
 		case msg, ok := <-c.send:
 			if !ok {
 				// Channel closed.
@@ -290,11 +355,25 @@ func (c *_Conn) writeLoop(ctx context.Context) {
 				log.Error("conn.writeLoop", err.Error())
 				return
 			}
-			c.socket.Write(m.Bytes())
+			if err := c.write(m.Bytes()); err != nil {
+				log.Error("conn.writeLoop", err.Error())
+				return
+			}
 		}
 	}
 }
 
+// write writes to the client with a write deadline so a stuck client does not block the writer
+// indefinitely. The socket is closed if the write fails.
+func (c *_Conn) write(b []byte) error {
+	c.socket.SetWriteDeadline(time.Now().Add(c.service.writeTimeout()))
+	if _, err := c.socket.Write(b); err != nil {
+		c.socket.Close()
+		return err
+	}
+	return nil
+}
+
 // onConnect is a handler for Connect events.
 func (c *_Conn) onConnect(clientID []byte) (uid.ID, *types.Error) {
 	start := time.Now()
@@ -323,7 +402,11 @@ func (c *_Conn) onConnect(clientID []byte) (uid.ID, *types.Error) {
 
 	//do not cache primary client Id
 	if !clientid.IsPrimary() {
-		cid := []byte(clientid.Encode(c.service.mac))
+		encoded, err := clientid.Encode(c.service.mac)
+		if err != nil {
+			return nil, types.ErrServerError
+		}
+		cid := []byte(encoded)
 		c.service.cache.LoadOrStore(crypto.SignatureToUint32(cid[crypto.EpochSize:crypto.MessageOffset]), clientid.Contract())
 	}
 
@@ -382,9 +465,14 @@ func (c *_Conn) onSubscribe(sub utp.Subscribe, subsc *utp.Subscription) *types.E
 		}
 	}
 
+	if err := c.authorize(topic, security.AllowRead, sub.IsForwarded); err != nil {
+		return err
+	}
+
 	if err := c.subscribe(sub, topic, subsc); err != nil {
 		return types.ErrServerError
 	}
+	c.trackSubscription(subsc)
 
 	return nil
 }
@@ -408,7 +496,7 @@ func (c *_Conn) onUnsubscribe(unsub utp.Unsubscribe, subsc *utp.Subscription) *t
 		}
 	}
 
-	if err := c.unsubscribe(unsub, topic); err != nil {
+	if err := c.unsubscribe(unsub, topic, subsc); err != nil {
 		return types.ErrServerError
 	}
 
@@ -416,11 +504,31 @@ func (c *_Conn) onUnsubscribe(unsub utp.Unsubscribe, subsc *utp.Subscription) *t
 }
 
 // OnPublish is a handler for Publish events.
-func (c *_Conn) onPublish(pub utp.Publish) *types.Error {
+func (c *_Conn) onPublish(pub utp.Publish) (err *types.Error) {
 	start := time.Now()
 	defer log.ErrLogger.Debug().Str("context", "conn.onPublish").Int64("duration", time.Since(start).Nanoseconds()).Msg("")
 
+	var acks []<-chan error
+	if c.window != nil {
+		// The publish takes one slot of the window whatever the number of its messages, so a
+		// publish with more messages than the window does not wait on itself. The connection
+		// is not read while the window is full.
+		select {
+		case c.window <- struct{}{}:
+		case <-c.closeC:
+			return types.ErrServerError
+		}
+		// The publish is acknowledged in the background once its messages are durable. If the
+		// publish fails part way, the stored messages only free the window slot.
+		defer func() {
+			c.closeW.Add(1)
+			go c.acknowledgeDurable(pub, acks, err == nil)
+		}()
+	}
 	for _, m := range pub.Messages {
+		if !c.aliases.resolve(m) {
+			return types.ErrBadRequest
+		}
 		//Parse the key
 		topic := security.ParseKey([]byte(m.Topic))
 		if topic.TopicType == security.TopicInvalid {
@@ -443,21 +551,98 @@ func (c *_Conn) onPublish(pub utp.Publish) *types.Error {
 			}
 		}
 
-		err := store.Message.Put(c.clientID.Contract(), topic.Topic, m.Payload, m.Ttl)
+		if err := c.authorize(topic, security.AllowWrite, pub.IsForwarded); err != nil {
+			return err
+		}
+
+		contract := c.clientID.Contract()
+		forward := !pub.IsForwarded && Globals.Cluster.hasRemoteReplicas(fmt.Sprint(contract))
+		seq, err := Globals.Cluster.orderPublish(contract, forward, func() error {
+			if c.window != nil {
+				acks = append(acks, store.Message.PutWithAck(contract, topic.Topic, m.Payload, m.Ttl))
+				return nil
+			}
+			return store.Message.Put(contract, topic.Topic, m.Payload, m.Ttl)
+		})
 		if err != nil {
 			log.Error("conn.onPublish", "store message "+err.Error())
 			return types.ErrServerError
 		}
 		// Iterate through all subscribers and send them the message
-		go c.publish(pub, topic, m)
+		go c.publish(pub, topic, m, seq)
 		// time.Sleep(100*time.Millisecond)
 		// panic("exit on publish")
 	}
 
+	if c.window != nil {
+		return nil
+	}
+
 	// acknowledge a Message
 	return c.acknowledge(pub)
 }
 
+// acknowledgeDurable waits for the messages of a Publish Message to be durable and frees
+// the slot of the publish in the publish window. The publish is acknowledged if ack is set.
+func (c *_Conn) acknowledgeDurable(pub utp.Publish, acks []<-chan error, ack bool) {
+	defer c.closeW.Done()
+	defer func() {
+		<-c.window
+	}()
+	// A publish interrupted by the connection close is left in flight, so its replay after
+	// reconnect is acknowledged rather than stored twice.
+	released := false
+	defer func() {
+		if released && !pub.IsForwarded {
+			c.inflight.release(pub)
+		}
+	}()
+
+	var failed error
+	for _, ack := range acks {
+		select {
+		case err := <-ack:
+			if err != nil && failed == nil {
+				failed = err
+			}
+		case <-c.closeC:
+			return
+		}
+	}
+	if failed != nil {
+		log.Error("conn.acknowledgeDurable", "store message "+failed.Error())
+		released = true
+		c.notifyError(types.ErrServerError, pub.MessageID)
+		return
+	}
+	if !ack {
+		released = true
+		return
+	}
+	select {
+	case c.send <- &utp.ControlMessage{
+		MessageType: utp.PUBLISH,
+		FlowControl: utp.ACKNOWLEDGE,
+		MessageID:   pub.MessageID,
+	}:
+		released = true
+	case <-c.closeC:
+	}
+}
+
+// rateLimit throttles the publish if the contract of the client exceeds its publish rate limit.
+// Forwarded publishes are limited by the node where the connection has originated.
+func (c *_Conn) rateLimit(pub utp.Publish) *types.Error {
+	if pub.IsForwarded || c.service == nil {
+		return nil
+	}
+	if !c.service.limiter.allow(c.clientID.Contract(), len(pub.Messages), time.Now()) {
+		c.service.meter.ThrottledMsgs.Inc(int64(len(pub.Messages)))
+		return types.ErrRateLimited
+	}
+	return nil
+}
+
 // acknowledge acknowledges a Publish Message
 func (c *_Conn) acknowledge(pub utp.Publish) *types.Error {
 	ack := &utp.ControlMessage{
@@ -465,7 +650,9 @@ func (c *_Conn) acknowledge(pub utp.Publish) *types.Error {
 		FlowControl: utp.ACKNOWLEDGE,
 		MessageID:   pub.MessageID,
 	}
-	c.send <- ack
+	if err := c.enqueue(ack); err != nil {
+		return types.ErrServerError
+	}
 	return nil
 }
 
@@ -489,6 +676,18 @@ func (c *_Conn) onSecureRequest(topic *security.Topic) (bool, *types.Error) {
 	return wildcard, nil
 }
 
+// authorize checks the topic ACL allows the client the access to the topic. Forwarded requests
+// are authorized by the node where the connection has originated.
+func (c *_Conn) authorize(topic *security.Topic, access uint32, forwarded bool) *types.Error {
+	if forwarded || c.service == nil {
+		return nil
+	}
+	if !c.service.acl.Allowed(c.aclClientID, topic.Topic[:topic.Size], access) {
+		return types.ErrTopicForbidden
+	}
+	return nil
+}
+
 // onSpecialRequest processes an special request.
 func (c *_Conn) onSpecialRequest(topic *security.Topic, payload []byte) (ok bool) {
 	var resp interface{}
@@ -529,7 +728,10 @@ func (c *_Conn) onClientIDRequest() (interface{}, bool) {
 	if err != nil {
 		return types.ErrBadRequest, false
 	}
-	cid := clientid.Encode(c.service.mac)
+	cid, err := clientid.Encode(c.service.mac)
+	if err != nil {
+		return types.ErrServerError, false
+	}
 	return &types.ClientIdResponse{
 		Status:   200,
 		ClientId: cid,
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"sync"
+
+	"github.com/unit-io/unitdb/server/internal/types"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+// inflightState is the state of an inbound message in the exactly-once delivery handshake.
+type inflightState uint8
+
+const (
+	inflightReceived inflightState = iota + 1 // PUBLISH received, not yet acknowledged
+	inflightReceipt                           // RECEIPT received, COMPLETE sent
+)
+
+// maxInflight is the maximum number of inbound messages in flight for a session.
+const maxInflight = 1024
+
+// _InflightStore records the packet IDs of inbound messages in flight for a session,
+// so a PUBLISH replayed by the client after reconnect isn't delivered twice. A packet ID
+// is released once the message is persisted and acknowledged, so the client can reuse it.
+type _InflightStore struct {
+	sync.Mutex
+	m map[uint16]inflightState
+}
+
+func newInflightStore() *_InflightStore {
+	return &_InflightStore{
+		m: make(map[uint16]inflightState),
+	}
+}
+
+// receive records an inbound publish. It returns false if the publish is a
+// duplicate of a message already in flight, and ErrInflightFull if the session
+// has too many messages in flight.
+func (s *_InflightStore) receive(pub utp.Publish) (bool, *types.Error) {
+	// Express messages are delivered at most once and are not tracked.
+	if pub.DeliveryMode == 0 || pub.MessageID == 0 {
+		return true, nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.m[pub.MessageID]; ok {
+		return false, nil
+	}
+	if len(s.m) >= maxInflight {
+		return false, types.ErrInflightFull
+	}
+	s.m[pub.MessageID] = inflightReceived
+	return true, nil
+}
+
+// release removes an inbound publish recorded by receive once it is acknowledged or has failed,
+// so a retry of the publish by the client is delivered.
+func (s *_InflightStore) release(pub utp.Publish) {
+	if pub.DeliveryMode == 0 || pub.MessageID == 0 {
+		return
+	}
+	s.complete(pub.MessageID)
+}
+
+// receipt moves the message to receipt state once the client acknowledges the delivery.
+func (s *_InflightStore) receipt(messageID uint16) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.m[messageID]; ok {
+		s.m[messageID] = inflightReceipt
+	}
+}
+
+// complete removes the message from the in-flight store, the packet ID can be reused by the client.
+func (s *_InflightStore) complete(messageID uint16) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, messageID)
+}
+
+// reset removes all messages from the in-flight store, a clean session starts with no messages in flight.
+func (s *_InflightStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.m = make(map[uint16]inflightState)
+}
+
+// state returns the state of the message with the given packet ID.
+func (s *_InflightStore) state(messageID uint16) (inflightState, bool) {
+	s.Lock()
+	defer s.Unlock()
+	st, ok := s.m[messageID]
+	return st, ok
+}
+
+func (s *_InflightStore) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.m)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/types"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+func TestInflightDuplicatePublish(t *testing.T) {
+	cache := NewConnCache()
+	sessID := uid.NewLID()
+	pub := utp.Publish{MessageID: 1, DeliveryMode: 1}
+	receive := func(s *_InflightStore, pub utp.Publish) bool {
+		ok, err := s.receive(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	s := cache.getInflight(sessID)
+	if !receive(s, pub) {
+		t.Fatal("first publish reported as duplicate")
+	}
+
+	// The client reconnects mid-handshake and resumes its in-flight set.
+	cache.releaseInflight(sessID)
+	s = cache.getInflight(sessID)
+	if receive(s, pub) {
+		t.Fatal("replayed publish delivered twice")
+	}
+
+	s.receipt(pub.MessageID)
+	if st, ok := s.state(pub.MessageID); !ok || st != inflightReceipt {
+		t.Fatalf("unexpected state %d", st)
+	}
+	if receive(s, pub) {
+		t.Fatal("replayed publish delivered after receipt")
+	}
+
+	// Once complete the packet ID can be reused.
+	s.complete(pub.MessageID)
+	if !receive(s, pub) {
+		t.Fatal("packet ID not released on complete")
+	}
+
+	// Once the publish is acknowledged the packet ID can be reused.
+	s.release(pub)
+	if !receive(s, pub) {
+		t.Fatal("packet ID not released once acknowledged")
+	}
+
+	// Express messages are not tracked.
+	express := utp.Publish{MessageID: 2}
+	if !receive(s, express) || !receive(s, express) {
+		t.Fatal("express publish reported as duplicate")
+	}
+
+	// A clean session starts with no messages in flight.
+	s.reset()
+	if s.len() != 0 || !receive(s, pub) {
+		t.Fatal("in-flight messages not reset")
+	}
+}
+
+func TestInflightFull(t *testing.T) {
+	s := newInflightStore()
+	for id := 1; id <= maxInflight; id++ {
+		if ok, err := s.receive(utp.Publish{MessageID: uint16(id), DeliveryMode: 1}); !ok || err != nil {
+			t.Fatalf("unexpected publish %d rejected: %v", id, err)
+		}
+	}
+	pub := utp.Publish{MessageID: maxInflight + 1, DeliveryMode: 1}
+	if _, err := s.receive(pub); err != types.ErrInflightFull {
+		t.Fatalf("expected %v, got %v", types.ErrInflightFull, err)
+	}
+
+	// A message acknowledged makes room for the next one.
+	s.release(utp.Publish{MessageID: 1, DeliveryMode: 1})
+	if ok, err := s.receive(pub); !ok || err != nil {
+		t.Fatalf("expected publish accepted once a message is released: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// ACL policy values.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+
+	ACLAnyClient = "*" // Client ID of a rule matching any client.
+)
+
+// ACL errors
+var (
+	ErrInvalidACLPolicy = errors.New("acl: policy must be either allow or deny")
+	ErrInvalidACLAccess = errors.New("acl: access must be read, write or readwrite")
+	ErrInvalidACLRule   = errors.New("acl: rule must have a client ID and a topic")
+)
+
+// ACLRule is a rule allowing or denying a client access to the topics matching the topic pattern.
+type ACLRule struct {
+	// Client ID the client connects with or "*" for any client.
+	ClientID string `json:"client_id"`
+	// Topic pattern, "*" matches a single part of the topic and a trailing "..." matches the remaining parts.
+	Topic string `json:"topic"`
+	// Access granted or denied by the rule: "read", "write" or "readwrite".
+	Access string `json:"access"`
+	// Policy of the rule: "allow" or "deny".
+	Policy string `json:"policy"`
+}
+
+// ACLConfig is the topic ACL policy.
+type ACLConfig struct {
+	// Policy applied if no rule matches: "allow" or "deny". Defaults to "allow".
+	Default string `json:"default"`
+	// Rules are evaluated in order and the first rule matching the client, topic and access applies.
+	Rules []ACLRule `json:"rules"`
+}
+
+type aclRule struct {
+	clientID string
+	topic    []byte
+	access   uint32
+	allow    bool
+}
+
+// ACL checks the read and write access of the clients to the topics. The zero ACL allows all access.
+type ACL struct {
+	sync.RWMutex
+	deny  bool // deny access if no rule matches
+	rules []aclRule
+}
+
+// NewACL creates an ACL from the policy.
+func NewACL(cfg ACLConfig) (*ACL, error) {
+	a := &ACL{}
+	if err := a.Load(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load validates the policy and replaces the policy of the ACL.
+func (a *ACL) Load(cfg ACLConfig) error {
+	deny, err := parseACLPolicy(cfg.Default)
+	if err != nil {
+		return err
+	}
+	rules := make([]aclRule, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		if r.ClientID == "" || r.Topic == "" {
+			return ErrInvalidACLRule
+		}
+		var access uint32
+		switch r.Access {
+		case "read":
+			access = AllowRead
+		case "write":
+			access = AllowWrite
+		case "readwrite":
+			access = AllowReadWrite
+		default:
+			return ErrInvalidACLAccess
+		}
+		ruleDeny, err := parseACLPolicy(r.Policy)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, aclRule{clientID: r.ClientID, topic: []byte(r.Topic), access: access, allow: !ruleDeny})
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.deny = deny
+	a.rules = rules
+	return nil
+}
+
+// parseACLPolicy returns true if the policy denies access.
+func parseACLPolicy(policy string) (bool, error) {
+	switch policy {
+	case "", ACLAllow:
+		return false, nil
+	case ACLDeny:
+		return true, nil
+	default:
+		return false, ErrInvalidACLPolicy
+	}
+}
+
+// Allowed returns true if the client is allowed the access to the topic. A nil ACL allows all access.
+func (a *ACL) Allowed(clientID string, topic []byte, access uint32) bool {
+	if a == nil {
+		return true
+	}
+	a.RLock()
+	defer a.RUnlock()
+	for _, r := range a.rules {
+		if r.access&access != access {
+			continue
+		}
+		if r.clientID != ACLAnyClient && r.clientID != clientID {
+			continue
+		}
+		if MatchTopic(r.topic, topic) {
+			return r.allow
+		}
+	}
+	return !a.deny
+}
+
+// MatchTopic returns true if the topic matches the topic pattern. A "*" part of the pattern matches
+// any single part of the topic and a trailing "..." matches the remaining parts, if any. The
+// parts are split on the separators that are not escaped.
+func MatchTopic(pattern, topic []byte) bool {
+	multi := hasGenericSuffix(pattern)
+	if multi {
+		pattern = pattern[:len(pattern)-3]
+	}
+	patternParts := splitTopic(pattern)
+	topicParts := splitTopic(topic)
+	if len(topicParts) < len(patternParts) || (!multi && len(topicParts) != len(patternParts)) {
+		return false
+	}
+	for i, part := range patternParts {
+		if !bytes.Equal(part, []byte{'*'}) && !bytes.Equal(part, topicParts[i]) {
+			return false
+		}
+	}
+	return true
+}
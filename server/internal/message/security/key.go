@@ -40,9 +40,10 @@ const (
 	TopicWildcard
 
 	TopicKeySeparator = '/'
-	TopicSeparator    = '.' // The separator character.
-	encodedLen        = 13  // string encoded len
-	rawLen            = 8   // binary raw len
+	TopicSeparator    = '.'  // The separator character.
+	TopicEscape       = '\\' // The escape character of a separator or a wildcard symbol in a topic part.
+	encodedLen        = 13   // string encoded len
+	rawLen            = 8    // binary raw len
 )
 
 // Key errors
@@ -50,18 +51,49 @@ var (
 	ErrTargetTooLong = errors.New("topic can not have more than 23 parts")
 )
 
-type splitFunc struct{}
+// fields splits the text on the separators that are not escaped, empty fields are skipped.
+func fields(text []byte, sep byte) [][]byte {
+	var parts [][]byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case TopicEscape:
+			i++
+		case sep:
+			if i > start {
+				parts = append(parts, text[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(text) {
+		parts = append(parts, text[start:])
+	}
+	return parts
+}
+
+// splitTopic splits the topic into parts on the separators that are not escaped.
+func splitTopic(topic []byte) [][]byte {
+	return fields(topic, TopicSeparator)
+}
 
-func (splitFunc) splitTopic(c rune) bool {
-	return c == TopicSeparator
+// escaped reports whether the character at i is escaped by an odd number of escape characters.
+func escaped(text []byte, i int) bool {
+	n := 0
+	for j := i - 1; j >= 0 && text[j] == TopicEscape; j-- {
+		n++
+	}
+	return n%2 == 1
 }
 
-func (splitFunc) splitKey(c rune) bool {
-	return c == TopicKeySeparator
+// hasGenericSuffix reports whether the topic ends with a "..." that is not escaped.
+func hasGenericSuffix(topic []byte) bool {
+	return bytes.HasSuffix(topic, []byte("...")) && !escaped(topic, len(topic)-3)
 }
 
-func (splitFunc) options(c rune) bool {
-	return c == '?'
+// hasWildcardSuffix reports whether the topic part ends with a "*" that is not escaped.
+func hasWildcardSuffix(part []byte) bool {
+	return bytes.HasSuffix(part, []byte{'*'}) && !escaped(part, len(part)-1)
 }
 
 // Topic represents a parsed topic.
@@ -95,12 +127,27 @@ func (topic *Topic) Target() uint32 {
 	return hash.WithSalt(topic.Topic[:topic.Size], message.Contract)
 }
 
-// ParseKey attempts to parse the key
+// IsWildcard checks whether the topic has a part ending with "*" or a trailing "...", as the
+// topic is parsed by the store. An escaped "*" or separator is part of the topic.
+func (topic *Topic) IsWildcard() bool {
+	t := topic.Topic[:topic.Size]
+	if hasGenericSuffix(t) {
+		return true
+	}
+	for _, part := range splitTopic(t) {
+		if hasWildcardSuffix(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseKey attempts to parse the key. The key and the options are split on the separators that
+// are not escaped.
 func ParseKey(text []byte) (topic *Topic) {
 	topic = new(Topic)
-	var fn splitFunc
 
-	parts := bytes.FieldsFunc(text, fn.splitKey)
+	parts := fields(text, TopicKeySeparator)
 	if parts == nil || len(parts) < 2 {
 		// topic.TopicType = TopicInvalid
 		topic.Topic = parts[0]
@@ -109,7 +156,7 @@ func ParseKey(text []byte) (topic *Topic) {
 	}
 	topic.Key = parts[0]
 	topic.Topic = parts[1]
-	parts = bytes.FieldsFunc(parts[1], fn.options)
+	parts = fields(parts[1], '?')
 	l := len(parts)
 	if parts == nil || l < 1 {
 		topic.TopicType = TopicInvalid
@@ -141,15 +188,14 @@ func (k Key) ValidateTopic(contract uint32, topic []byte) (ok bool, wildcard boo
 
 // SetTarget sets the topic for the key.
 func (k Key) SetTarget(contract uint32, topic []byte) error {
-	var fn splitFunc
 	// 1st bit is 0 for wildcard, 1 for strict type
 	bitPath := uint32(1 << 23)
-	if bytes.HasSuffix(topic, []byte("...")) {
+	if hasGenericSuffix(topic) {
 		bitPath = 0
 		//topic = bytes.TrimRight(topic, "...")
 	}
 
-	parts := bytes.FieldsFunc(topic, fn.splitTopic)
+	parts := splitTopic(topic)
 
 	// Perform some validation
 	if len(parts) > 23 {
@@ -158,7 +204,7 @@ func (k Key) SetTarget(contract uint32, topic []byte) error {
 
 	// Encode all of the parts
 	for _, part := range parts {
-		if bytes.HasSuffix(part, []byte{'*'}) {
+		if hasWildcardSuffix(part) {
 			bitPath = 0
 			break
 		}
@@ -166,7 +212,7 @@ func (k Key) SetTarget(contract uint32, topic []byte) error {
 
 	// Encode all of the parts
 	for idx, part := range parts {
-		if !bytes.HasSuffix(part, []byte{'*'}) && !bytes.HasSuffix(part, []byte("...")) {
+		if !hasWildcardSuffix(part) && !hasGenericSuffix(part) {
 			bitPath |= uint32(1 << (22 - uint16(idx)))
 		}
 	}
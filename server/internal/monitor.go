@@ -17,13 +17,20 @@
 package internal
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/unit-io/unitdb/server/internal/message"
+	"github.com/unit-io/unitdb/server/internal/message/security"
 	"github.com/unit-io/unitdb/server/internal/pkg/log"
 	"github.com/unit-io/unitdb/server/internal/pkg/metrics"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/store"
+	"github.com/unit-io/unitdb/server/internal/types"
 )
 
 type Meter struct {
@@ -35,6 +42,9 @@ type Meter struct {
 	OutMsgs        metrics.Counter
 	InBytes        metrics.Counter
 	OutBytes       metrics.Counter
+	DroppedMsgs    metrics.Counter
+	ThrottledMsgs  metrics.Counter
+	DeadNodes      metrics.Counter
 }
 
 func NewMeter() *Meter {
@@ -48,6 +58,9 @@ func NewMeter() *Meter {
 		OutMsgs:        metrics.NewCounter(),
 		InBytes:        metrics.NewCounter(),
 		OutBytes:       metrics.NewCounter(),
+		DroppedMsgs:    metrics.NewCounter(),
+		ThrottledMsgs:  metrics.NewCounter(),
+		DeadNodes:      metrics.NewCounter(),
 	}
 
 	c.ConnTimeSeries.Time(func() {})
@@ -56,6 +69,9 @@ func NewMeter() *Meter {
 	Metrics.GetOrRegister("InMsgs", c.InMsgs)
 	Metrics.GetOrRegister("OutMsgs", c.OutMsgs)
 	Metrics.GetOrRegister("InBytes", c.InBytes)
+	Metrics.GetOrRegister("DroppedMsgs", c.DroppedMsgs)
+	Metrics.GetOrRegister("ThrottledMsgs", c.ThrottledMsgs)
+	Metrics.GetOrRegister("DeadNodes", c.DeadNodes)
 	Metrics.GetOrRegister("Connections", c.Connections)
 
 	return c
@@ -76,6 +92,9 @@ type Varz struct {
 	InBytes       int64     `json:"in_bytes"`
 	OutBytes      int64     `json:"out_bytes"`
 	Subscriptions int64     `json:"subscriptions"`
+	DroppedMsgs   int64     `json:"dropped_msgs"`
+	ThrottledMsgs int64     `json:"throttled_msgs"`
+	DeadNodes     int64     `json:"dead_nodes"`
 	HMean         float64   `json:"hmean"` // Event duration harmonic mean.
 	P50           float64   `json:"p50"`   // Event duration nth percentiles ..
 	P75           float64   `json:"p75"`
@@ -128,6 +147,9 @@ func (s *_Service) Varz() (*Varz, error) {
 	v.InBytes = s.meter.InBytes.Count()
 	v.OutBytes = s.meter.OutBytes.Count()
 	v.Subscriptions = s.meter.Subscriptions.Count()
+	v.DroppedMsgs = s.meter.DroppedMsgs.Count()
+	v.ThrottledMsgs = s.meter.ThrottledMsgs.Count()
+	v.DeadNodes = s.meter.DeadNodes.Count()
 	ts := s.meter.ConnTimeSeries.Snapshot()
 	v.HMean = float64(ts.HMean())
 	v.P50 = float64(ts.P50())
@@ -172,3 +194,73 @@ func ResponseHandler(w http.ResponseWriter, r *http.Request, data []byte) {
 		w.Write(data)
 	}
 }
+
+// Subscriber is a subscription of a topic.
+type Subscriber struct {
+	ConnID       uint32 `json:"conn_id"`
+	DeliveryMode uint8  `json:"delivery_mode"`
+	Delay        int32  `json:"delay"`
+	Connected    bool   `json:"connected"`
+}
+
+// Subscribers outputs the subscriptions of a topic at /subscribers.
+type Subscribers struct {
+	Topic       string       `json:"topic"`
+	Count       int          `json:"count"`
+	Subscribers []Subscriber `json:"subscribers"`
+}
+
+// subscribers lists the subscriptions of the topic. Subscriptions are persisted with the
+// connection of the subscriber, so a subscription of a closed connection is reported
+// as not connected.
+func (m *_Service) subscribers(contract uint32, topic string) (*Subscribers, error) {
+	t := security.ParseKey([]byte(topic))
+	if t.TopicType == security.TopicInvalid {
+		return nil, types.ErrBadRequest
+	}
+	subscriptions, err := store.Subscription.Get(contract, t.Topic)
+	if err != nil {
+		return nil, err
+	}
+	subs := &Subscribers{Topic: string(t.Topic[:t.Size]), Subscribers: make([]Subscriber, 0, len(subscriptions))}
+	for _, subscription := range subscriptions {
+		if len(subscription) < 9 {
+			continue
+		}
+		sub := Subscriber{
+			DeliveryMode: subscription[0],
+			ConnID:       binary.LittleEndian.Uint32(subscription[1:5]),
+			Delay:        int32(binary.LittleEndian.Uint32(subscription[5:9])),
+		}
+		sub.Connected = Globals.connCache.get(uid.LID(sub.ConnID)) != nil
+		subs.Subscribers = append(subs.Subscribers, sub)
+	}
+	subs.Count = len(subs.Subscribers)
+	return subs, nil
+}
+
+// HandleSubscribers will process HTTP requests for the subscriptions of a topic. The topic is
+// passed as "topic" query parameter and the contract as an optional "contract" query parameter.
+func (m *_Service) HandleSubscribers(w http.ResponseWriter, r *http.Request) {
+	contract := message.Contract
+	if c := r.URL.Query().Get("contract"); c != "" {
+		v, err := strconv.ParseUint(c, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid contract", http.StatusBadRequest)
+			return
+		}
+		contract = uint32(v)
+	}
+	subs, err := m.subscribers(contract, r.URL.Query().Get("topic"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		log.Error("metrics", "Error marshaling response to /subscribers request: "+err.Error())
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
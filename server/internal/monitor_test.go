@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	_ "github.com/unit-io/unitdb/server/internal/db/unitdb"
+	"github.com/unit-io/unitdb/server/internal/message"
+	"github.com/unit-io/unitdb/server/internal/message/security"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/store"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+func TestSubscribers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subscribers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	s := &_Service{meter: NewMeter()}
+	defer s.meter.UnregisterAll()
+	topic := security.ParseKey([]byte("unit1.test"))
+	for i := 0; i < 3; i++ {
+		clientID := make(uid.ID, 16)
+		clientID.SetContract(message.Contract)
+		c := &_Conn{service: s, connID: uid.LID(i + 1), clientID: clientID, subs: message.NewStats()}
+		Globals.connCache.add(c)
+		sub := &utp.Subscription{Topic: "unit1.test", DeliveryMode: 1, Delay: int32(i)}
+		if err := c.subscribe(utp.Subscribe{}, topic, sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Globals.connCache.delete(uid.LID(3))
+
+	subs, err := s.subscribers(message.Contract, "unit1.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs.Count != 3 {
+		t.Fatalf("expected 3 subscribers; got %d", subs.Count)
+	}
+	var connected int
+	for _, sub := range subs.Subscribers {
+		if sub.DeliveryMode != 1 || sub.Delay != int32(sub.ConnID-1) {
+			t.Fatalf("unexpected subscriber %+v", sub)
+		}
+		if sub.Connected {
+			connected++
+		}
+	}
+	if connected != 2 {
+		t.Fatalf("expected 2 connected subscribers; got %d", connected)
+	}
+	if subs, err := s.subscribers(message.Contract, "unit2.test"); err != nil || subs.Count != 0 {
+		t.Fatalf("expected no subscribers of other topic; got %v, %v", subs, err)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+
+	healthz := func() int {
+		w := httptest.NewRecorder()
+		store.HealthzHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code
+	}
+	if code := healthz(); code != http.StatusOK {
+		t.Fatalf("expected the open store healthy; got status %d", code)
+	}
+	store.Close()
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the closed store unhealthy; got status %d", code)
+	}
+}
@@ -67,6 +67,28 @@ func (s *GrpcServer) Stream(stream pbx.Unitdb_StreamServer) error {
 	return nil
 }
 
+// publishConn is a gRPC publish stream with the durable acknowledgement window.
+type publishConn struct {
+	*common.Conn
+	window int
+}
+
+func (c *publishConn) PublishWindow() int {
+	return c.window
+}
+
+// Publish implements duplex unitdb.Publish. The publishes are acknowledged once they are
+// durable, and the stream is not read while the window of unacknowledged publishes is full,
+// so the gRPC flow control pushes back on the client.
+func (s *GrpcServer) Publish(stream pbx.Unitdb_PublishServer) error {
+	conn := &publishConn{Conn: StreamConn(stream), window: s.opts.PublishWindow}
+	defer conn.Close()
+
+	go s.Handler(conn)
+	<-stream.Context().Done()
+	return nil
+}
+
 func (s *GrpcServer) Serve(list net.Listener) error {
 	secure := ""
 	var opts []grpc.ServerOption
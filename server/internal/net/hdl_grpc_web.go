@@ -34,14 +34,22 @@ type HttpServer server
 func NewHttpServer(opts ...Options) *HttpServer {
 	srv := &HttpServer{
 		opts: new(options),
+		mux:  http.NewServeMux(),
 	}
 	WithDefaultOptions().set(srv.opts)
 	for _, opt := range opts {
 		opt.set(srv.opts)
 	}
+	srv.mux.HandleFunc("/", srv.HandleFunc)
 	return srv
 }
 
+// Handle registers the handler for the given pattern, the requests of other paths are
+// upgraded to websocket connections.
+func (s *HttpServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
 // Conn implements net.Conn across a Websocket.
 //
 // Methods such as
@@ -78,6 +86,10 @@ type Conn struct {
 	// Decoder for more information.
 	Decode common.Decoder
 
+	// compressionThreshold is the minimum size of a message to compress if
+	// compression is negotiated with the client, 0 disables compression.
+	compressionThreshold int
+
 	// readOffset tracks where we've read up to if we're reading a result
 	// that didn't fully fit into the target slice. See Read.
 	readOffset int
@@ -113,21 +125,21 @@ func (s *HttpServer) HandleFunc(w http.ResponseWriter, r *http.Request) {
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		return true
 	}
-	ws, err := upgrader.Upgrade(w, r, nil)
+	u := upgrader
+	// Negotiate permessage-deflate during the upgrade if compression is enabled.
+	u.EnableCompression = s.opts.CompressionThreshold > 0
+	ws, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 	conn := WebSocketConn(ws)
+	conn.compressionThreshold = s.opts.CompressionThreshold
 	go s.Handler(conn)
 }
 
 func (s *HttpServer) Serve(list net.Listener) error {
 	srv := new(http.Server)
-	// Create a new HTTP request multiplexer
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.HandleFunc)
-
-	srv.Handler = mux
+	srv.Handler = s.mux
 	go func() {
 		if err := srv.Serve(list); err != nil {
 			log.Println("gRPC server failed:", err)
@@ -195,6 +207,11 @@ func (c *Conn) Write(p []byte) (int, error) {
 			c.WriteLock.Lock()
 		}
 
+		// Compress large messages only, small messages do not benefit from compression.
+		if c.compressionThreshold > 0 {
+			c.Stream.EnableWriteCompression(len(c.OutMsg.(*pbx.Packet).Data) >= c.compressionThreshold)
+		}
+
 		// Send our message. Any error we also just abort out.
 		err = c.Stream.WriteMessage(websocket.BinaryMessage, c.OutMsg.(*pbx.Packet).Data)
 
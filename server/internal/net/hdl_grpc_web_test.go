@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package net
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// roundTrip sends a publish to an echo server and returns the publish read back
+// along with the number of bytes read from the wire.
+func roundTrip(t *testing.T, threshold int, pub *utp.Publish) (MessagePack, int64) {
+	srv := NewHttpServer(WithCompressionThreshold(threshold))
+	srv.Handler = func(c net.Conn) {
+		defer c.Close()
+		msg, err := Read(c, 1<<20)
+		if err != nil {
+			return
+		}
+		m, err := Encode(msg)
+		if err != nil {
+			return
+		}
+		c.Write(m.Bytes())
+	}
+	ts := httptest.NewServer(http.HandlerFunc(srv.HandleFunc))
+	defer ts.Close()
+
+	var n int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			return countingConn{Conn: c, n: &n}, err
+		},
+	}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	conn := WebSocketConn(ws)
+	raw, err := pub.ToBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Read(conn, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, atomic.LoadInt64(&n)
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"key":"value"}`), 1024)
+	pub := &utp.Publish{MessageID: 1, Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: payload}}}
+
+	msg, compressed := roundTrip(t, 512, pub)
+	if got := msg.(*utp.Publish).Messages[0].Payload; !bytes.Equal(got, payload) {
+		t.Fatal("payload mismatch")
+	}
+	_, plain := roundTrip(t, 0, pub)
+	if compressed >= plain {
+		t.Fatalf("compressed %d bytes, uncompressed %d bytes", compressed, plain)
+	}
+}
@@ -22,9 +22,11 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/unit-io/unitdb/server/internal/pkg/log"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 )
@@ -52,6 +54,21 @@ func MatchCT(strs string) Proto {
 	}
 }
 
+// MatchGRPC only matches the HTTP/2 requests with the gRPC content-type, e.g. "application/grpc+proto".
+// The settings of the client are replied to on the connection, as the gRPC clients wait for the
+// settings of the server before sending the request headers.
+func MatchGRPC() Proto {
+	return func(r io.Reader) bool {
+		w, ok := r.(io.Writer)
+		if !ok {
+			w = ioutil.Discard
+		}
+		return matchHTTP2Field(w, r, "content-type", func(gotValue string) bool {
+			return strings.HasPrefix(gotValue, "application/grpc")
+		})
+	}
+}
+
 func hasHTTP2Preface(r io.Reader) bool {
 	var b [len(http2.ClientPreface)]byte
 	last := 0
@@ -161,6 +178,8 @@ type Listener struct {
 	closing     chan struct{}
 	protos      []mux
 	readTimeout time.Duration
+	buffers     BufferSizes
+	logBuffers  sync.Once
 }
 
 func New(address string) (*Listener, error) {
@@ -187,12 +206,38 @@ func (m *Listener) SetReadTimeout(t time.Duration) {
 	m.readTimeout = t
 }
 
+// SetBufferSizes sets the socket buffer sizes of the accepted connections.
+func (m *Listener) SetBufferSizes(b BufferSizes) {
+	m.buffers = b
+}
+
+// applyBuffers sets the socket buffer sizes on the accepted connection. The effective sizes
+// are logged for the first connection.
+func (m *Listener) applyBuffers(c net.Conn) {
+	if m.buffers.IsZero() {
+		return
+	}
+	b, err := m.buffers.Apply(c)
+	if err != nil {
+		log.Error("listener.applyBuffers", "unable to set socket buffer sizes "+err.Error())
+		return
+	}
+	m.logBuffers.Do(func() {
+		log.Info("listener.applyBuffers", "socket buffer sizes "+b.String())
+	})
+}
+
 func (m *Listener) Addr() net.Addr {
 	return m.root.Addr()
 }
 
 func (m *Listener) Accept() (net.Conn, error) {
-	return m.root.Accept()
+	c, err := m.root.Accept()
+	if err != nil {
+		return nil, err
+	}
+	m.applyBuffers(c)
+	return c, nil
 }
 
 func (m *Listener) ServeCallback(proto Proto, serve func(l net.Listener) error) {
@@ -235,6 +280,7 @@ func (m *Listener) Serve() error {
 			continue
 		}
 
+		m.applyBuffers(c)
 		wg.Add(1)
 		go m.serve(c, m.closing, &wg)
 	}
@@ -250,7 +296,7 @@ func (m *Listener) serve(c net.Conn, donec <-chan struct{}, wg *sync.WaitGroup)
 
 	for _, p := range m.protos {
 		for _, proto := range p.protos {
-			matched := proto(muxc.startSniffing())
+			matched := proto(sniffer{Reader: muxc.startSniffing(), Writer: c})
 			if matched {
 				muxc.doneSniffing()
 				if m.readTimeout > zeroTime {
@@ -332,6 +378,13 @@ func (m *Conn) doneSniffing() {
 	m.buf.reset(false)
 }
 
+// sniffer reads the content of the connection sniffed by a Proto and writes the replies
+// the Proto needs to read the content to the connection.
+type sniffer struct {
+	io.Reader
+	io.Writer
+}
+
 // Stream represents a io.Reader which can peek incoming bytes and reset back to normal.
 type stream struct {
 	source     io.Reader
@@ -368,3 +421,25 @@ func (s *stream) reset(snif bool) {
 	s.bufferRead = 0
 	s.bufferSize = s.buffer.Len()
 }
+
+// TimeoutConn wraps a net.Conn and resets the read and write deadlines before each read and write,
+// so a stuck peer does not block the caller indefinitely. A zero timeout leaves the deadline unset.
+type TimeoutConn struct {
+	net.Conn
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+func (c *TimeoutConn) Read(p []byte) (int, error) {
+	if c.ReadTimeout > zeroTime {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *TimeoutConn) Write(p []byte) (int, error) {
+	if c.WriteTimeout > zeroTime {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	return c.Conn.Write(p)
+}
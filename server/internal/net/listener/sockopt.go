@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errBufferSize = errors.New("listener: socket buffer size must not be negative")
+
+// BufferSizes is the size in bytes of the socket read and write buffers. A zero size
+// leaves the OS default.
+type BufferSizes struct {
+	Read  int
+	Write int
+}
+
+// IsZero returns true if none of the buffer sizes is set.
+func (b BufferSizes) IsZero() bool {
+	return b.Read == 0 && b.Write == 0
+}
+
+func (b BufferSizes) String() string {
+	return fmt.Sprintf("read %d, write %d", b.Read, b.Write)
+}
+
+// Validate checks the buffer sizes against the OS limits. It returns the warnings for the sizes
+// above the limits, the OS caps the buffers at its limits.
+func (b BufferSizes) Validate() ([]string, error) {
+	if b.Read < 0 || b.Write < 0 {
+		return nil, errBufferSize
+	}
+	var warnings []string
+	if max := osBufferLimit("rmem_max"); max > 0 && b.Read > max {
+		warnings = append(warnings, fmt.Sprintf("read buffer size %d exceeds the OS limit %d", b.Read, max))
+	}
+	if max := osBufferLimit("wmem_max"); max > 0 && b.Write > max {
+		warnings = append(warnings, fmt.Sprintf("write buffer size %d exceeds the OS limit %d", b.Write, max))
+	}
+	return warnings, nil
+}
+
+// Apply sets the buffer sizes on the TCP connection and returns the effective sizes reported by
+// the OS. The connection is left as is if it is not a TCP connection or no buffer size is set.
+func (b BufferSizes) Apply(c net.Conn) (BufferSizes, error) {
+	if b.IsZero() {
+		return BufferSizes{}, nil
+	}
+	if mc, ok := c.(*Conn); ok {
+		c = mc.Conn
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return BufferSizes{}, nil
+	}
+	if b.Read > 0 {
+		if err := tc.SetReadBuffer(b.Read); err != nil {
+			return BufferSizes{}, err
+		}
+	}
+	if b.Write > 0 {
+		if err := tc.SetWriteBuffer(b.Write); err != nil {
+			return BufferSizes{}, err
+		}
+	}
+	return socketBufferSizes(tc)
+}
+
+// osBufferLimit returns the maximum socket buffer size set by the OS, or 0 if the limit is unknown.
+func osBufferLimit(name string) int {
+	data, err := ioutil.ReadFile("/proc/sys/net/core/" + name)
+	if err != nil {
+		return 0
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return max
+}
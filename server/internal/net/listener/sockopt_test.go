@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package listener
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBufferSizes(t *testing.T) {
+	l, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	want := BufferSizes{Read: 64 << 10, Write: 32 << 10}
+	if _, err := want.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l.SetBufferSizes(want)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		return
+	}
+	defer server.Close()
+
+	check := func(c net.Conn) {
+		// The OS may round up the sizes set, Linux doubles them.
+		got, err := socketBufferSizes(c.(*net.TCPConn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Read < want.Read || got.Write < want.Write {
+			t.Fatalf("expected buffer sizes at least %v; got %v", want, got)
+		}
+	}
+	check(server)
+
+	got, err := want.Apply(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Read < want.Read || got.Write < want.Write {
+		t.Fatalf("expected effective buffer sizes at least %v; got %v", want, got)
+	}
+	check(client)
+
+	if _, err := (BufferSizes{Read: -1}).Validate(); err != errBufferSize {
+		t.Fatalf("expected %v; got %v", errBufferSize, err)
+	}
+	if max := osBufferLimit("rmem_max"); max > 0 {
+		if warnings, err := (BufferSizes{Read: max + 1}).Validate(); err != nil || len(warnings) != 1 {
+			t.Fatalf("expected a warning for the size above the OS limit; got %v, %v", warnings, err)
+		}
+	}
+}
@@ -16,44 +16,29 @@
  * limitations under the License.
  */
 
-package unitdb
+package listener
 
 import (
-	"os"
+	"net"
 	"syscall"
 )
 
-type _UnixFileLock struct {
-	f    *os.File
-	name string
-}
-
-// Unlock removes the lock from file.
-func (fl *_UnixFileLock) unlock() error {
-	if err := os.Remove(fl.name); err != nil {
-		return err
-	}
-	return fl.f.Close()
-}
-
-func lockFile(f *os.File) error {
-	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
-		if err == syscall.EWOULDBLOCK {
-			err = os.ErrExist
-		}
-		return err
-	}
-	return nil
-}
-
-func newLockFile(name string) (_LockFile, error) {
-	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+// socketBufferSizes returns the socket buffer sizes of the TCP connection. Linux reports
+// double the size set to account for its bookkeeping overhead.
+func socketBufferSizes(c *net.TCPConn) (BufferSizes, error) {
+	raw, err := c.SyscallConn()
 	if err != nil {
-		return nil, err
+		return BufferSizes{}, err
 	}
-	if err := lockFile(f); err != nil {
-		f.Close()
-		return nil, err
+	var b BufferSizes
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		if b.Read, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		b.Write, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil {
+		return BufferSizes{}, err
 	}
-	return &_UnixFileLock{f, name}, nil
+	return b, sockErr
 }
@@ -0,0 +1,50 @@
+// +build windows
+
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package listener
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// socketBufferSizes returns the socket buffer sizes of the TCP connection.
+func socketBufferSizes(c *net.TCPConn) (BufferSizes, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return BufferSizes{}, err
+	}
+	getsockopt := func(fd uintptr, opt int32) (int, error) {
+		var v int32
+		l := int32(unsafe.Sizeof(v))
+		err := syscall.Getsockopt(syscall.Handle(fd), syscall.SOL_SOCKET, opt, (*byte)(unsafe.Pointer(&v)), &l)
+		return int(v), err
+	}
+	var b BufferSizes
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		if b.Read, sockErr = getsockopt(fd, syscall.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		b.Write, sockErr = getsockopt(fd, syscall.SO_SNDBUF)
+	}); err != nil {
+		return BufferSizes{}, err
+	}
+	return b, sockErr
+}
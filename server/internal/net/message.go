@@ -18,6 +18,7 @@ package net
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 
@@ -32,20 +33,25 @@ type MessagePack interface {
 	Info() utp.Info
 }
 
-// Read unpacks the packet from the provided reader.
-func Read(r io.Reader) (MessagePack, error) {
+// ErrMessageTooLarge occurs when the message length in the header exceeds the maximum message size.
+var ErrMessageTooLarge = errors.New("message::Read: message size exceeds the maximum message size")
+
+// Read unpacks the packet from the provided reader. The packet is rejected before
+// its body is allocated if the message length exceeds the maxMessageSize.
+func Read(r io.Reader, maxMessageSize int) (MessagePack, error) {
 	var fh utp.FixedHeader
-	fh.FromBinary(r)
+	if err := fh.FromBinary(r); err != nil {
+		return nil, err
+	}
 
 	// Check for empty Messages
-	switch fh.MessageType {
-	case 0:
+	if fh.MessageType == 0 {
 		// TODO fixe zero length message issue.
 		return &utp.Pingreq{}, nil
-	case utp.PINGREQ:
-		return &utp.Pingreq{}, nil
-	case utp.DISCONNECT:
-		return &utp.Disconnect{}, nil
+	}
+
+	if fh.MessageLength < 0 || fh.MessageLength > maxMessageSize {
+		return nil, ErrMessageTooLarge
 	}
 
 	rawMsg := make([]byte, fh.MessageLength)
@@ -72,6 +78,10 @@ func Read(r io.Reader) (MessagePack, error) {
 		pack = &utp.Subscribe{}
 	case utp.UNSUBSCRIBE:
 		pack = &utp.Unsubscribe{}
+	case utp.PINGREQ:
+		pack = &utp.Pingreq{}
+	case utp.DISCONNECT:
+		pack = &utp.Disconnect{}
 	default:
 		return nil, fmt.Errorf("message::Read: Invalid zero-length packet type %d", fh.MessageType)
 	}
@@ -80,15 +90,36 @@ func Read(r io.Reader) (MessagePack, error) {
 	return pack, nil
 }
 
-// Encode encodes the message into binary data
+// ReadConnectAcknowledge unpacks the CONNECT acknowledgement the server replies to a CONNECT with.
+// The acknowledgement is packed in the message of the CONNECT acknowledge control message.
+func ReadConnectAcknowledge(ctrl *utp.ControlMessage) (*utp.ConnectAcknowledge, error) {
+	if ctrl.MessageType != utp.CONNECT || ctrl.FlowControl != utp.ACKNOWLEDGE {
+		return nil, fmt.Errorf("message::ReadConnectAcknowledge: Invalid control message type %d", ctrl.MessageType)
+	}
+	r := bytes.NewReader(ctrl.Message)
+	var fh utp.FixedHeader
+	if err := fh.FromBinary(r); err != nil {
+		return nil, err
+	}
+	if fh.MessageLength < 0 || fh.MessageLength > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rawMsg := make([]byte, fh.MessageLength)
+	if _, err := io.ReadFull(r, rawMsg); err != nil {
+		return nil, err
+	}
+
+	connack := &utp.ConnectAcknowledge{}
+	connack.FromBinary(fh, rawMsg)
+	return connack, nil
+}
+
+// Encode encodes the message into binary data. Every message read by Read is encoded,
+// along with the CONNECT acknowledgement packed in a control message.
 func Encode(pack MessagePack) (bytes.Buffer, error) {
 	switch pack.Type() {
-	case utp.DISCONNECT:
-		return pack.(*utp.Disconnect).ToBinary()
-	case utp.PUBLISH:
-		return pack.(*utp.Publish).ToBinary()
-	case utp.FLOWCONTROL:
-		return pack.(*utp.ControlMessage).ToBinary()
+	case utp.CONNECT, utp.PUBLISH, utp.RELAY, utp.SUBSCRIBE, utp.UNSUBSCRIBE, utp.PINGREQ, utp.DISCONNECT, utp.FLOWCONTROL:
+		return pack.ToBinary()
 	default:
 		return bytes.Buffer{}, fmt.Errorf("message::Encode: Invalid zero-length packet type %d", pack.Type())
 	}
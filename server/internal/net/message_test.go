@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package net
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+func TestReadOversizedMessage(t *testing.T) {
+	pub := &utp.Publish{MessageID: 1, Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: make([]byte, 1024)}}}
+	raw, err := pub.ToBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Read(bytes.NewReader(raw.Bytes()), 512); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+
+	msg, err := Read(bytes.NewReader(raw.Bytes()), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != utp.PUBLISH {
+		t.Fatalf("message type %d", msg.Type())
+	}
+}
+
+func TestReadMalformedLength(t *testing.T) {
+	// The continuation bit is set on every byte of the fixed header length.
+	raw := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	if _, err := Read(bytes.NewReader(raw), 1<<16); err == nil {
+		t.Fatal("expected malformed length error")
+	}
+}
+
+func TestEncodeRead(t *testing.T) {
+	props := utp.Properties{UserProperties: map[string]string{"content-type": "json"}, MessageExpiryInterval: 60, TopicAlias: 7}
+	subs := []*utp.Subscription{{DeliveryMode: 1, Delay: 5, Topic: "unit1.test"}, {DeliveryMode: 2, Topic: "unit2.test"}}
+	tests := []struct {
+		name string
+		msg  MessagePack
+	}{
+		{"connect", &utp.Connect{Version: 2, InsecureFlag: true, ClientID: "client", KeepAlive: 60, CleanSessFlag: true, SessKey: 3, Username: "user", Password: []byte("pass"), BatchDuration: 10, BatchByteThreshold: 1024, BatchCountThreshold: 8, Properties: props}},
+		{"publish", &utp.Publish{MessageID: 1, DeliveryMode: 1, Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg"), Ttl: "1h", Properties: props}, {Topic: "unit2.test", Payload: []byte("msg")}}}},
+		{"relay", &utp.Relay{MessageID: 2, RelayRequests: []*utp.RelayRequest{{Topic: "unit1.test", Last: "1h"}, {Topic: "unit2.test"}}}},
+		{"subscribe", &utp.Subscribe{MessageID: 3, Subscriptions: subs, Properties: props}},
+		{"unsubscribe", &utp.Unsubscribe{MessageID: 4, Subscriptions: subs}},
+		{"pingreq", &utp.Pingreq{}},
+		{"disconnect", &utp.Disconnect{MessageID: 5}},
+		{"connect acknowledge", &utp.ControlMessage{MessageID: 6, MessageType: utp.CONNECT, FlowControl: utp.ACKNOWLEDGE, Message: []byte("ack")}},
+		{"publish acknowledge", &utp.ControlMessage{MessageID: 7, MessageType: utp.PUBLISH, FlowControl: utp.ACKNOWLEDGE}},
+		{"relay acknowledge", &utp.ControlMessage{MessageID: 8, MessageType: utp.RELAY, FlowControl: utp.ACKNOWLEDGE}},
+		{"subscribe acknowledge", &utp.ControlMessage{MessageID: 9, MessageType: utp.SUBSCRIBE, FlowControl: utp.ACKNOWLEDGE}},
+		{"unsubscribe acknowledge", &utp.ControlMessage{MessageID: 10, MessageType: utp.UNSUBSCRIBE, FlowControl: utp.ACKNOWLEDGE}},
+		{"pingreq acknowledge", &utp.ControlMessage{MessageID: 11, MessageType: utp.PINGREQ, FlowControl: utp.ACKNOWLEDGE}},
+		{"notify", &utp.ControlMessage{MessageID: 12, MessageType: utp.PUBLISH, FlowControl: utp.NOTIFY}},
+		{"receive", &utp.ControlMessage{MessageID: 13, MessageType: utp.PUBLISH, FlowControl: utp.RECEIVE}},
+		{"receipt", &utp.ControlMessage{MessageID: 14, MessageType: utp.PUBLISH, FlowControl: utp.RECEIPT}},
+		{"complete", &utp.ControlMessage{MessageID: 15, MessageType: utp.PUBLISH, FlowControl: utp.COMPLETE}},
+	}
+	for _, tt := range tests {
+		raw, err := Encode(tt.msg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// The messages follow each other on a connection.
+		raw.Write([]byte{0xff})
+		r := bytes.NewReader(raw.Bytes())
+		got, err := Read(r, 1<<16)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.msg) {
+			t.Fatalf("%s: expected %+v; got %+v", tt.name, tt.msg, got)
+		}
+		if r.Len() != 1 {
+			t.Fatalf("%s: expected the message to be read up to its end; %d bytes left", tt.name, r.Len())
+		}
+	}
+
+	connack := &utp.ConnectAcknowledge{ReturnCode: utp.ErrNotAuthorised, Epoch: 1, ConnID: 2}
+	rawAck, err := Encode(connack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := Encode(&utp.ControlMessage{MessageType: utp.CONNECT, FlowControl: utp.ACKNOWLEDGE, Message: rawAck.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Read(bytes.NewReader(raw.Bytes()), 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadConnectAcknowledge(msg.(*utp.ControlMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, connack) {
+		t.Fatalf("expected %+v; got %+v", connack, got)
+	}
+	if _, err := ReadConnectAcknowledge(&utp.ControlMessage{MessageType: utp.PUBLISH, FlowControl: utp.ACKNOWLEDGE}); err == nil {
+		t.Fatal("expected invalid control message error")
+	}
+}
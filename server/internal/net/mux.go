@@ -0,0 +1,39 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package net
+
+import (
+	"github.com/unit-io/unitdb/server/internal/net/listener"
+)
+
+// ServeMux serves the TCP, websocket and gRPC clients on the listener, so one port serves all the
+// protocols. The protocol of a connection is detected from its first bytes: an HTTP GET is a websocket
+// upgrade, an HTTP/2 request with the gRPC content-type is a gRPC stream and any other connection
+// is a TCP connection reading UTP packets. A nil server is not served. The caller starts the
+// listener using listener.Serve.
+func ServeMux(l *listener.Listener, tcp *TcpServer, http *HttpServer, grpc *GrpcServer) {
+	// The catch all TCP server is matched last.
+	if http != nil {
+		l.ServeCallback(listener.MatchWS("GET"), http.Serve)
+	}
+	if grpc != nil {
+		l.ServeCallback(listener.MatchGRPC(), grpc.Serve)
+	}
+	if tcp != nil {
+		l.ServeCallback(listener.MatchAny(), tcp.Serve)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package net
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/unit-io/unitdb/server/internal/net/listener"
+	pbx "github.com/unit-io/unitdb/server/proto"
+	"github.com/unit-io/unitdb/server/utp"
+	"google.golang.org/grpc"
+)
+
+func TestServeMux(t *testing.T) {
+	l, err := listener.New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type dispatch struct {
+		proto string
+		msg   MessagePack
+	}
+	dispatched := make(chan dispatch, 3)
+	handler := func(proto string) Handler {
+		return func(c net.Conn) {
+			msg, err := Read(c, 1<<20)
+			if err != nil {
+				t.Error(proto, err)
+				return
+			}
+			dispatched <- dispatch{proto: proto, msg: msg}
+		}
+	}
+	tcp, http, grpcSrv := NewTcpServer(), NewHttpServer(), NewGrpcServer(WithDefaultOptions())
+	tcp.Handler, http.Handler, grpcSrv.Handler = handler("tcp"), handler("websocket"), handler("grpc")
+	ServeMux(l, tcp, http, grpcSrv)
+	go l.Serve()
+
+	addr := l.Addr().String()
+	pub := &utp.Publish{MessageID: 1, Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("mux")}}}
+	raw, err := pub.ToBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(proto string) {
+		select {
+		case d := <-dispatched:
+			if d.proto != proto {
+				t.Fatalf("expected the %s server; got the %s server", proto, d.proto)
+			}
+			if got, ok := d.msg.(*utp.Publish); !ok || string(got.Messages[0].Payload) != "mux" {
+				t.Fatalf("expected the publish on the %s server; got %v", proto, d.msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the %s server to accept the connection", proto)
+		}
+	}
+
+	// A raw UTP frame.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expect("tcp")
+
+	// An HTTP upgrade.
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, err := WebSocketConn(ws).Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expect("websocket")
+
+	// A gRPC stream.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	stream, err := pbx.NewUnitdbClient(cc).Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&pbx.Packet{Data: raw.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+	expect("grpc")
+}
+
+func TestServeMuxHandle(t *testing.T) {
+	l, err := listener.New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	httpSrv := NewHttpServer()
+	httpSrv.Handle("/admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin"))
+	}))
+	ServeMux(l, NewTcpServer(), httpSrv, nil)
+	go l.Serve()
+
+	// A plain HTTP request of a registered path is served by its handler.
+	resp, err := http.Get("http://" + l.Addr().String() + "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != "admin" {
+		t.Fatalf("expected the admin handler to serve the request; got %d %q", resp.StatusCode, b)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -29,6 +30,10 @@ import (
 
 const (
 	MaxMessageSize = 1 << 19
+
+	// defaultPublishWindow is the number of publishes awaiting the durable acknowledgement
+	// on a publish stream.
+	defaultPublishWindow = 64
 )
 
 // ErrServerClosed occurs when a tcp server is closed.
@@ -45,9 +50,21 @@ const (
 //Handler is a callback which get called when a tcp, websocket connection is established or a grpc stream is established
 type Handler func(c net.Conn)
 
+// WindowedConn is a connection that acknowledges a publish only once its messages are
+// durable. At most PublishWindow publishes are awaiting the acknowledgement, the connection
+// is not read while the window is full.
+type WindowedConn interface {
+	net.Conn
+	PublishWindow() int
+}
+
 type options struct {
 	TLSConfig *tls.Config
 	KeepAlive bool
+	// Minimum size of a websocket message to compress, 0 disables compression.
+	CompressionThreshold int
+	// Number of publishes awaiting the durable acknowledgement on a publish stream.
+	PublishWindow int
 }
 
 // Options it contains configurable options for client
@@ -74,10 +91,12 @@ func newFuncOption(f func(*options)) *fOption {
 // WithDefaultOptions will create client connection with some default values.
 //   KeepAlive: true
 //   TlsConfig: nil
+//   PublishWindow: 64
 func WithDefaultOptions() Options {
 	return newFuncOption(func(o *options) {
 		o.KeepAlive = true
 		o.TLSConfig = nil
+		o.PublishWindow = defaultPublishWindow
 	})
 }
 
@@ -89,6 +108,22 @@ func WithTLSConfig(t *tls.Config) Options {
 	})
 }
 
+// WithCompressionThreshold enables permessage-deflate compression on websocket
+// connections. Only messages of at least threshold bytes are compressed.
+func WithCompressionThreshold(threshold int) Options {
+	return newFuncOption(func(o *options) {
+		o.CompressionThreshold = threshold
+	})
+}
+
+// WithPublishWindow sets the number of publishes awaiting the durable acknowledgement
+// on a gRPC publish stream before the server stops reading the stream.
+func WithPublishWindow(window int) Options {
+	return newFuncOption(func(o *options) {
+		o.PublishWindow = window
+	})
+}
+
 type Server interface {
 	// Serve serve the requests if type tcp, websocket or grpc stream
 	Serve(net.Listener) error
@@ -98,6 +133,8 @@ type server struct {
 	sync.Mutex
 	opts    *options
 	Handler Handler //The handler to invoke when a connection is accepted
+	// The HTTP handlers served along with the websocket connections, set only for the HTTP server
+	mux *http.ServeMux
 }
 
 func signalHandler() <-chan bool {
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"errors"
+	"sync"
+)
+
+// Cipher encrypts and decrypts short messages.
+type Cipher interface {
+	Encrypt(dst, src []byte) ([]byte, error)
+	Decrypt(dst, src []byte) ([]byte, error)
+	Overhead() int
+}
+
+// TaggedCipher is a Cipher holding multiple keys. The ciphertext is tagged with
+// the identifier of the key used to encrypt it, so decryption looks up the right key.
+type TaggedCipher interface {
+	Cipher
+	EncryptWithID(dst, src []byte) (string, []byte, error)
+	DecryptWithID(id string, dst, src []byte) ([]byte, error)
+}
+
+// errNoKeys is returned on an encryption with a keyring that holds no keys.
+var errNoKeys = errors.New("keyring: no keys")
+
+type keyringEntry struct {
+	timestamp uint32
+	mac       *MAC
+}
+
+// Keyring holds the MACs of all the encryption keys in use by their identifier. New
+// encryptions use the key with the latest timestamp, older keys are kept to decrypt
+// existing data.
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]keyringEntry
+	latest string
+}
+
+// NewKeyring creates an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]keyringEntry)}
+}
+
+// Add adds a key to the keyring. A key with the same identifier is replaced.
+func (k *Keyring) Add(id string, key []byte, timestamp uint32) error {
+	mac, err := New(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = keyringEntry{timestamp: timestamp, mac: mac}
+	if latest, ok := k.keys[k.latest]; !ok || k.latest == id || latest.timestamp <= timestamp {
+		k.latest = id
+	}
+	return nil
+}
+
+// Latest returns the identifier of the key used for new encryptions.
+func (k *Keyring) Latest() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.latest
+}
+
+// Len returns the number of keys in the keyring.
+func (k *Keyring) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys)
+}
+
+// Overhead returns the maximum difference between the lengths of a
+// plaintext and its ciphertext.
+func (k *Keyring) Overhead() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if e, ok := k.keys[k.latest]; ok {
+		return e.mac.Overhead()
+	}
+	return 0
+}
+
+// Encrypt encrypts src using the latest key and appends to dst, returning the
+// resulting byte slice. It returns an error if the keyring holds no keys.
+func (k *Keyring) Encrypt(dst, src []byte) ([]byte, error) {
+	_, dst, err := k.EncryptWithID(dst, src)
+	return dst, err
+}
+
+// EncryptWithID encrypts src using the latest key and appends to dst, returning the
+// identifier of the key and the resulting byte slice. It returns an error if the
+// keyring holds no keys.
+func (k *Keyring) EncryptWithID(dst, src []byte) (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	e, ok := k.keys[k.latest]
+	if !ok {
+		return "", dst, errNoKeys
+	}
+	dst, err := e.mac.Encrypt(dst, src)
+	return k.latest, dst, err
+}
+
+// Decrypt decrypts src using the first key in the keyring which authenticates
+// the input, starting with the latest key.
+func (k *Keyring) Decrypt(dst, src []byte) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if e, ok := k.keys[k.latest]; ok {
+		if out, err := e.mac.Decrypt(dst, src); err == nil {
+			return out, nil
+		}
+	}
+	for id, e := range k.keys {
+		if id == k.latest {
+			continue
+		}
+		if out, err := e.mac.Decrypt(dst, src); err == nil {
+			return out, nil
+		}
+	}
+	return dst, errors.New("Authentication failed.")
+}
+
+// DecryptWithID decrypts src using the key with the given identifier. If the
+// identifier is not known, every key in the keyring is tried.
+func (k *Keyring) DecryptWithID(id string, dst, src []byte) ([]byte, error) {
+	k.mu.RLock()
+	e, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return k.Decrypt(dst, src)
+	}
+	return e.mac.Decrypt(dst, src)
+}
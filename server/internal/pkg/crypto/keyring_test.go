@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	keyA = []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
+	keyB = []byte("mex8oBSd59m6I4BWm1vZletvrCDGWsF6")
+	msg  = []byte("0123456789ab")
+)
+
+func TestKeyringRollover(t *testing.T) {
+	k := NewKeyring()
+	// An empty keyring has no key to encrypt with.
+	if _, err := k.Encrypt(nil, msg); err != errNoKeys {
+		t.Fatalf("expected %v, got %v", errNoKeys, err)
+	}
+	if _, _, err := k.EncryptWithID(nil, msg); err != errNoKeys {
+		t.Fatalf("expected %v, got %v", errNoKeys, err)
+	}
+
+	if err := k.Add("a", keyA, 1); err != nil {
+		t.Fatal(err)
+	}
+	encA, err := k.Encrypt(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Roll over to the newer key.
+	if err := k.Add("b", keyB, 2); err != nil {
+		t.Fatal(err)
+	}
+	encB, err := k.Encrypt(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	macB, _ := New(keyB)
+	if _, err := macB.Decrypt(nil, append([]byte{}, encB...)); err != nil {
+		t.Fatal("new encryptions must use the latest key")
+	}
+
+	for _, enc := range [][]byte{encA, encB} {
+		dec, err := k.Decrypt(nil, append([]byte{}, enc...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Fatalf("decrypted %q, expected %q", dec, msg)
+		}
+	}
+}
+
+func TestKeyringIdentifier(t *testing.T) {
+	k := NewKeyring()
+	// Keys are added out of order, the latest timestamp wins.
+	if err := k.Add("b", keyB, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Add("a", keyA, 1); err != nil {
+		t.Fatal(err)
+	}
+	if k.Latest() != "b" {
+		t.Fatalf("latest key %s", k.Latest())
+	}
+
+	macA, _ := New(keyA)
+	encA, err := macA.Encrypt(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, encB, err := k.EncryptWithID(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "b" {
+		t.Fatalf("encrypted with key %s", id)
+	}
+
+	for id, enc := range map[string][]byte{"a": encA, "b": encB} {
+		dec, err := k.DecryptWithID(id, nil, append([]byte{}, enc...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Fatalf("decrypted %q, expected %q", dec, msg)
+		}
+	}
+
+	if _, err := k.DecryptWithID("b", nil, append([]byte{}, encA...)); err == nil {
+		t.Fatal("decrypted with the wrong key")
+	}
+}
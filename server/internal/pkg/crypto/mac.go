@@ -75,14 +75,17 @@ func Signature(value uint32) []byte {
 }
 
 // Encrypt encrypts src and appends to dst, returning the
-// resulting byte slice
-func (m *MAC) Encrypt(dst, src []byte) []byte {
+// resulting byte slice or an error if src is shorter than the epoch.
+func (m *MAC) Encrypt(dst, src []byte) ([]byte, error) {
+	if len(src) < EpochSize {
+		return dst, errors.New("Message is too short.")
+	}
 	//Copy first 4 bytes epoch from source
 	dst = append(dst, src[:EpochSize]...)
 	h := hash.New(src)
 	dst = append(dst, Signature(h)...)
 	nonce := append(m.salt, dst[:MessageOffset]...)
-	return m.parent.Seal(dst, nonce, src[EpochSize:], nil)
+	return m.parent.Seal(dst, nonce, src[EpochSize:], nil), nil
 }
 
 // Decrypt decrypts src and appends to dst, returning the
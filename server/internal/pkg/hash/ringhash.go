@@ -59,22 +59,42 @@ type Ring struct {
 }
 
 // New initializes an empty ringhash with the given number of replicas and a hash function.
-// If the hash function is nil, fnv.New32a() is used.
+// If the hash function is nil, fnv.New32a() is used. It panics if the hash function is not
+// deterministic, as the nodes of a ring must hash the keys the same way.
 func NewRing(replicas int, fn Hash) *Ring {
 	ring := &Ring{
 		replicas: replicas,
 		hashfunc: fn,
 	}
 	if ring.hashfunc == nil {
-		ring.hashfunc = func(data []byte) uint32 {
-			hash := fnv.New32a()
-			hash.Write(data)
-			return hash.Sum32()
+		ring.hashfunc = fnvHash
+	}
+	for _, key := range []string{"", "0", "ring"} {
+		if ring.hashfunc([]byte(key)) != ring.hashfunc([]byte(key)) {
+			panic("ringhash: hash function is not deterministic")
 		}
 	}
 	return ring
 }
 
+func fnvHash(data []byte) uint32 {
+	hash := fnv.New32a()
+	hash.Write(data)
+	return hash.Sum32()
+}
+
+// MixHash is fnv.New32a() followed by the murmur3 finalizer. Keys differing only in their
+// last bytes, such as sequential contract IDs, are spread evenly across the ring.
+func MixHash(data []byte) uint32 {
+	h := fnvHash(data)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
 // Len returns the number of keys in the ring.
 func (ring *Ring) Len() int {
 	return len(ring.keys)
@@ -83,12 +103,47 @@ func (ring *Ring) Len() int {
 // Add adds keys to the ring.
 func (ring *Ring) Add(keys ...string) {
 	for _, key := range keys {
-		for i := 0; i < ring.replicas; i++ {
-			ring.keys = append(ring.keys, elem{
-				hash: ring.hashfunc([]byte(strconv.Itoa(i) + key)),
-				key:  key})
-		}
+		ring.addReplicas(key, 1)
+	}
+	ring.sort()
+}
+
+// AddWeighted adds a key to the ring with the number of replicas scaled by weight,
+// so a key with a higher weight owns proportionally more of the ring.
+// A weight less than 1 is treated as 1.
+func (ring *Ring) AddWeighted(key string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	ring.addReplicas(key, weight)
+	ring.sort()
+}
+
+// AddWeightedAs adds the replicas of a key to the ring but maps them to owner, so owner takes
+// over the part of the ring the key would own while the rest of the ring is left as is.
+// A weight less than 1 is treated as 1.
+func (ring *Ring) AddWeightedAs(key, owner string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	ring.addReplicasAs(key, owner, weight)
+	ring.sort()
+}
+
+func (ring *Ring) addReplicas(key string, weight int) {
+	ring.addReplicasAs(key, key, weight)
+}
+
+func (ring *Ring) addReplicasAs(key, owner string, weight int) {
+	for i := 0; i < ring.replicas*weight; i++ {
+		ring.keys = append(ring.keys, elem{
+			hash: ring.hashfunc([]byte(strconv.Itoa(i) + key)),
+			key:  owner})
 	}
+}
+
+// sort sorts the keys and calculates the signature of the ring.
+func (ring *Ring) sort() {
 	sort.Sort(sortable(ring.keys))
 
 	// Calculate signature
@@ -133,6 +188,34 @@ func (ring *Ring) Get(key string) string {
 	return ring.keys[idx].key
 }
 
+// GetN returns up to n distinct items in the ring closest to the provided key,
+// starting with the item returned by Get and continuing clockwise around the ring.
+func (ring *Ring) GetN(key string, n int) []string {
+	if ring.Len() == 0 || n <= 0 {
+		return nil
+	}
+
+	hash := ring.hashfunc([]byte(key))
+
+	idx := sort.Search(len(ring.keys), func(i int) bool {
+		el := ring.keys[i]
+		return (el.hash > hash) || (el.hash == hash && el.key >= key)
+	})
+
+	var items []string
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(ring.keys) && len(items) < n; i++ {
+		el := ring.keys[(idx+i)%len(ring.keys)]
+		if seen[el.key] {
+			continue
+		}
+		seen[el.key] = true
+		items = append(items, el.key)
+	}
+
+	return items
+}
+
 // Signature returns the ring's hash signature. Two identical ringhashes
 // will have the same signature. Two hashes with different
 // number of keys or replicas or hash functions will have different
@@ -143,6 +226,6 @@ func (ring *Ring) Signature() string {
 
 func (ring *Ring) dump() {
 	for _, e := range ring.keys {
-		log.Println("key %s hash %d", e.key, e.hash)
+		log.Printf("key %s hash %d", e.key, e.hash)
 	}
 }
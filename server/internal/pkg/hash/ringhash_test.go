@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hash
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestWeightedRing(t *testing.T) {
+	ring := NewRing(100, nil)
+	ring.AddWeighted("light", 1)
+	ring.AddWeighted("heavy", 3)
+
+	const count = 100000
+	owned := make(map[string]int)
+	for i := 0; i < count; i++ {
+		owned[ring.Get(strconv.Itoa(i))]++
+	}
+
+	ratio := float64(owned["heavy"]) / float64(owned["light"])
+	if ratio < 2 || ratio > 4 {
+		t.Fatalf("heavy/light ratio = %v, owned = %v", ratio, owned)
+	}
+}
+
+func TestRingSignature(t *testing.T) {
+	a := NewRing(20, nil)
+	a.AddWeighted("one", 1)
+	a.AddWeighted("two", 2)
+
+	b := NewRing(20, nil)
+	b.AddWeighted("two", 2)
+	b.AddWeighted("one", 1)
+
+	if a.Signature() != b.Signature() {
+		t.Fatalf("signature mismatch %s != %s", a.Signature(), b.Signature())
+	}
+
+	c := NewRing(20, nil)
+	c.Add("one", "two")
+	if a.Signature() == c.Signature() {
+		t.Fatal("weighted and unweighted rings have the same signature")
+	}
+}
+
+func TestRingGetN(t *testing.T) {
+	ring := NewRing(20, nil)
+	ring.Add("a", "b", "c")
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		items := ring.GetN(key, 2)
+		if len(items) != 2 {
+			t.Fatalf("GetN(%s, 2) = %v", key, items)
+		}
+		if items[0] != ring.Get(key) {
+			t.Fatalf("GetN(%s) primary %s, Get %s", key, items[0], ring.Get(key))
+		}
+		if items[0] == items[1] {
+			t.Fatalf("GetN(%s) returned duplicate items %v", key, items)
+		}
+	}
+
+	if items := ring.GetN("key", 5); len(items) != 3 {
+		t.Fatalf("GetN(key, 5) = %v", items)
+	}
+}
+
+func TestRingCustomHash(t *testing.T) {
+	// Contract IDs differ only in their last digits.
+	const count = 10000
+	spread := func(fn Hash) float64 {
+		ring := NewRing(20, fn)
+		ring.Add("a", "b", "c")
+		owned := make(map[string]int)
+		for i := 0; i < count; i++ {
+			owned[ring.Get(strconv.Itoa(3376684800+i))]++
+		}
+		min, max := count, 0
+		for _, key := range []string{"a", "b", "c"} {
+			if owned[key] < min {
+				min = owned[key]
+			}
+			if owned[key] > max {
+				max = owned[key]
+			}
+		}
+		if min == 0 {
+			return count
+		}
+		return float64(max) / float64(min)
+	}
+
+	def, mix := spread(nil), spread(MixHash)
+	if mix > 1.5 || mix >= def {
+		t.Fatalf("max/min owned ratio default = %v, mix = %v", def, mix)
+	}
+
+	// Rings with the same hash function are the same.
+	a, b := NewRing(20, MixHash), NewRing(20, MixHash)
+	a.Add("a", "b", "c")
+	b.Add("c", "b", "a")
+	if a.Signature() != b.Signature() {
+		t.Fatal("expected same signature for the same hash function")
+	}
+	c := NewRing(20, nil)
+	c.Add("a", "b", "c")
+	if a.Signature() == c.Signature() {
+		t.Fatal("expected different signatures for different hash functions")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for a hash function that is not deterministic")
+		}
+	}()
+	var n uint32
+	NewRing(20, func(data []byte) uint32 {
+		n++
+		return n
+	})
+}
@@ -17,8 +17,10 @@
 package uid
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 
 	"github.com/unit-io/unitdb/server/internal/pkg/crypto"
@@ -34,6 +36,8 @@ const (
 
 	encodedLen = 13 // string encoded len
 	rawLen     = 12 // binary raw len
+
+	keyTagSeparator = '.' // separates the encoded ID from the identifier of the encryption key
 )
 
 // IsPrimary gets whether the ID is a primary client Id.
@@ -89,7 +93,10 @@ func (id ID) SetContract(value uint32) {
 	id[11] = byte(value)
 }
 
-func (id ID) Encode(mac *crypto.MAC) string {
+// Encode encrypts and encodes the ID. If the cipher holds multiple keys the encoded
+// ID is tagged with the identifier of the key used. It returns an error if the ID
+// cannot be encrypted.
+func (id ID) Encode(mac crypto.Cipher) (string, error) {
 	buffer := make([]byte, rawLen)
 	buffer[0] = id[0]
 	buffer[1] = id[1]
@@ -101,13 +108,31 @@ func (id ID) Encode(mac *crypto.MAC) string {
 	}
 
 	// Encryption.
-	ciphertext := mac.Encrypt(nil, buffer)
+	var keyID string
+	var ciphertext []byte
+	var err error
+	if tc, ok := mac.(crypto.TaggedCipher); ok {
+		keyID, ciphertext, err = tc.EncryptWithID(nil, buffer)
+	} else {
+		ciphertext, err = mac.Encrypt(nil, buffer)
+	}
+	if err != nil {
+		return "", err
+	}
 	text := make([]byte, 52)
 	encoding.Encode32(text, ciphertext[:])
-	return string(text)
+	if keyID != "" {
+		text = append(append(text, keyTagSeparator), keyID...)
+	}
+	return string(text), nil
 }
 
-func Decode(buffer []byte, mac *crypto.MAC) (ID, error) {
+func Decode(buffer []byte, mac crypto.Cipher) (ID, error) {
+	var keyID string
+	if i := bytes.IndexByte(buffer, keyTagSeparator); i >= 0 {
+		keyID = string(buffer[i+1:])
+		buffer = buffer[:i]
+	}
 	if len(buffer) < 52 {
 		return nil, errors.New("Key provided is invalid")
 	}
@@ -116,7 +141,13 @@ func Decode(buffer []byte, mac *crypto.MAC) (ID, error) {
 	// on memory allocations.
 	encoding.Decode32(buffer, buffer)
 	// Decryption.
-	key, err := mac.Decrypt(nil, buffer[:32])
+	var key []byte
+	var err error
+	if tc, ok := mac.(crypto.TaggedCipher); ok {
+		key, err = tc.DecryptWithID(keyID, nil, buffer[:32])
+	} else {
+		key, err = mac.Decrypt(nil, buffer[:32])
+	}
 	if err != nil {
 		return nil, errors.New("Key provided is invalid")
 	}
@@ -134,6 +165,16 @@ func Decode(buffer []byte, mac *crypto.MAC) (ID, error) {
 	return ID(buffer), nil
 }
 
+// Identity returns the identity of the encoded client ID: the decoded ID, whichever key the ID is
+// encrypted with and however it is tagged. It returns false if the client ID does not decode.
+func Identity(clientID string, mac crypto.Cipher) (string, bool) {
+	id, err := Decode([]byte(clientID), mac)
+	if err != nil {
+		return "", false
+	}
+	return hex.EncodeToString(id), true
+}
+
 // NewClientID generates a new primary client Id.
 func NewClientID(master uint16) (ID, error) {
 	raw := make([]byte, 4)
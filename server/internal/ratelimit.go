@@ -0,0 +1,79 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/server/internal/config"
+)
+
+// _TokenBucket holds the tokens available to a contract and the time it was last refilled.
+type _TokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// _RateLimiter is a token bucket rate limiter keyed by contract.
+type _RateLimiter struct {
+	sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64 // maximum tokens of a bucket
+	buckets map[uint32]*_TokenBucket
+}
+
+// newRateLimiter creates a rate limiter from the configuration. It returns nil if publishes are not limited.
+func newRateLimiter(cfg *config.RateLimitConfig) *_RateLimiter {
+	if cfg == nil || cfg.Rate <= 0 {
+		return nil
+	}
+	burst := float64(cfg.Burst)
+	if burst < 1 {
+		burst = math.Max(cfg.Rate, 1)
+	}
+	return &_RateLimiter{
+		rate:    cfg.Rate,
+		burst:   burst,
+		buckets: make(map[uint32]*_TokenBucket),
+	}
+}
+
+// allow takes n tokens from the bucket of the contract. It returns false, taking no tokens,
+// if the bucket does not have n tokens.
+func (l *_RateLimiter) allow(contract uint32, n int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[contract]
+	if !ok {
+		b = &_TokenBucket{tokens: l.burst, last: now}
+		l.buckets[contract] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/unit-io/unitdb/server/internal/config"
+	"github.com/unit-io/unitdb/server/internal/message"
+	"github.com/unit-io/unitdb/server/internal/pkg/stats"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+	"github.com/unit-io/unitdb/server/internal/store"
+	"github.com/unit-io/unitdb/server/internal/types"
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+func TestRateLimit(t *testing.T) {
+	l := newRateLimiter(&config.RateLimitConfig{Rate: 10, Burst: 5})
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if !l.allow(1, 1, now) {
+			t.Fatalf("publish %d is throttled within the burst", i)
+		}
+	}
+	if l.allow(1, 1, now) {
+		t.Fatal("publish is not throttled after the burst")
+	}
+	if !l.allow(2, 1, now) {
+		t.Fatal("publish of another contract is throttled")
+	}
+	// 10 tokens per second refills a token in 100ms.
+	if !l.allow(1, 1, now.Add(100*time.Millisecond)) {
+		t.Fatal("publish is throttled after the bucket is refilled")
+	}
+	if !newRateLimiter(nil).allow(1, 100, now) {
+		t.Fatal("publish is throttled without a rate limit")
+	}
+}
+
+func TestRateLimitPublish(t *testing.T) {
+	s := &_Service{meter: NewMeter(), limiter: newRateLimiter(&config.RateLimitConfig{Rate: 1, Burst: 2})}
+	defer s.meter.UnregisterAll()
+	c := &_Conn{service: s, clientID: uid.ID("clientid0001")}
+	pub := utp.Publish{Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg")}, {Topic: "unit1.test", Payload: []byte("msg")}}}
+	if err := c.rateLimit(pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rateLimit(pub); err != types.ErrRateLimited {
+		t.Fatalf("expected %v, got %v", types.ErrRateLimited, err)
+	}
+	if n := s.meter.ThrottledMsgs.Count(); n != 2 {
+		t.Fatalf("expected 2 throttled messages, got %d", n)
+	}
+	pub.IsForwarded = true
+	if err := c.rateLimit(pub); err != nil {
+		t.Fatalf("forwarded publish is throttled: %v", err)
+	}
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := store.Open(dir, `{"adapters": {"unitdb": {"mem_size": 1048576}}}`, true); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	connCache := Globals.connCache
+	Globals.connCache = NewConnCache()
+	defer func() {
+		Globals.connCache = connCache
+	}()
+
+	s := &_Service{meter: NewMeter(), stats: stats.New(&stats.Config{Addr: "localhost:8094"}),
+		limiter: newRateLimiter(&config.RateLimitConfig{Rate: 1, Burst: 1})}
+	defer s.meter.UnregisterAll()
+	defer s.stats.Unregister()
+	c := &_Conn{service: s, connID: uid.LID(1), clientID: uid.ID("clientid0001"), MessageIds: message.NewMessageIds(),
+		pub: make(chan *utp.Publish, 1), window: make(chan struct{}, 1), inflight: Globals.connCache.getInflight(uid.LID(1))}
+	pub := utp.Publish{MessageID: 1, DeliveryMode: 1, Messages: []*utp.PublishMessage{{Topic: "unit1.test", Payload: []byte("msg")}}}
+	if err := c.rateLimit(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	// The throttled publish is rejected before it is taken in flight, so its retry is not a duplicate.
+	if err := c.handler(&pub); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.inflight.len(); n != 0 {
+		t.Fatalf("expected throttled publish not in flight; got %d messages", n)
+	}
+	if msg := <-c.pub; msg.Messages[0].Topic != "unitdb/error/" {
+		t.Fatalf("expected error notified for the throttled publish; got %+v", msg.Messages[0])
+	}
+}
@@ -18,7 +18,10 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -27,6 +30,7 @@ import (
 	"time"
 
 	"github.com/unit-io/unitdb/server/internal/config"
+	"github.com/unit-io/unitdb/server/internal/message/security"
 	lp "github.com/unit-io/unitdb/server/internal/net"
 	"github.com/unit-io/unitdb/server/internal/net/listener"
 	"github.com/unit-io/unitdb/server/internal/pkg/crypto"
@@ -39,10 +43,17 @@ import (
 	"github.com/unit-io/unitdb/server/internal/store"
 )
 
+const (
+	// Default time to wait for the next message from a client
+	defaultReadTimeout = 120 * time.Second
+	// Default time to wait for a write to a client to complete
+	defaultWriteTimeout = 120 * time.Second
+)
+
 // _Service is a main struct
 type _Service struct {
 	pid     uint32             // The processid is unique Id for the application
-	mac     *crypto.MAC        // The MAC to use for decoding and encoding keys.
+	mac     *crypto.Keyring    // The MACs to use for decoding and encoding keys.
 	cache   *sync.Map          // The cache for the contracts.
 	context context.Context    // context for the service
 	config  *config.Config     // The configuration for the service.
@@ -52,6 +63,8 @@ type _Service struct {
 	tcp     *lp.TcpServer      // The underlying TCP server.
 	grpc    *lp.GrpcServer     // The underlying GRPC server.
 	meter   *Meter             // The metircs to measure timeseries on message events
+	limiter *_RateLimiter      // The publish rate limiter of the contracts.
+	acl     *security.ACL      // The topic ACL of the clients.
 	stats   *stats.Stats
 }
 
@@ -59,17 +72,19 @@ func NewService(cfg *config.Config) (s *_Service, err error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	s = &_Service{
 		pid:     uid.NewUnique(),
+		mac:     crypto.NewKeyring(),
 		cache:   new(sync.Map),
 		context: ctx,
 		config:  cfg,
 		cancel:  cancel,
 		start:   time.Now(),
 		// subscriptions: message.NewSubscriptions(),
-		http:  lp.NewHttpServer(),
-		tcp:   lp.NewTcpServer(),
-		grpc:  lp.NewGrpcServer(lp.WithDefaultOptions()),
-		meter: NewMeter(),
-		stats: stats.New(&stats.Config{Addr: "localhost:8094", Size: 50}, stats.MaxPacketSize(1400), stats.MetricPrefix("trace")),
+		http:    lp.NewHttpServer(lp.WithCompressionThreshold(cfg.WSCompressionThreshold)),
+		tcp:     lp.NewTcpServer(),
+		grpc:    lp.NewGrpcServer(lp.WithDefaultOptions()),
+		meter:   NewMeter(),
+		limiter: newRateLimiter(cfg.RateLimit),
+		stats:   stats.New(&stats.Config{Addr: "localhost:8094", Size: 50}, stats.MaxPacketSize(1400), stats.MetricPrefix("trace")),
 	}
 
 	Globals.connCache = NewConnCache()
@@ -80,13 +95,37 @@ func NewService(cfg *config.Config) (s *_Service, err error) {
 	// 	log.Info("service", "Stats variables exposed at "+cfg.VarzPath)
 	// }
 
+	// Admin handlers
+	s.http.Handle("/ownership", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Globals.Cluster.HandleOwnership(w, r)
+	}))
+	s.http.Handle("/subscribers", http.HandlerFunc(s.HandleSubscribers))
+	s.http.Handle("/healthz", store.HealthzHandler())
+
 	//attach handlers
 	s.grpc.Handler = s.onAcceptConn
 	s.http.Handler = s.onAcceptConn
 	s.tcp.Handler = s.onAcceptConn
 
-	// Create a new MAC from the key.
-	if s.mac, err = crypto.New([]byte(s.config.Encryption(s.config.EncryptionConfig).Key)); err != nil {
+	warnings, err := s.bufferSizes().Validate()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		log.Info("service", w)
+	}
+
+	// Create a new MAC from each key.
+	if err = s.addKeys(s.config.Encryption(s.config.EncryptionConfig)); err != nil {
+		return nil, err
+	}
+
+	// The client IDs of the ACL rules are decoded with the keys.
+	aclConfig, err := s.parseACLConfig(cfg.ACLConfig)
+	if err != nil {
+		return nil, err
+	}
+	if s.acl, err = security.NewACL(aclConfig); err != nil {
 		return nil, err
 	}
 
@@ -99,6 +138,42 @@ func NewService(cfg *config.Config) (s *_Service, err error) {
 	return s, nil
 }
 
+var errSealedKey = errors.New("service: sealed encryption key")
+
+// addKeys adds the keys from the encryption config to the keyring. No key is added if
+// a key is sealed.
+func (s *_Service) addKeys(encr config.EncryptionConfig) error {
+	keys := encr.AllKeys()
+	for _, key := range keys {
+		if key.Sealed {
+			return errSealedKey
+		}
+	}
+	for _, key := range keys {
+		if err := s.mac.Add(key.Identifier, []byte(key.Key), key.Timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReloadEncryption adds the keys from the encryption config to the running service.
+// The keys loaded earlier are kept to decrypt the existing client Ids, and the
+// key with the latest timestamp is used for the new ones.
+func (s *_Service) ReloadEncryption(encrConfig json.RawMessage) error {
+	var encr config.EncryptionConfig
+	if err := json.Unmarshal(encrConfig, &encr); err != nil {
+		return err
+	}
+	if err := s.addKeys(encr); err != nil {
+		return err
+	}
+	for _, key := range encr.AllKeys() {
+		log.Info("service.ReloadEncryption", "encryption key added "+key.Identifier)
+	}
+	return nil
+}
+
 // netListener creates net.Listener for tcp and unix domains:
 // if addr is is in the form "unix:/run/tinode.sock" it's a unix socket, otherwise TCP host:port.
 func netListener(addr string) (net.Listener, error) {
@@ -130,22 +205,93 @@ func (s *_Service) listen(addr string) {
 		panic(err)
 	}
 
-	l.SetReadTimeout(120 * time.Second)
+	l.SetReadTimeout(s.readTimeout())
+	l.SetBufferSizes(s.bufferSizes())
 
-	// Configure the protos
+	// Configure the protos, the gRPC clients are served on the main listener unless gRPC has its own.
 	if s.config.GrpcListen != "" {
 		grpcList, err := netListener(s.config.GrpcListen)
 		if err != nil {
 			return
 		}
 		s.grpc.Serve(grpcList)
+		lp.ServeMux(l, s.tcp, s.http, nil)
+	} else {
+		lp.ServeMux(l, s.tcp, s.http, s.grpc)
 	}
-	l.ServeCallback(listener.MatchWS("GET"), s.http.Serve)
-	l.ServeCallback(listener.MatchAny(), s.tcp.Serve)
 
 	go l.Serve()
 }
 
+// readTimeout returns the time to wait for the next message from a client.
+func (s *_Service) readTimeout() time.Duration {
+	if s.config == nil || s.config.ReadTimeout <= 0 {
+		return defaultReadTimeout
+	}
+	return time.Duration(s.config.ReadTimeout) * time.Millisecond
+}
+
+// bufferSizes returns the socket buffer sizes of the client connections.
+func (s *_Service) bufferSizes() listener.BufferSizes {
+	if s.config == nil {
+		return listener.BufferSizes{}
+	}
+	return listener.BufferSizes{Read: s.config.ReadBufferSize, Write: s.config.WriteBufferSize}
+}
+
+// writeTimeout returns the time to wait for a write to a client to complete.
+func (s *_Service) writeTimeout() time.Duration {
+	if s.config == nil || s.config.WriteTimeout <= 0 {
+		return defaultWriteTimeout
+	}
+	return time.Duration(s.config.WriteTimeout) * time.Millisecond
+}
+
+// parseACLConfig parses the topic ACL policy. All access is allowed if the policy is not set.
+// parseACLConfig parses the topic ACL policy. The client IDs of the rules are replaced with their
+// identities, so a rule matches the client whichever key its ID is tagged with.
+func (s *_Service) parseACLConfig(aclConfig json.RawMessage) (security.ACLConfig, error) {
+	var cfg security.ACLConfig
+	if len(aclConfig) == 0 {
+		return cfg, nil
+	}
+	if err := json.Unmarshal(aclConfig, &cfg); err != nil {
+		return cfg, err
+	}
+	for i, r := range cfg.Rules {
+		if r.ClientID != security.ACLAnyClient {
+			cfg.Rules[i].ClientID = s.aclIdentity(r.ClientID)
+		}
+	}
+	return cfg, nil
+}
+
+// aclIdentity returns the client ID matched by the topic ACL: the identity of the client ID, or the
+// client ID as is if it does not decode.
+func (s *_Service) aclIdentity(clientID string) string {
+	if s.mac == nil {
+		return clientID
+	}
+	if id, ok := uid.Identity(clientID, s.mac); ok {
+		return id
+	}
+	return clientID
+}
+
+// ReloadACL replaces the topic ACL policy of the running service. The connected clients are
+// checked against the new policy on their next subscribe or publish.
+func (s *_Service) ReloadACL(aclConfig json.RawMessage) error {
+	cfg, err := s.parseACLConfig(aclConfig)
+	if err != nil {
+		return err
+	}
+	if err := s.acl.Load(cfg); err != nil {
+		return err
+	}
+	log.Info("service.ReloadACL", "topic ACL reloaded")
+	return nil
+}
+
 // Handle a new connection request
 func (s *_Service) onAcceptConn(t net.Conn) {
 	conn := s.newConn(t)
@@ -184,8 +330,9 @@ func (s *_Service) Close() {
 	s.meter.UnregisterAll()
 	s.stats.Unregister()
 
-	store.Close()
+	// Shutdown local cluster node, if it's a part of a cluster. The queued messages are
+	// delivered before the store is closed.
+	Globals.Cluster.DrainAndClose(defaultClusterDrainTimeout)
 
-	// Shutdown local cluster node, if it's a part of a cluster.
-	Globals.Cluster.shutdown()
+	store.Close()
 }
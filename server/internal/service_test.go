@@ -0,0 +1,61 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/unit-io/unitdb/server/internal/pkg/crypto"
+	"github.com/unit-io/unitdb/server/internal/pkg/uid"
+)
+
+func TestReloadEncryptionKeys(t *testing.T) {
+	s := &_Service{mac: crypto.NewKeyring()}
+	// A sealed key in the list is rejected and no key is added.
+	sealed := `{"key": "4BWm1vZletvrCDGWsF6mex8oBSd59m6I", "identifier": "a", "timestamp": 1, "keys": [{"key": "mex8oBSd59m6I4BWm1vZletvrCDGWsF6", "identifier": "b", "sealed": true}]}`
+	if err := s.ReloadEncryption([]byte(sealed)); err != errSealedKey {
+		t.Fatalf("expected %v, got %v", errSealedKey, err)
+	}
+	if s.mac.Len() != 0 {
+		t.Fatalf("expected no keys added; got %d", s.mac.Len())
+	}
+
+	old := crypto.NewKeyring()
+	if err := old.Add("a", []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I"), 1); err != nil {
+		t.Fatal(err)
+	}
+	id, err := uid.NewClientID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := id.Encode(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listed keys are all added and the latest is used for new client Ids.
+	keys := `{"keys": [{"key": "mex8oBSd59m6I4BWm1vZletvrCDGWsF6", "identifier": "b", "timestamp": 2}, {"key": "4BWm1vZletvrCDGWsF6mex8oBSd59m6I", "identifier": "a", "timestamp": 1}]}`
+	if err := s.ReloadEncryption([]byte(keys)); err != nil {
+		t.Fatal(err)
+	}
+	if s.mac.Len() != 2 || s.mac.Latest() != "b" {
+		t.Fatalf("expected 2 keys with latest key b; got %d keys with latest key %s", s.mac.Len(), s.mac.Latest())
+	}
+	if _, err := uid.Decode([]byte(encoded), s.mac); err != nil {
+		t.Fatalf("expected client Id encoded with an older key decoded; got %v", err)
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"net/http"
 
+	"github.com/unit-io/unitdb/server/internal/config"
 	adapter "github.com/unit-io/unitdb/server/internal/db"
 	"github.com/unit-io/unitdb/server/internal/message"
 	lp "github.com/unit-io/unitdb/server/internal/net"
@@ -92,6 +94,18 @@ func IsOpen() bool {
 	return false
 }
 
+// HealthzHandler returns a http.Handler for load balancer health checks of the persistent storage.
+// It responds with the status 503 if the storage is not open or is unhealthy.
+func HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsOpen() {
+			http.Error(w, "store is not open", http.StatusServiceUnavailable)
+			return
+		}
+		adp.HealthzHandler().ServeHTTP(w, r)
+	})
+}
+
 // GetAdapterName returns the name of the current adater.
 func GetAdapterName() string {
 	if adp != nil {
@@ -157,6 +171,10 @@ func (s *SubscriptionStore) Delete(contract uint32, messageId, topic []byte) err
 	return adp.Delete(contract^connStoreId, messageId, topic)
 }
 
+func (s *SubscriptionStore) Topics(contract uint32, topic []byte) ([]string, error) {
+	return adp.Topics(contract^connStoreId, topic)
+}
+
 // MessageStore is a Message struct to hold methods for persistence mapping for the Message object.
 type MessageStore struct{}
 
@@ -167,6 +185,11 @@ func (m *MessageStore) Put(contract uint32, topic, payload []byte, ttl string) e
 	return adp.Put(contract, topic, payload, ttl)
 }
 
+// PutWithAck stores the message and returns a channel that receives nil once the message is durable.
+func (m *MessageStore) PutWithAck(contract uint32, topic, payload []byte, ttl string) <-chan error {
+	return adp.PutWithAck(contract, topic, payload, ttl)
+}
+
 func (m *MessageStore) Get(contract uint32, topic []byte, last string) (matches []*message.Message, err error) {
 	resp, err := adp.Get(contract, topic, last)
 	for _, payload := range resp {
@@ -180,6 +203,10 @@ func (m *MessageStore) Get(contract uint32, topic []byte, last string) (matches
 	return matches, err
 }
 
+func (m *MessageStore) Topics(contract uint32, topic []byte) ([]string, error) {
+	return adp.Topics(contract, topic)
+}
+
 // SessionStore is a Session struct to hold methods for persistence mapping for the Session object.
 type SessionStore struct{}
 
@@ -249,7 +276,7 @@ func (l *MessageLog) PersistInbound(blockID uint32, inMsg lp.MessagePack) {
 func (l *MessageLog) Get(key uint64) lp.MessagePack {
 	if raw, err := adp.GetMessage(key); raw != nil && err == nil {
 		r := bytes.NewReader(raw)
-		if msg, err := lp.Read(r); err == nil {
+		if msg, err := lp.Read(r, config.MaxMessageSize); err == nil {
 			return msg
 		}
 	}
@@ -268,6 +295,14 @@ func (l *MessageLog) Keys(prefix uint32) []uint64 {
 	return matches
 }
 
+// Size returns the number of messages in the message log.
+func (l *MessageLog) Size() int64 {
+	if adp == nil || !adp.IsOpen() {
+		return 0
+	}
+	return adp.Size()
+}
+
 // Delete is used to delete message.
 func (l *MessageLog) Delete(key uint64) {
 	adp.DeleteMessage(key)
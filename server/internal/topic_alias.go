@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"sync"
+
+	"github.com/unit-io/unitdb/server/utp"
+)
+
+// maxTopicAliases is the maximum number of aliases a connection can register.
+const maxTopicAliases = 1024
+
+// _TopicAliases is the topic alias table of a connection. A client registers an alias for a
+// topic once, by a subscribe or a publish carrying both the topic and the alias, and then
+// publishes by alias alone. The zero value is an empty table.
+type _TopicAliases struct {
+	sync.Mutex
+	topics map[uint16]string
+}
+
+// reset removes all aliases, the aliases of a connection do not outlive the connection.
+func (a *_TopicAliases) reset() {
+	a.Lock()
+	defer a.Unlock()
+	a.topics = nil
+}
+
+// register registers the alias for the topic, replacing the topic of the alias if any. It returns
+// false if the alias is not registered yet and the connection has registered the maximum number of aliases.
+func (a *_TopicAliases) register(alias uint16, topic string) bool {
+	a.Lock()
+	defer a.Unlock()
+	if a.topics == nil {
+		a.topics = make(map[uint16]string)
+	}
+	if _, ok := a.topics[alias]; !ok && len(a.topics) >= maxTopicAliases {
+		return false
+	}
+	a.topics[alias] = topic
+	return true
+}
+
+// resolve sets the full topic of the publish message in place. A message with both a topic and an
+// alias registers the alias, and a message with only an alias takes the topic registered for it.
+// The alias is cleared so the message is delivered and forwarded with its full topic. It returns
+// false if the alias of the message is not registered or the alias table is full.
+func (a *_TopicAliases) resolve(m *utp.PublishMessage) bool {
+	alias := m.Properties.TopicAlias
+	if alias == 0 {
+		return true
+	}
+	if m.Topic != "" {
+		if !a.register(alias, m.Topic) {
+			return false
+		}
+	} else {
+		a.Lock()
+		topic, ok := a.topics[alias]
+		a.Unlock()
+		if !ok {
+			return false
+		}
+		m.Topic = topic
+	}
+	m.Properties.TopicAlias = 0
+	return true
+}
+
+// resolvePublish resolves the topics of all messages of the publish.
+func (a *_TopicAliases) resolvePublish(pub *utp.Publish) bool {
+	for _, m := range pub.Messages {
+		if !a.resolve(m) {
+			return false
+		}
+	}
+	return true
+}
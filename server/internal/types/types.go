@@ -50,6 +50,9 @@ var (
 	ErrBadRequest        = &Error{ReturnCode: 0x12, Status: 400, Message: "The request was invalid or cannot be otherwise served."}
 	ErrTargetTooLong     = &Error{ReturnCode: 0x13, Status: 400, Message: "Topic can not have more than 23 parts."}
 	ErrNotImplemented    = &Error{ReturnCode: 0x14, Status: 501, Message: "The server does not recognize the request method."}
+	ErrRateLimited       = &Error{ReturnCode: 0x15, Status: 429, Message: "The publish rate limit of the contract is exceeded, retry later."}
+	ErrTopicForbidden    = &Error{ReturnCode: 0x16, Status: 403, Message: "The client is not allowed to access the topic by the topic ACL."}
+	ErrInflightFull      = &Error{ReturnCode: 0x17, Status: 429, Message: "Too many publishes in flight for the session, wait for the acknowledgements."}
 )
 
 type KeyGenRequest struct {
@@ -82,6 +85,12 @@ type KeyGenResponse struct {
 	Topic  string `json:"topic"`
 }
 
+type MatchesResponse struct {
+	Status  int      `json:"status"`
+	Topic   string   `json:"topic"`
+	Matches []string `json:"matches"`
+}
+
 type ClientIdResponse struct {
 	Status   int    `json:"status"`
 	ClientId string `json:"key"`
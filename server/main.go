@@ -20,7 +20,9 @@ import (
 	"encoding/json"
 	"flag"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	jcr "github.com/DisposaBoy/JsonConfigReader"
@@ -97,7 +99,38 @@ func main() {
 
 	internal.Globals.Service = svc
 
+	// Reload the encryption keys and the topic ACL from the config file on SIGHUP.
+	go reloadOnHangup(svc, *configfile)
+
 	// Listen and serve
 	svc.Listen()
 	log.Info("main", "Service is running at port "+cfg.Listen)
 }
+
+func reloadOnHangup(svc interface {
+	ReloadEncryption(json.RawMessage) error
+	ReloadACL(json.RawMessage) error
+}, configfile string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		var cfg *config.Config
+		file, err := os.Open(configfile)
+		if err != nil {
+			log.Error("main", "Failed to read config file "+err.Error())
+			continue
+		}
+		err = json.NewDecoder(jcr.New(file)).Decode(&cfg)
+		file.Close()
+		if err != nil {
+			log.Error("main", "Failed to parse config file "+err.Error())
+			continue
+		}
+		if err := svc.ReloadEncryption(cfg.EncryptionConfig); err != nil {
+			log.Error("main", "Failed to reload encryption config "+err.Error())
+		}
+		if err := svc.ReloadACL(cfg.ACLConfig); err != nil {
+			log.Error("main", "Failed to reload ACL config "+err.Error())
+		}
+	}
+}
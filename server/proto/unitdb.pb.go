@@ -23,6 +23,7 @@ It has these top-level messages:
 	Subscribe
 	Unsubscribe
 	ControlMessage
+	Properties
 */
 package __schema
 
@@ -176,17 +177,18 @@ func (m *FixedHeader) GetMessageLength() int32 {
 
 // Connect represents a CONNECT Message type.
 type Connect struct {
-	Version             int32  `protobuf:"varint,1,opt,name=Version" json:"Version,omitempty"`
-	InsecureFlag        bool   `protobuf:"varint,2,opt,name=InsecureFlag" json:"InsecureFlag,omitempty"`
-	ClientID            string `protobuf:"bytes,3,opt,name=ClientID" json:"ClientID,omitempty"`
-	KeepAlive           int32  `protobuf:"varint,4,opt,name=KeepAlive" json:"KeepAlive,omitempty"`
-	CleanSessFlag       bool   `protobuf:"varint,5,opt,name=CleanSessFlag" json:"CleanSessFlag,omitempty"`
-	SessKey             int32  `protobuf:"varint,6,opt,name=SessKey" json:"SessKey,omitempty"`
-	Username            string `protobuf:"bytes,7,opt,name=Username" json:"Username,omitempty"`
-	Password            []byte `protobuf:"bytes,8,opt,name=Password,proto3" json:"Password,omitempty"`
-	BatchDuration       int32  `protobuf:"varint,9,opt,name=BatchDuration" json:"BatchDuration,omitempty"`
-	BatchByteThreshold  int32  `protobuf:"varint,10,opt,name=BatchByteThreshold" json:"BatchByteThreshold,omitempty"`
-	BatchCountThreshold int32  `protobuf:"varint,11,opt,name=BatchCountThreshold" json:"BatchCountThreshold,omitempty"`
+	Version             int32       `protobuf:"varint,1,opt,name=Version" json:"Version,omitempty"`
+	InsecureFlag        bool        `protobuf:"varint,2,opt,name=InsecureFlag" json:"InsecureFlag,omitempty"`
+	ClientID            string      `protobuf:"bytes,3,opt,name=ClientID" json:"ClientID,omitempty"`
+	KeepAlive           int32       `protobuf:"varint,4,opt,name=KeepAlive" json:"KeepAlive,omitempty"`
+	CleanSessFlag       bool        `protobuf:"varint,5,opt,name=CleanSessFlag" json:"CleanSessFlag,omitempty"`
+	SessKey             int32       `protobuf:"varint,6,opt,name=SessKey" json:"SessKey,omitempty"`
+	Username            string      `protobuf:"bytes,7,opt,name=Username" json:"Username,omitempty"`
+	Password            []byte      `protobuf:"bytes,8,opt,name=Password,proto3" json:"Password,omitempty"`
+	BatchDuration       int32       `protobuf:"varint,9,opt,name=BatchDuration" json:"BatchDuration,omitempty"`
+	BatchByteThreshold  int32       `protobuf:"varint,10,opt,name=BatchByteThreshold" json:"BatchByteThreshold,omitempty"`
+	BatchCountThreshold int32       `protobuf:"varint,11,opt,name=BatchCountThreshold" json:"BatchCountThreshold,omitempty"`
+	Properties          *Properties `protobuf:"bytes,12,opt,name=Properties" json:"Properties,omitempty"`
 }
 
 func (m *Connect) Reset()                    { *m = Connect{} }
@@ -271,6 +273,13 @@ func (m *Connect) GetBatchCountThreshold() int32 {
 	return 0
 }
 
+func (m *Connect) GetProperties() *Properties {
+	if m != nil {
+		return m.Properties
+	}
+	return nil
+}
+
 // ConnectAcknowledge represents a CONNECT Acknowledge Message type.
 // 0x00 connection accepted
 // 0x01 refused: unacceptable proto version
@@ -338,9 +347,10 @@ func (m *Disconnect) GetMessageID() int32 {
 }
 
 type PublishMessage struct {
-	Topic   string `protobuf:"bytes,1,opt,name=Topic" json:"Topic,omitempty"`
-	Payload []byte `protobuf:"bytes,2,opt,name=Payload,proto3" json:"Payload,omitempty"`
-	Ttl     string `protobuf:"bytes,3,opt,name=Ttl" json:"Ttl,omitempty"`
+	Topic      string      `protobuf:"bytes,1,opt,name=Topic" json:"Topic,omitempty"`
+	Payload    []byte      `protobuf:"bytes,2,opt,name=Payload,proto3" json:"Payload,omitempty"`
+	Ttl        string      `protobuf:"bytes,3,opt,name=Ttl" json:"Ttl,omitempty"`
+	Properties *Properties `protobuf:"bytes,4,opt,name=Properties" json:"Properties,omitempty"`
 }
 
 func (m *PublishMessage) Reset()                    { *m = PublishMessage{} }
@@ -369,6 +379,13 @@ func (m *PublishMessage) GetTtl() string {
 	return ""
 }
 
+func (m *PublishMessage) GetProperties() *Properties {
+	if m != nil {
+		return m.Properties
+	}
+	return nil
+}
+
 // Publish represents a PUBREQ Message type. It supports following delivery mode.
 // 0 EXPRESS
 // 1 RELIEABLE
@@ -497,6 +514,7 @@ func (m *Subscription) GetTopic() string {
 type Subscribe struct {
 	MessageID     int32           `protobuf:"varint,1,opt,name=MessageID" json:"MessageID,omitempty"`
 	Subscriptions []*Subscription `protobuf:"bytes,2,rep,name=Subscriptions" json:"Subscriptions,omitempty"`
+	Properties    *Properties     `protobuf:"bytes,3,opt,name=Properties" json:"Properties,omitempty"`
 }
 
 func (m *Subscribe) Reset()                    { *m = Subscribe{} }
@@ -518,6 +536,13 @@ func (m *Subscribe) GetSubscriptions() []*Subscription {
 	return nil
 }
 
+func (m *Subscribe) GetProperties() *Properties {
+	if m != nil {
+		return m.Properties
+	}
+	return nil
+}
+
 // Unsubscribe is the Message to send if you don't want to subscribe to a topic anymore.
 type Unsubscribe struct {
 	MessageID     int32           `protobuf:"varint,1,opt,name=MessageID" json:"MessageID,omitempty"`
@@ -569,6 +594,41 @@ func (m *ControlMessage) GetMessage() []byte {
 	return nil
 }
 
+// Properties carries the optional properties of a Message. Absent properties are treated as empty.
+// MessageExpiryInterval is the lifetime of the message in seconds.
+// TopicAlias is a small integer used in place of the topic.
+type Properties struct {
+	UserProperties        map[string]string `protobuf:"bytes,1,rep,name=UserProperties" json:"UserProperties,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	MessageExpiryInterval int32             `protobuf:"varint,2,opt,name=MessageExpiryInterval" json:"MessageExpiryInterval,omitempty"`
+	TopicAlias            int32             `protobuf:"varint,3,opt,name=TopicAlias" json:"TopicAlias,omitempty"`
+}
+
+func (m *Properties) Reset()                    { *m = Properties{} }
+func (m *Properties) String() string            { return proto.CompactTextString(m) }
+func (*Properties) ProtoMessage()               {}
+func (*Properties) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
+
+func (m *Properties) GetUserProperties() map[string]string {
+	if m != nil {
+		return m.UserProperties
+	}
+	return nil
+}
+
+func (m *Properties) GetMessageExpiryInterval() int32 {
+	if m != nil {
+		return m.MessageExpiryInterval
+	}
+	return 0
+}
+
+func (m *Properties) GetTopicAlias() int32 {
+	if m != nil {
+		return m.TopicAlias
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Empty)(nil), "unitdb.schema.Empty")
 	proto.RegisterType((*Packet)(nil), "unitdb.schema.Packet")
@@ -585,6 +645,7 @@ func init() {
 	proto.RegisterType((*Subscribe)(nil), "unitdb.schema.Subscribe")
 	proto.RegisterType((*Unsubscribe)(nil), "unitdb.schema.Unsubscribe")
 	proto.RegisterType((*ControlMessage)(nil), "unitdb.schema.ControlMessage")
+	proto.RegisterType((*Properties)(nil), "unitdb.schema.Properties")
 	proto.RegisterEnum("unitdb.schema.FlowControl", FlowControl_name, FlowControl_value)
 	proto.RegisterEnum("unitdb.schema.MessageType", MessageType_name, MessageType_value)
 }
@@ -601,6 +662,7 @@ const _ = grpc.SupportPackageIsVersion4
 
 type UnitdbClient interface {
 	Stream(ctx context.Context, opts ...grpc.CallOption) (Unitdb_StreamClient, error)
+	Publish(ctx context.Context, opts ...grpc.CallOption) (Unitdb_PublishClient, error)
 }
 
 type unitdbClient struct {
@@ -642,10 +704,42 @@ func (x *unitdbStreamClient) Recv() (*Packet, error) {
 	return m, nil
 }
 
+func (c *unitdbClient) Publish(ctx context.Context, opts ...grpc.CallOption) (Unitdb_PublishClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Unitdb_serviceDesc.Streams[1], c.cc, "/unitdb.schema.Unitdb/Publish", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &unitdbPublishClient{stream}
+	return x, nil
+}
+
+type Unitdb_PublishClient interface {
+	Send(*Packet) error
+	Recv() (*Packet, error)
+	grpc.ClientStream
+}
+
+type unitdbPublishClient struct {
+	grpc.ClientStream
+}
+
+func (x *unitdbPublishClient) Send(m *Packet) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *unitdbPublishClient) Recv() (*Packet, error) {
+	m := new(Packet)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for Unitdb service
 
 type UnitdbServer interface {
 	Stream(Unitdb_StreamServer) error
+	Publish(Unitdb_PublishServer) error
 }
 
 func RegisterUnitdbServer(s *grpc.Server, srv UnitdbServer) {
@@ -678,6 +772,32 @@ func (x *unitdbStreamServer) Recv() (*Packet, error) {
 	return m, nil
 }
 
+func _Unitdb_Publish_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UnitdbServer).Publish(&unitdbPublishServer{stream})
+}
+
+type Unitdb_PublishServer interface {
+	Send(*Packet) error
+	Recv() (*Packet, error)
+	grpc.ServerStream
+}
+
+type unitdbPublishServer struct {
+	grpc.ServerStream
+}
+
+func (x *unitdbPublishServer) Send(m *Packet) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *unitdbPublishServer) Recv() (*Packet, error) {
+	m := new(Packet)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _Unitdb_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "unitdb.schema.Unitdb",
 	HandlerType: (*UnitdbServer)(nil),
@@ -689,6 +809,12 @@ var _Unitdb_serviceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Publish",
+			Handler:       _Unitdb_Publish_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "unitdb.proto",
 }
@@ -696,58 +822,67 @@ var _Unitdb_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("unitdb.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 839 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xbc, 0x55, 0x4d, 0x6f, 0xe2, 0x46,
-	0x18, 0x5e, 0x07, 0x0c, 0xf8, 0x05, 0x52, 0x6b, 0xba, 0xad, 0xac, 0x6d, 0x5a, 0x45, 0x56, 0x0f,
-	0x51, 0x0e, 0x68, 0x95, 0x5e, 0xfa, 0x75, 0x01, 0xdb, 0xd9, 0x58, 0x21, 0x40, 0x07, 0x48, 0xb5,
-	0x55, 0x55, 0x69, 0xb0, 0x5f, 0x81, 0xb5, 0x8e, 0x4d, 0x3d, 0x43, 0x53, 0x2e, 0x95, 0x7a, 0xe9,
-	0xdf, 0xe9, 0x5f, 0xac, 0x66, 0x18, 0x82, 0x1d, 0xb1, 0xbb, 0xb7, 0xde, 0xe6, 0x79, 0xfc, 0x7e,
-	0x3c, 0xef, 0xc7, 0x78, 0xa0, 0xb3, 0xc9, 0x12, 0x11, 0x2f, 0x7a, 0xeb, 0x22, 0x17, 0x39, 0xe9,
-	0x6a, 0xc4, 0xa3, 0x15, 0x3e, 0x30, 0xb7, 0x09, 0x66, 0xf0, 0xb0, 0x16, 0x5b, 0xf7, 0x0c, 0x1a,
-	0x13, 0x16, 0xbd, 0x43, 0x41, 0x08, 0xd4, 0x63, 0x26, 0x98, 0x63, 0x9c, 0x1b, 0x17, 0x1d, 0xaa,
-	0xce, 0xee, 0xbf, 0x06, 0xb4, 0xaf, 0x93, 0x3f, 0x31, 0xbe, 0x41, 0x16, 0x63, 0x41, 0x7e, 0x84,
-	0xf6, 0x1d, 0x72, 0xce, 0x96, 0x38, 0xdb, 0xae, 0x51, 0x99, 0x9e, 0x5e, 0xbd, 0xea, 0x55, 0x62,
-	0xf7, 0x4a, 0x16, 0xb4, 0x6c, 0x2e, 0xbd, 0xaf, 0xd3, 0xfc, 0xd1, 0xcb, 0x33, 0x51, 0xe4, 0xa9,
-	0x73, 0x72, 0xd4, 0xbb, 0x64, 0x41, 0xcb, 0xe6, 0xe4, 0x6b, 0xe8, 0xea, 0x60, 0x43, 0xcc, 0x96,
-	0x62, 0xe5, 0xd4, 0xce, 0x8d, 0x0b, 0x93, 0x56, 0x49, 0xf7, 0xef, 0x1a, 0x34, 0xbd, 0x3c, 0xcb,
-	0x30, 0x12, 0xc4, 0x81, 0xe6, 0x3d, 0x16, 0x3c, 0xc9, 0x33, 0xa5, 0xd4, 0xa4, 0x7b, 0x48, 0x5c,
-	0xe8, 0x84, 0x19, 0xc7, 0x68, 0x53, 0xe0, 0x75, 0xca, 0x96, 0x4a, 0x4a, 0x8b, 0x56, 0x38, 0xf2,
-	0x0a, 0x5a, 0x5e, 0x9a, 0x60, 0x26, 0x42, 0x5f, 0xa5, 0xb2, 0xe8, 0x13, 0x26, 0x67, 0x60, 0xdd,
-	0x22, 0xae, 0xfb, 0x69, 0xf2, 0x07, 0x3a, 0x75, 0x15, 0xfb, 0x40, 0x48, 0xa5, 0x5e, 0x8a, 0x2c,
-	0x9b, 0x22, 0xe7, 0x2a, 0xbc, 0xa9, 0xc2, 0x57, 0x49, 0xa9, 0x4e, 0x9e, 0x6f, 0x71, 0xeb, 0x34,
-	0x76, 0xea, 0x34, 0x94, 0x99, 0xe7, 0x1c, 0x8b, 0x8c, 0x3d, 0xa0, 0xd3, 0xdc, 0x65, 0xde, 0x63,
-	0xf9, 0x6d, 0xc2, 0x38, 0x7f, 0xcc, 0x8b, 0xd8, 0x69, 0xa9, 0x49, 0x3d, 0x61, 0x99, 0x77, 0xc0,
-	0x44, 0xb4, 0xf2, 0x37, 0x05, 0x13, 0xb2, 0x6a, 0x6b, 0xd7, 0xa1, 0x0a, 0x49, 0x7a, 0x40, 0x14,
-	0x31, 0xd8, 0x0a, 0x9c, 0xad, 0x0a, 0xe4, 0xab, 0x3c, 0x8d, 0x1d, 0x50, 0xa6, 0x47, 0xbe, 0x90,
-	0xd7, 0xf0, 0xa9, 0x62, 0xbd, 0x7c, 0x93, 0x89, 0x83, 0x43, 0x5b, 0x39, 0x1c, 0xfb, 0xe4, 0x2e,
-	0x80, 0xe8, 0x11, 0xf4, 0xa3, 0x77, 0x59, 0xfe, 0x98, 0x62, 0xbc, 0x44, 0xf2, 0x15, 0x00, 0x45,
-	0xb1, 0x29, 0x32, 0x2f, 0x8f, 0x51, 0x0f, 0xa4, 0xc4, 0x90, 0x97, 0x60, 0x06, 0xeb, 0x3c, 0x5a,
-	0xa9, 0x61, 0x98, 0x74, 0x07, 0xc8, 0xe7, 0xd0, 0x90, 0xb1, 0xf4, 0x0c, 0x4c, 0xaa, 0x91, 0xdb,
-	0x85, 0xf6, 0x24, 0xc9, 0x96, 0x14, 0x7f, 0xdf, 0x20, 0x17, 0xee, 0x25, 0x80, 0x9f, 0xf0, 0x48,
-	0x0f, 0xfe, 0x0c, 0x2c, 0xbd, 0x15, 0xa1, 0xaf, 0x33, 0x1d, 0x08, 0x97, 0xc2, 0xe9, 0x64, 0xb3,
-	0x48, 0x13, 0xbe, 0xd2, 0x9c, 0x4c, 0x3d, 0xcb, 0xd7, 0x49, 0xa4, 0x6c, 0x2d, 0xba, 0x03, 0x72,
-	0x40, 0x13, 0xb6, 0x4d, 0x73, 0x16, 0x2b, 0x49, 0x1d, 0xba, 0x87, 0xc4, 0x86, 0xda, 0x4c, 0xa4,
-	0x7a, 0x2b, 0xe4, 0xd1, 0xfd, 0xc7, 0x80, 0xa6, 0x0e, 0xfa, 0xe1, 0xec, 0x72, 0xf5, 0x7c, 0x94,
-	0x6b, 0x52, 0x6c, 0xef, 0x64, 0x23, 0x76, 0xd5, 0x56, 0x38, 0xf2, 0x1d, 0xb4, 0xb4, 0x03, 0x77,
-	0x6a, 0xe7, 0xb5, 0x8b, 0xf6, 0xd5, 0x97, 0xcf, 0x6e, 0x49, 0xb5, 0x00, 0xfa, 0x64, 0xee, 0x7e,
-	0x0b, 0x1d, 0x8a, 0x29, 0xdb, 0xea, 0xc6, 0xbc, 0xa7, 0x34, 0x02, 0xf5, 0x21, 0xe3, 0x42, 0x25,
-	0xb7, 0xa8, 0x3a, 0xbb, 0x2b, 0x30, 0x95, 0xe7, 0x47, 0xf4, 0xf7, 0xa1, 0x5b, 0x94, 0x12, 0x70,
-	0xe7, 0x44, 0x09, 0xfc, 0xe2, 0x99, 0xc0, 0xb2, 0x08, 0x5a, 0xf5, 0x70, 0x7f, 0x83, 0xce, 0x74,
-	0xb3, 0xe0, 0x51, 0x91, 0xac, 0x85, 0xbe, 0x8d, 0x95, 0x96, 0x18, 0x47, 0x5a, 0xf2, 0x12, 0x4c,
-	0x5f, 0x06, 0xd9, 0x6f, 0x87, 0x02, 0x87, 0xea, 0x6a, 0xa5, 0xea, 0xdc, 0x14, 0x2c, 0x1d, 0x7f,
-	0x81, 0x1f, 0xaf, 0xa6, 0x2c, 0xe5, 0x7d, 0xd5, 0x94, 0x6d, 0x68, 0xd5, 0xc3, 0xcd, 0xa0, 0x3d,
-	0xcf, 0xf8, 0xff, 0x97, 0xef, 0x06, 0x4e, 0xf5, 0x2f, 0x71, 0xbf, 0xbe, 0x1f, 0x4e, 0xe9, 0x40,
-	0x53, 0x83, 0xfd, 0x1a, 0x6b, 0x78, 0xf9, 0x6b, 0xe5, 0x7f, 0x4c, 0x5a, 0x50, 0x1f, 0x8d, 0x47,
-	0x81, 0xfd, 0x82, 0x7c, 0x02, 0xed, 0xbe, 0x77, 0x3b, 0x1a, 0xff, 0x3c, 0x0c, 0xfc, 0x37, 0x81,
-	0x6d, 0x10, 0x80, 0xc6, 0x68, 0x3c, 0x0b, 0xaf, 0xdf, 0xda, 0x27, 0xa4, 0x0d, 0x4d, 0x1a, 0x78,
-	0x41, 0x78, 0x1f, 0xd8, 0xb5, 0x27, 0x30, 0x99, 0xd9, 0x75, 0xd2, 0x81, 0x96, 0x37, 0xbe, 0x9b,
-	0x0c, 0x83, 0x59, 0x60, 0x9b, 0x97, 0x7f, 0x55, 0xde, 0x0a, 0xd2, 0x05, 0x8b, 0x06, 0x74, 0x1a,
-	0xd0, 0xfb, 0xc0, 0xb7, 0x5f, 0x48, 0x47, 0x6f, 0x3c, 0x1a, 0x05, 0xde, 0xcc, 0x36, 0x24, 0x98,
-	0xcc, 0x07, 0xc3, 0x70, 0x7a, 0x63, 0x9f, 0x10, 0x0b, 0x4c, 0x1a, 0x0c, 0xfb, 0x6f, 0xed, 0x9a,
-	0xf4, 0x99, 0xce, 0x07, 0x53, 0x8f, 0x86, 0x83, 0xc0, 0xae, 0x4b, 0x59, 0xf3, 0xd1, 0x81, 0x30,
-	0x95, 0x5f, 0x38, 0x7a, 0x43, 0x83, 0x9f, 0xec, 0x06, 0x39, 0x05, 0xf0, 0xc3, 0xe9, 0x3e, 0x68,
-	0xf3, 0xca, 0x87, 0xc6, 0x5c, 0x35, 0x95, 0x7c, 0x0f, 0x8d, 0xa9, 0x28, 0x90, 0x3d, 0x90, 0xcf,
-	0x9e, 0x5f, 0x23, 0xf5, 0xf4, 0xbd, 0x3a, 0x4e, 0x5f, 0x18, 0xaf, 0x8d, 0x01, 0xfc, 0xd2, 0xea,
-	0xfd, 0xb0, 0xa3, 0x17, 0x0d, 0xf5, 0x94, 0x7e, 0xf3, 0x5f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x88,
-	0xb8, 0x3c, 0xf1, 0x5a, 0x07, 0x00, 0x00,
+	// 982 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xbc, 0x56, 0xcd, 0x6e, 0xe3, 0x36,
+	0x10, 0x5e, 0xc5, 0x96, 0x7f, 0xc6, 0x4e, 0x2a, 0x70, 0x77, 0x0b, 0x35, 0x4d, 0x8b, 0x40, 0xe8,
+	0x21, 0x08, 0x50, 0x63, 0x91, 0xf6, 0xb0, 0x3f, 0xbd, 0xd8, 0xb2, 0xb2, 0x31, 0xe2, 0x38, 0x2e,
+	0x6d, 0xa7, 0xd8, 0xa2, 0x28, 0x40, 0xcb, 0x03, 0x5b, 0x88, 0x22, 0xb9, 0x22, 0x9d, 0xac, 0x2e,
+	0x05, 0x7a, 0xe9, 0xad, 0xcf, 0xd1, 0x63, 0x5f, 0xa0, 0x8f, 0xd6, 0x43, 0x41, 0x9a, 0x8e, 0x25,
+	0xc3, 0xd9, 0x45, 0x2e, 0x7b, 0xe3, 0xf7, 0x71, 0x7e, 0x3e, 0xce, 0x0c, 0x29, 0x41, 0x7d, 0x11,
+	0x05, 0x62, 0x32, 0x6e, 0xcc, 0x93, 0x58, 0xc4, 0x64, 0x57, 0x23, 0xee, 0xcf, 0xf0, 0x86, 0x39,
+	0x65, 0x30, 0xbd, 0x9b, 0xb9, 0x48, 0x9d, 0x03, 0x28, 0xf5, 0x99, 0x7f, 0x8d, 0x82, 0x10, 0x28,
+	0x4e, 0x98, 0x60, 0xb6, 0x71, 0x68, 0x1c, 0xd5, 0xa9, 0x5a, 0x3b, 0xff, 0x18, 0x50, 0x3b, 0x0d,
+	0xde, 0xe3, 0xe4, 0x0c, 0xd9, 0x04, 0x13, 0xf2, 0x03, 0xd4, 0x2e, 0x90, 0x73, 0x36, 0xc5, 0x61,
+	0x3a, 0x47, 0x65, 0xba, 0x77, 0xb2, 0xdf, 0xc8, 0xc5, 0x6e, 0x64, 0x2c, 0x68, 0xd6, 0x5c, 0x7a,
+	0x9f, 0x86, 0xf1, 0x9d, 0x1b, 0x47, 0x22, 0x89, 0x43, 0x7b, 0x67, 0xab, 0x77, 0xc6, 0x82, 0x66,
+	0xcd, 0xc9, 0x37, 0xb0, 0xab, 0x83, 0x75, 0x31, 0x9a, 0x8a, 0x99, 0x5d, 0x38, 0x34, 0x8e, 0x4c,
+	0x9a, 0x27, 0x9d, 0x7f, 0x0b, 0x50, 0x76, 0xe3, 0x28, 0x42, 0x5f, 0x10, 0x1b, 0xca, 0x57, 0x98,
+	0xf0, 0x20, 0x8e, 0x94, 0x52, 0x93, 0xae, 0x20, 0x71, 0xa0, 0xde, 0x89, 0x38, 0xfa, 0x8b, 0x04,
+	0x4f, 0x43, 0x36, 0x55, 0x52, 0x2a, 0x34, 0xc7, 0x91, 0x7d, 0xa8, 0xb8, 0x61, 0x80, 0x91, 0xe8,
+	0xb4, 0x55, 0xaa, 0x2a, 0xbd, 0xc7, 0xe4, 0x00, 0xaa, 0xe7, 0x88, 0xf3, 0x66, 0x18, 0xdc, 0xa2,
+	0x5d, 0x54, 0xb1, 0xd7, 0x84, 0x54, 0xea, 0x86, 0xc8, 0xa2, 0x01, 0x72, 0xae, 0xc2, 0x9b, 0x2a,
+	0x7c, 0x9e, 0x94, 0xea, 0xe4, 0xfa, 0x1c, 0x53, 0xbb, 0xb4, 0x54, 0xa7, 0xa1, 0xcc, 0x3c, 0xe2,
+	0x98, 0x44, 0xec, 0x06, 0xed, 0xf2, 0x32, 0xf3, 0x0a, 0xcb, 0xbd, 0x3e, 0xe3, 0xfc, 0x2e, 0x4e,
+	0x26, 0x76, 0x45, 0x75, 0xea, 0x1e, 0xcb, 0xbc, 0x2d, 0x26, 0xfc, 0x59, 0x7b, 0x91, 0x30, 0x21,
+	0x4f, 0x5d, 0x5d, 0x56, 0x28, 0x47, 0x92, 0x06, 0x10, 0x45, 0xb4, 0x52, 0x81, 0xc3, 0x59, 0x82,
+	0x7c, 0x16, 0x87, 0x13, 0x1b, 0x94, 0xe9, 0x96, 0x1d, 0xf2, 0x02, 0x9e, 0x2a, 0xd6, 0x8d, 0x17,
+	0x91, 0x58, 0x3b, 0xd4, 0x94, 0xc3, 0xb6, 0x2d, 0xf2, 0x0a, 0xa0, 0x9f, 0xc4, 0x73, 0x4c, 0x44,
+	0x80, 0xdc, 0xae, 0x1f, 0x1a, 0x47, 0xb5, 0x93, 0x2f, 0x36, 0xda, 0xbc, 0x36, 0xa0, 0x19, 0x63,
+	0x67, 0x0c, 0x44, 0x77, 0xaf, 0xe9, 0x5f, 0x47, 0xf1, 0x5d, 0x88, 0x93, 0x29, 0x92, 0xaf, 0x01,
+	0x28, 0x8a, 0x45, 0x12, 0xb9, 0xf1, 0x04, 0x75, 0x2f, 0x33, 0x0c, 0x79, 0x06, 0xa6, 0x37, 0x8f,
+	0xfd, 0x99, 0xea, 0xa3, 0x49, 0x97, 0x80, 0x7c, 0x0e, 0x25, 0x19, 0x4b, 0xb7, 0xcf, 0xa4, 0x1a,
+	0x39, 0xbb, 0x50, 0xeb, 0x07, 0xd1, 0x94, 0xe2, 0x6f, 0x0b, 0xe4, 0xc2, 0x39, 0x06, 0x68, 0x07,
+	0xdc, 0xd7, 0x33, 0x73, 0x00, 0x55, 0x3d, 0x50, 0x9d, 0xb6, 0xce, 0xb4, 0x26, 0x9c, 0xbf, 0x0c,
+	0xd8, 0xeb, 0x2f, 0xc6, 0x61, 0xc0, 0x67, 0x9a, 0x94, 0xb9, 0x87, 0xf1, 0x3c, 0xf0, 0x95, 0x71,
+	0x95, 0x2e, 0x81, 0x6c, 0x6e, 0x9f, 0xa5, 0x61, 0xcc, 0x26, 0x4a, 0x53, 0x9d, 0xae, 0x20, 0xb1,
+	0xa0, 0x30, 0x14, 0xa1, 0x9e, 0x28, 0xb9, 0xdc, 0x28, 0x57, 0xf1, 0x31, 0xe5, 0xfa, 0xd3, 0x80,
+	0xb2, 0xd6, 0xf3, 0x61, 0xe5, 0x72, 0xe2, 0xdb, 0x28, 0xa7, 0x33, 0x49, 0x2f, 0x64, 0x11, 0x97,
+	0x95, 0xca, 0x71, 0xe4, 0x15, 0x54, 0xb4, 0x03, 0xb7, 0x0b, 0x87, 0x85, 0xa3, 0xda, 0xc9, 0x57,
+	0x9b, 0x32, 0x72, 0x67, 0xa7, 0xf7, 0xe6, 0xce, 0x4b, 0xa8, 0x53, 0x0c, 0x59, 0xaa, 0x8b, 0xfa,
+	0x40, 0x55, 0x08, 0x14, 0xbb, 0x8c, 0x0b, 0x95, 0xbc, 0x4a, 0xd5, 0xda, 0x99, 0x81, 0xa9, 0x3c,
+	0x3f, 0xa2, 0xbf, 0x09, 0xbb, 0x49, 0x26, 0x01, 0xb7, 0x77, 0x94, 0xc0, 0x2f, 0x37, 0x04, 0x66,
+	0x45, 0xd0, 0xbc, 0x87, 0xf3, 0x2b, 0xd4, 0x07, 0x8b, 0x31, 0xf7, 0x93, 0x60, 0x2e, 0xf4, 0x23,
+	0x90, 0x2b, 0x89, 0xb1, 0xa5, 0x24, 0xcf, 0xc0, 0x6c, 0xcb, 0x20, 0xab, 0xc9, 0x52, 0x60, 0x7d,
+	0xba, 0x42, 0xe6, 0x74, 0xce, 0xdf, 0x06, 0x54, 0x75, 0x82, 0x31, 0x7e, 0xfc, 0x38, 0x59, 0x2d,
+	0x0f, 0x1d, 0x27, 0x6b, 0x43, 0xf3, 0x1e, 0x1b, 0x63, 0x53, 0x78, 0xcc, 0xd8, 0x44, 0x50, 0x1b,
+	0x45, 0xfc, 0x93, 0x49, 0x75, 0xce, 0x60, 0x4f, 0xbf, 0xe2, 0xab, 0x5b, 0xf3, 0xe1, 0x94, 0x36,
+	0x94, 0x35, 0x58, 0xdd, 0x1e, 0x0d, 0x9d, 0xff, 0x8c, 0xec, 0xa9, 0xc9, 0x08, 0xf6, 0xe4, 0xcb,
+	0xb8, 0x66, 0x6c, 0x43, 0x89, 0xfb, 0xf6, 0xc1, 0x3a, 0x34, 0xf2, 0xf6, 0x5e, 0x24, 0x92, 0x94,
+	0x6e, 0x04, 0x21, 0xdf, 0xc3, 0x73, 0x9d, 0xd0, 0x7b, 0x3f, 0x0f, 0x92, 0xb4, 0x13, 0x09, 0x4c,
+	0x6e, 0x59, 0xa8, 0xa7, 0x60, 0xfb, 0xa6, 0x7c, 0xa5, 0xd4, 0x20, 0x34, 0xc3, 0x80, 0x71, 0xfd,
+	0xe6, 0x64, 0x98, 0xfd, 0x26, 0x3c, 0xdd, 0x92, 0x5c, 0x3e, 0x08, 0xd7, 0x98, 0xea, 0x8b, 0x22,
+	0x97, 0x72, 0xbc, 0x6e, 0x59, 0xb8, 0x40, 0x7d, 0x4f, 0x96, 0xe0, 0xf5, 0xce, 0x4b, 0xe3, 0xf8,
+	0x97, 0xdc, 0x17, 0x94, 0x54, 0xa0, 0xd8, 0xbb, 0xec, 0x79, 0xd6, 0x13, 0xf2, 0x19, 0xd4, 0x9a,
+	0xee, 0x79, 0xef, 0xf2, 0xa7, 0xae, 0xd7, 0x7e, 0xeb, 0x59, 0x06, 0x01, 0x28, 0xf5, 0x2e, 0x87,
+	0x9d, 0xd3, 0x77, 0xd6, 0x0e, 0xa9, 0x41, 0x99, 0x7a, 0xae, 0xd7, 0xb9, 0xf2, 0xac, 0xc2, 0x3d,
+	0xe8, 0x0f, 0xad, 0x22, 0xa9, 0x43, 0xc5, 0xbd, 0xbc, 0xe8, 0x77, 0xbd, 0xa1, 0x67, 0x99, 0xc7,
+	0xbf, 0xe7, 0xbe, 0xee, 0x64, 0x17, 0xaa, 0xd4, 0xa3, 0x03, 0x8f, 0x5e, 0x79, 0x6d, 0xeb, 0x89,
+	0x74, 0x74, 0x2f, 0x7b, 0x3d, 0xcf, 0x1d, 0x5a, 0x86, 0x04, 0xfd, 0x51, 0xab, 0xdb, 0x19, 0x9c,
+	0x59, 0x3b, 0xa4, 0x0a, 0x26, 0xf5, 0xba, 0xcd, 0x77, 0x56, 0x41, 0xfa, 0x0c, 0x46, 0xad, 0x81,
+	0x4b, 0x3b, 0x2d, 0xcf, 0x2a, 0x4a, 0x59, 0xa3, 0xde, 0x9a, 0x30, 0x95, 0x5f, 0xa7, 0xf7, 0x96,
+	0x7a, 0x3f, 0x5a, 0x25, 0xb2, 0x07, 0xd0, 0xee, 0x0c, 0x56, 0x41, 0xcb, 0x27, 0x7f, 0x18, 0x50,
+	0x1a, 0xa9, 0xbe, 0x91, 0xd7, 0x50, 0x1a, 0x88, 0x04, 0xd9, 0x0d, 0x79, 0xbe, 0xd9, 0x4a, 0xf5,
+	0xb7, 0xb2, 0xbf, 0x9d, 0x3e, 0x32, 0x5e, 0x18, 0xe4, 0xcd, 0xfa, 0x4d, 0x7c, 0xb4, 0x73, 0x0b,
+	0x7e, 0xae, 0x34, 0xde, 0x2c, 0xe9, 0x71, 0x49, 0xfd, 0x3a, 0x7d, 0xf7, 0xff, 0x00, 0x36, 0x8f,
+	0xa9, 0xb3, 0x4a, 0x09, 0x00, 0x00,
 }
@@ -36,6 +36,7 @@ type Connect struct {
 	BatchDuration       int32
 	BatchByteThreshold  int32
 	BatchCountThreshold int32
+	Properties          Properties
 }
 
 // ConnectAcknowledge represents a CONNECT Acknowledge Message.
@@ -75,6 +76,7 @@ func (c *Connect) ToBinary() (bytes.Buffer, error) {
 		BatchDuration:       c.BatchDuration,
 		BatchByteThreshold:  c.BatchByteThreshold,
 		BatchCountThreshold: c.BatchCountThreshold,
+		Properties:          c.Properties.toProto(),
 	}
 	rawMsg, err := proto.Marshal(&conn)
 	if err != nil {
@@ -101,6 +103,7 @@ func (c *Connect) FromBinary(fh FixedHeader, data []byte) {
 	c.BatchDuration = conn.BatchDuration
 	c.BatchByteThreshold = conn.BatchByteThreshold
 	c.BatchCountThreshold = conn.BatchCountThreshold
+	c.Properties.fromProto(conn.Properties)
 }
 
 // Type returns the Message type.
@@ -179,7 +182,9 @@ func (p *Pingreq) Info() Info {
 
 func (d *Disconnect) ToBinary() (bytes.Buffer, error) {
 	var msg bytes.Buffer
-	var disc pbx.Disconnect
+	disc := pbx.Disconnect{
+		MessageID: int32(d.MessageID),
+	}
 	rawMsg, err := proto.Marshal(&disc)
 	if err != nil {
 		return msg, err
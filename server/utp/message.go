@@ -18,6 +18,7 @@ package utp
 
 import (
 	"bytes"
+	"errors"
 	"io"
 
 	"github.com/golang/protobuf/proto"
@@ -51,6 +52,18 @@ const (
 	ErrBadRequest                = 0x06
 )
 
+const (
+	// Maximum size of the encoded fixed header. The header holds two enums and the message length.
+	maxFixedHeaderSize = 32
+	// Maximum number of bytes of an encoded length.
+	maxLengthBytes = 4
+)
+
+var (
+	errMalformedLength    = errors.New("utp: malformed length")
+	errFixedHeaderTooLong = errors.New("utp: fixed header too long")
+)
+
 // FixedHeader
 type FixedHeader struct {
 	MessageType   MessageType
@@ -58,6 +71,45 @@ type FixedHeader struct {
 	MessageLength int
 }
 
+// Properties represents the optional properties of a Message. Messages from
+// older clients carry no properties and are decoded with empty properties.
+type Properties struct {
+	// User defined key value pairs
+	UserProperties map[string]string
+	// Lifetime of the message in seconds
+	MessageExpiryInterval uint32
+	// Small integer used in place of the topic
+	TopicAlias uint16
+}
+
+// IsEmpty returns true if none of the properties is set.
+func (p *Properties) IsEmpty() bool {
+	return len(p.UserProperties) == 0 && p.MessageExpiryInterval == 0 && p.TopicAlias == 0
+}
+
+func (p *Properties) toProto() *pbx.Properties {
+	if p.IsEmpty() {
+		return nil
+	}
+	return &pbx.Properties{
+		UserProperties:        p.UserProperties,
+		MessageExpiryInterval: int32(p.MessageExpiryInterval),
+		TopicAlias:            int32(p.TopicAlias),
+	}
+}
+
+func (p *Properties) fromProto(props *pbx.Properties) {
+	if props == nil {
+		*p = Properties{}
+		return
+	}
+	*p = Properties{
+		UserProperties:        props.UserProperties,
+		MessageExpiryInterval: uint32(props.MessageExpiryInterval),
+		TopicAlias:            uint16(props.TopicAlias),
+	}
+}
+
 // Info returns Qos and MessageID by the Info() function called on the Packet
 type Info struct {
 	DeliveryMode uint8
@@ -86,6 +138,9 @@ func (fh *FixedHeader) FromBinary(r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if fhSize > maxFixedHeaderSize {
+		return errFixedHeaderTooLong
+	}
 
 	// read FixedHeader
 	head := make([]byte, fhSize)
@@ -126,7 +181,7 @@ func decodeLength(r io.Reader) (int, error) {
 	var rLength uint32
 	var multiplier uint32
 	b := make([]byte, 1)
-	for multiplier < 27 { //fix: Infinite '(digit & 128) == 1' will cause the dead loop
+	for i := 0; i < maxLengthBytes; i++ {
 		_, err := io.ReadFull(r, b)
 		if err != nil {
 			return 0, err
@@ -135,9 +190,10 @@ func decodeLength(r io.Reader) (int, error) {
 		digit := b[0]
 		rLength |= uint32(digit&127) << multiplier
 		if (digit & 128) == 0 {
-			break
+			return int(rLength), nil
 		}
 		multiplier += 7
 	}
-	return int(rLength), nil
+	// The continuation bit is set on the last byte.
+	return 0, errMalformedLength
 }
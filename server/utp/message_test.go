@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, raw bytes.Buffer) (FixedHeader, []byte) {
+	var fh FixedHeader
+	r := bytes.NewReader(raw.Bytes())
+	if err := fh.FromBinary(r); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, fh.MessageLength)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return fh, data
+}
+
+func TestPublishProperties(t *testing.T) {
+	pub := &Publish{
+		MessageID:    1,
+		DeliveryMode: 1,
+		Messages: []*PublishMessage{{
+			Topic:   "unit1.test",
+			Payload: []byte("msg"),
+			Properties: Properties{
+				UserProperties:        map[string]string{"content-type": "json"},
+				MessageExpiryInterval: 60,
+				TopicAlias:            7,
+			},
+		}},
+	}
+	raw, err := pub.ToBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, data := decode(t, raw)
+	if fh.MessageType != PUBLISH {
+		t.Fatalf("message type %d", fh.MessageType)
+	}
+	var got Publish
+	got.FromBinary(fh, data)
+	if !reflect.DeepEqual(got.Messages[0].Properties, pub.Messages[0].Properties) {
+		t.Fatalf("properties = %+v", got.Messages[0].Properties)
+	}
+}
+
+func TestPublishNoProperties(t *testing.T) {
+	pub := &Publish{MessageID: 1, Messages: []*PublishMessage{{Topic: "unit1.test", Payload: []byte("msg")}}}
+	raw, err := pub.ToBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, data := decode(t, raw)
+	var got Publish
+	got.FromBinary(fh, data)
+	if !got.Messages[0].Properties.IsEmpty() {
+		t.Fatalf("properties = %+v", got.Messages[0].Properties)
+	}
+}
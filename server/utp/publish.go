@@ -25,9 +25,10 @@ import (
 
 // PublishMessage reprensents a publish Message
 type PublishMessage struct {
-	Topic   string
-	Payload []byte
-	Ttl     string
+	Topic      string
+	Payload    []byte
+	Ttl        string
+	Properties Properties
 }
 
 // Publish represents a publish Messages.
@@ -47,6 +48,7 @@ func (p *Publish) ToBinary() (bytes.Buffer, error) {
 		pubMsg.Topic = string(m.Topic)
 		pubMsg.Payload = m.Payload
 		pubMsg.Ttl = m.Ttl
+		pubMsg.Properties = m.Properties.toProto()
 		pubMessages = append(pubMessages, &pubMsg)
 	}
 	pub := pbx.Publish{
@@ -74,6 +76,7 @@ func (p *Publish) FromBinary(fh FixedHeader, data []byte) {
 			Payload: m.Payload,
 			Ttl:     m.Ttl,
 		}
+		pubMsg.Properties.fromProto(m.Properties)
 		pubMessages = append(pubMessages, pubMsg)
 	}
 	p.MessageID = uint16(pub.MessageID)
@@ -38,6 +38,7 @@ type Subscribe struct {
 	IsForwarded   bool
 	MessageID     uint16
 	Subscriptions []*Subscription
+	Properties    Properties
 }
 
 // Unsubscribe is the Message to send if you don't want to subscribe to a topic anymore
@@ -60,6 +61,7 @@ func (s *Subscribe) ToBinary() (bytes.Buffer, error) {
 	sub := pbx.Subscribe{
 		MessageID:     int32(s.MessageID),
 		Subscriptions: subs,
+		Properties:    s.Properties.toProto(),
 	}
 	rawMsg, err := proto.Marshal(&sub)
 	if err != nil {
@@ -85,6 +87,7 @@ func (s *Subscribe) FromBinary(fh FixedHeader, data []byte) {
 
 	s.MessageID = uint16(sub.MessageID)
 	s.Subscriptions = subs
+	s.Properties.fromProto(sub.Properties)
 }
 
 // Type returns the Message type.
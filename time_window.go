@@ -17,8 +17,12 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -29,6 +33,9 @@ type (
 	_WinEntry struct {
 		sequence  uint64
 		expiresAt uint32
+		// insertedAt is the time in seconds the entry is put, or 0 if the entry is written to
+		// a window block of version 1 or recovered from the WAL.
+		insertedAt uint32
 	}
 	_WinBlock struct {
 		topicHash uint64
@@ -40,12 +47,20 @@ type (
 		cutoffTime int64
 		entryIdx   uint16
 
+		// legacy is set for a window block of version 1 whose entries have no insertion time.
+		legacy bool
+
 		// dirty used during timeWindow append and not persisted.
 		dirty bool
 
 		// leased used in timeWindow write and not persisted.
 		leased bool
 	}
+	// _ExpiryEntry is a window entry added to the expiry window along with its topic hash.
+	_ExpiryEntry struct {
+		_WinEntry
+		topicHash uint64
+	}
 )
 
 func newWinEntry(seq uint64, expiresAt uint32) _WinEntry {
@@ -60,6 +75,10 @@ func (e _WinEntry) expiryTime() uint32 {
 	return e.expiresAt
 }
 
+func (e _WinEntry) insertionTime() uint32 {
+	return e.insertedAt
+}
+
 func (e _WinEntry) isExpired() bool {
 	return e.expiresAt != 0 && e.expiresAt <= uint32(time.Now().Unix())
 }
@@ -68,35 +87,64 @@ func (b _WinBlock) cutoff(cutoff int64) bool {
 	return b.cutoffTime != 0 && b.cutoffTime < cutoff
 }
 
-// marshalBinary serialized window block into binary data.
+// capacity returns the number of entries the window block holds. A window block of version 1 holds
+// more entries as its entries have no insertion time.
+func (b _WinBlock) capacity() int {
+	if b.legacy {
+		return entriesPerWindowBlock
+	}
+	return entriesPerTimeBlock
+}
+
+// marshalBinary serialized window block into binary data. The last byte of the block holds the
+// version of the window block, it is zero in a window block of version 1.
 func (b _WinBlock) marshalBinary() []byte {
 	buf := make([]byte, blockSize)
 	data := buf
-	for i := 0; i < entriesPerWindowBlock; i++ {
+	for i := 0; i < b.capacity(); i++ {
 		e := b.entries[i]
 		binary.LittleEndian.PutUint64(buf[:8], e.sequence)
 		binary.LittleEndian.PutUint32(buf[8:12], e.expiresAt)
 		buf = buf[12:]
+		if !b.legacy {
+			binary.LittleEndian.PutUint32(buf[:4], e.insertedAt)
+			buf = buf[4:]
+		}
 	}
 	binary.LittleEndian.PutUint64(buf[:8], uint64(b.cutoffTime))
 	binary.LittleEndian.PutUint64(buf[8:16], b.topicHash)
 	binary.LittleEndian.PutUint64(buf[16:24], uint64(b.next))
 	binary.LittleEndian.PutUint16(buf[24:26], b.entryIdx)
+	if !b.legacy {
+		data[blockSize-1] = winVersion
+	}
 	return data
 }
 
 // unmarshalBinary de-serialized window block from binary data.
 func (b *_WinBlock) unmarshalBinary(data []byte) error {
-	for i := 0; i < entriesPerWindowBlock; i++ {
+	b.legacy = data[blockSize-1] == 0
+	n := b.capacity()
+	for i := 0; i < n; i++ {
 		_ = data[12] // bounds check hint to compiler; see golang.org/issue/14808.
 		b.entries[i].sequence = binary.LittleEndian.Uint64(data[:8])
 		b.entries[i].expiresAt = binary.LittleEndian.Uint32(data[8:12])
 		data = data[12:]
+		if !b.legacy {
+			b.entries[i].insertedAt = binary.LittleEndian.Uint32(data[:4])
+			data = data[4:]
+		}
+	}
+	for i := n; i < entriesPerWindowBlock; i++ {
+		b.entries[i] = _WinEntry{}
 	}
 	b.cutoffTime = int64(binary.LittleEndian.Uint64(data[:8]))
 	b.topicHash = binary.LittleEndian.Uint64(data[8:16])
 	b.next = int64(binary.LittleEndian.Uint64(data[16:24]))
 	b.entryIdx = binary.LittleEndian.Uint16(data[24:26])
+	if int(b.entryIdx) > n {
+		return errCorrupted
+	}
 	return nil
 }
 
@@ -104,12 +152,121 @@ func winBlockOffset(idx int32) int64 {
 	return int64(blockSize * idx)
 }
 
+// The first window block of the window file is reserved for the header, as the zero offset marks
+// a topic without window blocks and the end of the chain of window blocks of a topic. The header is
+// the DB signature followed by the version of the window file. A window file written before the
+// header was added has no header and may hold the first window block of a topic in the reserved
+// block, the block is moved to the end of the window file and the header is written on open.
+// The window blocks of version 2 hold the insertion time of the entries, the window blocks of
+// version 1 are kept as is and the header of a window file of version 1 is upgraded on open.
+const winVersion = 2
+
+func winHeader() []byte {
+	buf := make([]byte, blockSize)
+	copy(buf[:7], signature[:])
+	binary.LittleEndian.PutUint32(buf[7:11], winVersion)
+	return buf
+}
+
+// initWindowFile checks the header of the window file and writes the header to a new window
+// file or a window file without the header. A read-only window file is read as is.
+func initWindowFile(winFile *_File, readOnly bool) error {
+	size := winFile.currSize()
+	buf := make([]byte, blockSize)
+	if size >= int64(blockSize) {
+		data, err := winFile.slice(0, int64(blockSize))
+		if err != nil {
+			return err
+		}
+		buf = data
+	}
+	if bytes.Equal(buf[:7], signature[:]) {
+		v := binary.LittleEndian.Uint32(buf[7:11])
+		if v > winVersion {
+			return errWindowVersion
+		}
+		if v == winVersion || readOnly {
+			return nil
+		}
+		if _, err := winFile.WriteAt(winHeader(), 0); err != nil {
+			return err
+		}
+		return winFile.Sync()
+	}
+	if readOnly {
+		return nil
+	}
+	if size < int64(blockSize) {
+		if _, err := winFile.extend(uint32(int64(blockSize) - size)); err != nil {
+			return err
+		}
+	}
+	var b _WinBlock
+	if err := b.unmarshalBinary(buf); err != nil {
+		return err
+	}
+	if b.entryIdx != 0 {
+		if err := moveWindowBlock(winFile, b, buf); err != nil {
+			return err
+		}
+	}
+	if _, err := winFile.WriteAt(winHeader(), 0); err != nil {
+		return err
+	}
+	return winFile.Sync()
+}
+
+// moveWindowBlock moves the window block written to the reserved block to the end of the
+// window file and links the next window block of the topic to the moved block. A copy of the
+// block left by an earlier move is reused.
+func moveWindowBlock(winFile *_File, b _WinBlock, data []byte) error {
+	r := _WindowReader{winFile: winFile}
+	nBlocks := int32(winFile.currSize() / int64(blockSize))
+	off := int64(-1)
+	for idx := int32(1); idx < nBlocks && off == -1; idx++ {
+		buf, err := winFile.slice(winBlockOffset(idx), winBlockOffset(idx+1))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(buf, data) {
+			off = winBlockOffset(idx)
+		}
+	}
+	if off == -1 {
+		off = winBlockOffset(nBlocks)
+		if _, err := winFile.WriteAt(data, off); err != nil {
+			return err
+		}
+		winFile.currSize()
+	}
+	// The next window block of the topic had its link to the reserved block read as the end of
+	// the chain.
+	for idx := int32(1); idx < nBlocks; idx++ {
+		r.offset = winBlockOffset(idx)
+		next, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		if r.offset == off || next.entryIdx == 0 || next.topicHash != b.topicHash || next.next != 0 {
+			continue
+		}
+		next.next = off
+		if _, err := winFile.WriteAt(next.marshalBinary(), r.offset); err != nil {
+			return err
+		}
+	}
+	return winFile.Sync()
+}
+
 type (
 	_TimeOptions struct {
 		maxDuration         time.Duration
 		expDurationType     time.Duration
 		maxExpDurations     int
 		backgroundKeyExpiry bool
+		expiryInterval      time.Duration
+		expiryBatchSize     int
+		keyHash             hash.KeyHash
 	}
 	_TimeWindowBucket struct {
 		sync.RWMutex
@@ -137,12 +294,16 @@ type _WindowBlocks struct {
 	consistent *hash.Consistent
 }
 
-// newWindowBlocks creates a new concurrent windows.
-func newWindowBlocks() *_WindowBlocks {
+// newWindowBlocks creates a new concurrent windows, the topic hashes are hashed by fn
+// before they are assigned to the shards if fn is not nil.
+func newWindowBlocks(fn hash.KeyHash) *_WindowBlocks {
 	wb := &_WindowBlocks{
 		window:     make([]*_TimeWindow, nShards),
 		consistent: hash.InitConsistent(nShards, nShards),
 	}
+	if fn != nil {
+		wb.consistent = hash.InitConsistentWithHash(nShards, nShards, fn)
+	}
 
 	for i := 0; i < nShards; i++ {
 		wb.window[i] = &_TimeWindow{entries: make(map[_Key]_WindowEntries)}
@@ -159,13 +320,18 @@ func (w *_WindowBlocks) getWindowBlock(blockID uint64) *_TimeWindow {
 }
 
 func newTimeWindowBucket(opts *_TimeOptions) *_TimeWindowBucket {
-	l := &_TimeWindowBucket{}
-	l.windowBlocks = newWindowBlocks()
+	l := &_TimeWindowBucket{opts: opts}
+	l.windowBlocks = newWindowBlocks(opts.keyHash)
 	l.expiryWindowBucket = newExpiryWindowBucket(opts.backgroundKeyExpiry, opts.expDurationType, opts.maxExpDurations)
 	return l
 }
 
+// add adds the window entry to the time block, the entry is inserted at the current time unless
+// it has the insertion time.
 func (tw *_TimeWindowBucket) add(timeID int64, topicHash uint64, e _WinEntry) (ok bool) {
+	if e.insertedAt == 0 {
+		e.insertedAt = uint32(time.Now().Unix())
+	}
 	// get windowBlock shard.
 	tw.RLock()
 	b := tw.windowBlocks.getWindowBlock(topicHash)
@@ -185,6 +351,21 @@ func (tw *_TimeWindowBucket) add(timeID int64, topicHash uint64, e _WinEntry) (o
 	}
 	return true
 }
+
+// insertionTimes returns the insertion times of the window entries of the topic added to the time
+// block by the seqs of the entries.
+func (tw *_TimeWindowBucket) insertionTimes(timeID int64, topicHash uint64) map[uint64]uint32 {
+	b := tw.windowBlocks.getWindowBlock(topicHash)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	wEntries := b.entries[_Key{timeID: timeID, topicHash: topicHash}]
+	times := make(map[uint64]uint32, len(wEntries))
+	for _, we := range wEntries {
+		times[we.sequence] = we.insertedAt
+	}
+	return times
+}
+
 func (tw *_TimeWindowBucket) release() func(timeID int64) error {
 	releasedKeys := make(map[int64][]_Key)
 	for i := 0; i < nShards; i++ {
@@ -217,55 +398,86 @@ func (tw *_TimeWindowBucket) release() func(timeID int64) error {
 }
 
 // ilookup lookups window entries from timeWindowBucket and not yet sync to DB.
-func (tw *_TimeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries _WindowEntries) {
-	winEntries = make([]_WinEntry, 0)
+// Entries at or after the before seq are skipped if before is non zero.
+func (tw *_TimeWindowBucket) ilookup(topicHash, before, since uint64, limit int, withExpired bool) (winEntries _WindowEntries) {
 	// get windowBlock shard.
 	b := tw.windowBlocks.getWindowBlock(topicHash)
 	b.mu.RLock()
-	defer b.mu.RUnlock()
-	var l int
-	var expiryCount int
+	winEntries, expired := tw.ilookupBlock(b, topicHash, before, since, limit, withExpired)
+	b.mu.RUnlock()
+	tw.addExpiry(expired)
+	return winEntries
+}
+
+// ilookupBlock lookups window entries from the window block shard. The caller must hold the shard lock.
+// The expired entries found are returned so the caller adds them to the expiry window once the
+// shard lock is released. Entries at or before the since seq are skipped if since is non zero.
+// Expired entries are skipped unless withExpired is set.
+func (tw *_TimeWindowBucket) ilookupBlock(b *_TimeWindow, topicHash, before, since uint64, limit int, withExpired bool) (winEntries _WindowEntries, expired []_ExpiryEntry) {
+	winEntries = make([]_WinEntry, 0)
 
 	for key := range b.entries {
 		if key.topicHash != topicHash {
 			continue
 		}
 		wEntries := b.entries[key]
-		if len(wEntries) > 0 {
-			l = limit + expiryCount - l
-			if len(wEntries) < l {
-				l = len(wEntries)
+		l := 0
+		for i := len(wEntries) - 1; i >= 0 && l < limit; i-- {
+			we := wEntries[i]
+			if before != 0 && we.seq() >= before {
+				continue
+			}
+			if since != 0 && we.seq() <= since {
+				continue
 			}
-			for i := len(wEntries) - 1; i >= len(wEntries)-l; i-- {
-				we := wEntries[i]
-				if we.isExpired() {
-					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-						expiryCount++
-						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
-					}
-					// if id is expired it does not return an error but continue the iteration.
+			if we.isExpired() {
+				expired = append(expired, _ExpiryEntry{_WinEntry: we, topicHash: topicHash})
+				// an expired id is skipped without an error unless expired entries are requested.
+				if !withExpired {
 					continue
 				}
-				winEntries = append(winEntries, we)
 			}
+			winEntries = append(winEntries, we)
+			l++
 		}
 	}
-	return winEntries
+	return winEntries, expired
 }
 
-// lookup lookups window entries from window file.
-func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff int64, limit int) (winEntries _WindowEntries) {
-	winEntries = make([]_WinEntry, 0)
-	winEntries = tw.ilookup(topicHash, limit)
+// addExpiry adds the expired entries to the expiry window.
+func (tw *_TimeWindowBucket) addExpiry(expired []_ExpiryEntry) {
+	for _, e := range expired {
+		if err := tw.expiryWindowBucket.addExpiry(e); err != nil {
+			logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
+		}
+	}
+}
+
+// lookup lookups window entries from window file. Entries at or before the since seq are skipped
+// if since is non zero, and expired entries are skipped unless withExpired is set. It returns the
+// context error if the context is done before the lookup is complete.
+func (tw *_TimeWindowBucket) lookup(ctx context.Context, fs *_FileSet, topicHash, before, since uint64, off, cutoff int64, limit int, withExpired bool) (winEntries _WindowEntries, err error) {
+	return tw.flookup(ctx, fs, topicHash, before, since, off, cutoff, limit, withExpired, tw.ilookup(topicHash, before, since, limit, withExpired))
+}
+
+// flookup lookups window entries from window file following the in memory window entries.
+// The entries are not ordered by seq as the entries put concurrently are added in any order,
+// so the entries at or before the since seq are skipped without stopping the lookup.
+func (tw *_TimeWindowBucket) flookup(ctx context.Context, fs *_FileSet, topicHash, before, since uint64, off, cutoff int64, limit int, withExpired bool, winEntries _WindowEntries) (_WindowEntries, error) {
 	if len(winEntries) >= limit {
-		return winEntries
+		return winEntries, nil
 	}
 	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
 	if err != nil {
-		return winEntries
+		return winEntries, nil
 	}
 	next := func(blockOff int64, f func(_WinBlock) (bool, error)) error {
 		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
 			r := _WindowReader{winFile: winFile, offset: blockOff}
 			b, err := r.readWindowBlock()
 			if err != nil {
@@ -280,53 +492,208 @@ func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff
 			blockOff = b.next
 		}
 	}
-	expiryCount := 0
 	err = next(off, func(curb _WinBlock) (bool, error) {
 		b := &curb
 		if b.topicHash != topicHash {
 			return true, nil
 		}
-		if len(winEntries) > limit-int(b.entryIdx) {
-			limit = limit - len(winEntries)
-			for i := len(b.entries[:b.entryIdx]) - 1; i >= len(b.entries[:b.entryIdx])-limit; i-- {
-				we := b.entries[i]
-				if we.isExpired() {
-					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-						expiryCount++
-						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
-					}
-					// if id is expired it does not return an error but continue the iteration.
-					continue
-				}
-				winEntries = append(winEntries, we)
-			}
-			if len(winEntries) >= limit {
-				return true, nil
-			}
-		}
 		for i := len(b.entries[:b.entryIdx]) - 1; i >= 0; i-- {
 			we := b.entries[i]
+			if before != 0 && we.seq() >= before {
+				continue
+			}
+			if since != 0 && we.seq() <= since {
+				continue
+			}
 			if we.isExpired() {
-				if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-					expiryCount++
+				if err := tw.expiryWindowBucket.addExpiry(_ExpiryEntry{_WinEntry: we, topicHash: topicHash}); err != nil {
 					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 				}
-				// if id is expired it does not return an error but continue the iteration.
-				continue
+				// an expired id is skipped without an error unless expired entries are requested.
+				if !withExpired {
+					continue
+				}
 			}
 			winEntries = append(winEntries, we)
-
+			if len(winEntries) >= limit {
+				return true, nil
+			}
 		}
 		if b.cutoff(cutoff) {
 			return true, nil
 		}
 		return false, nil
 	})
+	if err != nil && err == ctx.Err() {
+		return winEntries, err
+	}
+
+	return winEntries, nil
+}
+
+// lookupAscending lookups window entries in insertion order from the window file followed by the
+// entries from timeWindowBucket not yet sync to DB. Entries at or before the after seq are skipped
+// if after is non zero, and expired entries are skipped unless withExpired is set. It returns the context
+// error if the context is done before the lookup is complete.
+func (tw *_TimeWindowBucket) lookupAscending(ctx context.Context, fs *_FileSet, topicHash, after uint64, off, cutoff int64, limit int, withExpired bool) (_WindowEntries, error) {
+	winEntries := make([]_WinEntry, 0)
+	add := func(we _WinEntry) bool {
+		if after != 0 && we.seq() <= after {
+			return false
+		}
+		if we.isExpired() {
+			if err := tw.expiryWindowBucket.addExpiry(_ExpiryEntry{_WinEntry: we, topicHash: topicHash}); err != nil {
+				logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
+			}
+			if !withExpired {
+				return false
+			}
+		}
+		winEntries = append(winEntries, we)
+		return len(winEntries) >= limit
+	}
+
+	if winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow}); err == nil {
+		// Blocks are chained backward so block offsets are collected from the latest block
+		// and the blocks are read from the earliest block.
+		var blockOffs []int64
+		for blockOff := off; ; {
+			select {
+			case <-ctx.Done():
+				return winEntries, ctx.Err()
+			default:
+			}
+			r := _WindowReader{winFile: winFile, offset: blockOff}
+			b, err := r.readWindowBlock()
+			if err != nil || b.topicHash != topicHash {
+				break
+			}
+			blockOffs = append(blockOffs, blockOff)
+			if b.cutoff(cutoff) || b.next == 0 {
+				break
+			}
+			blockOff = b.next
+		}
+		for i := len(blockOffs) - 1; i >= 0; i-- {
+			r := _WindowReader{winFile: winFile, offset: blockOffs[i]}
+			b, err := r.readWindowBlock()
+			if err != nil {
+				return winEntries, nil
+			}
+			for _, we := range b.entries[:b.entryIdx] {
+				if add(we) {
+					return winEntries, nil
+				}
+			}
+		}
+	}
+
+	wEntries := tw.ilookup(topicHash, 0, after, math.MaxInt32, withExpired)
+	sort.Slice(wEntries[:], func(i, j int) bool {
+		return wEntries[i].seq() < wEntries[j].seq()
+	})
+	for _, we := range wEntries {
+		if add(we) {
+			break
+		}
+	}
+	return winEntries, nil
+}
+
+// find finds the window entry for the seq of the topic from the timeWindowBucket or the window file.
+// Expired entries are returned so the caller can tell them apart from the entries not found.
+func (tw *_TimeWindowBucket) find(ctx context.Context, fs *_FileSet, topicHash, seq uint64, off int64) (_WinEntry, bool, error) {
+	b := tw.windowBlocks.getWindowBlock(topicHash)
+	b.mu.RLock()
+	for key, wEntries := range b.entries {
+		if key.topicHash != topicHash {
+			continue
+		}
+		for _, we := range wEntries {
+			if we.seq() == seq {
+				b.mu.RUnlock()
+				return we, true, nil
+			}
+		}
+	}
+	b.mu.RUnlock()
+
+	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
 	if err != nil {
-		return winEntries
+		return _WinEntry{}, false, nil
 	}
+	for blockOff := off; ; {
+		select {
+		case <-ctx.Done():
+			return _WinEntry{}, false, ctx.Err()
+		default:
+		}
+		r := _WindowReader{winFile: winFile, offset: blockOff}
+		b, err := r.readWindowBlock()
+		if err != nil || b.topicHash != topicHash {
+			return _WinEntry{}, false, nil
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.seq() == seq {
+				return we, true, nil
+			}
+		}
+		// Blocks are chained from the latest to the earliest entries.
+		if b.entryIdx == 0 || b.entries[0].seq() < seq || b.next == 0 {
+			return _WinEntry{}, false, nil
+		}
+		blockOff = b.next
+	}
+}
 
-	return winEntries
+// expiringBefore returns the window entries with an expiry before the time t from the
+// timeWindowBucket and the window file. Entries expired but not yet reclaimed are included.
+// The window entries and the expiry windows are not changed. It returns an error if a window
+// block is not read from the window file.
+func (tw *_TimeWindowBucket) expiringBefore(fs *_FileSet, t time.Time) ([]_ExpiryEntry, error) {
+	before := uint32(t.Unix())
+	var entries []_ExpiryEntry
+	seen := make(map[uint64]bool)
+	add := func(topicHash uint64, we _WinEntry) {
+		if we.expiresAt == 0 || we.expiresAt >= before || seen[we.seq()] {
+			return
+		}
+		seen[we.seq()] = true
+		entries = append(entries, _ExpiryEntry{_WinEntry: we, topicHash: topicHash})
+	}
+
+	tw.RLock()
+	defer tw.RUnlock()
+	tw.windowBlocks.RLock()
+	for i := 0; i < nShards; i++ {
+		b := tw.windowBlocks.window[i]
+		b.mu.RLock()
+		for key, wEntries := range b.entries {
+			for _, we := range wEntries {
+				add(key.topicHash, we)
+			}
+		}
+		b.mu.RUnlock()
+	}
+	tw.windowBlocks.RUnlock()
+
+	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return entries, nil
+	}
+	size := winFile.currSize()
+	// The first block is the header of the window file.
+	for off := winBlockOffset(1); off+int64(blockSize) <= size; off += int64(blockSize) {
+		r := _WindowReader{winFile: winFile, offset: off}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return nil, err
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			add(b.topicHash, we)
+		}
+	}
+	return entries, nil
 }
 
 func (b _WinBlock) validation(topicHash uint64) error {
@@ -54,27 +54,88 @@ func (r *_WindowReader) readWindowBlock() (_WinBlock, error) {
 	return r.winBlock, nil
 }
 
-// blockIterator iterates all window blocks from disk.
+// blockIterator iterates all window blocks from disk. It calls f once per topic with
+// the start sequence of the first window block and the offset of the last window block,
+// so that appends after a restart resume filling the tail block of the topic.
 func (r *_WindowReader) blockIterator(f func(startSeq, topicHash uint64, off int64) (bool, error)) (err error) {
-	windowIdx := int32(0)
+	type _BlockRange struct {
+		startSeq uint64
+		head     bool
+		offs     []int64
+	}
+	var topics []uint64
+	ranges := make(map[uint64]*_BlockRange) // map[topicHash]blockRange
+	linked := make(map[int64]bool)          // offsets of the window blocks linked from a later block.
+	// The first block is the header of the window file.
+	windowIdx := int32(1)
 	nBlocks := r.windowIdx
 	for windowIdx <= nBlocks {
 		r.offset = winBlockOffset(windowIdx)
 		b, err := r.readWindowBlock()
 		if err != nil {
 			if err == io.EOF {
-				return nil
+				break
 			}
 			return err
 		}
 		windowIdx++
-		if b.entryIdx == 0 || b.next != 0 {
+		if b.entryIdx == 0 {
+			continue
+		}
+		br, ok := ranges[b.topicHash]
+		if !ok {
+			br = &_BlockRange{}
+			ranges[b.topicHash] = br
+			topics = append(topics, b.topicHash)
+		}
+		if b.next == 0 && !br.head {
+			br.head = true
+			br.startSeq = b.entries[0].sequence
+		}
+		if b.next != 0 {
+			linked[b.next] = true
+		}
+		br.offs = append(br.offs, r.offset)
+	}
+	for _, topicHash := range topics {
+		br := ranges[topicHash]
+		// Topics without the first window block are skipped.
+		if !br.head {
 			continue
 		}
-		// fmt.Println("timeWindow.blockIterator: topicHash, seq ", b.topicHash, b.entries[0].sequence)
-		if stop, err := f(b.entries[0].sequence, b.topicHash, r.offset); stop || err != nil {
+		// The tail block is not linked from a later block, window blocks are mostly allocated in
+		// increasing order so the last such block read is taken.
+		off := br.offs[len(br.offs)-1]
+		for i := len(br.offs) - 1; i >= 0; i-- {
+			if !linked[br.offs[i]] {
+				off = br.offs[i]
+				break
+			}
+		}
+		// fmt.Println("timeWindow.blockIterator: topicHash, seq ", topicHash, br.startSeq)
+		if stop, err := f(br.startSeq, topicHash, off); stop || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryIterator iterates the window entries of all window blocks from disk.
+func (r *_WindowReader) entryIterator(f func(topicHash uint64, we _WinEntry) error) error {
+	for windowIdx := int32(1); windowIdx <= r.windowIdx; windowIdx++ {
+		r.offset = winBlockOffset(windowIdx)
+		b, err := r.readWindowBlock()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
 			return err
 		}
+		for i := 0; i < int(b.entryIdx); i++ {
+			if err := f(b.topicHash, b.entries[i]); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -18,6 +18,8 @@ package unitdb
 
 import (
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/bpool"
@@ -79,6 +81,49 @@ func (w *_WindowWriter) del(seq uint64, winIdx int32) error {
 	return nil
 }
 
+// readBlocks reads the window blocks at the topic offsets that are not yet buffered using a bounded
+// pool of workers, so the appends do not read the window file for each topic in turn.
+func (w *_WindowWriter) readBlocks(topicOffs map[uint64]int64) error {
+	type _BlockRead struct {
+		wIdx int32
+		b    _WinBlock
+		err  error
+	}
+	var reads []_BlockRead
+	for _, off := range topicOffs {
+		wIdx := int32(off / int64(blockSize))
+		if _, ok := w.winBlocks[wIdx]; ok || off == 0 || wIdx > w.windowIdx {
+			continue
+		}
+		reads = append(reads, _BlockRead{wIdx: wIdx})
+	}
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for n := syncWorkers(len(reads), minSyncWorkerBlocks); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(reads) {
+					return
+				}
+				r := _WindowReader{winFile: w.winFile, offset: winBlockOffset(reads[i].wIdx)}
+				reads[i].b, reads[i].err = r.readWindowBlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, rd := range reads {
+		if rd.err != nil {
+			return rd.err
+		}
+		rd.b.leased = true
+		w.winBlocks[rd.wIdx] = rd.b
+	}
+	return nil
+}
+
 // append appends window entries to buffer.
 func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntries) (newOff int64, err error) {
 	var b _WinBlock
@@ -107,7 +152,7 @@ func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntr
 		if we.sequence == 0 {
 			continue
 		}
-		if b.entryIdx == entriesPerWindowBlock {
+		if int(b.entryIdx) == b.capacity() {
 			topicHash := b.topicHash
 			next := int64(blockSize * wIdx)
 			// set approximate cutoff on winBlock.
@@ -120,7 +165,7 @@ func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntr
 		if b.leased {
 			w.winLeases[wIdx] = append(w.winLeases[wIdx], we.sequence)
 		}
-		b.entries[b.entryIdx] = _WinEntry{sequence: we.sequence, expiresAt: we.expiresAt}
+		b.entries[b.entryIdx] = _WinEntry{sequence: we.sequence, expiresAt: we.expiresAt, insertedAt: we.insertedAt}
 		b.dirty = true
 		b.entryIdx++
 	}
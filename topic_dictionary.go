@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// topicRecordHeaderSize is size of the record length, topic hash and raw topic length of a topic record.
+const topicRecordHeaderSize = 14
+
+type _TopicRecord struct {
+	rawTopic []byte
+	name     string
+}
+
+// _TopicDictionary maps topic hashes to the raw topics and the topic names. Records are appended
+// to the topic file with a checksum, a torn record at the end of the file is truncated on load.
+type _TopicDictionary struct {
+	mu     sync.RWMutex
+	file   _FileSet
+	topics map[uint64]_TopicRecord
+}
+
+// newTopicDictionary loads the topic dictionary from the topic file.
+func newTopicDictionary(file _FileSet, readOnly bool) (*_TopicDictionary, error) {
+	d := &_TopicDictionary{file: file, topics: make(map[uint64]_TopicRecord)}
+	size := file.currSize()
+	if size == 0 {
+		return d, nil
+	}
+	raw := make([]byte, size)
+	if _, err := file.ReadAt(raw, 0); err != nil {
+		return d, err
+	}
+	var off int64
+	for off+topicRecordHeaderSize+4 <= size {
+		n := int64(binary.LittleEndian.Uint32(raw[off : off+4]))
+		if n < topicRecordHeaderSize || off+n+4 > size {
+			break
+		}
+		data := raw[off : off+n]
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(raw[off+n:off+n+4]) {
+			break
+		}
+		hash := binary.LittleEndian.Uint64(data[4:12])
+		rawLen := int(binary.LittleEndian.Uint16(data[12:14]))
+		if topicRecordHeaderSize+rawLen > len(data) {
+			break
+		}
+		rawTopic := make([]byte, rawLen)
+		copy(rawTopic, data[topicRecordHeaderSize:topicRecordHeaderSize+rawLen])
+		d.topics[hash] = _TopicRecord{rawTopic: rawTopic, name: string(data[topicRecordHeaderSize+rawLen:])}
+		off += n + 4
+	}
+	if off < size {
+		logger.Info().Str("context", "topicDictionary.load").Int64("offset", off).Msg("truncating torn topic record")
+		if !readOnly {
+			if err := file.truncate(off); err != nil {
+				return d, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// get returns the raw topic and the topic name of the topic hash.
+func (d *_TopicDictionary) get(topicHash uint64) (_TopicRecord, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	r, ok := d.topics[topicHash]
+	return r, ok
+}
+
+// add appends the topic record to the topic file. The record replaces an earlier record of the
+// topic hash unless the raw topic is unchanged, an empty name keeps the name of the earlier record.
+func (d *_TopicDictionary) add(topicHash uint64, rawTopic []byte, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.topics[topicHash]; ok && bytes.Equal(r.rawTopic, rawTopic) && (name == "" || name == r.name) {
+		return nil
+	}
+	n := topicRecordHeaderSize + len(rawTopic) + len(name)
+	buf := make([]byte, n+4)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(n))
+	binary.LittleEndian.PutUint64(buf[4:12], topicHash)
+	binary.LittleEndian.PutUint16(buf[12:14], uint16(len(rawTopic)))
+	copy(buf[topicRecordHeaderSize:], rawTopic)
+	copy(buf[topicRecordHeaderSize+len(rawTopic):], name)
+	binary.LittleEndian.PutUint32(buf[n:], crc32.ChecksumIEEE(buf[:n]))
+	if _, err := d.file.write(buf); err != nil {
+		return err
+	}
+	rawCopy := make([]byte, len(rawTopic))
+	copy(rawCopy, rawTopic)
+	d.topics[topicHash] = _TopicRecord{rawTopic: rawCopy, name: name}
+	return nil
+}
+
+// sync flushes the topic file to disk.
+func (d *_TopicDictionary) sync() error {
+	return d.file.Sync()
+}
+
+// setTopicName names the topic from its record in the topic dictionary.
+func (db *DB) setTopicName(topicHash uint64, r _TopicRecord) {
+	if t := new(message.Topic); r.name != "" && t.Unmarshal(r.rawTopic) == nil && len(t.Parts) > 0 {
+		// The first part of the raw topic is the contract.
+		db.internal.topics.setName(topicHash, t.Parts[0].Hash, r.name)
+	}
+}
+
+// putTopic adds a new topic to the topic dictionary if the DB keeps a topic dictionary.
+func (db *DB) putTopic(topicHash uint64, rawTopic []byte, name string) error {
+	if db.internal.topicDict == nil {
+		return nil
+	}
+	return db.internal.topicDict.add(topicHash, rawTopic, name)
+}
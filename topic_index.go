@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+type _TopicKey struct {
+	contract uint32
+	name     string
+}
+
+func (k _TopicKey) less(other _TopicKey) bool {
+	if k.contract != other.contract {
+		return k.contract < other.contract
+	}
+	return k.name < other.name
+}
+
+// _TopicIndex keeps the topic names sorted by contract and name, so the topics under a prefix
+// are a contiguous range of the index.
+type _TopicIndex struct {
+	mu     sync.RWMutex
+	keys   []_TopicKey
+	topics map[uint64]_TopicKey
+}
+
+// staticTopic reports whether the topic has no wildcards, only static topics are kept in the index.
+func staticTopic(t *message.Topic) bool {
+	if t.Depth == message.TopicMaxDepth {
+		return false
+	}
+	for _, part := range t.Parts {
+		if part.Wildchars > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func newTopicIndex() *_TopicIndex {
+	return &_TopicIndex{topics: make(map[uint64]_TopicKey)}
+}
+
+// search returns the position of the first key not less than the key.
+func (x *_TopicIndex) search(k _TopicKey) int {
+	return sort.Search(len(x.keys), func(i int) bool {
+		return !x.keys[i].less(k)
+	})
+}
+
+// add adds the topic name to the index, a topic already in the index is skipped.
+func (x *_TopicIndex) add(contract uint32, name string, topicHash uint64) {
+	x.mu.RLock()
+	_, ok := x.topics[topicHash]
+	x.mu.RUnlock()
+	if ok {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.topics[topicHash]; ok {
+		return
+	}
+	k := _TopicKey{contract: contract, name: name}
+	x.topics[topicHash] = k
+	i := x.search(k)
+	if i < len(x.keys) && x.keys[i] == k {
+		return
+	}
+	x.keys = append(x.keys, _TopicKey{})
+	copy(x.keys[i+1:], x.keys[i:])
+	x.keys[i] = k
+}
+
+// remove removes the topic from the index.
+func (x *_TopicIndex) remove(topicHash uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	k, ok := x.topics[topicHash]
+	if !ok {
+		return
+	}
+	delete(x.topics, topicHash)
+	if i := x.search(k); i < len(x.keys) && x.keys[i] == k {
+		x.keys = append(x.keys[:i], x.keys[i+1:]...)
+	}
+}
+
+// prefix returns the names of the topics of the contract under the prefix in lexical order,
+// skipping offset names and returning at most limit names. A topic is under the prefix if it is
+// the prefix topic or a topic below it, so "a.b" matches "a.b" and "a.b.c" but not "a.bc".
+func (x *_TopicIndex) prefix(contract uint32, prefix string, offset, limit int) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var names []string
+	for i := x.search(_TopicKey{contract: contract, name: prefix}); i < len(x.keys); i++ {
+		k := x.keys[i]
+		if k.contract != contract || !strings.HasPrefix(k.name, prefix) {
+			break
+		}
+		if prefix != "" && len(k.name) > len(prefix) && k.name[len(prefix)] != '.' {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		names = append(names, k.name)
+		if limit > 0 && len(names) == limit {
+			break
+		}
+	}
+	return names
+}
@@ -63,27 +63,33 @@ type _Node struct {
 	topics   _Topics
 }
 
+// orphan removes the node from its parent if the node has no topics and no children,
+// the parents left empty are removed up the tree.
 func (n *_Node) orphan() {
-	if n.parent == nil {
+	if n.parent == nil || len(n.topics) != 0 || len(n.children) != 0 {
 		return
 	}
 
 	delete(n.parent.children, n.part)
-	if len(n.parent.children) == 0 {
-		n.parent.orphan()
-	}
+	n.parent.orphan()
 }
 
 // _topicTrie represents an efficient collection of Trie with lookup capability.
 type _TopicTrie struct {
-	summary map[uint64]*_Node // summary is map of topichash to node of tree.
-	root    *_Node            // The root node of the tree.
+	summary  map[uint64]*_Node         // summary is map of topichash to node of tree.
+	reserved map[uint64][]message.Part // reserved is map of topichash to parts of the topics not yet added.
+	pending  map[uint64]int            // pending is map of topichash to count of entries being written.
+	live     map[uint64]int            // live is map of topichash to count of live entries, if it is known.
+	root     *_Node                    // The root node of the tree.
 }
 
 // newTopicTrie creates a new Trie.
 func newTopicTrie() *_TopicTrie {
 	return &_TopicTrie{
-		summary: make(map[uint64]*_Node),
+		summary:  make(map[uint64]*_Node),
+		reserved: make(map[uint64][]message.Part),
+		pending:  make(map[uint64]int),
+		live:     make(map[uint64]int),
 		root: &_Node{
 			children: make(map[_Part]*_Node),
 		},
@@ -93,15 +99,12 @@ func newTopicTrie() *_TopicTrie {
 // _Trie trie data structure to store topic parts
 type _Trie struct {
 	sync.RWMutex
-	mutex     _Mutex
 	topicTrie *_TopicTrie
 }
 
 // newTrie new trie creates a Trie with an initialized Trie.
-// Mutex is used to lock concurent read/write on a contract, and it does not lock entire trie.
 func newTrie() *_Trie {
 	return &_Trie{
-		mutex:     newMutex(),
 		topicTrie: newTopicTrie(),
 	}
 }
@@ -113,12 +116,11 @@ func (t *_Trie) Count() int {
 	return len(t.topicTrie.summary)
 }
 
-// add adds a topic to trie.
+// add adds a topic to trie. The nodes of the topic are walked and inserted under the trie
+// lock, so a concurrent remove does not prune a node the topic is added to.
 func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8) (added bool) {
-	// Get mutex
-	mu := t.mutex.getMutex(topic.hash)
-	mu.Lock()
-	defer mu.Unlock()
+	t.Lock()
+	defer t.Unlock()
 	if _, ok := t.topicTrie.summary[topic.hash]; ok {
 		return false
 	}
@@ -128,28 +130,113 @@ func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8) (added bool
 			hash:      p.Hash,
 			wildchars: p.Wildchars,
 		}
-		t.RLock()
 		child, ok := curr.children[newPart]
-		t.RUnlock()
 		if !ok {
 			child = &_Node{
 				part:     newPart,
 				parent:   curr,
 				children: make(map[_Part]*_Node),
 			}
-			t.Lock()
 			curr.children[newPart] = child
-			t.Unlock()
 		}
 		curr = child
 	}
-	t.Lock()
 	curr.topics.addUnique(topic)
 	t.topicTrie.summary[topic.hash] = curr
-	t.Unlock()
-	added = true
+	delete(t.topicTrie.reserved, topic.hash)
 	curr.depth = depth
-	return
+	return true
+}
+
+// remove removes a topic from the trie and prunes the nodes of the topic left empty.
+func (t *_Trie) remove(topicHash uint64) (removed bool) {
+	t.Lock()
+	defer t.Unlock()
+	return t.removeLocked(topicHash)
+}
+
+// removeLocked removes a topic from the trie. It must be called with the trie lock held.
+func (t *_Trie) removeLocked(topicHash uint64) (removed bool) {
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return false
+	}
+	for i, topic := range curr.topics {
+		if topic.hash == topicHash {
+			curr.topics = append(curr.topics[:i], curr.topics[i+1:]...)
+			break
+		}
+	}
+	delete(t.topicTrie.summary, topicHash)
+	delete(t.topicTrie.pending, topicHash)
+	delete(t.topicTrie.live, topicHash)
+	curr.orphan()
+	return true
+}
+
+// pin marks an entry of the topic as being written if the topic is in the trie or its hash is reserved.
+// It returns false if the topic was removed, the topic hash is then resolved again.
+func (t *_Trie) pin(topicHash uint64) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.topicTrie.summary[topicHash]
+	if _, reserved := t.topicTrie.reserved[topicHash]; !ok && !reserved {
+		return false
+	}
+	t.topicTrie.pending[topicHash]++
+	return true
+}
+
+// release releases n entries of the topic marked as being written by reserveHash or pin, the
+// entries count towards the live entries of the topic if they are written.
+func (t *_Trie) release(topicHash uint64, n int, written bool) {
+	t.Lock()
+	defer t.Unlock()
+	if t.topicTrie.pending[topicHash] -= n; t.topicTrie.pending[topicHash] <= 0 {
+		delete(t.topicTrie.pending, topicHash)
+	}
+	if live, ok := t.topicTrie.live[topicHash]; ok && written {
+		t.topicTrie.live[topicHash] = live + n
+	}
+}
+
+// prune counts a deleted entry of the topic and removes the topic once it has no live entries and
+// no entries being written. The live entries of a topic loaded on open are counted once by the count
+// function from the window offset of the topic, the count is then kept up to date as entries are
+// written and deleted. It returns true if the topic is removed.
+func (t *_Trie) prune(topicHash uint64, count func(off int64) (int, error)) (bool, error) {
+	t.Lock()
+	defer t.Unlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return false, nil
+	}
+	live, ok := t.topicTrie.live[topicHash]
+	pending := t.topicTrie.pending[topicHash]
+	switch {
+	case ok:
+		live--
+	case pending > 0:
+		// The entries being written may or may not be counted, the live entries are counted later.
+		return false, nil
+	default:
+		var off int64
+		for _, topic := range curr.topics {
+			if topic.hash == topicHash {
+				off = topic.offset
+			}
+		}
+		n, err := count(off)
+		if err != nil {
+			return false, err
+		}
+		live = n
+	}
+	t.topicTrie.live[topicHash] = live
+	if live > 0 || pending > 0 {
+		return false, nil
+	}
+	return t.removeLocked(topicHash), nil
 }
 
 // lookup returns window entry set for given topic.
@@ -187,25 +274,189 @@ func (t *_Trie) ilookup(query []message.Part, depth, topicType uint8, tops *_Top
 	}
 }
 
+// match returns the concrete topics matching the query. Unlike lookup which matches
+// the wildcard topics in the trie to a static query, the wildcards are in the query.
+func (t *_Trie) match(query []message.Part) (tops _Topics) {
+	t.RLock()
+	defer t.RUnlock()
+	t.imatch(query, &tops, t.topicTrie.root)
+	return
+}
+
+func (t *_Trie) imatch(query []message.Part, tops *_Topics, currNode *_Node) {
+	if len(query) == 0 {
+		for _, topic := range currNode.topics {
+			tops.addUnique(topic)
+		}
+		return
+	}
+
+	q := query[0]
+	switch {
+	case q.Hash == message.Wildcard && q.Wildchars > 0:
+		// Leading single level wildcards.
+		t.iskip(query[1:], q.Wildchars, tops, currNode)
+		return
+	case q.Hash == message.Wildcard:
+		// Multi level wildcard matches all topics below the current branch.
+		t.imatch(nil, tops, currNode)
+		for part, n := range currNode.children {
+			if part.hash != message.Wildcard && part.wildchars == 0 {
+				t.imatch(query, tops, n)
+			}
+		}
+		return
+	}
+	n, ok := currNode.children[_Part{hash: q.Hash}]
+	if !ok {
+		return
+	}
+	t.iskip(query[1:], q.Wildchars, tops, n)
+}
+
+// iskip skips the single level wildcards below the current branch.
+func (t *_Trie) iskip(query []message.Part, wildchars uint8, tops *_Topics, currNode *_Node) {
+	if wildchars == 0 {
+		t.imatch(query, tops, currNode)
+		return
+	}
+	for part, n := range currNode.children {
+		if part.hash != message.Wildcard && part.wildchars == 0 {
+			t.iskip(query, wildchars-1, tops, n)
+		}
+	}
+}
+
+// topicHash returns the hash of the topic with the parts. The parts hashes are combined by xor
+// so distinct topics may share a hash, the hash of a topic is resolved from the node of its parts.
+// A new topic colliding with the hash of another topic is chained to the next free hash keeping
+// the contract and depth bits of the hash. It returns false if the topic is not found in the trie.
+func (t *_Trie) topicHash(hash uint64, parts []message.Part) (uint64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	h, ok, _ := t.resolveHash(hash, parts)
+	return h, ok
+}
+
+// reserveHash returns the hash of the topic with the parts as topicHash does, and reserves
+// the hash of a new topic until the topic is added to the trie. The topics of entries written
+// in a batch are added to the trie when the batch is written, so a colliding topic resolved
+// before then is chained past the reserved hash. The entry is marked as being written so the
+// topic is not pruned until the entry is released. It returns false if the topic is not found
+// in the trie, the raw topic is then packed with the entry.
+func (t *_Trie) reserveHash(hash uint64, parts []message.Part) (uint64, bool) {
+	t.Lock()
+	defer t.Unlock()
+	h, ok, reserved := t.resolveHash(hash, parts)
+	if !ok && !reserved {
+		t.topicTrie.reserved[h] = parts
+		t.topicTrie.live[h] = 0
+	}
+	t.topicTrie.pending[h]++
+	return h, ok
+}
+
+// resolveHash resolves the hash of the topic with the parts from the trie and the reserved
+// hashes. It must be called with the trie lock held.
+func (t *_Trie) resolveHash(hash uint64, parts []message.Part) (h uint64, ok, reserved bool) {
+	curr := t.topicTrie.root
+	for _, p := range parts {
+		child, ok := curr.children[_Part{hash: p.Hash, wildchars: p.Wildchars}]
+		if !ok {
+			curr = nil
+			break
+		}
+		curr = child
+	}
+	if curr != nil {
+		for _, topic := range curr.topics {
+			if uint32(topic.hash) == uint32(hash) {
+				return topic.hash, true, false
+			}
+		}
+	}
+	for {
+		if _, ok := t.topicTrie.summary[hash]; !ok {
+			p, ok := t.topicTrie.reserved[hash]
+			if !ok {
+				return hash, false, false
+			}
+			if equalParts(p, parts) {
+				return hash, false, true
+			}
+		}
+		hash += 1 << 32
+	}
+}
+
+func equalParts(a, b []message.Part) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getOffset returns the window offset of the topic. It returns false if the topic is not found in the trie.
 func (t *_Trie) getOffset(topicHash uint64) (off int64, ok bool) {
 	t.RLock()
 	defer t.RUnlock()
 	if curr, ok := t.topicTrie.summary[topicHash]; ok {
 		for _, topic := range curr.topics {
 			if topic.hash == topicHash {
-				return topic.offset, ok
+				return topic.offset, true
 			}
 		}
 	}
-	return off, ok
+	return off, false
 }
 
-func (t *_Trie) setOffset(topic _Topic) (ok bool) {
+// offsets returns the window offsets of the topics in the trie by topic hash.
+func (t *_Trie) offsets() map[uint64]int64 {
+	t.RLock()
+	defer t.RUnlock()
+	offsets := make(map[uint64]int64, len(t.topicTrie.summary))
+	for topicHash, curr := range t.topicTrie.summary {
+		for _, topic := range curr.topics {
+			if topic.hash == topicHash {
+				offsets[topicHash] = topic.offset
+			}
+		}
+	}
+	return offsets
+}
+
+// setOffset sets the window offset of the topic. It returns false if the topic is not found in the trie.
+func (t *_Trie) setOffset(topicHash uint64, offset int64) (ok bool) {
 	t.Lock()
 	defer t.Unlock()
-	if curr, ok := t.topicTrie.summary[topic.hash]; ok {
-		curr.topics.addUnique(topic)
-		return ok
+	if curr, ok := t.topicTrie.summary[topicHash]; ok {
+		for i := range curr.topics {
+			if curr.topics[i].hash == topicHash {
+				curr.topics[i].offset = offset
+				return true
+			}
+		}
 	}
 	return false
 }
+
+// getTopic returns the parsed topic of the topic hash built from the parts of the trie. It returns false
+// if the topic is not found in the trie.
+func (t *_Trie) getTopic(topicHash uint64) (*message.Topic, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return nil, false
+	}
+	topic := &message.Topic{Depth: curr.depth}
+	for n := curr; n.parent != nil; n = n.parent {
+		topic.Parts = append([]message.Part{{Hash: n.part.hash, Wildchars: n.part.wildchars}}, topic.Parts...)
+	}
+	return topic, true
+}
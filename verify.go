@@ -0,0 +1,228 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package unitdb
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// VerifyReport holds the inconsistencies between the index, the data file, the window file
+// and the trie found by Verify.
+type VerifyReport struct {
+	Entries int // Number of index entries checked.
+	Topics  int // Number of topics checked.
+	// DanglingOffsets holds the seqs of index entries with a data offset outside the data file.
+	DanglingOffsets []uint64
+	// MismatchedTopics holds the seqs of index entries whose stored topic does not resolve to
+	// the topic hash of the window entry.
+	MismatchedTopics []uint64
+	// CorruptRecords holds the seqs of index entries whose record does not match its checksum.
+	CorruptRecords []uint64
+	// UnresolvedTopics holds the topic hashes of topics whose window offset in the trie does not
+	// resolve to a window block of the topic.
+	UnresolvedTopics []uint64
+	// MissingEntries holds the seqs of window entries without an index entry. The entries deleted
+	// or dropped from the index by the compaction are not missing.
+	MissingEntries []uint64
+	// OrphanedEntries holds the seqs of index entries not referenced by a window entry.
+	OrphanedEntries []uint64
+}
+
+// Consistent returns true if Verify found no inconsistencies.
+func (r VerifyReport) Consistent() bool {
+	return len(r.DanglingOffsets) == 0 && len(r.MismatchedTopics) == 0 && len(r.CorruptRecords) == 0 &&
+		len(r.UnresolvedTopics) == 0 && len(r.MissingEntries) == 0 && len(r.OrphanedEntries) == 0
+}
+
+// Verify checks the consistency of the DB files synced to disk. Every index entry must point
+// to a record within the data file that matches its checksum, the stored topic of a record must
+// resolve to the topic hash of its window entry, every window entry must have an index entry and every topic offset in
+// the trie must resolve to a window block of the topic. Deleted and expired entries are not
+// checked. Verify does not modify the DB, entries not yet synced are not checked.
+func (db *DB) Verify() (VerifyReport, error) {
+	if err := db.ok(); err != nil {
+		return VerifyReport{}, err
+	}
+	// Verify does not run concurrently with sync, expiry or compaction.
+	select {
+	case db.internal.syncLockC <- struct{}{}:
+	case <-db.internal.closeC:
+		return VerifyReport{}, errClosed
+	}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+
+	return db.verify()
+}
+
+// verify checks the consistency of the DB files. The caller must hold the sync lock.
+func (db *DB) verify() (VerifyReport, error) {
+	var report VerifyReport
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return report, err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return report, err
+	}
+
+	// Index entries by seq, the deleted entries are not checked. The blocks with entries dropped
+	// by the compaction are kept so the dropped entries are not reported missing.
+	entries := make(map[uint64]_IndexEntry)
+	indexed := make(map[uint64]bool)
+	compacted := make(map[int32]bool)
+	r := _BlockReader{indexFile: indexFile}
+	nIndexBlocks := int32(indexFile.currSize() / int64(blockSize))
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return report, err
+		}
+		if b.dropped > 0 {
+			compacted[bIdx] = true
+		}
+		for i := 0; i < int(b.entryIdx); i++ {
+			e := b.entries[i]
+			if e.seq == 0 {
+				continue
+			}
+			indexed[e.seq] = true
+			if e.isDeleted() {
+				continue
+			}
+			entries[e.seq] = e
+		}
+	}
+	report.Entries = len(entries)
+
+	// Window entries by topic, the expired entries are not checked as their records may be reclaimed.
+	topics := make(map[uint64][]uint64)
+	referenced := make(map[uint64]bool)
+	wr := newWindowReader(db.fs)
+	if wr.winFile != nil {
+		if err := wr.entryIterator(func(topicHash uint64, we _WinEntry) error {
+			referenced[we.seq()] = true
+			if !we.isExpired() {
+				topics[topicHash] = append(topics[topicHash], we.seq())
+			}
+			return nil
+		}); err != nil {
+			return report, err
+		}
+	}
+
+	free := db.internal.freeList.ranges()
+	dataSize := dataFile.currSize()
+	for seq, e := range entries {
+		if !referenced[seq] {
+			report.OrphanedEntries = append(report.OrphanedEntries, seq)
+		}
+		if e.msgOffset < 0 || e.msgOffset+int64(e.mSize(db.fileVersion())) > dataSize {
+			report.DanglingOffsets = append(report.DanglingOffsets, seq)
+			delete(entries, seq)
+		}
+	}
+
+	offsets := db.internal.trie.offsets()
+	unresolved := make(map[uint64]bool)
+	for topicHash, seqs := range topics {
+		live := false
+		for _, seq := range seqs {
+			e, ok := entries[seq]
+			if !ok {
+				if !indexed[seq] && !compacted[blockIndex(seq)] {
+					report.MissingEntries = append(report.MissingEntries, seq)
+				}
+				continue
+			}
+			if free.contains(e.msgOffset, e.mSize(db.fileVersion())) {
+				continue
+			}
+			live = true
+			if e.topicSize == 0 {
+				if _, err := db.internal.reader.readRecord(e); err == ErrCorruptRecord {
+					report.CorruptRecords = append(report.CorruptRecords, seq)
+				}
+				continue
+			}
+			ok, err := db.verifyTopic(topicHash, e)
+			if err == ErrCorruptRecord {
+				report.CorruptRecords = append(report.CorruptRecords, seq)
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			if !ok {
+				report.MismatchedTopics = append(report.MismatchedTopics, seq)
+			}
+		}
+		// The topic is pruned from the trie once its last entry is deleted.
+		if _, ok := offsets[topicHash]; !ok && live {
+			unresolved[topicHash] = true
+		}
+	}
+	for topicHash, off := range offsets {
+		if _, ok := topics[topicHash]; !ok && off == 0 {
+			// The topic is not yet synced to the window file.
+			continue
+		}
+		wr.offset = off
+		if b, err := wr.readWindowBlock(); err != nil || b.topicHash != topicHash {
+			unresolved[topicHash] = true
+		}
+	}
+	for topicHash := range unresolved {
+		report.UnresolvedTopics = append(report.UnresolvedTopics, topicHash)
+	}
+	report.Topics = len(offsets)
+
+	for _, s := range [][]uint64{report.DanglingOffsets, report.MismatchedTopics, report.CorruptRecords, report.UnresolvedTopics, report.MissingEntries, report.OrphanedEntries} {
+		sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	}
+	return report, nil
+}
+
+// verifyTopic checks the stored topic of the entry resolves to the topic hash.
+func (db *DB) verifyTopic(topicHash uint64, e _IndexEntry) (bool, error) {
+	prefix, _, err := db.internal.reader.readMessage(e)
+	if err != nil {
+		return false, err
+	}
+	rawTopic, err := db.internal.reader.readTopic(e)
+	if err != nil {
+		return false, err
+	}
+	// The raw topic holds the depth followed by the wildchars and the hash of each part.
+	if len(rawTopic) < 6 || (len(rawTopic)-1)%5 != 0 {
+		return false, nil
+	}
+	t := new(message.Topic)
+	if err := t.Unmarshal(rawTopic); err != nil {
+		return false, nil
+	}
+	contract := binary.LittleEndian.Uint32(prefix[4:8])
+	h, ok := db.internal.trie.topicHash(t.GetHash(contract), t.Parts)
+	return ok && h == topicHash, nil
+}
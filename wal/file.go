@@ -19,27 +19,34 @@ package wal
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/fs"
 )
 
 type (
 	_FileStore struct {
 		sync.RWMutex
+		fsys    fs.FileSystem
 		dirName string
 		opened  bool
+		// size is the total size of the logs in the file store.
+		size int64
+		// unsynced is the list of logs written since the last sync.
+		unsynced []int64
 	}
 	_FileInfos []os.FileInfo
 )
 
-func openFile(dirName string, bufferSize int64) (*_FileStore, error) {
+func openFile(fsys fs.FileSystem, dirName string, bufferSize int64) (*_FileStore, error) {
 	fs := &_FileStore{
+		fsys:    fsys,
 		dirName: dirName,
 		opened:  false,
 	}
@@ -50,14 +57,20 @@ func openFile(dirName string, bufferSize int64) (*_FileStore, error) {
 	}
 
 	// if store dir does not exists then create it.
-	if !exists(dirName) {
+	if !fs.exists(dirName) {
 		perms := os.FileMode(0770)
-		if err := os.MkdirAll(fs.dirName, perms); err != nil {
+		if err := fs.fsys.MkdirAll(fs.dirName, perms); err != nil {
 			return nil, err
 		}
 	}
 	fs.opened = true
 
+	for _, timeID := range fs.all() {
+		if fi, err := fs.fsys.Stat(logPath(fs.dirName, timeID)); err == nil {
+			fs.size += fi.Size()
+		}
+	}
+
 	return fs, nil
 }
 
@@ -74,7 +87,7 @@ func (fs *_FileStore) put(info _LogInfo, data *bpool.Buffer) error {
 		return errors.New("Trying to use file store, but not open")
 	}
 	tmp := tmpPath(fs.dirName, info.timeID)
-	f, err := os.Create(tmp)
+	f, err := fs.fsys.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
@@ -93,69 +106,167 @@ func (fs *_FileStore) put(info _LogInfo, data *bpool.Buffer) error {
 	}
 	log := logPath(fs.dirName, info.timeID)
 
-	if err := os.Rename(tmp, log); err != nil {
+	if err := fs.fsys.Rename(tmp, log); err != nil {
 		return err
 	}
 
-	if !exists(log) {
+	if !fs.exists(log) {
 		return errors.New(fmt.Sprintf("file not created, %s", log))
 	}
+	atomic.AddInt64(&fs.size, int64(logHeaderSize)+int64(len(data.Bytes())))
+	fs.unsynced = append(fs.unsynced, info.timeID)
 
 	return nil
 }
 
+// sync flushes the logs written since the last sync and the log directory to disk.
+func (fs *_FileStore) sync() error {
+	fs.Lock()
+	defer fs.Unlock()
+	if !fs.opened {
+		return errors.New("Trying to use file store, but not open")
+	}
+	for len(fs.unsynced) > 0 {
+		f, err := fs.fsys.OpenFile(logPath(fs.dirName, fs.unsynced[0]), os.O_RDWR, 0666)
+		if err == nil {
+			err = f.Sync()
+			f.Close()
+		}
+		// log is already applied if it does not exist.
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fs.unsynced = fs.unsynced[1:]
+	}
+
+	// sync the directory so the renamed logs are found on recovery.
+	return fs.fsys.SyncDir(fs.dirName)
+}
+
+// upgrade rewrites the log in the layout of the current version if it is written with an
+// earlier version. Only the header is read for a log of the current version. A log with an
+// unreadable header is left in place for the reader.
+func (fs *_FileStore) upgrade(timeID int64) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	log := logPath(fs.dirName, timeID)
+	f, err := fs.fsys.OpenFile(log, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	info := _LogInfo{}
+	buf := make([]byte, logHeaderSize)
+	if _, err := f.ReadAt(buf, 0); err != nil || info.UnmarshalBinary(buf) != nil {
+		return nil
+	}
+	if info.version == version || int64(logHeaderSize)+int64(info.size) > stat.Size() {
+		return nil
+	}
+	raw := make([]byte, info.size)
+	if _, err := f.ReadAt(raw, int64(logHeaderSize)); err != nil {
+		return err
+	}
+	info, data, err := upgradeLog(info, raw)
+	if err != nil {
+		return err
+	}
+	buf, err = info.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	tmp := tmpPath(fs.dirName, timeID)
+	if err := fs.writeFile(tmp, append(buf, data...)); err != nil {
+		return err
+	}
+	if err := fs.fsys.Rename(tmp, log); err != nil {
+		return err
+	}
+	// Logs are recovered in the order of the modification time.
+	if err := fs.fsys.Chtimes(log, stat.ModTime(), stat.ModTime()); err != nil {
+		return err
+	}
+	atomic.AddInt64(&fs.size, int64(logHeaderSize+len(data))-stat.Size())
+	fs.unsynced = append(fs.unsynced, timeID)
+	return nil
+}
+
 func (fs *_FileStore) read(timeID int64, data *bpool.Buffer) _LogInfo {
+	info, err := fs.readLog(timeID, data)
+	if err == errLogCorrupted {
+		fs.fsys.Rename(logPath(fs.dirName, timeID), corruptPath(fs.dirName, timeID))
+	}
+	return info
+}
+
+// readLog reads the log into data. It returns errLogCorrupted if the log is unreadable
+// and leaves the log in place, so it is safe to use for verifying the logs.
+func (fs *_FileStore) readLog(timeID int64, data *bpool.Buffer) (_LogInfo, error) {
 	fs.RLock()
 	defer fs.RUnlock()
 
 	info := _LogInfo{}
 
 	if !fs.opened {
-		// trying to use file store, but not open.
-		return info
+		return info, errors.New("Trying to use file store, but not open")
 	}
 
 	log := logPath(fs.dirName, timeID)
-	if !exists(log) {
-		return info
+	f, err := fs.fsys.OpenFile(log, os.O_RDONLY, 0)
+	if err != nil {
+		return info, err
 	}
+	defer f.Close()
 
-	f, err := os.Open(log)
+	stat, err := f.Stat()
 	if err != nil {
-		return info
+		return info, err
 	}
 
 	buf := make([]byte, uint32(logHeaderSize))
 	if _, err := f.ReadAt(buf, 0); err != nil {
-		f.Close()
-		os.Rename(log, corruptPath(fs.dirName, timeID))
-
-		// log was unreadable, return nil
-		return info
+		return info, errLogCorrupted
 	}
 
 	if err := info.UnmarshalBinary(buf); err != nil {
-		f.Close()
-		os.Rename(log, corruptPath(fs.dirName, timeID))
+		return _LogInfo{}, errLogCorrupted
+	}
 
-		// log was unreadable, return nil
-		return info
+	if int64(logHeaderSize)+int64(info.size) > stat.Size() {
+		return _LogInfo{}, errLogCorrupted
+	}
+
+	if info.size == 0 {
+		return info, nil
 	}
 
 	if _, err := data.Extend(int64(info.size)); err != nil {
-		return info
+		return _LogInfo{}, err
 	}
 
 	if _, err := f.ReadAt(data.Internal(), int64(logHeaderSize)); err != nil {
-		f.Close()
-		os.Rename(log, corruptPath(fs.dirName, timeID))
+		return _LogInfo{}, errLogCorrupted
+	}
 
-		// log was unreadable, return nil
-		return info
+	// A log of an earlier version left in place by a read-only open is upgraded in memory.
+	if info.version != version {
+		upgraded, raw, err := upgradeLog(info, append([]byte(nil), data.Bytes()...))
+		if err != nil {
+			return _LogInfo{}, err
+		}
+		data.Reset()
+		if _, err := data.Write(raw); err != nil {
+			return _LogInfo{}, err
+		}
+		info = upgraded
 	}
-	f.Close()
 
-	return info
+	return info, nil
 }
 
 // all provides a list of all time IDs currently stored in the file store.
@@ -168,7 +279,7 @@ func (fs *_FileStore) all() []int64 {
 		return nil
 	}
 
-	files, err := ioutil.ReadDir(fs.dirName)
+	files, err := fs.fsys.ReadDir(fs.dirName)
 	if err != nil {
 		return nil
 	}
@@ -205,11 +316,26 @@ func (fs *_FileStore) del(timeID int64) {
 	}
 
 	log := logPath(fs.dirName, timeID)
-	if !exists(log) {
+	fi, err := fs.fsys.Stat(log)
+	if err != nil {
 		return
 	}
 
-	os.Remove(log)
+	if err := fs.fsys.Remove(log); err == nil {
+		atomic.AddInt64(&fs.size, -fi.Size())
+	}
+	// The applied log is not synced.
+	for i, id := range fs.unsynced {
+		if id == timeID {
+			fs.unsynced = append(fs.unsynced[:i], fs.unsynced[i+1:]...)
+			break
+		}
+	}
+}
+
+// fileSize returns the total size of the logs in the file store.
+func (fs *_FileStore) fileSize() int64 {
+	return atomic.LoadInt64(&fs.size)
 }
 
 // reset removes all persisted logs from file store.
@@ -234,8 +360,21 @@ func corruptPath(dirName string, timeID int64) string {
 	return path.Join(dirName, suffix)
 }
 
-func exists(file string) bool {
-	if _, err := os.Stat(file); err != nil {
+// writeFile writes the data to the named file on the file system.
+func (fs *_FileStore) writeFile(name string, data []byte) error {
+	f, err := fs.fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (fs *_FileStore) exists(file string) bool {
+	if _, err := fs.fsys.Stat(file); err != nil {
 		if os.IsNotExist(err) {
 			return false
 		}
@@ -71,6 +71,29 @@ func (r *Reader) Iterator(f func(timeID int64) (bool, error)) (err error) {
 	return nil
 }
 
+// Verify iterates all logs stored in the WAL without modifying the WAL. A log that
+// is unreadable is passed to f with the error and has no records to read.
+func (r *Reader) Verify(f func(timeID int64, err error) (bool, error)) (err error) {
+	r.wal.mu.RLock()
+	r.buffer = r.wal.bufPool.Get()
+	defer func() {
+		r.wal.bufPool.Put(r.buffer)
+		r.wal.mu.RUnlock()
+	}()
+
+	for _, timeID := range r.wal.logStore.all() {
+		r.offset = 0
+		r.buffer.Reset()
+		info, err := r.wal.logStore.readLog(timeID, r.buffer)
+		r.entryCount = info.count
+		if stop, err := f(timeID, err); stop || err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Count returns entry count for the current interation.
 func (r *Reader) Count() uint32 {
 	return r.entryCount
@@ -82,8 +105,14 @@ func (r *Reader) Next() ([]byte, bool, error) {
 		return nil, false, nil
 	}
 	r.entryCount--
+	if r.offset+4 > r.buffer.Size() {
+		return nil, false, errors.New("error reading log")
+	}
 	scratch, _ := r.buffer.Slice(r.offset, r.offset+4)
 	dataLen := binary.LittleEndian.Uint32(scratch)
+	if dataLen < 4 || r.offset+int64(dataLen) > r.buffer.Size() {
+		return nil, false, errors.New("error reading log")
+	}
 	data, err := r.buffer.Slice(r.offset+4, r.offset+int64(dataLen))
 	if err != nil {
 		return nil, false, errors.New("error reading log")
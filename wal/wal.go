@@ -18,10 +18,12 @@ package wal
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/fs"
 )
 
 const (
@@ -62,18 +64,90 @@ type (
 	// Options wal options to create new WAL. WAL logs uses cyclic rotation to avoid fragmentation.
 	// It allocates free blocks only when log reaches target size.
 	Options struct {
-		Path       string
+		Path string
+		// FileSystem is the file system the logs are stored in, the OS file system if nil.
+		FileSystem fs.FileSystem
 		BufferSize int64
 		Reset      bool
+		// ReadOnly opens the logs without rewriting them, the logs written with an earlier
+		// version are upgraded in memory as they are read.
+		ReadOnly bool
+
+		// PoolSize sets maximum number of buffers kept in the buffer pool.
+		PoolSize int
+		// PoolBufferSize sets size a buffer is allocated with by the log writer.
+		PoolBufferSize int64
 	}
 )
 
+const (
+	// MinPoolSize is the minimum number of buffers kept in the buffer pool.
+	MinPoolSize = 1
+	// MinPoolBufferSize is the minimum size a pooled buffer is allocated with.
+	MinPoolBufferSize = 1 << 10
+)
+
+var (
+	errPoolInvalid  = errors.New("wal buffer pool size is invalid")
+	errLogCorrupted = errors.New("wal log is corrupted")
+	errLogVersion   = errors.New("wal log version is not supported")
+)
+
+// _Migration upgrades a log written with a version to the layout of the next version.
+type _Migration func(info _LogInfo, data []byte) (_LogInfo, []byte, error)
+
+// migrations holds the upgrades of the logs keyed by the version upgraded from. A log with a
+// version without an upgrade path to the current version is refused on open.
+var migrations = map[uint16]_Migration{}
+
+// upgradeLog upgrades the log to the current version by applying the migrations in turn.
+func upgradeLog(info _LogInfo, data []byte) (_LogInfo, []byte, error) {
+	if info.version > version {
+		return info, nil, fmt.Errorf("%w: log %d has version %d, current version is %d", errLogVersion, info.timeID, info.version, version)
+	}
+	for info.version < version {
+		migrate, ok := migrations[info.version]
+		if !ok {
+			return info, nil, fmt.Errorf("%w: log %d has version %d with no upgrade to version %d", errLogVersion, info.timeID, info.version, version)
+		}
+		from := info.version
+		var err error
+		if info, data, err = migrate(info, data); err != nil {
+			return info, nil, err
+		}
+		info.version = from + 1
+		info.size = uint32(len(data))
+	}
+	return info, data, nil
+}
+
+// ValidPoolSize checks the buffer pool sizing; zero values keeps the pool defaults.
+func ValidPoolSize(poolSize int, bufferSize int64) bool {
+	if poolSize == 0 && bufferSize == 0 {
+		return true
+	}
+	return poolSize >= MinPoolSize && bufferSize >= MinPoolBufferSize
+}
+
 func newWal(opts Options) (wal *WAL, err error) {
+	if !ValidPoolSize(opts.PoolSize, opts.PoolBufferSize) {
+		return nil, errPoolInvalid
+	}
+	if opts.FileSystem == nil {
+		opts.FileSystem = fs.OS
+	}
+	var poolOpts *bpool.Options
+	if opts.PoolSize > 0 {
+		poolOpts = &bpool.Options{MaxPoolSize: opts.PoolSize}
+		if size := int64(opts.PoolSize) * opts.PoolBufferSize; size > opts.BufferSize {
+			opts.BufferSize = size
+		}
+	}
 	wal = &WAL{
-		bufPool: bpool.NewBufferPool(opts.BufferSize, nil),
+		bufPool: bpool.NewBufferPool(opts.BufferSize, poolOpts),
 		opts:    opts,
 	}
-	wal.logStore, err = openFile(opts.Path, opts.BufferSize)
+	wal.logStore, err = openFile(opts.FileSystem, opts.Path, opts.BufferSize)
 	if err != nil {
 		return wal, err
 	}
@@ -83,14 +157,32 @@ func newWal(opts Options) (wal *WAL, err error) {
 		return wal, nil
 	}
 
-	wal.recoverWal()
+	if err := wal.recoverWal(); err != nil {
+		return wal, err
+	}
 
 	return wal, nil
 }
 
 // recoverWal recovers a WAL for the log written but not released. It also updates free blocks.
-func (wal *WAL) recoverWal() {
+// The logs written with an earlier version are upgraded to the current version, it returns an
+// error if a log cannot be upgraded. The logs are left unchanged if the WAL is read-only.
+func (wal *WAL) recoverWal() error {
+	if wal.opts.ReadOnly {
+		wal.recoveredTimeIDs = wal.logStore.all()
+		return nil
+	}
+	for _, timeID := range wal.logStore.all() {
+		if err := wal.logStore.upgrade(timeID); err != nil {
+			return err
+		}
+	}
+	// Sync the upgraded logs.
+	if err := wal.logStore.sync(); err != nil {
+		return err
+	}
 	wal.recoveredTimeIDs = wal.logStore.all()
+	return nil
 }
 
 // Close closes the wal, frees used resources and checks for active
@@ -132,6 +224,31 @@ func (wal *WAL) SignalLogApplied(timeID int64) error {
 	return nil
 }
 
+// Sync flushes the logs written to the WAL to disk.
+func (wal *WAL) Sync() error {
+	if err := wal.ok(); err != nil {
+		return err
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	return wal.logStore.sync()
+}
+
+// FileSize returns the total size of the logs written but not yet applied.
+func (wal *WAL) FileSize() int64 {
+	return wal.logStore.fileSize()
+}
+
+// LogFiles returns the paths of the logs written but not yet applied.
+func (wal *WAL) LogFiles() []string {
+	var files []string
+	for _, timeID := range wal.logStore.all() {
+		files = append(files, logPath(wal.logStore.dirName, timeID))
+	}
+	return files
+}
+
 // Reset removes all persistested logs from log store.
 func (wal *WAL) Reset() {
 	wal.logStore.reset()
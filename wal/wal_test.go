@@ -19,6 +19,7 @@ package wal
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -174,3 +175,216 @@ func TestSimple(t *testing.T) {
 	}
 
 }
+
+func TestBufferPoolAllocs(t *testing.T) {
+	const writers = 64
+	val := make([]byte, 256)
+	allocs := func(opts Options) float64 {
+		os.RemoveAll(dbPath)
+		if err := os.MkdirAll(dbPath, 0777); err != nil {
+			t.Fatal(err)
+		}
+		wal, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wal.Close()
+		return testing.AllocsPerRun(10, func() {
+			var logWriters [writers]*Writer
+			for i := range logWriters {
+				w, err := wal.NewWriter()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for j := 0; j < 16; j++ {
+					if err := w.append(val); err != nil {
+						t.Fatal(err)
+					}
+				}
+				logWriters[i] = w
+			}
+			for _, w := range logWriters {
+				wal.bufPool.Put(w.buffer)
+			}
+		})
+	}
+
+	logOpts := Options{Path: dbPath + "/" + logDir, BufferSize: 1 << 20}
+	defaultAllocs := allocs(logOpts)
+
+	logOpts.PoolSize = writers
+	logOpts.PoolBufferSize = 1 << 13
+	pooledAllocs := allocs(logOpts)
+	if pooledAllocs >= defaultAllocs {
+		t.Fatalf("expected fewer allocations with a sized pool: default %v, pooled %v", defaultAllocs, pooledAllocs)
+	}
+
+	logOpts.PoolBufferSize = MinPoolBufferSize - 1
+	if _, err := New(logOpts); err != errPoolInvalid {
+		t.Fatalf("expected errPoolInvalid, got %v", err)
+	}
+}
+
+func TestLogVersion(t *testing.T) {
+	wal, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n = 10
+	for i := 0; i < n; i++ {
+		if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-logWriter.SignalInitWrite(int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// stamp writes the version to the header of the log.
+	log := logPath(dbPath+"/"+logDir, int64(n))
+	stamp := func(v uint16) {
+		f, err := os.OpenFile(log, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{byte(v), byte(v >> 8)}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Logs with a version later than the current version or without an upgrade are refused.
+	for _, v := range []uint16{version + 1, version - 1} {
+		stamp(v)
+		wal, err := newTestWal(false)
+		if !errors.Is(err, errLogVersion) {
+			t.Fatalf("expected log with version %d refused; got %v", v, err)
+		}
+		wal.Close()
+	}
+
+	// Logs with an upgrade are migrated to the current version on open.
+	migrated := 0
+	migrations[version-1] = func(info _LogInfo, data []byte) (_LogInfo, []byte, error) {
+		migrated++
+		return info, data, nil
+	}
+	defer delete(migrations, version-1)
+
+	// A read-only open leaves the log in place and upgrades it as it is read.
+	rwal, err := New(Options{Path: dbPath + "/" + logDir, BufferSize: 1 << 8, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := rwal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := r.Verify(func(timeID int64, err error) (bool, error) {
+		if err != nil {
+			return true, err
+		}
+		for {
+			_, ok, err := r.Next()
+			if !ok || err != nil {
+				return false, err
+			}
+			count++
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rwal.Close()
+	if count != n || migrated != 1 {
+		t.Fatalf("expected %d entries from the log migrated once; got %d entries migrated %d times", n, count, migrated)
+	}
+	header, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := uint16(header[0]) | uint16(header[1])<<8; v != version-1 {
+		t.Fatalf("expected log left with version %d by a read-only open; got %d", version-1, v)
+	}
+	migrated = 0
+
+	wal, err = newTestWal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if migrated != 1 {
+		t.Fatalf("expected log migrated once; got %d", migrated)
+	}
+	if len(wal.logStore.unsynced) != 0 {
+		t.Fatalf("expected migrated log synced on open; got %d logs unsynced", len(wal.logStore.unsynced))
+	}
+	r, err = wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count = 0
+	if err := r.Iterator(func(timeID int64) (bool, error) {
+		for {
+			_, ok, err := r.Next()
+			if !ok || err != nil {
+				return false, err
+			}
+			count++
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d entries from the migrated log; got %d", n, count)
+	}
+	info, err := wal.logStore.readLog(int64(n), wal.bufPool.Get())
+	if err != nil || info.version != version {
+		t.Fatalf("expected log rewritten with version %d; got %d %v", version, info.version, err)
+	}
+}
+
+func TestLogUnsynced(t *testing.T) {
+	wal, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for n := 1; n <= 2; n++ {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", n))); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-logWriter.SignalInitWrite(int64(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(wal.logStore.unsynced) != 2 {
+		t.Fatalf("expected 2 logs unsynced; got %d", len(wal.logStore.unsynced))
+	}
+
+	// The applied logs and the synced logs are not synced again.
+	if err := wal.SignalLogApplied(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.logStore.unsynced) != 1 {
+		t.Fatalf("expected applied log removed from the unsynced logs; got %d logs unsynced", len(wal.logStore.unsynced))
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.logStore.unsynced) != 0 {
+		t.Fatalf("expected no logs unsynced after sync; got %d", len(wal.logStore.unsynced))
+	}
+}
@@ -54,6 +54,10 @@ func (wal *WAL) NewWriter() (*Writer, error) {
 	}
 
 	w.buffer = wal.bufPool.Get()
+	// Pre-size the buffer so appends to the log do not grow it.
+	if size := wal.opts.PoolBufferSize; size > 0 && int64(cap(w.buffer.Internal())) < size {
+		w.buffer = wal.bufPool.NewBuffer(make([]byte, 0, size))
+	}
 	return w, nil
 }
 
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import "sync"
+
+// WriteEvent is an event sent to the watchers for each entry synced to the DB.
+type WriteEvent struct {
+	TopicHash uint64 // The hash of the topic of the entry.
+	Seq       uint64 // The seq of the entry.
+	Contract  uint32 // The contract of the entry.
+}
+
+type (
+	_Watcher struct {
+		eventC chan WriteEvent
+		doneC  chan struct{}
+		once   sync.Once
+	}
+	// _Watchers holds the watchers of the write events.
+	_Watchers struct {
+		mu       sync.RWMutex
+		watchers map[*_Watcher]struct{}
+		size     int
+		policy   WatchPolicy
+		closeC   chan struct{}
+		closed   bool
+	}
+)
+
+func newWatchers(size int, policy WatchPolicy, closeC chan struct{}) *_Watchers {
+	return &_Watchers{watchers: make(map[*_Watcher]struct{}), size: size, policy: policy, closeC: closeC}
+}
+
+// add adds a watcher and returns its event channel and the func to remove it.
+func (w *_Watchers) add() (<-chan WriteEvent, func()) {
+	wr := &_Watcher{eventC: make(chan WriteEvent, w.size), doneC: make(chan struct{})}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		close(wr.eventC)
+		return wr.eventC, func() {}
+	}
+	w.watchers[wr] = struct{}{}
+	return wr.eventC, func() { w.remove(wr) }
+}
+
+// remove removes the watcher and closes its event channel. An event blocked on the watcher
+// is dropped, so the removal does not wait on a reader.
+func (w *_Watchers) remove(wr *_Watcher) {
+	wr.once.Do(func() {
+		close(wr.doneC)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.watchers[wr]; ok {
+			delete(w.watchers, wr)
+			close(wr.eventC)
+		}
+	})
+}
+
+// len returns the number of watchers.
+func (w *_Watchers) len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.watchers)
+}
+
+// send sends the events to the watchers. The events are dropped for a watcher with a full
+// buffer unless the policy blocks, then the send waits for the watcher to receive the event,
+// the watcher to be removed or the DB to be closed.
+func (w *_Watchers) send(events []WriteEvent) {
+	if len(events) == 0 {
+		return
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for wr := range w.watchers {
+		for _, e := range events {
+			select {
+			case wr.eventC <- e:
+				continue
+			default:
+			}
+			if w.policy != WatchBlock {
+				continue
+			}
+			select {
+			case wr.eventC <- e:
+			case <-wr.doneC:
+			case <-w.closeC:
+				return
+			}
+		}
+	}
+}
+
+// close removes all watchers and closes their event channels.
+func (w *_Watchers) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	for wr := range w.watchers {
+		delete(w.watchers, wr)
+		close(wr.eventC)
+	}
+}
+
+// Watch returns a channel of the write events of the entries synced to the DB and the func to
+// stop watching. An event is sent once an entry is durably synced, in the order of the sync.
+// The events are buffered up to the watch buffer size, once the buffer is full the events are
+// dropped or the sync blocks as set by WithWatchPolicy. The channel is closed once the watch is
+// cancelled or the DB is closed.
+func (db *DB) Watch() (<-chan WriteEvent, func()) {
+	return db.internal.watchers.add()
+}